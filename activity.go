@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// fetchActivityLog adds the activity log entries written since the last call
+// to the counters derived from them. Jellyfin itself doesn't log image
+// requests, ImageRequest entries are only written by builds or plugins that
+// add them.
+func (c *JellyfinGetCollector) fetchActivityLog(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	entries, err := client.GetActivityLog(ctx, c.activitySince)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.ID <= c.activityLastID {
+			continue
+		}
+		if entry.Type == "ImageRequest" {
+			c.imageRequests[entry.ImageRequestType()]++
+		}
+		if adminActionTypes[entry.Type] {
+			c.adminActions[entry.Type]++
+		}
+		if configChangeTypes[entry.Type] {
+			c.configChanges++
+		}
+	}
+	for _, entry := range entries {
+		if entry.ID > c.activityLastID {
+			c.activityLastID = entry.ID
+		}
+		if entry.Date.After(c.activitySince) {
+			c.activitySince = entry.Date
+		}
+	}
+
+	if c.Config.ImageMetrics {
+		for imageType, count := range c.imageRequests {
+			rec.RecordCounter("image_requests_total", count, imageType)
+		}
+	}
+	if c.Config.AdminActionMetrics {
+		for actionType := range adminActionTypes {
+			rec.RecordCounter("admin_actions_total", c.adminActions[actionType], actionType)
+		}
+	}
+	if c.Config.AuditMetrics {
+		rec.RecordCounter("server_config_changes_total", c.configChanges)
+	}
+	return nil
+}
+
+// adminActionTypes are the activity log entry types counted by
+// admin_actions_total.
+var adminActionTypes = map[string]bool{
+	"UserCreated":          true,
+	"UserDeleted":          true,
+	"UserPolicyUpdated":    true,
+	"ConfigurationUpdated": true,
+}
+
+// configChangeTypes are the activity log entry types counted by
+// server_config_changes_total. Jellyfin logs changes of the server
+// configuration as ConfigurationUpdated, ServerConfigurationUpdated is
+// counted as well for builds that log that type.
+var configChangeTypes = map[string]bool{
+	"ConfigurationUpdated":       true,
+	"ServerConfigurationUpdated": true,
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageRequests(t *testing.T) {
+	// the second call answers the last entry of the first again, MinDate
+	// includes it
+	responses := []string{
+		`{"Items": [
+			{"Id": 1, "Name": "Thumbnail requested", "Type": "ImageRequest", "Date": "2024-03-01T20:00:00Z"},
+			{"Id": 2, "Name": "Image requested", "Type": "ImageRequest", "ShortOverview": "Backdrop of Heat", "Date": "2024-03-01T20:01:00Z"},
+			{"Id": 3, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:02:00Z"}
+		]}`,
+		`{"Items": [
+			{"Id": 3, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:02:00Z"},
+			{"Id": 4, "Name": "Logo requested", "Type": "ImageRequest", "Date": "2024-03-01T20:03:00Z"},
+			{"Id": 5, "Name": "Primary image requested", "Type": "ImageRequest", "Date": "2024-03-01T20:04:00Z"},
+			{"Id": 6, "Name": "Thumb requested", "Type": "ImageRequest", "Date": "2024-03-01T20:05:00Z"}
+		]}`,
+	}
+	var calls int
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/ActivityLog/Entries": func(w http.ResponseWriter, r *http.Request) {
+			rawJSON(responses[calls])(w, r)
+			calls++
+		},
+	}, "--image-metrics-enabled")
+
+	tests := []map[string]float64{
+		{"thumbnail": 1, "backdrop": 1},
+		{"thumbnail": 2, "backdrop": 1, "logo": 1, "other": 1},
+	}
+	for i, want := range tests {
+		rec := NewTestRecorder()
+		err := c.fetchActivityLog(context.Background(), *c.client, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countSeries(rec, "image_requests_total"); n != len(want) {
+			t.Errorf("call %d: image_requests_total has %d series, want %d: %v", i, n, len(want), rec.Values)
+		}
+		for imageType, count := range want {
+			if got, _ := rec.Value("image_requests_total", imageType); got != count {
+				t.Errorf("call %d: image_requests_total{%s} = %v, want %v", i, imageType, got, count)
+			}
+		}
+	}
+}
+
+func TestActivityLogPages(t *testing.T) {
+	var entries []string
+	for id := 1; id <= 5; id++ {
+		entries = append(entries, fmt.Sprintf(`{"Id": %d, "Name": "Thumbnail requested", "Type": "ImageRequest", "Date": "2024-03-01T20:0%d:00Z"}`, id, id))
+	}
+	var starts []string
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/ActivityLog/Entries": func(w http.ResponseWriter, r *http.Request) {
+			start, _ := strconv.Atoi(r.URL.Query().Get("StartIndex"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("Limit"))
+			starts = append(starts, r.URL.Query().Get("StartIndex"))
+			end := start + limit
+			if end > len(entries) {
+				end = len(entries)
+			}
+			rawJSON(fmt.Sprintf(`{"Items": [%s], "TotalRecordCount": %d}`, strings.Join(entries[start:end], ","), len(entries)))(w, r)
+		},
+	}, "--image-metrics-enabled", "--page-size=2")
+
+	rec := NewTestRecorder()
+	err := c.fetchActivityLog(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entries of every page are counted, not only those of the first
+	if got, _ := rec.Value("image_requests_total", "thumbnail"); got != 5 {
+		t.Errorf("image_requests_total{thumbnail} = %v, want 5", got)
+	}
+	if want := []string{"0", "2", "4"}; !reflect.DeepEqual(starts, want) {
+		t.Errorf("StartIndex %v, want %v", starts, want)
+	}
+	if c.activityLastID != 5 {
+		t.Errorf("activityLastID = %d, want 5", c.activityLastID)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	responses := []string{
+		`{"Items": [
+			{"Id": 10, "Name": "User bob has been created", "Type": "UserCreated", "Date": "2024-03-01T20:00:00Z"},
+			{"Id": 11, "Name": "Server configuration updated", "Type": "ConfigurationUpdated", "Date": "2024-03-01T20:01:00Z"},
+			{"Id": 12, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:02:00Z"}
+		]}`,
+		`{"Items": [
+			{"Id": 12, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:02:00Z"},
+			{"Id": 13, "Name": "Policy of bob updated", "Type": "UserPolicyUpdated", "Date": "2024-03-01T20:03:00Z"},
+			{"Id": 14, "Name": "User carol has been created", "Type": "UserCreated", "Date": "2024-03-01T20:04:00Z"}
+		]}`,
+		`{"Items": [
+			{"Id": 14, "Name": "User carol has been created", "Type": "UserCreated", "Date": "2024-03-01T20:04:00Z"}
+		]}`,
+	}
+	var minDates []string
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/ActivityLog/Entries": func(w http.ResponseWriter, r *http.Request) {
+			rawJSON(responses[len(minDates)])(w, r)
+			minDates = append(minDates, r.URL.Query().Get("MinDate"))
+		},
+	}, "--admin-action-metrics-enabled")
+	// the cursor starts when the exporter does
+	c.activitySince = time.Date(2024, 3, 1, 19, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		wantMinDate string
+		want        map[string]float64
+	}{
+		{"2024-03-01T19:00:00Z", map[string]float64{"UserCreated": 1, "ConfigurationUpdated": 1}},
+		{"2024-03-01T20:02:00Z", map[string]float64{"UserCreated": 2, "ConfigurationUpdated": 1, "UserPolicyUpdated": 1}},
+		// the entries seen before aren't counted again
+		{"2024-03-01T20:04:00Z", map[string]float64{"UserCreated": 2, "ConfigurationUpdated": 1, "UserPolicyUpdated": 1}},
+	}
+	for i, tt := range tests {
+		rec := NewTestRecorder()
+		err := c.fetchActivityLog(context.Background(), *c.client, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if minDates[i] != tt.wantMinDate {
+			t.Errorf("call %d: MinDate %s, want %s", i, minDates[i], tt.wantMinDate)
+		}
+		// every action type is exported, the ones not seen yet as 0
+		if n := countSeries(rec, "admin_actions_total"); n != len(adminActionTypes) {
+			t.Errorf("call %d: admin_actions_total has %d series, want %d", i, n, len(adminActionTypes))
+		}
+		for actionType, count := range tt.want {
+			if got, _ := rec.Value("admin_actions_total", actionType); got != count {
+				t.Errorf("call %d: admin_actions_total{%s} = %v, want %v", i, actionType, got, count)
+			}
+		}
+	}
+}
+
+func TestServerConfigChanges(t *testing.T) {
+	responses := []string{
+		`{"Items": [
+			{"Id": 20, "Name": "Server configuration updated", "Type": "ServerConfigurationUpdated", "Date": "2024-03-01T20:00:00Z"},
+			{"Id": 21, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:01:00Z"}
+		]}`,
+		// entries at the cursor are returned again
+		`{"Items": [
+			{"Id": 21, "Name": "alice is online", "Type": "SessionStarted", "Date": "2024-03-01T20:01:00Z"},
+			{"Id": 22, "Name": "Server configuration updated", "Type": "ConfigurationUpdated", "Date": "2024-03-01T20:01:00Z"},
+			{"Id": 23, "Name": "Server configuration updated", "Type": "ServerConfigurationUpdated", "Date": "2024-03-01T20:05:00Z"}
+		]}`,
+		`{"Items": [
+			{"Id": 23, "Name": "Server configuration updated", "Type": "ServerConfigurationUpdated", "Date": "2024-03-01T20:05:00Z"}
+		]}`,
+		`{"Items": []}`,
+	}
+	tests := []struct {
+		name         string
+		args         []string
+		wantMinDates []string
+		want         []float64
+	}{
+		{
+			name:         "enabled",
+			args:         []string{"--audit-metrics-enabled"},
+			wantMinDates: []string{"2024-03-01T19:00:00Z", "2024-03-01T20:01:00Z", "2024-03-01T20:05:00Z", "2024-03-01T20:05:00Z"},
+			want:         []float64{1, 3, 3, 3},
+		},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var minDates []string
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/ActivityLog/Entries": func(w http.ResponseWriter, r *http.Request) {
+					rawJSON(responses[len(minDates)])(w, r)
+					minDates = append(minDates, r.URL.Query().Get("MinDate"))
+				},
+			}, tt.args...)
+			c.activitySince = time.Date(2024, 3, 1, 19, 0, 0, 0, time.UTC)
+
+			for i := range responses {
+				rec := NewTestRecorder()
+				if err := c.fetchActivityLog(context.Background(), *c.client, rec); err != nil {
+					t.Fatal(err)
+				}
+				got, ok := rec.Value("server_config_changes_total")
+				if tt.want == nil {
+					if ok {
+						t.Errorf("call %d: server_config_changes_total recorded without --audit-metrics-enabled", i)
+					}
+					continue
+				}
+				if minDates[i] != tt.wantMinDates[i] {
+					t.Errorf("call %d: MinDate %s, want %s", i, minDates[i], tt.wantMinDates[i])
+				}
+				if got != tt.want[i] {
+					t.Errorf("call %d: server_config_changes_total = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
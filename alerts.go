@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// AlertsOptions are the options of the alerts subcommand.
+type AlertsOptions struct {
+	Namespace        string        `long:"namespace" description:"metric name prefix" default:"jellyfin" env:"METRIC_NAMESPACE"`
+	For              time.Duration `long:"for" description:"time a condition must hold before the alert fires" default:"5m"`
+	SessionThreshold int           `long:"session-threshold" description:"alert when more sessions are playing than this (0 to omit the rule)" default:"0"`
+	CertExpiry       time.Duration `long:"cert-expiry" description:"alert when the TLS certificate of Jellyfin expires within this, needs --check-cert-expiry (0 to omit the rule)" default:"168h"`
+	RestartThreshold int           `long:"restart-threshold" description:"alert when Jellyfin restarted more often than this within an hour (0 to omit the rule)" default:"2"`
+}
+
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+type alertGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+type alertRules struct {
+	Groups []alertGroup `yaml:"groups"`
+}
+
+// runAlerts writes a Prometheus alerting rules file to out. Its args are
+// those following the alerts subcommand.
+func runAlerts(args []string, out io.Writer) error {
+	var options AlertsOptions
+	_, err := flags.ParseArgs(&options, args)
+	if err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	err = encoder.Encode(generateAlerts(options))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// generateAlerts returns rules for Jellyfin being unreachable, failing api
+// calls, its certificate expiring, a restart loop and, with a
+// SessionThreshold, too many playing sessions.
+func generateAlerts(options AlertsOptions) alertRules {
+	name := func(metric string) string {
+		return prom.BuildFQName(options.Namespace, "", metric)
+	}
+	window := model.Duration(options.For).String()
+	rule := func(alert, expr, severity, summary string) alertRule {
+		return alertRule{
+			Alert:       alert,
+			Expr:        expr,
+			For:         window,
+			Labels:      map[string]string{"severity": severity},
+			Annotations: map[string]string{"summary": summary},
+		}
+	}
+
+	rules := []alertRule{
+		rule("JellyfinDown", fmt.Sprintf("max(%s) == 0", name("endpoint_healthy")),
+			"critical", "The exporter can't reach the Jellyfin api"),
+		rule("JellyfinScrapeErrors", fmt.Sprintf("increase(%s[%s]) > 0", name("scrape_errors_total"), window),
+			"warning", "Calls to the Jellyfin api endpoint {{ $labels.endpoint }} are failing"),
+	}
+	if options.CertExpiry > 0 {
+		rules = append(rules, rule("JellyfinCertExpiring",
+			fmt.Sprintf("%s - time() < %d", name("ssl_cert_expiry_timestamp_seconds"), int64(options.CertExpiry.Seconds())),
+			"warning", fmt.Sprintf("The TLS certificate of Jellyfin expires within %s", model.Duration(options.CertExpiry))))
+	}
+	if options.RestartThreshold > 0 {
+		rules = append(rules, rule("JellyfinRestartLoop",
+			fmt.Sprintf("increase(%s[1h]) > %d", name("server_restart_total"), options.RestartThreshold),
+			"critical", fmt.Sprintf("Jellyfin restarted more than %d times within an hour", options.RestartThreshold)))
+	}
+	if options.SessionThreshold > 0 {
+		rules = append(rules, rule("JellyfinSessionsHigh",
+			fmt.Sprintf(`sum(%s{media_type!="none"}) > %d`, name("streams_by_media_type_total"), options.SessionThreshold),
+			"warning", fmt.Sprintf("More than %d sessions are playing", options.SessionThreshold)))
+	}
+
+	return alertRules{Groups: []alertGroup{{Name: options.Namespace, Rules: rules}}}
+}
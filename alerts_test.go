@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRunAlerts(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantAlerts []string
+		wantExpr   map[string]string
+	}{
+		{
+			name:       "defaults",
+			wantAlerts: []string{"JellyfinDown", "JellyfinScrapeErrors", "JellyfinCertExpiring", "JellyfinRestartLoop"},
+			wantExpr: map[string]string{
+				"JellyfinScrapeErrors": "increase(jellyfin_scrape_errors_total[5m]) > 0",
+				"JellyfinCertExpiring": "jellyfin_ssl_cert_expiry_timestamp_seconds - time() < 604800",
+			},
+		},
+		{
+			name:       "session threshold",
+			args:       []string{"--session-threshold=20", "--cert-expiry=0", "--restart-threshold=0", "--for=10m", "--namespace=media"},
+			wantAlerts: []string{"JellyfinDown", "JellyfinScrapeErrors", "JellyfinSessionsHigh"},
+			wantExpr: map[string]string{
+				"JellyfinSessionsHigh": `sum(media_streams_by_media_type_total{media_type!="none"}) > 20`,
+				"JellyfinScrapeErrors": "increase(media_scrape_errors_total[10m]) > 0",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runAlerts(tt.args, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rules struct {
+				Groups []struct {
+					Name  string
+					Rules []map[string]interface{}
+				}
+			}
+			err = yaml.Unmarshal(out.Bytes(), &rules)
+			if err != nil {
+				t.Fatalf("invalid rules YAML: %v", err)
+			}
+			if len(rules.Groups) != 1 {
+				t.Fatalf("%d rule groups, want 1", len(rules.Groups))
+			}
+
+			var alerts []string
+			for _, rule := range rules.Groups[0].Rules {
+				alert, _ := rule["alert"].(string)
+				alerts = append(alerts, alert)
+				for _, key := range []string{"expr", "for", "labels", "annotations"} {
+					if rule[key] == nil {
+						t.Errorf("%s has no %s", alert, key)
+					}
+				}
+				if want, ok := tt.wantExpr[alert]; ok && rule["expr"] != want {
+					t.Errorf("%s expr %q, want %q", alert, rule["expr"], want)
+				}
+			}
+			if strings.Join(alerts, ",") != strings.Join(tt.wantAlerts, ",") {
+				t.Errorf("alerts %v, want %v", alerts, tt.wantAlerts)
+			}
+		})
+	}
+}
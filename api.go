@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// lastGather keeps the metrics of the last scrape for the json api.
+type lastGather struct {
+	mu       sync.RWMutex
+	families []*dto.MetricFamily
+	at       time.Time
+}
+
+// recordingGatherer gathers the metrics of gatherer and stores them in last.
+type recordingGatherer struct {
+	gatherer prom.Gatherer
+	last     *lastGather
+}
+
+func (g recordingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	g.last.mu.Lock()
+	g.last.families = families
+	g.last.at = time.Now().UTC()
+	g.last.mu.Unlock()
+	return families, err
+}
+
+// labelingGatherer adds labels to the metrics of gatherer, for those of the
+// default registry that aren't created with the constant labels of the
+// exporter.
+type labelingGatherer struct {
+	gatherer prom.Gatherer
+	labels   prom.Labels
+}
+
+func (g labelingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if len(g.labels) == 0 {
+		return families, err
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for name, value := range g.labels {
+				metric.Label = append(metric.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(value),
+				})
+			}
+			sort.Slice(metric.Label, func(i, j int) bool {
+				return metric.Label[i].GetName() < metric.Label[j].GetName()
+			})
+		}
+	}
+	return families, err
+}
+
+// apiMetric is the response of /api/v1/metrics/{metric_name}. Value is set
+// for metrics with a single series without labels, Series otherwise.
+type apiMetric struct {
+	Name      string      `json:"name"`
+	Value     *float64    `json:"value,omitempty"`
+	Series    []apiSeries `json:"series,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type apiSeries struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// apiHandler serves the metrics of the last scrape as JSON, gathering them
+// with newGatherer if there was none yet. Histograms and summaries report
+// their sample count.
+func (l *lastGather) apiHandler(timeout time.Duration, newGatherer func(context.Context) prom.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/metrics/")
+
+		l.mu.RLock()
+		scraped := !l.at.IsZero()
+		l.mu.RUnlock()
+		if !scraped {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			_, err := recordingGatherer{newGatherer(ctx), l}.Gather()
+			if err != nil {
+				requestLog(ctx).WithError(err).Warn("gather metrics")
+			}
+		}
+
+		l.mu.RLock()
+		response := apiMetric{Name: name, Timestamp: l.at}
+		found := false
+		for _, family := range l.families {
+			if family.GetName() != name {
+				continue
+			}
+			found = true
+			for _, metric := range family.GetMetric() {
+				labels := make(map[string]string, len(metric.GetLabel()))
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				response.Series = append(response.Series, apiSeries{labels, metricValue(metric)})
+			}
+		}
+		l.mu.RUnlock()
+		if !found {
+			http.Error(w, "unknown metric "+name, http.StatusNotFound)
+			return
+		}
+		if len(response.Series) == 1 && len(response.Series[0].Labels) == 0 {
+			response.Value = &response.Series[0].Value
+			response.Series = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(response)
+		if err != nil {
+			requestLog(r.Context()).WithError(err).Warn("write api response")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func TestAPIHandler(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": jsonResponse(jellyfin.ItemCounts{MovieCount: 42}),
+	})
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	c.collectors = []Collector{library}
+	var gathers int
+	newGatherer := func(ctx context.Context) prom.Gatherer {
+		gathers++
+		registry := prom.NewRegistry()
+		registry.MustRegister(scrapeCollector{c, ctx})
+		return registry
+	}
+	handler := (&lastGather{}).apiHandler(time.Second, newGatherer)
+
+	tests := []struct {
+		name       string
+		metric     string
+		wantStatus int
+		wantValue  *float64
+		wantSeries []apiSeries
+	}{
+		{
+			name:       "single value",
+			metric:     "jellyfin_movieCount",
+			wantStatus: http.StatusOK,
+			wantValue:  func() *float64 { v := 42.0; return &v }(),
+		},
+		{
+			name:       "labeled series",
+			metric:     "jellyfin_endpoint_healthy",
+			wantStatus: http.StatusOK,
+			wantSeries: []apiSeries{{Labels: map[string]string{"endpoint": "/Items/Counts"}, Value: 1}},
+		},
+		{name: "unknown metric", metric: "jellyfin_typo", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/metrics/"+tt.metric, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", got)
+			}
+
+			var got struct {
+				Name      string      `json:"name"`
+				Value     *float64    `json:"value"`
+				Series    []apiSeries `json:"series"`
+				Timestamp time.Time   `json:"timestamp"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.metric {
+				t.Errorf("name %q, want %q", got.Name, tt.metric)
+			}
+			if (got.Value == nil) != (tt.wantValue == nil) || (got.Value != nil && *got.Value != *tt.wantValue) {
+				t.Errorf("value %v, want %v", got.Value, tt.wantValue)
+			}
+			if len(got.Series) != len(tt.wantSeries) {
+				t.Fatalf("series %v, want %v", got.Series, tt.wantSeries)
+			}
+			for i, series := range tt.wantSeries {
+				if got.Series[i].Value != series.Value || got.Series[i].Labels["endpoint"] != series.Labels["endpoint"] {
+					t.Errorf("series %d = %v, want %v", i, got.Series[i], series)
+				}
+			}
+			if got.Timestamp.IsZero() || time.Since(got.Timestamp) > time.Minute {
+				t.Errorf("timestamp %v, want the time of the scrape", got.Timestamp)
+			}
+		})
+	}
+	// the api serves the last scrape, it scrapes only if there was none
+	if gathers != 1 {
+		t.Errorf("%d gathers for %d requests, want 1", gathers, len(tests))
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func (c *JellyfinGetCollector) getAPI(ctx context.Context, endpoint string, out interface{}) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.getAPIWithToken(ctx, endpoint, token, out)
+	// session tokens are revoked when the session ends, log in again once
+	if c.Config.UseSessionAuth && jellyfin.IsStatus(err, http.StatusUnauthorized) {
+		c.expireToken(token)
+		token, err = c.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.getAPIWithToken(ctx, endpoint, token, out)
+	}
+	// during a key rotation the fallback keys are tried in order
+	for !c.Config.UseSessionAuth && jellyfin.IsStatus(err, http.StatusUnauthorized) && c.nextAPIKey(ctx, token) {
+		token, err = c.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.getAPIWithToken(ctx, endpoint, token, out)
+	}
+	return err
+}
+
+func (c *JellyfinGetCollector) getAPIWithToken(ctx context.Context, endpoint, token string, out interface{}) error {
+	u, err := apiURL(c.Config.Host, c.Config.BasePath, endpoint)
+	if err != nil {
+		return err
+	}
+	requestLog(ctx).WithField("url", u.String()).Debug("GET api")
+
+	var netClient = &http.Client{
+		Transport: c.transport,
+		Timeout:   c.Config.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > c.Config.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", c.Config.MaxRedirects)
+			}
+			c.redirectsMu.Lock()
+			c.redirects[u.Path]++
+			c.redirectsMu.Unlock()
+			// net/http only drops Authorization and Cookie on redirects to
+			// another host, the api key is sent in a header of its own
+			if req.URL.Host != via[0].URL.Host {
+				req.Header.Del(c.Config.AuthHeader)
+				req.Header.Del("X-Emby-Authorization")
+			}
+			return nil
+		},
+	}
+
+	if c.Config.TLSSessionMetrics {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+				if err == nil && state.DidResume {
+					c.tlsResumptionsMu.Lock()
+					c.tlsResumptions++
+					c.tlsResumptionsMu.Unlock()
+				}
+			},
+		})
+	}
+	if c.Config.ConnectionMetrics {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				c.connectionsMu.Lock()
+				if info.Reused {
+					c.reusedConns[u.Path]++
+				} else {
+					c.newConns[u.Path]++
+				}
+				c.connectionsMu.Unlock()
+			},
+		})
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	authHeader, authValue := c.Config.AuthHeader, token
+	if c.Config.LegacyAuthHeader {
+		authHeader, authValue = "X-Emby-Authorization", mediaBrowserAuthorization(token)
+	}
+	req.Header.Set(authHeader, authValue)
+	req.Header.Set("Accept", "application/json")
+	if !c.Config.DisableCompression {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && c.Config.RequestIDHeader != "" {
+		req.Header.Set(c.Config.RequestIDHeader, id)
+	}
+	logHTTP := c.httpLogger(ctx)
+	if logHTTP != nil {
+		dump, err := httputil.DumpRequestOut(redactRequest(req, authHeader), false)
+		if err == nil {
+			logHTTP.Log(string(dump))
+		}
+	}
+	start := time.Now()
+	resp, err := netClient.Do(req)
+	c.observeDuration(ctx, u.Path, time.Since(start))
+	if err != nil {
+		if c.Config.LogAPICalls {
+			requestLog(ctx).WithError(err).WithFields(logrus.Fields{
+				"endpoint":    u.Path,
+				"duration_ms": time.Since(start).Milliseconds(),
+			}).Info("jellyfin api call failed")
+		}
+		return err
+	}
+	// closing the body returns the connection to the pool of c.transport
+	defer resp.Body.Close()
+	if c.Config.CheckCertExpiry && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		c.certExpiryMu.Lock()
+		c.certExpiry = resp.TLS.PeerCertificates[0].NotAfter
+		c.certExpiryMu.Unlock()
+	}
+
+	counter := &countingReader{reader: resp.Body}
+	defer func() {
+		c.apiResponseSizes.WithLabelValues(u.Path).Observe(float64(counter.n))
+		if c.Config.LogAPICalls {
+			requestLog(ctx).WithFields(logrus.Fields{
+				"endpoint":       u.Path,
+				"status_code":    resp.StatusCode,
+				"duration_ms":    time.Since(start).Milliseconds(),
+				"response_bytes": counter.n,
+			}).Info("jellyfin api call")
+		}
+	}()
+
+	var reader io.Reader = counter
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	// read one byte past the limit to tell a body of exactly the limit from
+	// a truncated one, the limit applies to the decompressed body
+	buf := c.buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer c.buffers.Put(buf)
+	_, err = buf.ReadFrom(io.LimitReader(reader, c.Config.MaxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	// body is only valid until buf is put back, everything derived from it
+	// is copied
+	body := buf.Bytes()
+	if logHTTP != nil {
+		dump, err := httputil.DumpResponse(resp, false)
+		if err == nil {
+			logHTTP.Log(string(dump) + string(body))
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &jellyfin.APIError{StatusCode: resp.StatusCode}
+	}
+	if int64(len(body)) > c.Config.MaxResponseBytes {
+		return fmt.Errorf("response of %s exceeds %d bytes", u.Path, c.Config.MaxResponseBytes)
+	}
+	if out == nil {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return &ContentTypeError{Endpoint: u.Path, ContentType: resp.Header.Get("Content-Type")}
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// hostLabel returns the host and port of --host.
+func (c *JellyfinGetCollector) hostLabel() string {
+	u, err := url.Parse(c.Config.Host)
+	if err != nil || u.Host == "" {
+		return c.Config.Host
+	}
+	return u.Host
+}
+
+// apiURL returns the url of endpoint, which may include a query, on host
+// with the path of host and basePath prepended.
+func apiURL(host, basePath, endpoint string) (*url.URL, error) {
+	base, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Path == "" {
+		// JoinPath would return a relative path otherwise
+		base.Path = "/"
+	}
+	u := base.JoinPath(basePath, ep.EscapedPath())
+	u.RawQuery = ep.RawQuery
+	return u, nil
+}
+
+// observeDuration records the duration of an api call. With --otel-enabled
+// the trace of the scrape, if any, is attached as exemplar.
+func (c *JellyfinGetCollector) observeDuration(ctx context.Context, endpoint string, duration time.Duration) {
+	observer := c.apiDurations.WithLabelValues(endpoint)
+	span := trace.SpanContextFromContext(ctx)
+	if c.Config.OTel && span.IsValid() {
+		observer.(prom.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prom.Labels{
+			"traceID": span.TraceID().String(),
+			"spanID":  span.SpanID().String(),
+		})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
+
+// httpLogger returns the logger raw api exchanges are written to, or nil if
+// they aren't logged.
+func (c *JellyfinGetCollector) httpLogger(ctx context.Context) *httpLog {
+	level := logrus.TraceLevel
+	if c.Config.LogHTTP {
+		level = logrus.InfoLevel
+	}
+	if !log.Logger.IsLevelEnabled(level) {
+		return nil
+	}
+	return &httpLog{entry: requestLog(ctx), level: level}
+}
+
+type httpLog struct {
+	entry *logrus.Entry
+	level logrus.Level
+}
+
+func (l *httpLog) Log(dump string) {
+	l.entry.Log(l.level, dump)
+}
+
+// redactRequest returns a copy of req with the api key in authHeader removed,
+// for logging.
+func redactRequest(req *http.Request, authHeader string) *http.Request {
+	redacted := req.Clone(req.Context())
+	if redacted.Header.Get(authHeader) != "" {
+		redacted.Header.Set(authHeader, "REDACTED")
+	}
+	return redacted
+}
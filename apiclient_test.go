@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel/trace"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// redirects redirects to itself with n one lower until n is 0, then
+// answers with an empty JSON object.
+func redirects(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	if n > 0 {
+		http.Redirect(w, r, r.URL.Path+"?n="+strconv.Itoa(n-1), http.StatusFound)
+		return
+	}
+	jsonResponse(struct{}{})(w, r)
+}
+
+func TestMaxRedirects(t *testing.T) {
+	tests := []struct {
+		redirects int
+		wantErr   bool
+	}{
+		{0, false},
+		{1, false},
+		{3, false},
+		{4, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.redirects), func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": redirects}, "--max-redirects=3")
+			var out struct{}
+			err := c.getAPI(context.Background(), "/System/Info?n="+strconv.Itoa(tt.redirects), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAPI error %v, want error %v", err, tt.wantErr)
+			}
+
+			rec := scrape(t, c)
+			want := float64(tt.redirects)
+			if tt.wantErr {
+				want = 3
+			}
+			got, ok := rec.Value("api_redirects_total", "/System/Info")
+			if got != want || ok != (want > 0) {
+				t.Errorf("api_redirects_total{/System/Info} = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	items := `{"Items": [], "TotalRecordCount": 0, "Padding": "` + strings.Repeat("x", 1000) + `"}`
+	tests := []struct {
+		name    string
+		limit   int
+		gzip    bool
+		wantErr bool
+	}{
+		{"below the limit", len(items) + 1, false, false},
+		{"exactly the limit", len(items), false, false},
+		{"above the limit", len(items) - 1, false, true},
+		// the limit applies to the decompressed body
+		{"compressed above the limit", len(items) - 1, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if !tt.gzip {
+					w.Write([]byte(items))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write([]byte(items))
+				gz.Close()
+			}}, "--max-response-bytes="+strconv.Itoa(tt.limit))
+			var out jellyfin.ItemsResponse
+			err := c.getAPI(context.Background(), "/Items", &out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getAPI error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogHTTPRedactsAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		header string
+	}{
+		{"default header", nil, "X-Emby-Token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": rawJSON(`{"Version": "10.8.13"}`)},
+				append([]string{"--log-http", "--apikey=s3cret-key"}, tt.args...)...)
+			var out jellyfin.SystemInfo
+			err := c.getAPI(context.Background(), "/System/Info", &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var request string
+			for _, entry := range hook.AllEntries() {
+				if strings.Contains(entry.Message, "s3cret-key") {
+					t.Errorf("api key logged: %s", entry.Message)
+				}
+				if strings.HasPrefix(entry.Message, "GET /System/Info") {
+					request = entry.Message
+				}
+			}
+			if !strings.Contains(request, tt.header+": REDACTED") {
+				t.Errorf("logged request without a redacted %s header: %q", tt.header, request)
+			}
+		})
+	}
+}
+
+func TestObserveDurationExemplar(t *testing.T) {
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	tests := []struct {
+		name         string
+		args         []string
+		withSpan     bool
+		wantExemplar bool
+	}{
+		{"span", []string{"--otel-enabled"}, true, true},
+		{"no span", []string{"--otel-enabled"}, false, false},
+		{"otel disabled", nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t, tt.args...)
+			ctx := context.Background()
+			if tt.withSpan {
+				ctx = trace.ContextWithSpanContext(ctx, span)
+			}
+			c.observeDuration(ctx, "/System/Info", 150*time.Millisecond)
+
+			var m dto.Metric
+			err := c.apiDurations.WithLabelValues("/System/Info").(prom.Metric).Write(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Histogram.GetSampleCount() != 1 {
+				t.Fatalf("%d observations, want 1", m.Histogram.GetSampleCount())
+			}
+			var exemplar *dto.Exemplar
+			for _, bucket := range m.Histogram.Bucket {
+				if bucket.Exemplar != nil {
+					exemplar = bucket.Exemplar
+				}
+			}
+			if !tt.wantExemplar {
+				if exemplar != nil {
+					t.Errorf("exemplar %v attached", exemplar)
+				}
+				return
+			}
+			if exemplar == nil {
+				t.Fatal("no exemplar attached")
+			}
+			labels := make(map[string]string)
+			for _, pair := range exemplar.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels["traceID"] != "4bf92f3577b34da6a3ce929d0e0e4736" || labels["spanID"] != "00f067aa0ba902b7" {
+				t.Errorf("exemplar labels %v", labels)
+			}
+		})
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantEncoding string
+	}{
+		{"compressed", nil, "gzip"},
+		{"compression disabled", []string{"--disable-compression"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encoding string
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "application/json")
+				body := []byte(`{"Version": "10.8.13", "LocalAddress": "http://192.168.1.10:8096"}`)
+				if !strings.Contains(encoding, "gzip") {
+					w.Write(body)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write(body)
+				gz.Close()
+			}}, tt.args...)
+
+			info, err := c.client.GetSystemInfo(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != tt.wantEncoding {
+				t.Errorf("Accept-Encoding %q, want %q", encoding, tt.wantEncoding)
+			}
+			if info.Version != "10.8.13" || info.LocalAddress != "http://192.168.1.10:8096" {
+				t.Errorf("decoded %+v", info)
+			}
+		})
+	}
+}
+
+func TestCorruptGzipResponse(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte(`{"Version": "10.8.13"}`))
+	}})
+	if _, err := c.client.GetSystemInfo(context.Background()); err == nil {
+		t.Error("no error for a response that isn't gzip encoded")
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		header string
+	}{
+		{"default header", nil, "X-Request-ID"},
+		{"configured header", []string{"--request-id-header=X-Correlation-ID"}, "X-Correlation-ID"},
+		{"disabled", []string{"--request-id-header="}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ids []string
+			record := func(handler http.HandlerFunc) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					ids = append(ids, r.Header.Get("X-Request-ID")+r.Header.Get("X-Correlation-ID"))
+					mu.Unlock()
+					handler(w, r)
+				}
+			}
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items/Counts":   record(jsonResponse(jellyfin.ItemCounts{})),
+				"/ScheduledTasks": record(jsonResponse([]jellyfin.ScheduledTask{})),
+			}, tt.args...)
+			library := NewLibraryCollector(c)
+			library.endpoints = library.endpoints[:2]
+			c.collectors = []Collector{library}
+
+			scrape(t, c)
+			first := ids
+			ids = nil
+			scrape(t, c)
+			if len(first) != 2 || len(ids) != 2 {
+				t.Fatalf("%d and %d api calls, want 2 per scrape", len(first), len(ids))
+			}
+			if tt.header == "" {
+				if first[0] != "" || ids[0] != "" {
+					t.Errorf("request ids %v and %v sent with --request-id-header empty", first, ids)
+				}
+				return
+			}
+			// all calls of a scrape share its id
+			if first[0] == "" || first[0] != first[1] || ids[0] != ids[1] {
+				t.Errorf("request ids %v and %v, want one id per scrape", first, ids)
+			}
+			if first[0] == ids[0] {
+				t.Errorf("both scrapes sent request id %s", first[0])
+			}
+		})
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		header string
+		other  string
+	}{
+		{"default", nil, "X-Emby-Token", "X-MediaBrowser-Token"},
+		{"configured", []string{"--auth-header=X-MediaBrowser-Token"}, "X-MediaBrowser-Token", "X-Emby-Token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got, other string
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+				got, other = r.Header.Get(tt.header), r.Header.Get(tt.other)
+				jsonResponse(jellyfin.SystemInfo{Version: "10.8.13"})(w, r)
+			}}, tt.args...)
+			_, err := c.client.GetSystemInfo(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "key" {
+				t.Errorf("%s header %q, want key", tt.header, got)
+			}
+			if other != "" {
+				t.Errorf("api key sent in %s as well", tt.other)
+			}
+		})
+	}
+}
+
+// legacyAuth accepts only the MediaBrowser style X-Emby-Authorization
+// header of older Jellyfin versions with the api key key.
+func legacyAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Emby-Authorization")
+		if r.Header.Get("X-Emby-Token") != "" ||
+			!strings.HasPrefix(header, "MediaBrowser ") ||
+			!strings.Contains(header, `Client="jellyfin-exporter"`) ||
+			!strings.Contains(header, `Token="key"`) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func TestLegacyAuthHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "legacy header", args: []string{"--use-legacy-auth-header"}},
+		{name: "token header", wantErr: true},
+		{name: "legacy header overrides --auth-header", args: []string{"--use-legacy-auth-header", "--auth-header=X-MediaBrowser-Token"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": legacyAuth(jsonResponse(jellyfin.SystemInfo{Version: "10.8.13"})),
+			}, tt.args...)
+			info, err := c.client.GetSystemInfo(context.Background())
+			if tt.wantErr {
+				if !jellyfin.IsStatus(err, http.StatusUnauthorized) {
+					t.Errorf("error %v, want 401", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Version != "10.8.13" {
+				t.Errorf("version %q, want 10.8.13", info.Version)
+			}
+		})
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		host, basePath, endpoint string
+		want                     string
+	}{
+		{"http://jellyfin:8096", "/", "/System/Info", "http://jellyfin:8096/System/Info"},
+		{"http://jellyfin:8096", "/jellyfin", "/System/Info", "http://jellyfin:8096/jellyfin/System/Info"},
+		{"http://jellyfin:8096", "jellyfin/", "/System/Info", "http://jellyfin:8096/jellyfin/System/Info"},
+		{"https://example.com/", "/jellyfin/", "/Items?Recursive=true&Limit=0", "https://example.com/jellyfin/Items?Recursive=true&Limit=0"},
+		{"https://example.com/media", "/jellyfin", "/Users", "https://example.com/media/jellyfin/Users"},
+		{"http://jellyfin:8096", "/", "/Shows/a%2Fb/Episodes", "http://jellyfin:8096/Shows/a%2Fb/Episodes"},
+	}
+	for _, tt := range tests {
+		u, err := apiURL(tt.host, tt.basePath, tt.endpoint)
+		if err != nil {
+			t.Errorf("apiURL(%q, %q, %q): %v", tt.host, tt.basePath, tt.endpoint, err)
+			continue
+		}
+		if u.String() != tt.want {
+			t.Errorf("apiURL(%q, %q, %q) = %s, want %s", tt.host, tt.basePath, tt.endpoint, u, tt.want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/jellyfin/System/Info": jsonResponse(jellyfin.SystemInfo{Version: "10.8.13"}),
+	}, "--base-path=/jellyfin")
+	info, err := c.client.GetSystemInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "10.8.13" {
+		t.Errorf("version %q, want 10.8.13", info.Version)
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(rawJSON(`{"Version": "10.8.13"}`))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		want float64
+		ok   bool
+	}{
+		{"enabled", []string{"--tls-session-metrics-enabled"}, 2, true},
+		{"disabled", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t, append([]string{"--host=" + server.URL, "--apikey=key"}, tt.args...)...)
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+			c.transport.TLSClientConfig.RootCAs = roots
+
+			for i := 0; i < 3; i++ {
+				var out jellyfin.SystemInfo
+				if err := c.getAPI(context.Background(), "/System/Info", &out); err != nil {
+					t.Fatal(err)
+				}
+				// every call opens a new connection
+				c.transport.CloseIdleConnections()
+			}
+
+			// no collectors, so the scrape makes no further calls
+			c.collectors = nil
+			rec := scrape(t, c)
+			got, ok := rec.Value("tls_session_reuse_total")
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("tls_session_reuse_total = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResponseBuffersReused(t *testing.T) {
+	bodies := []string{
+		`{"Version": "10.8.13", "OperatingSystem": "` + strings.Repeat("Linux", 1000) + `", "SystemArchitecture": "X64"}`,
+		`{"Version": "10.9.0"}`,
+		`{"OperatingSystem": "Windows"}`,
+	}
+	var calls int
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+		rawJSON(bodies[calls])(w, r)
+		calls++
+	}})
+
+	var infos []jellyfin.SystemInfo
+	for range bodies {
+		var out jellyfin.SystemInfo
+		if err := c.getAPI(context.Background(), "/System/Info", &out); err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, out)
+	}
+
+	want := []jellyfin.SystemInfo{
+		{Version: "10.8.13", OperatingSystem: strings.Repeat("Linux", 1000), SystemArchitecture: "X64"},
+		{Version: "10.9.0"},
+		{OperatingSystem: "Windows"},
+	}
+	for i := range want {
+		got := infos[i]
+		if got.Version != want[i].Version || got.OperatingSystem != want[i].OperatingSystem ||
+			got.SystemArchitecture != want[i].SystemArchitecture {
+			t.Errorf("response %d decoded as %q %.20q %q, want %q %.20q %q", i,
+				got.Version, got.OperatingSystem, got.SystemArchitecture,
+				want[i].Version, want[i].OperatingSystem, want[i].SystemArchitecture)
+		}
+	}
+}
+
+func BenchmarkGetAPI(b *testing.B) {
+	body := `{"Items": [` + strings.Repeat(`{"Name": "Heat", "Type": "Movie"},`, 200) + `{}], "TotalRecordCount": 201}`
+	server := httptest.NewServer(rawJSON(body))
+	defer server.Close()
+	c := newTestCollector(b, "--host="+server.URL, "--apikey=key")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out jellyfin.ItemsResponse
+		if err := c.getAPI(context.Background(), "/Items", &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLogAPICalls(t *testing.T) {
+	const body = `{"Version": "10.8.13"}`
+	tests := []struct {
+		name       string
+		args       []string
+		handler    http.HandlerFunc
+		wantLogged bool
+		wantStatus int
+		wantBytes  int64
+	}{
+		{
+			name:       "successful call",
+			args:       []string{"--log-api-calls", "--disable-compression"},
+			handler:    rawJSON(body),
+			wantLogged: true,
+			wantStatus: http.StatusOK,
+			wantBytes:  int64(len(body)),
+		},
+		{
+			name:       "failed call",
+			args:       []string{"--log-api-calls", "--disable-compression"},
+			handler:    statusResponse(http.StatusInternalServerError),
+			wantLogged: true,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{name: "disabled", handler: rawJSON(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": tt.handler}, tt.args...)
+			var info jellyfin.SystemInfo
+			c.getAPI(context.Background(), "/System/Info", &info)
+
+			var logged []*logrus.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "jellyfin api call" {
+					logged = append(logged, entry)
+				}
+			}
+			if !tt.wantLogged {
+				if len(logged) != 0 {
+					t.Errorf("logged %v without --log-api-calls", logged[0].Data)
+				}
+				return
+			}
+			if len(logged) != 1 {
+				t.Fatalf("logged %d api calls, want 1", len(logged))
+			}
+			entry := logged[0]
+			if entry.Level != logrus.InfoLevel {
+				t.Errorf("logged at %s, want info", entry.Level)
+			}
+			if got := entry.Data["endpoint"]; got != "/System/Info" {
+				t.Errorf("endpoint %v, want /System/Info", got)
+			}
+			if got := entry.Data["status_code"]; got != tt.wantStatus {
+				t.Errorf("status_code %v, want %d", got, tt.wantStatus)
+			}
+			if _, ok := entry.Data["duration_ms"].(int64); !ok {
+				t.Errorf("duration_ms %v, want milliseconds", entry.Data["duration_ms"])
+			}
+			if tt.wantBytes != 0 && entry.Data["response_bytes"] != tt.wantBytes {
+				t.Errorf("response_bytes %v, want %d", entry.Data["response_bytes"], tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestLogAPICallsUnreachable(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	c := newTestCollector(t, "--host="+server.URL, "--apikey=key", "--log-api-calls")
+	if err := c.getAPI(context.Background(), "/System/Info", nil); err == nil {
+		t.Fatal("no error from a closed server")
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Message != "jellyfin api call failed" {
+		t.Fatalf("last log entry %v, want the failed api call", entry)
+	}
+	if entry.Data["endpoint"] != "/System/Info" || entry.Data[logrus.ErrorKey] == nil {
+		t.Errorf("logged %v, want the endpoint and the error", entry.Data)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"json", "application/json", `{"Version": "10.8.13"}`, false},
+		{"json with charset", "application/json; charset=utf-8", `{"Version": "10.8.13"}`, false},
+		{"xml", "application/xml", `<SystemInfo><Version>10.8.13</Version></SystemInfo>`, true},
+		{"html", "text/html", `<html>login</html>`, true},
+		{"no content type", "", `{"Version": "10.8.13"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accept string
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+				accept = r.Header.Get("Accept")
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.Write([]byte(tt.body))
+			}})
+			var info jellyfin.SystemInfo
+			err := c.getAPI(context.Background(), "/System/Info", &info)
+			if accept != "application/json" {
+				t.Errorf("Accept header %q, want application/json", accept)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Version != "10.8.13" {
+					t.Errorf("version %q, want 10.8.13", info.Version)
+				}
+				return
+			}
+			var contentTypeErr *ContentTypeError
+			if !errors.As(err, &contentTypeErr) {
+				t.Fatalf("error %v, want a ContentTypeError", err)
+			}
+			if contentTypeErr.Endpoint != "/System/Info" || contentTypeErr.ContentType != tt.contentType {
+				t.Errorf("error %+v, want /System/Info answering %q", contentTypeErr, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestCertExpiry(t *testing.T) {
+	notAfter := time.Now().Add(5 * 24 * time.Hour).Truncate(time.Second)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "jellyfin"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsServer := httptest.NewUnstartedServer(rawJSON(`{"Version": "10.8.13"}`))
+	tlsServer.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	server := httptest.NewServer(rawJSON(`{"Version": "10.8.13"}`))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		host   string
+		args   []string
+		wantOK bool
+	}{
+		{"https", tlsServer.URL, []string{"--check-cert-expiry"}, true},
+		{"disabled", tlsServer.URL, nil, false},
+		{"http", server.URL, []string{"--check-cert-expiry"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t, append([]string{"--host=" + tt.host, "--apikey=key"}, tt.args...)...)
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+			c.transport.TLSClientConfig.RootCAs = roots
+			var out jellyfin.SystemInfo
+			if err := c.getAPI(context.Background(), "/System/Info", &out); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := scrape(t, c)
+			got, ok := rec.Value("ssl_cert_expiry_timestamp_seconds")
+			if ok != tt.wantOK {
+				t.Fatalf("ssl_cert_expiry_timestamp_seconds recorded %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got != float64(notAfter.Unix()) {
+				t.Errorf("ssl_cert_expiry_timestamp_seconds = %v, want %v", got, notAfter.Unix())
+			}
+		})
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantReuse map[string]float64
+		wantNew   map[string]float64
+	}{
+		{
+			name:      "enabled",
+			args:      []string{"--http-connection-metrics-enabled"},
+			wantReuse: map[string]float64{"/System/Info": 2, "/Users": 1},
+			wantNew:   map[string]float64{"/System/Info": 2},
+		},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": rawJSON(`{"Version": "10.8.13"}`),
+				"/Users":       rawJSON(`[]`),
+			}, tt.args...)
+			call := func(endpoint string) {
+				t.Helper()
+				if err := c.getAPI(context.Background(), endpoint, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the first call opens the connection the others reuse
+			call("/System/Info")
+			call("/System/Info")
+			call("/Users")
+			call("/System/Info")
+			c.transport.CloseIdleConnections()
+			call("/System/Info")
+
+			// only the calls above are counted
+			c.collectors = nil
+			rec := scrape(t, c)
+			for name, want := range map[string]map[string]float64{
+				"api_connection_reuse_total": tt.wantReuse,
+				"api_new_connections_total":  tt.wantNew,
+			} {
+				if n := countSeries(rec, name); n != len(want) {
+					t.Errorf("%s has %d series, want %d: %v", name, n, len(want), rec.Values)
+				}
+				for endpoint, count := range want {
+					if got, _ := rec.Value(name, endpoint); got != count {
+						t.Errorf("%s{%s} = %v, want %v", name, endpoint, got, count)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAPIDurationBuckets(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []float64
+	}{
+		{"default", nil, prom.DefBuckets},
+		{"configured", []string{"--api-duration-buckets=0.01,0.05,0.1,0.5,1.0,5.0"}, []float64{0.01, 0.05, 0.1, 0.5, 1, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": rawJSON(`{"Version": "10.8.13"}`)}, tt.args...)
+			if err := c.getAPI(context.Background(), "/System/Info", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			registry := prom.NewPedanticRegistry()
+			registry.MustRegister(c.apiDurations)
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(families) != 1 || len(families[0].Metric) != 1 {
+				t.Fatalf("gathered %v, want the duration of /System/Info", families)
+			}
+			var got []float64
+			for _, bucket := range families[0].Metric[0].Histogram.Bucket {
+				got = append(got, bucket.GetUpperBound())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirectToOtherHostDropsAPIKey(t *testing.T) {
+	var sameHost, otherHost string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHost = r.Header.Get("X-Emby-Token")
+		jsonResponse(struct{}{})(w, r)
+	}))
+	defer other.Close()
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/System/Info/Public", http.StatusFound)
+		},
+		"/System/Info/Public": func(w http.ResponseWriter, r *http.Request) {
+			sameHost = r.Header.Get("X-Emby-Token")
+			http.Redirect(w, r, other.URL+"/System/Info", http.StatusFound)
+		},
+	})
+
+	var out struct{}
+	err := c.getAPI(context.Background(), "/System/Info", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameHost != "key" {
+		t.Errorf("api key %q after a redirect to the same host, want key", sameHost)
+	}
+	if otherHost != "" {
+		t.Errorf("api key %q sent to another host", otherHost)
+	}
+}
+
+func TestAPIResponseBytes(t *testing.T) {
+	body := `{"Version": "10.8.13", "Padding": "` + strings.Repeat("x", 2000) + `"}`
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(body))
+	gz.Close()
+
+	tests := []struct {
+		name       string
+		gzip       bool
+		wantSize   float64
+		wantBucket float64
+	}{
+		{"plain", false, float64(len(body)), 10e3},
+		// the size on the wire is observed
+		{"compressed", true, float64(compressed.Len()), 1e3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if !tt.gzip {
+					w.Write([]byte(body))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(compressed.Bytes())
+			}})
+			var out jellyfin.SystemInfo
+			err := c.getAPI(context.Background(), "/System/Info", &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count, sum, buckets := histogram(t, c.apiResponseSizes.WithLabelValues("/System/Info").(prom.Histogram))
+			if count != 1 || sum != tt.wantSize {
+				t.Errorf("api_response_bytes count %d, sum %v, want 1 and %v", count, sum, tt.wantSize)
+			}
+			for bound, n := range buckets {
+				if want := uint64(boolToFloat(bound >= tt.wantBucket)); n != want {
+					t.Errorf("api_response_bytes bucket %v has %d observations, want %d", bound, n, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricAssertion is an --assert-metric expression, such as jellyfin_up=1.
+type metricAssertion struct {
+	expr   string
+	metric string
+	op     string
+	value  float64
+}
+
+// parseAssertion parses metric_name followed by one of =, >, <, >= or <=
+// and a number.
+func parseAssertion(expr string) (metricAssertion, error) {
+	i := strings.IndexAny(expr, "=<>")
+	if i <= 0 {
+		return metricAssertion{}, fmt.Errorf("--assert-metric %q: expected metric_name, an operator (=, >, <, >=, <=) and a value", expr)
+	}
+	op := expr[i : i+1]
+	if op != "=" && strings.HasPrefix(expr[i+1:], "=") {
+		op += "="
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(expr[i+len(op):]), 64)
+	if err != nil {
+		return metricAssertion{}, fmt.Errorf("--assert-metric %q: invalid value: %w", expr, err)
+	}
+	return metricAssertion{
+		expr:   expr,
+		metric: strings.TrimSpace(expr[:i]),
+		op:     op,
+		value:  value,
+	}, nil
+}
+
+func parseAssertions(exprs []string) ([]metricAssertion, error) {
+	assertions := make([]metricAssertion, 0, len(exprs))
+	for _, expr := range exprs {
+		assertion, err := parseAssertion(expr)
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions, nil
+}
+
+func (a metricAssertion) holds(value float64) bool {
+	switch a.op {
+	case "=":
+		return value == a.value
+	case ">":
+		return value > a.value
+	case "<":
+		return value < a.value
+	case ">=":
+		return value >= a.value
+	default:
+		return value <= a.value
+	}
+}
+
+// check returns why the assertion fails for families, or an empty string if
+// every series of its metric satisfies it. Histograms and summaries are
+// compared by their sample count.
+func (a metricAssertion) check(families []*dto.MetricFamily) string {
+	for _, family := range families {
+		if family.GetName() != a.metric {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			value := metricValue(metric)
+			if !a.holds(value) {
+				return fmt.Sprintf("%s%s is %g", a.metric, labelString(metric), value)
+			}
+		}
+		return ""
+	}
+	return a.metric + " wasn't exported"
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Histogram != nil:
+		return float64(metric.Histogram.GetSampleCount())
+	case metric.Summary != nil:
+		return float64(metric.Summary.GetSampleCount())
+	default:
+		return metric.GetUntyped().GetValue()
+	}
+}
+
+func labelString(metric *dto.Metric) string {
+	if len(metric.GetLabel()) == 0 {
+		return ""
+	}
+	labels := make([]string, 0, len(metric.GetLabel()))
+	for _, label := range metric.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// runAssertions collects the metrics of collectors once and writes the
+// result of every assertion to out. It returns false if any failed.
+func runAssertions(ctx context.Context, collectors []*JellyfinGetCollector, assertions []metricAssertion, out io.Writer) (bool, error) {
+	registry := prom.NewRegistry()
+	for _, collector := range collectors {
+		registry.MustRegister(scrapeCollector{collector, ctx})
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for _, assertion := range assertions {
+		failure := assertion.check(families)
+		if failure == "" {
+			fmt.Fprintf(out, "PASS %s\n", assertion.expr)
+		} else {
+			ok = false
+			fmt.Fprintf(out, "FAIL %s: %s\n", assertion.expr, failure)
+		}
+	}
+	return ok, nil
+}
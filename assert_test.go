@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    metricAssertion
+		wantErr bool
+	}{
+		{expr: "jellyfin_up=1", want: metricAssertion{metric: "jellyfin_up", op: "=", value: 1}},
+		{expr: "jellyfin_movieCount>0", want: metricAssertion{metric: "jellyfin_movieCount", op: ">", value: 0}},
+		{expr: "jellyfin_movieCount >= 10", want: metricAssertion{metric: "jellyfin_movieCount", op: ">=", value: 10}},
+		{expr: "jellyfin_sessions_total<5", want: metricAssertion{metric: "jellyfin_sessions_total", op: "<", value: 5}},
+		{expr: "jellyfin_sessions_total<=0.5", want: metricAssertion{metric: "jellyfin_sessions_total", op: "<=", value: 0.5}},
+		{expr: "jellyfin_up", wantErr: true},
+		{expr: "=1", wantErr: true},
+		{expr: "jellyfin_up==1", wantErr: true},
+		{expr: "jellyfin_up=one", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseAssertion(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAssertion error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tt.want.expr = tt.expr
+			if got != tt.want {
+				t.Errorf("parseAssertion = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionOperators(t *testing.T) {
+	tests := []struct {
+		op   string
+		want map[float64]bool
+	}{
+		{"=", map[float64]bool{1: false, 2: true, 3: false}},
+		{">", map[float64]bool{1: false, 2: false, 3: true}},
+		{"<", map[float64]bool{1: true, 2: false, 3: false}},
+		{">=", map[float64]bool{1: false, 2: true, 3: true}},
+		{"<=", map[float64]bool{1: true, 2: true, 3: false}},
+	}
+	for _, tt := range tests {
+		assertion, err := parseAssertion("jellyfin_up" + tt.op + "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for value, want := range tt.want {
+			if got := assertion.holds(value); got != want {
+				t.Errorf("%g %s 2 = %v, want %v", value, tt.op, got, want)
+			}
+		}
+	}
+}
+
+func TestRunAssertions(t *testing.T) {
+	tests := []struct {
+		exprs      []string
+		wantOK     bool
+		wantOutput []string
+	}{
+		{[]string{"jellyfin_up=1", "jellyfin_movieCount>0"}, true, []string{"PASS jellyfin_up=1", "PASS jellyfin_movieCount>0"}},
+		{[]string{"jellyfin_up=1", "jellyfin_movieCount>=10"}, false, []string{"PASS jellyfin_up=1", "FAIL jellyfin_movieCount>=10: jellyfin_movieCount is 7"}},
+		{[]string{"jellyfin_typo=1"}, false, []string{"FAIL jellyfin_typo=1: jellyfin_typo wasn't exported"}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.exprs, " "), func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items/Counts": jsonResponse(jellyfin.ItemCounts{MovieCount: 7}),
+			})
+			library := NewLibraryCollector(c)
+			library.endpoints = library.endpoints[:1]
+			c.collectors = []Collector{library}
+
+			assertions, err := parseAssertions(tt.exprs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			ok, err := runAssertions(context.Background(), []*JellyfinGetCollector{c}, assertions, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("runAssertions = %v, want %v", ok, tt.wantOK)
+			}
+			if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(tt.wantOutput, "\n") {
+				t.Errorf("output\n%s\nwant\n%s", out.String(), strings.Join(tt.wantOutput, "\n"))
+			}
+		})
+	}
+}
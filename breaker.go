@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is the error of the endpoints not called while the circuit
+// breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open, Jellyfin not called")
+
+// circuitBreaker stops calling Jellyfin after --circuit-breaker-threshold
+// consecutive failed scrapes, serving the cached metrics instead. Once the
+// cooldown passed a scrape calls Jellyfin again, closing the breaker if it
+// succeeds. A threshold of 0 disables it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// openedAt is when the breaker opened, zero while it is closed, and
+	// retryAt when the next scrape may call Jellyfin again
+	openedAt time.Time
+	retryAt  time.Time
+	// recoveredAt is when the breaker last closed and openDuration how long
+	// it was open before
+	recoveredAt  time.Time
+	openDuration time.Duration
+}
+
+// allow reports whether a scrape starting at now may call Jellyfin.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openedAt.IsZero() || !now.Before(b.retryAt)
+}
+
+// record records the result of a scrape that called Jellyfin. It returns
+// true if the scrape closed the breaker.
+func (b *circuitBreaker) record(now time.Time, failed bool) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !failed:
+		b.failures = 0
+		if b.openedAt.IsZero() {
+			return false
+		}
+		b.recoveredAt = now
+		b.openDuration = now.Sub(b.openedAt)
+		b.openedAt = time.Time{}
+		return true
+	case !b.openedAt.IsZero():
+		// the probe after the cooldown failed, wait for another one
+		b.retryAt = now.Add(b.cooldown)
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = now
+			b.retryAt = now.Add(b.cooldown)
+		}
+	}
+	return false
+}
+
+// recordMetrics records when the breaker last closed, and after how long.
+func (b *circuitBreaker) recordMetrics(rec MetricRecorder) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.recoveredAt.IsZero() {
+		return
+	}
+	rec.RecordGauge("circuit_breaker_recovery_timestamp_seconds", float64(b.recoveredAt.UnixNano())/1e9)
+	rec.RecordGauge("circuit_breaker_open_duration_seconds", b.openDuration.Seconds())
+}
+
+// circuitOpenKey is the context key marking the scrapes that mustn't call
+// Jellyfin.
+type circuitOpenKey struct{}
+
+func breakerOpen(ctx context.Context) bool {
+	open, _ := ctx.Value(circuitOpenKey{}).(bool)
+	return open
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	type step struct {
+		at int
+		// allowed is the expected result of allow, failed the result of the
+		// scrape recorded if it was allowed
+		allowed bool
+		failed  bool
+	}
+	tests := []struct {
+		name         string
+		steps        []step
+		wantRecovery time.Time
+		wantDuration float64
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []step{
+				{at: 0, allowed: true, failed: true},
+				{at: 10, allowed: true, failed: true},
+				{at: 20, allowed: true},
+				{at: 30, allowed: true, failed: true},
+			},
+		},
+		{
+			name: "opens at the threshold",
+			steps: []step{
+				{at: 0, allowed: true, failed: true},
+				{at: 10, allowed: true, failed: true},
+				{at: 20, allowed: true, failed: true},
+				{at: 30},
+			},
+		},
+		{
+			name: "closes after a successful probe",
+			steps: []step{
+				{at: 0, allowed: true, failed: true},
+				{at: 10, allowed: true, failed: true},
+				{at: 20, allowed: true, failed: true},
+				{at: 30},
+				{at: 80, allowed: true},
+				{at: 90, allowed: true},
+			},
+			wantRecovery: at(80),
+			wantDuration: 60,
+		},
+		{
+			name: "failed probe opens again for the cooldown",
+			steps: []step{
+				{at: 0, allowed: true, failed: true},
+				{at: 10, allowed: true, failed: true},
+				{at: 20, allowed: true, failed: true},
+				{at: 50, allowed: true, failed: true},
+				{at: 70},
+				{at: 100, allowed: true},
+			},
+			wantRecovery: at(100),
+			wantDuration: 80,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := circuitBreaker{threshold: 3, cooldown: 30 * time.Second}
+			for _, s := range tt.steps {
+				allowed := b.allow(at(s.at))
+				if allowed != s.allowed {
+					t.Fatalf("allow at %ds = %v, want %v", s.at, allowed, s.allowed)
+				}
+				if allowed {
+					b.record(at(s.at), s.failed)
+				}
+			}
+
+			rec := NewTestRecorder()
+			b.recordMetrics(rec)
+			recovery, ok := rec.Value("circuit_breaker_recovery_timestamp_seconds")
+			if tt.wantRecovery.IsZero() {
+				if ok {
+					t.Errorf("circuit_breaker_recovery_timestamp_seconds = %v before a recovery", recovery)
+				}
+				return
+			}
+			if want := float64(tt.wantRecovery.Unix()); recovery != want {
+				t.Errorf("circuit_breaker_recovery_timestamp_seconds = %v, want %v", recovery, want)
+			}
+			if got, _ := rec.Value("circuit_breaker_open_duration_seconds"); got != tt.wantDuration {
+				t.Errorf("circuit_breaker_open_duration_seconds = %v, want %v", got, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var b circuitBreaker
+	for i := 0; i < 10; i++ {
+		if !b.allow(time.Now()) {
+			t.Fatal("disabled circuit breaker opened")
+		}
+		b.record(time.Now(), true)
+	}
+	rec := NewTestRecorder()
+	b.recordMetrics(rec)
+	if len(rec.Values) != 0 {
+		t.Errorf("disabled circuit breaker recorded %v", rec.Values)
+	}
+}
+
+func TestCircuitBreakerSkipsAPICalls(t *testing.T) {
+	var calls atomic.Int64
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c := newTestCollector(t, "--host="+server.URL, "--apikey=key",
+		"--circuit-breaker-threshold=2", "--circuit-breaker-cooldown=1h")
+	c.collectors = []Collector{NewSystemCollector(c)}
+	scrape := func() {
+		metrics := make(chan prom.Metric)
+		go func() {
+			c.collect(context.Background(), metrics)
+			close(metrics)
+		}()
+		for range metrics {
+		}
+	}
+
+	scrape()
+	scrape()
+	called := calls.Load()
+	if called == 0 {
+		t.Fatal("no api calls before the circuit breaker opened")
+	}
+	scrape()
+	if calls.Load() != called {
+		t.Errorf("%d api calls while the circuit breaker is open", calls.Load()-called)
+	}
+
+	// the cooldown passed
+	failing.Store(false)
+	c.breaker.mu.Lock()
+	c.breaker.retryAt = time.Now()
+	c.breaker.mu.Unlock()
+	scrape()
+	if calls.Load() == called {
+		t.Error("no api calls after the cooldown")
+	}
+	rec := NewTestRecorder()
+	c.breaker.recordMetrics(rec)
+	if _, ok := rec.Value("circuit_breaker_recovery_timestamp_seconds"); !ok {
+		t.Error("no circuit_breaker_recovery_timestamp_seconds after the recovery")
+	}
+}
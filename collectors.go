@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// Collector is a group of metrics collected from the Jellyfin api. The
+// collectors of a JellyfinGetCollector are run concurrently on every scrape.
+// Collect returns all failures of the scrape, a MultiError if there are
+// several.
+type Collector interface {
+	Name() string
+	Describe(descs chan<- *prom.Desc)
+	Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error
+}
+
+// endpoint is a single fetch of a built-in collector. The key identifies the
+// fetch in the cache and in endpoint_healthy, so it must be unique. Disabled
+// endpoints are never called, but their metrics are still described.
+type endpoint struct {
+	key     string
+	enabled bool
+	fetch   func(context.Context, jellyfin.Client, MetricRecorder) error
+	metrics []string
+}
+
+// endpointCollector is the base of the built-in collectors, it exports
+// metrics from metricInfos using the cache and endpoint health tracking of
+// the JellyfinGetCollector it belongs to.
+type endpointCollector struct {
+	owner     *JellyfinGetCollector
+	endpoints []endpoint
+}
+
+// add adds an endpoint exporting metrics, it is only called if enabled.
+func (e *endpointCollector) add(
+	key string, enabled bool, fetch func(context.Context, jellyfin.Client, MetricRecorder) error, metrics ...string,
+) {
+	e.endpoints = append(e.endpoints, endpoint{key: key, enabled: enabled, fetch: fetch, metrics: metrics})
+}
+
+// addSlow adds an expensive endpoint, which is only called once per
+// --slow-metrics-interval and served from cache in between.
+func (e *endpointCollector) addSlow(
+	key string, enabled bool, fetch func(context.Context, jellyfin.Client, MetricRecorder) error, metrics ...string,
+) {
+	e.owner.CollectionSchedule[key] = e.owner.Config.SlowMetricsInterval
+	e.add(key, enabled, fetch, metrics...)
+}
+
+// Endpoints returns all endpoints of the collector, including disabled ones.
+func (e *endpointCollector) Endpoints() []endpoint {
+	return e.endpoints
+}
+
+func (e *endpointCollector) Describe(descs chan<- *prom.Desc) {
+	for _, ep := range e.endpoints {
+		for _, name := range ep.metrics {
+			descs <- e.owner.descs[name]
+		}
+	}
+}
+
+func (e *endpointCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	rec := PromRecorder{Descs: e.owner.descs, Metrics: metrics}
+
+	// the group isn't derived from ctx, a failing endpoint doesn't cancel
+	// the others. Wait only returns the first error, errs has all of them
+	var (
+		group  errgroup.Group
+		errsMu sync.Mutex
+		errs   []error
+	)
+	for _, ep := range e.endpoints {
+		if !ep.enabled {
+			continue
+		}
+		ep := ep
+		group.Go(func() error {
+			err := e.owner.collectEndpoint(ctx, ep.key, client, rec, ep.fetch)
+			errsMu.Lock()
+			errs = append(errs, err)
+			errsMu.Unlock()
+			return err
+		})
+	}
+	_ = group.Wait()
+	return newMultiError(errs)
+}
+
+// SystemCollector exports server information and configuration.
+type SystemCollector struct{ endpointCollector }
+
+func NewSystemCollector(c *JellyfinGetCollector) *SystemCollector {
+	s := &SystemCollector{endpointCollector{owner: c}}
+
+	s.add("/System/Info", true, c.fetchSystemInfo,
+		"version", "target_info", "server_address_info", "wan_address_info", "system_encoder_info", "system_info",
+		"feature_compatibility", "maintenance_mode",
+		"database_size_bytes", "log_file_size_bytes", "server_memory_usage_bytes", "server_cpu_usage_percent",
+		"server_disk_read_bytes_total", "server_disk_write_bytes_total")
+	s.add("/System/Configuration", true, c.fetchConfiguration,
+		"remote_access_enabled", "https_enabled", "concurrent_stream_limit_configured",
+		"subtitle_download_language_configured")
+	s.add("/QuickConnect/Enabled", c.Config.SecurityMetrics, c.fetchQuickConnect,
+		"quick_connect_enabled")
+	s.add("/Auth/Keys", c.Config.SecurityMetrics, c.fetchAPIKeys,
+		"api_keys_total")
+	s.add("/System/Configuration/encoding", c.Config.HardwareMetrics && c.features.supportsHWAcceleration, c.fetchEncodingConfiguration,
+		"transcoding_hardware_acceleration_enabled", "transcoding_hardware_acceleration_type")
+	s.add("/System/SearchIndex", c.Config.SearchMetrics, c.fetchSearchIndex,
+		"search_index_items_total", "search_index_last_updated_timestamp_seconds")
+	s.add("/System/Backup/Status", c.Config.BackupMetrics && c.features.supportsBackup, c.fetchBackupStatus,
+		"last_backup_timestamp_seconds", "last_backup_size_bytes")
+	return s
+}
+
+func (s *SystemCollector) Name() string { return "system" }
+
+// LibraryCollector exports metrics about the library and its items.
+type LibraryCollector struct{ endpointCollector }
+
+func NewLibraryCollector(c *JellyfinGetCollector) *LibraryCollector {
+	l := &LibraryCollector{endpointCollector{owner: c}}
+
+	l.add("/Items/Counts", true, c.fetchItemCounts,
+		"movieCount", "seriesCount", "items_total")
+	l.add("/ScheduledTasks", true, c.fetchScheduledTasks,
+		"scheduled_tasks_total", "scheduled_tasks_by_state_total", "library_scan_in_progress",
+		"library_last_scan_timestamp_seconds")
+	l.add("/Items?Filters=IsResumable", true, c.fetchResumableItems,
+		"items_in_progress_total")
+	l.add("/Library/VirtualFolders", true, c.fetchVirtualFolders,
+		"virtual_folders_total", "virtual_folder_item_count")
+	l.add("/Library/VirtualFolders?ItemCounts", c.Config.LibraryItemCounts, c.fetchLibraryItemCounts,
+		"library_item_count")
+	l.add("/Items?Filters=IsFavorite", c.Config.EngagementMetrics, c.fetchFavorites,
+		"favorite_items_total")
+	l.add("/Items?IsUnidentified=true", true, c.fetchUnidentifiedItems,
+		"items_unidentified_total")
+	l.addSlow("/Items?Fields=UserData", c.Config.PlayCountHistogram, c.fetchPlayCountDistribution,
+		"item_play_count_distribution")
+	l.add("/Items?SortBy=DateCreated&Limit=200", true, c.fetchRecentlyAdded,
+		"items_added_last_day_total", "items_added_last_week_total")
+	l.add("/Items?SortBy=DateCreated", c.Config.IngestRateMetrics, c.fetchIngestRate,
+		"items_added_per_day_7d_avg")
+	l.add("/Items?ImageTypes=Trickplay", c.Config.TrickplayMetrics && c.features.supportsTrickplay, c.fetchTrickplay,
+		"items_with_trickplay_total")
+	l.addSlow("/Items?IncludeItemTypes=Movie&Fields=LocalTrailerCount", c.Config.TrailerMetrics, c.fetchTrailers,
+		"movies_with_trailer_total", "movies_without_trailer_total")
+	l.addSlow("/Items?IncludeItemTypes=Episode&Fields=Chapters", c.Config.IntroMetrics, c.fetchIntroMarkers,
+		"episodes_with_intro_data_total", "episodes_without_intro_data_total")
+	l.addSlow("/Items?Fields=Chapters", c.Config.ChapterMetrics, c.fetchChapters,
+		"library_chapters_total", "items_with_chapters_total")
+	l.addSlow("/Items?Fields=ProviderIds", c.Config.NFOMetrics || c.Config.MetadataSources, c.fetchProviderIds,
+		"items_with_nfo_total", "metadata_source_total")
+	l.addSlow("/Items?Fields=MediaStreams", c.Config.SubtitleFormats || c.Config.SubtitleMetrics, c.fetchSubtitles,
+		"subtitle_format_total", "items_with_external_subtitles_total", "items_with_embedded_subtitles_total")
+	l.addSlow("/Items?Fields=Path", c.Config.FileExtensions, c.fetchFileExtensions,
+		"library_file_extension_total")
+	l.add("/LiveTv/Channels", c.Config.LiveTVMetrics, c.fetchLiveTVChannels,
+		"iptv_channels_total", "iptv_channels_by_group_total")
+	l.add("/Library/MediaFolders", c.Config.SharingMetrics, c.fetchSharing,
+		"shared_libraries_total", "library_shares_total")
+	l.add("/Items?IncludeItemTypes=Movie&SortBy=PlayCount", c.Config.PopularityMetrics, c.fetchPopularItems,
+		"item_play_count")
+	l.add("/Items?IncludeItemTypes=Series&SortBy=PlayCount", c.Config.SeriesPopularity, c.fetchPopularSeries,
+		"series_play_count")
+	l.add("/Items?IncludeItemTypes=MusicAlbum&SortBy=PlayCount", c.Config.MusicPopularity, c.fetchPopularAlbums,
+		"album_play_count")
+	l.addSlow("/Shows/Episodes", c.Config.SeriesCompletion, c.fetchSeriesCompletion,
+		"series_completion_ratio")
+	l.addSlow("/Items/MusicAlbum", c.Config.MusicCompleteness, c.fetchAlbumCompleteness,
+		"music_album_track_ratio")
+	return l
+}
+
+func (l *LibraryCollector) Name() string { return "library" }
+
+// UserCollector exports metrics about users.
+type UserCollector struct{ endpointCollector }
+
+func NewUserCollector(c *JellyfinGetCollector) *UserCollector {
+	u := &UserCollector{endpointCollector{owner: c}}
+
+	u.add("/Users", true, c.fetchUsers,
+		"user_last_activity_timestamp_seconds", "user_max_sessions_configured", "user_max_bitrate_configured_bits_per_second",
+		"users_by_auth_provider_total", "users_with_2fa_total", "users_total", "users_never_logged_in_total")
+	u.add("/Notifications/Summary", c.Config.NotificationMetrics, c.fetchNotifications,
+		"notifications_unread_total")
+	return u
+}
+
+func (u *UserCollector) Name() string { return "users" }
+
+// SessionCollector exports metrics about active sessions.
+type SessionCollector struct{ endpointCollector }
+
+func NewSessionCollector(c *JellyfinGetCollector) *SessionCollector {
+	s := &SessionCollector{endpointCollector{owner: c}}
+
+	s.add("/Sessions", true, c.fetchSessions,
+		"session_estimated_bandwidth_bits_per_second", "sessions_by_protocol_total", "streams_by_media_type_total",
+		"user_streams_by_media_type_total", "transcode_progress_percent",
+		"sessions_by_network_total", "sessions_by_country_total", "sessions_by_ip_version_total", "sessions_by_tls_total",
+		"client_version_total", "idle_sessions_total", "transcoding_conversions_total")
+	return s
+}
+
+func (s *SessionCollector) Name() string { return "sessions" }
+
+func (s *SessionCollector) Describe(descs chan<- *prom.Desc) {
+	s.endpointCollector.Describe(descs)
+	s.owner.streamBitrates.Describe(descs)
+	s.owner.audioBitrates.Describe(descs)
+}
+
+// Collect exports the stream bitrate histograms after the sessions have been
+// fetched, so they include the observations of this scrape.
+func (s *SessionCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	err := s.endpointCollector.Collect(ctx, metrics, client)
+	s.owner.streamBitrates.Collect(metrics)
+	s.owner.audioBitrates.Collect(metrics)
+	return err
+}
+
+// ActivityCollector exports counters derived from the activity log.
+type ActivityCollector struct{ endpointCollector }
+
+func NewActivityCollector(c *JellyfinGetCollector) *ActivityCollector {
+	a := &ActivityCollector{endpointCollector{owner: c}}
+
+	a.add("/System/ActivityLog/Entries", c.Config.ImageMetrics || c.Config.AdminActionMetrics || c.Config.AuditMetrics,
+		c.fetchActivityLog, "image_requests_total", "admin_actions_total", "server_config_changes_total")
+	return a
+}
+
+func (a *ActivityCollector) Name() string { return "activity" }
+
+func (a *ActivityCollector) Describe(descs chan<- *prom.Desc) {
+	a.endpointCollector.Describe(descs)
+	for _, name := range webhookMetrics {
+		descs <- a.owner.descs[name]
+	}
+}
+
+// Collect also exports the counters of the events received from the webhook
+// plugin, which don't need an api call.
+func (a *ActivityCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	err := a.endpointCollector.Collect(ctx, metrics, client)
+	if a.owner.Config.ActivityWebhook {
+		a.owner.recordWebhookCounters(PromRecorder{Descs: a.owner.descs, Metrics: metrics})
+	}
+	return err
+}
+
+// adminEndpoints are the endpoints that respond 403 to api keys of users
+// without administrator rights.
+var adminEndpoints = map[string]bool{
+	"/Users":                             true,
+	"/Auth/Keys":                         true,
+	"/System/Configuration":              true,
+	"/System/Configuration/encoding":     true,
+	"/System/ActivityLog/Entries":        true,
+	"/System/Backup/Status":              true,
+	"/ScheduledTasks":                    true,
+	"/Library/VirtualFolders":            true,
+	"/Library/VirtualFolders?ItemCounts": true,
+	"/Library/MediaFolders":              true,
+}
+
+// endpointLister is implemented by the built-in collectors.
+type endpointLister interface {
+	Endpoints() []endpoint
+}
+
+// callsAPI reports whether the collector calls the Jellyfin api, which
+// built-in collectors only do if they have enabled endpoints.
+func callsAPI(collector Collector) bool {
+	lister, ok := collector.(endpointLister)
+	if !ok {
+		return true
+	}
+	for _, ep := range lister.Endpoints() {
+		if ep.enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPermissions warns about the metrics that will be unavailable because
+// the api key belongs to a user without administrator rights. Api keys
+// created in the dashboard don't belong to a user and have full access.
+func (c *JellyfinGetCollector) checkPermissions(ctx context.Context) {
+	me, err := c.client.GetCurrentUser(ctx)
+	if err != nil {
+		log.WithError(err).Debug("api key doesn't belong to a user, assuming administrator rights")
+		return
+	}
+	if me.Policy.IsAdministrator {
+		return
+	}
+
+	var endpoints, metrics []string
+	for _, collector := range c.collectors {
+		lister, ok := collector.(endpointLister)
+		if !ok {
+			continue
+		}
+		for _, ep := range lister.Endpoints() {
+			if ep.enabled && adminEndpoints[ep.key] {
+				endpoints = append(endpoints, ep.key)
+				metrics = append(metrics, ep.metrics...)
+			}
+		}
+	}
+	if len(metrics) > 0 {
+		log.WithFields(logrus.Fields{
+			"user":      me.Name,
+			"endpoints": strings.Join(endpoints, ", "),
+			"metrics":   strings.Join(metrics, ", "),
+		}).Warn("api key has no administrator rights, these metrics will be unavailable")
+	}
+}
+
+// CollectorFactory creates a collector when it is enabled.
+type CollectorFactory func() Collector
+
+// CollectorRegistry holds the collectors that can be enabled by name.
+type CollectorRegistry struct {
+	names     []string
+	factories map[string]CollectorFactory
+	enabled   map[string]bool
+}
+
+func NewCollectorRegistry() *CollectorRegistry {
+	return &CollectorRegistry{
+		factories: make(map[string]CollectorFactory),
+		enabled:   make(map[string]bool),
+	}
+}
+
+// Register adds a collector, enabled by default.
+func (r *CollectorRegistry) Register(name string, factory CollectorFactory) error {
+	if _, ok := r.factories[name]; ok {
+		return fmt.Errorf("collector %q is already registered", name)
+	}
+	r.names = append(r.names, name)
+	r.factories[name] = factory
+	r.enabled[name] = true
+	return nil
+}
+
+// Select limits the enabled collectors to those in enable, if it isn't empty
+// or the defaults are disabled, minus those in disable. With the defaults
+// disabled at least one collector must remain enabled.
+func (r *CollectorRegistry) Select(enable, disable []string, disableDefaults bool) error {
+	for _, name := range append(append([]string(nil), enable...), disable...) {
+		if _, ok := r.factories[name]; !ok {
+			return fmt.Errorf("unknown collector %q, available collectors are %s",
+				name, strings.Join(r.names, ", "))
+		}
+	}
+
+	if len(enable) > 0 || disableDefaults {
+		for _, name := range r.names {
+			r.enabled[name] = containsString(enable, name)
+		}
+	}
+	for _, name := range disable {
+		r.enabled[name] = false
+	}
+	if disableDefaults {
+		for _, name := range r.names {
+			if r.enabled[name] {
+				return nil
+			}
+		}
+		return fmt.Errorf("no collector enabled, --disable-default-collectors requires --enable-collectors to name at least one of %s",
+			strings.Join(r.names, ", "))
+	}
+	return nil
+}
+
+// Enabled creates the enabled collectors, in the order they were registered.
+func (r *CollectorRegistry) Enabled() []Collector {
+	var collectors []Collector
+	for _, name := range r.names {
+		if r.enabled[name] {
+			collectors = append(collectors, r.factories[name]())
+		}
+	}
+	return collectors
+}
+
+// metricSummary tells whether a metric is collected, and from which endpoint.
+type metricSummary struct {
+	MetricName string `json:"metric_name"`
+	Endpoint   string `json:"endpoint"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// Summary lists the metrics of all registered collectors with endpoints. A
+// metric is enabled if both its collector and its endpoint are.
+func (r *CollectorRegistry) Summary() []metricSummary {
+	var summary []metricSummary
+	for _, name := range r.names {
+		lister, ok := r.factories[name]().(endpointLister)
+		if !ok {
+			continue
+		}
+		for _, ep := range lister.Endpoints() {
+			for _, metric := range ep.metrics {
+				summary = append(summary, metricSummary{
+					MetricName: metric,
+					Endpoint:   ep.key,
+					Enabled:    r.enabled[name] && ep.enabled,
+				})
+			}
+		}
+	}
+	return summary
+}
+
+// registerCollectors registers the built-in collectors of c.
+func registerCollectors(registry *CollectorRegistry, c *JellyfinGetCollector) {
+	builtin := map[string]CollectorFactory{
+		"system":   func() Collector { return NewSystemCollector(c) },
+		"library":  func() Collector { return NewLibraryCollector(c) },
+		"users":    func() Collector { return NewUserCollector(c) },
+		"sessions": func() Collector { return NewSessionCollector(c) },
+		"activity": func() Collector { return NewActivityCollector(c) },
+	}
+	for _, name := range []string{"system", "library", "users", "sessions", "activity"} {
+		err := registry.Register(name, builtin[name])
+		if err != nil {
+			log.WithError(err).Panic("register collector")
+		}
+	}
+}
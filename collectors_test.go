@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// maintenanceCollector is a third-party collector exporting whether the
+// server is in maintenance mode, read with the client it is given.
+type maintenanceCollector struct {
+	desc *prom.Desc
+}
+
+func (m *maintenanceCollector) Name() string { return "maintenance" }
+
+func (m *maintenanceCollector) Describe(descs chan<- *prom.Desc) { descs <- m.desc }
+
+func (m *maintenanceCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	info, err := client.GetSystemInfo(ctx)
+	if err != nil {
+		return err
+	}
+	metrics <- prom.MustNewConstMetric(m.desc, prom.GaugeValue, boolToFloat(info.MaintenanceMode))
+	return nil
+}
+
+func TestCustomCollector(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Info": rawJSON(`{"Version": "10.8.13", "MaintenanceMode": true}`),
+	})
+	c.collectors = append(c.collectors, &maintenanceCollector{
+		desc: prom.NewDesc("extension_maintenance", "maintenance mode read by an extension", nil, nil),
+	})
+
+	rec := scrape(t, c)
+	if got, ok := rec.Value("extension_maintenance"); !ok || got != 1 {
+		t.Errorf("extension_maintenance = %v, %v, want 1", got, ok)
+	}
+	// the built-in collectors still run next to it
+	if got, ok := rec.Value("version", "10.8.13"); !ok || got != 1 {
+		t.Errorf("version{10.8.13} = %v, %v, want 1", got, ok)
+	}
+}
+
+func TestCollectorsDescribeEveryMetric(t *testing.T) {
+	c := newTestCollector(t)
+	owners := make(map[*prom.Desc][]string)
+	for _, collector := range c.collectors {
+		descs := make(chan *prom.Desc, len(metricInfos))
+		collector.Describe(descs)
+		close(descs)
+		for desc := range descs {
+			owners[desc] = append(owners[desc], collector.Name())
+		}
+	}
+	for _, name := range collectorMetrics {
+		owners[c.descs[name]] = append(owners[c.descs[name]], "exporter")
+	}
+
+	for _, info := range metricInfos {
+		if got := owners[c.descs[info.Name]]; len(got) != 1 {
+			t.Errorf("%s is described by %v, want exactly one collector", info.Name, got)
+		}
+	}
+}
+
+func TestCollectorEndpoints(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "/System/Configuration,/System/Info"},
+		{[]string{"--security-metrics-enabled", "--search-metrics-enabled"},
+			"/Auth/Keys,/QuickConnect/Enabled,/System/Configuration,/System/Info,/System/SearchIndex"},
+	}
+	for _, tt := range tests {
+		system := NewSystemCollector(newTestCollector(t, tt.args...))
+		var keys []string
+		for _, ep := range system.endpoints {
+			if ep.enabled {
+				keys = append(keys, ep.key)
+			}
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != tt.want {
+			t.Errorf("%v: system endpoints %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+// spyCollector counts the calls of its methods.
+type spyCollector struct {
+	name      string
+	describes atomic.Int64
+	collects  atomic.Int64
+}
+
+func (s *spyCollector) Name() string { return s.name }
+
+func (s *spyCollector) Describe(descs chan<- *prom.Desc) { s.describes.Add(1) }
+
+func (s *spyCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	s.collects.Add(1)
+	return nil
+}
+
+func TestCollectorRegistry(t *testing.T) {
+	tests := []struct {
+		name            string
+		enable          []string
+		disable         []string
+		disableDefaults bool
+		wantEnabled     []string
+		wantErr         string
+	}{
+		{name: "defaults", wantEnabled: []string{"first", "second", "third"}},
+		{name: "disable", disable: []string{"second"}, wantEnabled: []string{"first", "third"}},
+		{name: "enable", enable: []string{"third", "first"}, wantEnabled: []string{"first", "third"}},
+		{name: "enable and disable", enable: []string{"first", "second"}, disable: []string{"first"}, wantEnabled: []string{"second"}},
+		{name: "without defaults", enable: []string{"second"}, disableDefaults: true, wantEnabled: []string{"second"}},
+		{name: "nothing enabled", disableDefaults: true, wantErr: "no collector enabled"},
+		{name: "unknown collector", disable: []string{"fourth"}, wantErr: "available collectors are first, second, third"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spies := map[string]*spyCollector{}
+			registry := NewCollectorRegistry()
+			for _, name := range []string{"first", "second", "third"} {
+				spy := &spyCollector{name: name}
+				spies[name] = spy
+				if err := registry.Register(name, func() Collector { return spy }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := registry.Register("first", func() Collector { return spies["first"] }); err == nil {
+				t.Error("registered first twice")
+			}
+
+			err := registry.Select(tt.enable, tt.disable, tt.disableDefaults)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := newTestCollector(t)
+			c.collectors = registry.Enabled()
+			scrape(t, c)
+			var enabled []string
+			for _, collector := range c.collectors {
+				enabled = append(enabled, collector.Name())
+			}
+			if strings.Join(enabled, ",") != strings.Join(tt.wantEnabled, ",") {
+				t.Errorf("enabled collectors %v, want %v", enabled, tt.wantEnabled)
+			}
+			for name, spy := range spies {
+				// registering the collector describes it as well
+				described, collected := spy.describes.Load() > 0, spy.collects.Load() > 0
+				if enabled := containsString(tt.wantEnabled, name); described != enabled || collected != enabled {
+					t.Errorf("%s described %v and collected %v, want %v", name, described, collected, enabled)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableDefaultCollectors(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantEnabled []string
+	}{
+		{name: "defaults", wantEnabled: []string{"system", "library", "users", "sessions", "activity"}},
+		{name: "only enabled", args: []string{"--disable-default-collectors", "--enable-collectors=system,users"}, wantEnabled: []string{"system", "users"}},
+		{name: "every collector disabled", args: []string{"--disable-collectors=system,library,users,sessions,activity"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": rawJSON(`{"Version": "10.8.13"}`),
+				"/Users/Me":    rawJSON(`{"Name": "admin", "Policy": {"IsAdministrator": true}}`),
+			}, tt.args...)
+			collector, err := setupCollector(c.Config, io.Discard, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var enabled []string
+			for _, collector := range collector.collectors {
+				enabled = append(enabled, collector.Name())
+			}
+			if strings.Join(enabled, ",") != strings.Join(tt.wantEnabled, ",") {
+				t.Fatalf("enabled collectors %v, want %v", enabled, tt.wantEnabled)
+			}
+
+			// the collectors whose endpoints record each metric
+			owners := map[string][]string{}
+			registry := NewCollectorRegistry()
+			registerCollectors(registry, collector)
+			for _, name := range registry.names {
+				for _, ep := range registry.factories[name]().(endpointLister).Endpoints() {
+					for _, metric := range ep.metrics {
+						owners[metric] = append(owners[metric], name)
+					}
+				}
+			}
+			rec := scrape(t, collector)
+			if _, ok := rec.Value("up"); !ok {
+				t.Error("up isn't collected")
+			}
+			for key := range rec.Values {
+				name, _, _ := strings.Cut(key, "{")
+				if metricOwners, ok := owners[name]; ok && !containsAnyString(tt.wantEnabled, metricOwners) {
+					t.Errorf("%s of the disabled collectors %v is collected", key, metricOwners)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableDefaultCollectorsValidation(t *testing.T) {
+	config := testConfig(t)
+	config.DisableDefaultCollectors = true
+	if err := validateConfig(config); err == nil || !strings.Contains(err.Error(), "no collector enabled") {
+		t.Errorf("validateConfig error %v, want no collector enabled", err)
+	}
+	config.EnableCollectors = "sessions"
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig rejected --enable-collectors=sessions: %v", err)
+	}
+}
+
+func containsAnyString(list, values []string) bool {
+	for _, value := range values {
+		if containsString(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		name     string
+		me       http.HandlerFunc
+		wantWarn bool
+	}{
+		{"administrator", rawJSON(`{"Name": "admin", "Policy": {"IsAdministrator": true}}`), false},
+		{"user", rawJSON(`{"Name": "alice", "Policy": {"IsAdministrator": false}}`), true},
+		{"dashboard api key", statusResponse(http.StatusBadRequest), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Users/Me": tt.me})
+			c.collectors = []Collector{NewUserCollector(c)}
+			c.checkPermissions(context.Background())
+
+			var warning *logrus.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warning = entry
+				}
+			}
+			if (warning != nil) != tt.wantWarn {
+				t.Fatalf("warned %v, want %v", warning != nil, tt.wantWarn)
+			}
+			if warning == nil {
+				return
+			}
+			if warning.Data["endpoints"] != "/Users" {
+				t.Errorf("warned about endpoints %q, want /Users", warning.Data["endpoints"])
+			}
+			if metrics, _ := warning.Data["metrics"].(string); !strings.Contains(metrics, "users_with_2fa_total") {
+				t.Errorf("warned about metrics %q, want users_with_2fa_total among them", metrics)
+			}
+		})
+	}
+}
+
+func TestMetricSummary(t *testing.T) {
+	c := newTestCollector(t)
+	registry := NewCollectorRegistry()
+	registerCollectors(registry, c)
+	if err := registry.Select(nil, []string{"users"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	enabled := map[string]bool{}
+	endpoints := map[string]string{}
+	for _, metric := range registry.Summary() {
+		enabled[metric.MetricName] = metric.Enabled
+		endpoints[metric.MetricName] = metric.Endpoint
+	}
+	for metric, want := range map[string]bool{
+		"system_info":                          true,
+		"movieCount":                           true,
+		"sessions_by_protocol_total":           true,
+		"quick_connect_enabled":                false,
+		"user_last_activity_timestamp_seconds": false,
+	} {
+		got, ok := enabled[metric]
+		if !ok {
+			t.Errorf("summary lacks %s", metric)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s enabled %v, want %v", metric, got, want)
+		}
+		if endpoints[metric] == "" {
+			t.Errorf("%s has no endpoint", metric)
+		}
+	}
+}
+
+func TestDisableCollectors(t *testing.T) {
+	tests := []struct {
+		args        []string
+		wantVersion bool
+	}{
+		{nil, true},
+		{[]string{"--disable-collectors=system"}, false},
+		{[]string{"--enable-collectors=users,system"}, true},
+		{[]string{"--enable-collectors=users"}, false},
+	}
+	for _, tt := range tests {
+		c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+			"/System/Info": rawJSON(`{"Version": "10.8.13"}`),
+		}, tt.args...)
+		rec := scrape(t, c)
+		if _, ok := rec.Value("version", "10.8.13"); ok != tt.wantVersion {
+			t.Errorf("%v: version collected %v, want %v", tt.args, ok, tt.wantVersion)
+		}
+	}
+}
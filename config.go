@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+type ExporterConfig struct {
+	LogLevel     string `long:"log-level" description:"log verbosity level (trace, debug, info, warn, error, fatal)" env:"LOG_LEVEL" default:"info"`
+	LogHTTP      bool   `long:"log-http" description:"log Jellyfin api requests and responses at info level, they are logged at trace level otherwise" env:"LOG_HTTP"`
+	OTel         bool   `long:"otel-enabled" description:"read W3C trace context from scrape requests and attach it as exemplars to api request durations" env:"OTEL_ENABLED"`
+	Namespace    string `long:"namespace" description:"metric name prefix" default:"jellyfin" env:"METRIC_NAMESPACE"`
+	InstanceName string `long:"instance-name" description:"human readable name of the Jellyfin server (e.g. home-media), added as instance_name label to all metrics" env:"INSTANCE_NAME"`
+	Listen       string `short:"l" long:"listen" description:"host:port to listen on" default:":9453" env:"LISTEN"`
+	ListenV6     string `long:"listen-ipv6" description:"IPv6 address to listen on instead of the host of --listen, without brackets (e.g. ::1)" env:"LISTEN_IPV6"`
+
+	AssertMetrics []string `long:"assert-metric" description:"collect once, check metric_name=value (or >, <, >=, <=) and exit 1 if it doesn't hold, repeatable" env:"ASSERT_METRICS" env-delim:","`
+
+	Watch         bool          `long:"watch" description:"print the metrics to stdout every --watch-interval instead of serving them, until interrupted" env:"WATCH"`
+	WatchInterval time.Duration `long:"watch-interval" description:"interval of --watch" default:"5s" env:"WATCH_INTERVAL"`
+
+	RemoteWriteURL      string        `long:"remote-write-url" description:"Prometheus remote write endpoint (e.g. http://prometheus:9090/api/v1/write) to push the metrics to every --remote-write-interval, besides serving them" env:"REMOTE_WRITE_URL"`
+	RemoteWriteInterval time.Duration `long:"remote-write-interval" description:"interval of --remote-write-url" default:"30s" env:"REMOTE_WRITE_INTERVAL"`
+
+	ValidateConfig bool `long:"validate-config" description:"validate the options, print Config OK and exit without calling Jellyfin" env:"VALIDATE_CONFIG"`
+	ConfigDiff     bool `long:"config-diff" description:"print the options that differ from their defaults, with secrets redacted, and exit" env:"CONFIG_DIFF"`
+
+	// LibraryTypePrefixes is parsed into libraryPrefixes by validateConfig
+	LibraryTypePrefixes string `long:"library-type-prefix-map" description:"metric name prefix per library type instead of --namespace, as type=prefix list or JSON object (types: movies, tvshows, music)" env:"LIBRARY_TYPE_PREFIX_MAP"`
+	libraryPrefixes     map[string]string
+
+	// MetricPrefixOverrides is parsed into prefixOverrides by validateConfig
+	MetricPrefixOverrides []string `long:"metric-prefix-override" description:"rename the metrics starting with a prefix, as from=to (e.g. jellyfin_movie=media_movie), repeatable" env:"METRIC_PREFIX_OVERRIDES" env-delim:","`
+	prefixOverrides       []prefixOverride
+
+	// VersionExtraLabels is parsed into versionLabels by validateConfig
+	VersionExtraLabels []string `long:"version-extra-labels" description:"constant labels added to the version metric, as key=value (e.g. update_channel=stable), repeatable" env:"VERSION_EXTRA_LABELS" env-delim:","`
+	versionLabels      map[string]string
+
+	// APIDurationBuckets is parsed into apiDurationBuckets by validateConfig, nil
+	// leaves the histogram with the default buckets
+	APIDurationBuckets string `long:"api-duration-buckets" description:"comma separated upper bounds in seconds of the buckets of api_request_duration_seconds, the Prometheus default buckets if empty" env:"API_DURATION_BUCKETS"`
+	apiDurationBuckets []float64
+
+	SNMPCompatLabels bool   `long:"snmp-compat-labels" description:"add an oid label to every Jellyfin metric, for SNMP bridges correlating them" env:"SNMP_COMPAT_LABELS"`
+	SNMPOIDBase      string `long:"snmp-oid-base" description:"object id the oid labels of --snmp-compat-labels are below" default:"1.3.6.1.4.1.99999.1" env:"SNMP_OID_BASE"`
+
+	// ConfigFile is loaded into helpOverrides by validateConfig
+	ConfigFile    string `long:"config-file" description:"YAML file with further settings (metric_help_overrides)" env:"CONFIG_FILE"`
+	helpOverrides map[string]string
+
+	// instance is the Consul service id of the host, set by CollectorManager
+	instance string
+
+	ServerReadHeaderTimeout time.Duration `long:"server-read-header-timeout" description:"time allowed to read the headers of a request" default:"2s" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ServerReadTimeout       time.Duration `long:"server-read-timeout" description:"time allowed to read a whole request, including the body" default:"5s" env:"SERVER_READ_TIMEOUT"`
+	OutputFormat            string        `long:"output-format" description:"format of /metrics, prometheus or influxdb (line protocol)" default:"prometheus" env:"OUTPUT_FORMAT"`
+	EnableAPI               bool          `long:"enable-api" description:"serve the metrics of the last scrape as JSON at /api/v1/metrics/{metric_name}" env:"ENABLE_API"`
+	EnableDebugEndpoints    bool          `long:"enable-debug-endpoints" description:"serve the state of the collectors, their last run, error and number of series, as JSON at /debug/collector" env:"ENABLE_DEBUG_ENDPOINTS"`
+	EnableH2C               bool          `long:"enable-h2c" description:"serve HTTP/2 without TLS (h2c), not recommended outside trusted networks" env:"ENABLE_H2C"`
+	CORSOrigins             string        `long:"cors-origins" description:"comma separated origins allowed to fetch metrics from a browser" env:"CORS_ORIGINS"`
+	TLSCert                 string        `long:"tls-cert" description:"certificate file to serve metrics over https" env:"TLS_CERT"`
+	TLSKey                  string        `long:"tls-key" description:"private key file of --tls-cert" env:"TLS_KEY"`
+	TLSClientCA             string        `long:"tls-client-ca" description:"CA file to require client certificates from (mutual TLS) on /metrics and the api endpoints, /_health and /_ready stay open to probes" env:"TLS_CLIENT_CA"`
+	Host                    string        `short:"h" long:"host" description:"jellyfin host to export metrics for, required without --consul-address" env:"HOST"`
+	ConsulAddress           string        `long:"consul-address" description:"url of a Consul agent to discover the Jellyfin hosts from instead of --host" env:"CONSUL_ADDRESS"`
+	ConsulServiceName       string        `long:"consul-service-name" description:"service the Jellyfin hosts are registered as in Consul" default:"jellyfin" env:"CONSUL_SERVICE_NAME"`
+	ConsulRefreshInterval   time.Duration `long:"consul-refresh-interval" description:"interval to discover the Jellyfin hosts from Consul in" default:"1m" env:"CONSUL_REFRESH_INTERVAL"`
+	APIKey                  string        `short:"u" long:"apikey" description:"jellyfin apikey for auth, required without --use-session-auth" env:"API_KEY"`
+	APIKeyFile              string        `long:"apikey-file" description:"file containing the jellyfin apikey, such as a mounted Kubernetes secret, read again on every scrape, takes precedence over --apikey" env:"APIKEY_FILE"`
+	APIKeyFallbacks         string        `long:"api-key-fallbacks" description:"comma separated api keys tried in order when Jellyfin rejects --apikey, for key rotation" env:"API_KEY_FALLBACKS"`
+	ReadinessEndpoint       string        `long:"readiness-check-endpoint" description:"api endpoint called by /_ready to check that Jellyfin is reachable" default:"/System/Ping" env:"READINESS_CHECK_ENDPOINT"`
+	BackgroundHealthProbe   bool          `long:"background-health-probe-enabled" description:"ping Jellyfin every --health-check-interval between scrapes and report up as 0 while the ping fails" env:"BACKGROUND_HEALTH_PROBE_ENABLED"`
+	HealthCheckInterval     time.Duration `long:"health-check-interval" description:"interval of --background-health-probe-enabled" default:"30s" env:"HEALTH_CHECK_INTERVAL"`
+	BasePath                string        `long:"base-path" description:"path Jellyfin is served under, e.g. /jellyfin behind a reverse proxy" default:"/" env:"BASE_PATH"`
+	AuthHeader              string        `long:"auth-header" description:"header to send the apikey in, e.g. X-MediaBrowser-Token" default:"X-Emby-Token" env:"AUTH_HEADER"`
+	LegacyAuthHeader        bool          `long:"use-legacy-auth-header" description:"send the api key in a MediaBrowser style X-Emby-Authorization header instead of --auth-header, for older servers" env:"USE_LEGACY_AUTH_HEADER"`
+	UseSessionAuth          bool          `long:"use-session-auth" description:"authenticate with --jellyfin-username and --jellyfin-password instead of --apikey" env:"USE_SESSION_AUTH"`
+	JellyfinUsername        string        `long:"jellyfin-username" description:"jellyfin user to authenticate as with --use-session-auth" env:"JELLYFIN_USERNAME"`
+	JellyfinPassword        string        `long:"jellyfin-password" description:"password of --jellyfin-username" env:"JELLYFIN_PASSWORD"`
+	DeadLetterFile          string        `long:"dead-letter-file" description:"file to append failed Jellyfin api calls to, one JSON object per line" env:"DEAD_LETTER_FILE"`
+	StartupDelay            time.Duration `long:"startup-delay" description:"time to wait before the first Jellyfin api call, for Jellyfin started at the same time" env:"STARTUP_DELAY"`
+	MaxScrapeDuration       time.Duration `long:"max-scrape-duration" description:"time after which a scrape is aborted, serving the metrics collected so far (0 for no limit)" default:"30s" env:"MAX_SCRAPE_DURATION"`
+	Timeout                 time.Duration `long:"timeout" description:"timeout of a Jellyfin api call, and of a scrape without X-Prometheus-Scrape-Timeout-Seconds header" default:"10s" env:"TIMEOUT"`
+	MaxResponseBytes        int64         `long:"max-response-bytes" description:"maximum size of a Jellyfin api response body" default:"10485760" env:"MAX_RESPONSE_BYTES"`
+	SlowMetricsInterval     time.Duration `long:"slow-metrics-interval" description:"interval of metrics that enumerate the whole library, they are served from cache in between (0 to refresh on every scrape)" default:"1h" env:"SLOW_METRICS_INTERVAL"`
+	StalenessTimeout        time.Duration `long:"staleness-timeout" description:"time after which the cached metrics of a failing endpoint are dropped instead of served, counted from when the endpoint was due (0 to serve them forever)" default:"5m" env:"STALENESS_TIMEOUT"`
+	CircuitBreakerThreshold int           `long:"circuit-breaker-threshold" description:"number of consecutive scrapes without a successful Jellyfin api call after which scrapes are served from cache for --circuit-breaker-cooldown, without calling Jellyfin (0 to disable)" env:"CIRCUIT_BREAKER_THRESHOLD"`
+	CircuitBreakerCooldown  time.Duration `long:"circuit-breaker-cooldown" description:"time the circuit breaker stays open before a scrape calls Jellyfin again" default:"30s" env:"CIRCUIT_BREAKER_COOLDOWN"`
+	LibraryConcurrency      int           `long:"library-fetch-concurrency" description:"number of libraries counted concurrently by --library-item-count-metrics-enabled" default:"4" env:"LIBRARY_FETCH_CONCURRENCY"`
+	LibraryFetchTimeout     time.Duration `long:"library-fetch-timeout" description:"timeout of counting the items of one library" default:"10s" env:"LIBRARY_FETCH_TIMEOUT"`
+	PageSize                int           `long:"page-size" description:"number of items requested per page from paginated Jellyfin api endpoints" default:"500" env:"PAGE_SIZE"`
+	MaxRedirects            int           `long:"max-redirects" description:"maximum number of redirects followed per Jellyfin api call" default:"3" env:"MAX_REDIRECTS"`
+	HTTPMaxIdleConns        int           `long:"http-max-idle-conns" description:"maximum number of idle connections to Jellyfin (0 for no limit)" default:"100" env:"HTTP_MAX_IDLE_CONNS"`
+	HTTPMaxIdleConnsPerHost int           `long:"http-max-idle-conns-per-host" description:"maximum number of idle connections per Jellyfin host" default:"10" env:"HTTP_MAX_IDLE_CONNS_PER_HOST"`
+	HTTPIdleConnTimeout     time.Duration `long:"http-idle-conn-timeout" description:"time an idle connection to Jellyfin is kept open (0 for no limit)" default:"90s" env:"HTTP_IDLE_CONN_TIMEOUT"`
+	RequestIDHeader         string        `long:"request-id-header" description:"header to send the request id of the scrape in to Jellyfin (empty to disable)" default:"X-Request-ID" env:"REQUEST_ID_HEADER"`
+	LogAPICalls             bool          `long:"log-api-calls" description:"log every Jellyfin api call with its status code, duration and response size at info level" env:"LOG_API_CALLS"`
+	DisableCompression      bool          `long:"disable-compression" description:"request uncompressed Jellyfin api responses instead of gzip" env:"DISABLE_COMPRESSION"`
+
+	MaxUserLabels            int `long:"max-user-label-count" description:"maximum number of users to export per-user metrics for (0 for no limit)" default:"100" env:"MAX_USER_LABEL_COUNT"`
+	MaxItemLabels            int `long:"max-item-label-count" description:"maximum number of library items (series, albums) to export per-item metrics for" default:"100" env:"MAX_ITEM_LABEL_COUNT"`
+	CardinalityWarnThreshold int `long:"cardinality-warn-threshold" description:"warn when a metric has more label combinations than this (0 to disable)" default:"100" env:"CARDINALITY_WARN_THRESHOLD"`
+	MetricChannelBufferSize  int `long:"metric-channel-buffer-size" description:"number of metrics the collectors can send without waiting for the registry" default:"256" env:"METRIC_CHANNEL_BUFFER_SIZE"`
+	InflightScrapeThreshold  int `long:"inflight-scrape-warn-threshold" description:"warn when more scrapes than this run at the same time (0 to disable)" default:"1" env:"INFLIGHT_SCRAPE_WARN_THRESHOLD"`
+	GoroutineLeakThreshold   int `long:"goroutine-leak-threshold" description:"warn when a scrape leaves more goroutines running than this (0 to disable)" default:"10" env:"GOROUTINE_LEAK_THRESHOLD"`
+
+	SecurityMetrics bool `long:"security-metrics-enabled" description:"export security related metrics (quick connect, api keys)" env:"SECURITY_METRICS_ENABLED"`
+	AuthMetrics     bool `long:"auth-metrics-enabled" description:"export user authentication metrics" env:"AUTH_METRICS_ENABLED"`
+	HardwareMetrics bool `long:"hardware-metrics-enabled" description:"export transcoding hardware acceleration metrics" env:"HARDWARE_METRICS_ENABLED"`
+
+	IdleSessionThreshold time.Duration `long:"idle-session-threshold" description:"time without activity after which a listed session counts as idle" default:"5m" env:"IDLE_SESSION_THRESHOLD"`
+
+	NotificationMetrics bool `long:"notification-metrics-enabled" description:"export the unread notification count of the api key user" env:"NOTIFICATION_METRICS_ENABLED"`
+	SeriesCompletion    bool `long:"series-completion-metrics-enabled" description:"export the ratio of available episodes per series (one api call per series)" env:"SERIES_COMPLETION_METRICS_ENABLED"`
+	MusicCompleteness   bool `long:"music-completeness-metrics-enabled" description:"export the ratio of available tracks per album (one api call per album)" env:"MUSIC_COMPLETENESS_METRICS_ENABLED"`
+	PerSessionBandwidth bool `long:"per-session-bandwidth" description:"export estimated bandwidth per session instead of per user" env:"PER_SESSION_BANDWIDTH"`
+	TranscodeProgress   bool `long:"transcode-progress-metrics-enabled" description:"export the progress of every transcode, labeled by session" env:"TRANSCODE_PROGRESS_METRICS_ENABLED"`
+	TrickplayMetrics    bool `long:"trickplay-metrics-enabled" description:"export the number of items with trickplay images" env:"TRICKPLAY_METRICS_ENABLED"`
+	TrailerMetrics      bool `long:"trailer-metrics-enabled" description:"export the number of movies with and without local trailers (enumerates all movies)" env:"TRAILER_METRICS_ENABLED"`
+	IntroMetrics        bool `long:"intro-metrics-enabled" description:"export the number of episodes with and without intro markers (enumerates all episodes)" env:"INTRO_METRICS_ENABLED"`
+	ChapterMetrics      bool `long:"chapter-metrics-enabled" description:"export the number of chapters in the library (enumerates all videos)" env:"CHAPTER_METRICS_ENABLED"`
+	NFOMetrics          bool `long:"nfo-metrics-enabled" description:"export the number of items with nfo sidecar metadata (enumerates all items)" env:"NFO_METRICS_ENABLED"`
+	CheckCertExpiry     bool `long:"check-cert-expiry" description:"export the expiry of the TLS certificate of an https --host" env:"CHECK_CERT_EXPIRY"`
+	TLSSessionMetrics   bool `long:"tls-session-metrics-enabled" description:"count TLS connections to Jellyfin that resumed a previous session" env:"TLS_SESSION_METRICS_ENABLED"`
+	ConnectionMetrics   bool `long:"http-connection-metrics-enabled" description:"count the Jellyfin api calls per endpoint that reused a kept-alive connection and that opened a new one" env:"HTTP_CONNECTION_METRICS_ENABLED"`
+	FileExtensions      bool `long:"file-extension-metrics-enabled" description:"export the number of files per extension, up to 50 extensions (enumerates all items)" env:"FILE_EXTENSION_METRICS_ENABLED"`
+	SubtitleFormats     bool `long:"subtitle-format-metrics-enabled" description:"export the number of subtitle streams per format (enumerates all videos)" env:"SUBTITLE_FORMAT_METRICS_ENABLED"`
+	LibraryItemCounts   bool `long:"library-item-count-metrics-enabled" description:"export the number of items per library and type, counting --library-fetch-concurrency libraries at a time" env:"LIBRARY_ITEM_COUNT_METRICS_ENABLED"`
+	SubtitleMetrics     bool `long:"subtitle-metrics-enabled" description:"export the number of videos with external and with embedded subtitles (enumerates all videos)" env:"SUBTITLE_METRICS_ENABLED"`
+	SubtitleConfig      bool `long:"subtitle-config-metrics-enabled" description:"export the languages Jellyfin is configured to download subtitles in" env:"SUBTITLE_CONFIG_METRICS_ENABLED"`
+	MetadataSources     bool `long:"metadata-source-metrics-enabled" description:"export the number of items per metadata provider (enumerates all items)" env:"METADATA_SOURCE_METRICS_ENABLED"`
+	UserMetrics         bool `long:"user-metrics-enabled" description:"export the number of users and of users who have never logged in" env:"USER_METRICS_ENABLED"`
+	UserPolicyMetrics   bool `long:"user-policy-metrics-enabled" description:"export the remote streaming bitrate limit of every user, up to --max-user-label-count" env:"USER_POLICY_METRICS_ENABLED"`
+	SharingMetrics      bool `long:"sharing-metrics-enabled" description:"export the number of libraries shared with users" env:"SHARING_METRICS_ENABLED"`
+	AdminActionMetrics  bool `long:"admin-action-metrics-enabled" description:"count user and configuration changes recorded in the activity log" env:"ADMIN_ACTION_METRICS_ENABLED"`
+	AuditMetrics        bool `long:"audit-metrics-enabled" description:"count server configuration changes recorded in the activity log" env:"AUDIT_METRICS_ENABLED"`
+	ImageMetrics        bool `long:"image-metrics-enabled" description:"count image requests recorded in the activity log" env:"IMAGE_METRICS_ENABLED"`
+	ActivityWebhook     bool `long:"activity-webhook-enabled" description:"count failed logins and added and deleted items from Jellyfin webhook plugin notifications POSTed to /ingest/activity" env:"ACTIVITY_WEBHOOK_ENABLED"`
+	LiveTVMetrics       bool `long:"livetv-metrics-enabled" description:"export the number of live tv (IPTV) channels, per group" env:"LIVETV_METRICS_ENABLED"`
+	SearchMetrics       bool `long:"search-metrics-enabled" description:"export search index metrics, on Jellyfin builds that provide them" env:"SEARCH_METRICS_ENABLED"`
+	BackupMetrics       bool `long:"backup-metrics-enabled" description:"export the last backup time and size, on Jellyfin builds with backups" env:"BACKUP_METRICS_ENABLED"`
+	IOMetrics           bool `long:"io-metrics-enabled" description:"export the disk io of the Jellyfin process, on Jellyfin builds that report it (stock Jellyfin doesn't, use node_exporter or cAdvisor)" env:"IO_METRICS_ENABLED"`
+	StorageDetails      bool `long:"storage-detail-metrics-enabled" description:"export database and log file sizes, on Jellyfin builds that report them" env:"STORAGE_DETAIL_METRICS_ENABLED"`
+	PopularityMetrics   bool `long:"popularity-metrics-enabled" description:"export the play count of the movies most played by the --metrics-user-id user" env:"POPULARITY_METRICS_ENABLED"`
+	TopNItems           int  `long:"top-n-items" description:"number of most played movies exported (at most 50)" default:"10" env:"TOP_N_ITEMS"`
+	SeriesPopularity    bool `long:"series-popularity-enabled" description:"export the play count of the series most played by the --metrics-user-id user" env:"SERIES_POPULARITY_ENABLED"`
+	TopNSeries          int  `long:"top-n-series" description:"number of most played series exported (at most 50)" default:"10" env:"TOP_N_SERIES"`
+	MusicPopularity     bool `long:"music-popularity-enabled" description:"export the play count of the albums most played by the --metrics-user-id user, up to --max-item-label-count" env:"MUSIC_POPULARITY_ENABLED"`
+	EngagementMetrics   bool `long:"engagement-metrics-enabled" description:"export the number of favorite items per media type of the --metrics-user-id user" env:"ENGAGEMENT_METRICS_ENABLED"`
+	PlayCountHistogram  bool `long:"play-count-distribution-enabled" description:"export a histogram of the play counts of all items by the --metrics-user-id user (enumerates all items)" env:"PLAY_COUNT_DISTRIBUTION_ENABLED"`
+	IngestRateMetrics   bool `long:"ingest-rate-metrics-enabled" description:"export the average number of items added per day over the last 7 days (from the 1000 newest items)" env:"INGEST_RATE_METRICS_ENABLED"`
+	ClientVersions      bool `long:"client-version-metrics-enabled" description:"export the number of sessions per client application version" env:"CLIENT_VERSION_METRICS_ENABLED"`
+	ClientVersionsTopN  int  `long:"client-version-top-n" description:"number of client/version combinations exported, the rest is counted as other" default:"10" env:"CLIENT_VERSION_TOP_N"`
+
+	GeoIPEnabled bool   `long:"geoip-enabled" description:"export the number of remote sessions per country, resolved with --geoip-db" env:"GEOIP_ENABLED"`
+	GeoIPDB      string `long:"geoip-db" description:"MaxMind GeoLite2 Country or City database file of --geoip-enabled" env:"GEOIP_DB"`
+
+	MetricsUserID string `long:"metrics-user-id" description:"id of the user whose resume points, favorites and play counts are exported, Jellyfin keeps them per user, the user of the api key (/Users/Me) if empty" env:"METRICS_USER_ID"`
+
+	ActivityWebhookSecret string `long:"activity-webhook-secret" description:"token the webhook plugin must send in the X-Webhook-Secret header or the token query parameter, required with --activity-webhook-enabled" env:"ACTIVITY_WEBHOOK_SECRET"`
+
+	EnableCollectors         string `long:"enable-collectors" description:"comma separated collectors to run, all if empty (system, library, users, sessions, activity)" env:"ENABLE_COLLECTORS"`
+	DisableCollectors        string `long:"disable-collectors" description:"comma separated collectors not to run" env:"DISABLE_COLLECTORS"`
+	DisableDefaultCollectors bool   `long:"disable-default-collectors" description:"run no collector unless named in --enable-collectors, even if it is empty" env:"DISABLE_DEFAULT_COLLECTORS"`
+}
+
+// envPrefix namespaces the environment variables of the options, so
+// JELLYFIN_EXPORTER_LOG_LEVEL can be used in place of LOG_LEVEL.
+const envPrefix = "JELLYFIN_EXPORTER_"
+
+// applyEnvPrefix sets the environment variable of every option to the value
+// of its prefixed form, if that is set. The prefixed form takes precedence.
+func applyEnvPrefix(groups []*flags.Group, prefix string) {
+	for _, group := range groups {
+		for _, option := range group.Options() {
+			if option.EnvDefaultKey == "" {
+				continue
+			}
+			value, ok := os.LookupEnv(prefix + option.EnvDefaultKey)
+			if ok {
+				os.Setenv(option.EnvDefaultKey, value)
+			}
+		}
+		applyEnvPrefix(group.Groups(), prefix)
+	}
+}
+
+// checkCollectorSelection returns an error if --enable-collectors or
+// --disable-collectors name unknown collectors, or no collector is left with
+// --disable-default-collectors.
+func checkCollectorSelection(config *ExporterConfig) error {
+	registry := NewCollectorRegistry()
+	registerCollectors(registry, NewJellyfinGetCollector(config))
+	return registry.Select(splitList(config.EnableCollectors), splitList(config.DisableCollectors), config.DisableDefaultCollectors)
+}
+
+// validateConfig checks the options main would otherwise reject or warn about
+// at startup, without making any api calls.
+func validateConfig(config *ExporterConfig) error {
+	_, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return fmt.Errorf("--log-level: %w", err)
+	}
+	if config.ConsulAddress == "" {
+		u, err := url.Parse(config.Host)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("--host: %q is not an absolute url", config.Host)
+		}
+	}
+	config.libraryPrefixes, err = parseLibraryPrefixes(config.LibraryTypePrefixes)
+	if err != nil {
+		return fmt.Errorf("--library-type-prefix-map: %w", err)
+	}
+	config.prefixOverrides, err = parsePrefixOverrides(config.MetricPrefixOverrides)
+	if err != nil {
+		return fmt.Errorf("--metric-prefix-override: %w", err)
+	}
+	err = checkMetricNames(config)
+	if err != nil {
+		return err
+	}
+	config.versionLabels, err = parseVersionLabels(config.VersionExtraLabels)
+	if err != nil {
+		return fmt.Errorf("--version-extra-labels: %w", err)
+	}
+	config.apiDurationBuckets, err = parseBuckets(config.APIDurationBuckets)
+	if err != nil {
+		return fmt.Errorf("--api-duration-buckets: %w", err)
+	}
+	if config.ConfigFile != "" {
+		file, err := loadConfigFile(config.ConfigFile, config)
+		if err != nil {
+			return fmt.Errorf("--config-file: %w", err)
+		}
+		config.helpOverrides = file.MetricHelpOverrides
+	}
+
+	err = checkCollectorSelection(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = listenAddress(config.Listen, config.ListenV6)
+	if err != nil {
+		return fmt.Errorf("listen address: %w", err)
+	}
+	if config.MetricChannelBufferSize < 0 {
+		return errors.New("--metric-channel-buffer-size can't be negative")
+	}
+	if config.Watch && config.WatchInterval <= 0 {
+		return errors.New("--watch-interval must be positive")
+	}
+	if config.BackgroundHealthProbe && config.HealthCheckInterval <= 0 {
+		return errors.New("--health-check-interval must be positive")
+	}
+	if config.ActivityWebhook && config.ActivityWebhookSecret == "" {
+		return errors.New("--activity-webhook-enabled requires --activity-webhook-secret")
+	}
+	if config.RemoteWriteURL != "" {
+		err = checkRemoteWrite(config)
+		if err != nil {
+			return err
+		}
+	}
+	if config.LibraryConcurrency < 1 {
+		return errors.New("--library-fetch-concurrency must be at least 1")
+	}
+	if config.OutputFormat != "prometheus" && config.OutputFormat != "influxdb" {
+		return fmt.Errorf("--output-format must be prometheus or influxdb, not %q", config.OutputFormat)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return errors.New("--tls-cert and --tls-key must be set together")
+	}
+	if config.TLSCert != "" {
+		_, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return fmt.Errorf("--tls-cert: %w", err)
+		}
+	}
+	if config.TLSClientCA != "" {
+		if config.TLSCert == "" {
+			return errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		_, err = clientCATLSConfig(config.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("--tls-client-ca: %w", err)
+		}
+	}
+	if config.GeoIPEnabled && config.GeoIPDB != "" {
+		database, err := openGeoIPDatabase(config.GeoIPDB)
+		if err != nil {
+			return fmt.Errorf("--geoip-db: %w", err)
+		}
+		database.Close()
+	}
+	return nil
+}
+
+// listenAddress returns the address to serve metrics at. If ipv6 is set it
+// replaces the host of listen, keeping its port.
+func listenAddress(listen, ipv6 string) (string, error) {
+	if ipv6 != "" {
+		ip := net.ParseIP(strings.Trim(ipv6, "[]"))
+		if ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("%q is not an IPv6 address", ipv6)
+		}
+		_, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return "", err
+		}
+		listen = net.JoinHostPort(ip.String(), port)
+	}
+	_, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return "", err
+	}
+	return listen, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+var metricPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseLibraryPrefixes parses --library-type-prefix-map, either a JSON object
+// or a comma separated list of type=prefix pairs.
+func parseLibraryPrefixes(value string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		err := json.Unmarshal([]byte(value), &prefixes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, entry := range splitList(value) {
+			libraryType, prefix, ok := strings.Cut(entry, "=")
+			if !ok {
+				return nil, fmt.Errorf("%q is not a type=prefix pair", entry)
+			}
+			prefixes[strings.TrimSpace(libraryType)] = strings.TrimSpace(prefix)
+		}
+	}
+
+	for libraryType, prefix := range prefixes {
+		known := false
+		for _, t := range metricLibraryTypes {
+			known = known || t == libraryType
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown library type %q, known types are movies, tvshows, music", libraryType)
+		}
+		if !metricPrefixPattern.MatchString(prefix) {
+			return nil, fmt.Errorf("%q is not a valid metric name prefix", prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// prefixOverride is a --metric-prefix-override, renaming the metrics whose
+// name starts with from.
+type prefixOverride struct {
+	from, to string
+}
+
+// parsePrefixOverrides parses from=to pairs, both of which must be valid
+// metric name prefixes.
+func parsePrefixOverrides(values []string) ([]prefixOverride, error) {
+	overrides := make([]prefixOverride, 0, len(values))
+	for _, value := range values {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a from=to pair", value)
+		}
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		for _, prefix := range []string{from, to} {
+			if !metricPrefixPattern.MatchString(prefix) {
+				return nil, fmt.Errorf("%q is not a valid metric name prefix", prefix)
+			}
+		}
+		overrides = append(overrides, prefixOverride{from, to})
+	}
+	return overrides, nil
+}
+
+// parseVersionLabels parses the key=value pairs of --version-extra-labels.
+// The keys must be valid label names other than those version has already.
+func parseVersionLabels(values []string) (map[string]string, error) {
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		key, labelValue, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value pair", value)
+		}
+		key = strings.TrimSpace(key)
+		if !metricPrefixPattern.MatchString(key) || strings.HasPrefix(key, "__") {
+			return nil, fmt.Errorf("%q is not a valid label name", key)
+		}
+		if key == "version" || key == "jellyfin_instance" || key == "instance_name" {
+			return nil, fmt.Errorf("label %q is set by the exporter", key)
+		}
+		labels[key] = strings.TrimSpace(labelValue)
+	}
+	return labels, nil
+}
+
+// parseBuckets parses comma separated histogram bucket upper bounds, which
+// must be positive and ascending. It returns nil for an empty string.
+func parseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, value := range splitList(list) {
+		bound, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		if bound <= 0 {
+			return nil, fmt.Errorf("bucket %g is not positive", bound)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be ascending, %g follows %g", bound, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	if buckets == nil && strings.TrimSpace(list) != "" {
+		return nil, errors.New("no buckets")
+	}
+	return buckets, nil
+}
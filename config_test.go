@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		listen  string
+		ipv6    string
+		want    string
+		wantErr bool
+	}{
+		{listen: ":0", want: ":0"},
+		{listen: "127.0.0.1:0", want: "127.0.0.1:0"},
+		{listen: "[::1]:0", want: "[::1]:0"},
+		{listen: ":0", ipv6: "::1", want: "[::1]:0"},
+		{listen: "127.0.0.1:0", ipv6: "[::1]", want: "[::1]:0"},
+		{listen: ":0", ipv6: "127.0.0.1", wantErr: true},
+		{listen: ":0", ipv6: "localhost", wantErr: true},
+		{listen: "9453", ipv6: "::1", wantErr: true},
+		{listen: "::1:9453", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := listenAddress(tt.listen, tt.ipv6)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("listenAddress(%q, %q) = %q, want an error", tt.listen, tt.ipv6, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("listenAddress(%q, %q) = %q, %v, want %q", tt.listen, tt.ipv6, got, err, tt.want)
+			continue
+		}
+
+		listener, err := net.Listen("tcp", got)
+		if err != nil && strings.HasPrefix(got, "[") {
+			// the host may have no ipv6 loopback
+			t.Logf("bind %s: %v", got, err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("bind %s: %v", got, err)
+			continue
+		}
+		listener.Close()
+	}
+}
+
+func TestParseLibraryPrefixesInvalid(t *testing.T) {
+	for _, value := range []string{
+		"movies",
+		"books=book_library",
+		"movies=video-library",
+		"movies=1video",
+		`{"movies": 1}`,
+	} {
+		if _, err := parseLibraryPrefixes(value); err == nil {
+			t.Errorf("parseLibraryPrefixes(%q) accepted an invalid map", value)
+		}
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"plain", map[string]string{"LOG_LEVEL": "debug"}, "debug"},
+		{"prefixed", map[string]string{"JELLYFIN_EXPORTER_LOG_LEVEL": "warn"}, "warn"},
+		{"both", map[string]string{"LOG_LEVEL": "debug", "JELLYFIN_EXPORTER_LOG_LEVEL": "warn"}, "warn"},
+		{"neither", nil, "info"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// applyEnvPrefix sets LOG_LEVEL, t.Setenv restores it
+			for _, key := range []string{"LOG_LEVEL", "JELLYFIN_EXPORTER_LOG_LEVEL"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			var config ExporterConfig
+			parser := flags.NewParser(&config, flags.None)
+			applyEnvPrefix(parser.Groups(), envPrefix)
+			_, err := parser.ParseArgs([]string{"--host=http://jellyfin.test", "--apikey=key"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.LogLevel != tt.want {
+				t.Errorf("LogLevel %q, want %q", config.LogLevel, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []float64
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "0.01,0.05,0.1,0.5,1.0,5.0", want: []float64{0.01, 0.05, 0.1, 0.5, 1, 5}},
+		{list: " 0.25 , 2.5 ", want: []float64{0.25, 2.5}},
+		{list: "1e-3,1e1", want: []float64{0.001, 10}},
+		{list: ",", wantErr: true},
+		{list: "0.1,fast", wantErr: true},
+		{list: "0,1", wantErr: true},
+		{list: "-0.5,1", wantErr: true},
+		{list: "1,0.5", wantErr: true},
+		{list: "0.5,0.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := parseBuckets(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBuckets error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBuckets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
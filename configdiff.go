@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// sensitiveOptions are the options whose values --config-diff redacts.
+var sensitiveOptions = map[string]bool{
+	"apikey":                  true,
+	"api-key-fallbacks":       true,
+	"jellyfin-password":       true,
+	"activity-webhook-secret": true,
+}
+
+// defaultConfig returns the options as they are without any flags or env
+// vars.
+func defaultConfig() (*ExporterConfig, error) {
+	var defaults ExporterConfig
+	parser := flags.NewParser(&defaults, flags.None)
+	ignoreEnv(parser.Groups())
+	_, err := parser.ParseArgs(nil)
+	return &defaults, err
+}
+
+func ignoreEnv(groups []*flags.Group) {
+	for _, group := range groups {
+		for _, option := range group.Options() {
+			option.EnvDefaultKey = ""
+		}
+		ignoreEnv(group.Groups())
+	}
+}
+
+// writeConfigDiff writes the options of config that differ from defaults to
+// out, in the order of the flags, as --name: default → actual lines.
+func writeConfigDiff(out io.Writer, config, defaults *ExporterConfig) error {
+	actual := reflect.ValueOf(config).Elem()
+	original := reflect.ValueOf(defaults).Elem()
+	for i := 0; i < actual.NumField(); i++ {
+		// fields without flag are derived from the options by validateConfig
+		name := actual.Type().Field(i).Tag.Get("long")
+		if name == "" || name == "config-diff" {
+			continue
+		}
+		value, defaultValue := actual.Field(i).Interface(), original.Field(i).Interface()
+		if reflect.DeepEqual(value, defaultValue) {
+			continue
+		}
+		_, err := fmt.Fprintf(out, "--%s: %s → %s\n", name,
+			formatOption(name, defaultValue), formatOption(name, value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatOption(name string, value interface{}) string {
+	if sensitiveOptions[name] && !reflect.ValueOf(value).IsZero() {
+		return "REDACTED"
+	}
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
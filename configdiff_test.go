@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestWriteConfigDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"defaults", nil, ""},
+		{"log level", []string{"--log-level=debug"}, "--log-level: \"info\" → \"debug\"\n"},
+		{
+			name: "in flag order",
+			args: []string{"--timeout=5s", "--host=http://jellyfin:8096", "--log-level=warn"},
+			want: "--log-level: \"info\" → \"warn\"\n" +
+				"--host: \"\" → \"http://jellyfin:8096\"\n" +
+				"--timeout: 10s → 5s\n",
+		},
+		{
+			name: "secrets redacted",
+			args: []string{"--apikey=s3cret", "--jellyfin-password=hunter2"},
+			want: "--apikey: \"\" → REDACTED\n--jellyfin-password: \"\" → REDACTED\n",
+		},
+		{"own flag", []string{"--config-diff"}, ""},
+	}
+	defaults, err := defaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config ExporterConfig
+			parser := flags.NewParser(&config, flags.None)
+			ignoreEnv(parser.Groups())
+			if _, err := parser.ParseArgs(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			if err := writeConfigDiff(&out, &config, defaults); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("diff\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigDiffFlag(t *testing.T) {
+	code, stdout, stderr := runMain(t, "--log-level=debug", "--apikey=s3cret", "--config-diff")
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "--log-level: \"info\" → \"debug\"\n") {
+		t.Errorf("output %q doesn't contain the changed --log-level", stdout)
+	}
+	if strings.Contains(stdout, "s3cret") {
+		t.Errorf("output %q contains the api key", stdout)
+	}
+}
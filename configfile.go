@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the YAML file of --config-file, for settings that don't fit
+// in a flag.
+type configFile struct {
+	// MetricHelpOverrides maps fully qualified metric names, such as
+	// jellyfin_movieCount, to the help text to use instead of the default
+	MetricHelpOverrides map[string]string `yaml:"metric_help_overrides"`
+}
+
+// loadConfigFile reads and validates the config file at path.
+func loadConfigFile(path string, config *ExporterConfig) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file configFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	// an empty file is a valid config
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(metricInfos))
+	for _, info := range metricInfos {
+		known[metricFQName(config, info.Name)] = true
+	}
+	var unknown []string
+	for name := range file.MetricHelpOverrides {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("metric_help_overrides: unknown metrics %s", strings.Join(unknown, ", "))
+	}
+	return &file, nil
+}
+
+// hashConfig returns the FNV-1a hash of the effective config in hex: the
+// options after flag and env var parsing together with what main derived
+// from them, such as the loaded config file. The sensitiveOptions are left
+// out, so that the hash doesn't change when a credential is rotated and
+// can't be used to guess one.
+func hashConfig(config *ExporterConfig) string {
+	options := *config
+	fields := reflect.ValueOf(&options).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if sensitiveOptions[fields.Type().Field(i).Tag.Get("long")] {
+			fields.Field(i).Set(reflect.Zero(fields.Field(i).Type()))
+		}
+	}
+	effective, err := json.Marshal(struct {
+		Options         *ExporterConfig
+		LibraryPrefixes map[string]string
+		HelpOverrides   map[string]string
+	}{&options, config.libraryPrefixes, config.helpOverrides})
+	if err != nil {
+		log.WithError(err).Panic("marshal config")
+	}
+	hash := fnv.New64a()
+	hash.Write(effective)
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// metricNamePattern matches valid Prometheus metric names.
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// checkMetricNames returns an error listing the metrics of metricInfos whose
+// name isn't a valid Prometheus metric name with the configured namespace
+// and prefixes.
+func checkMetricNames(config *ExporterConfig) error {
+	var invalid []string
+	for _, info := range metricInfos {
+		name := metricFQName(config, info.Name)
+		if !metricNamePattern.MatchString(name) {
+			invalid = append(invalid, strconv.Quote(name))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid metric names %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
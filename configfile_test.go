@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricHelpOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{"override", "metric_help_overrides:\n  jellyfin_maintenance_mode: Server refuses logins\n", ""},
+		{"empty file", "", ""},
+		{"unknown metric", "metric_help_overrides:\n  jellyfin_users: Accounts\n  jellyfin_typo_total: Typo\n", "unknown metrics jellyfin_typo_total, jellyfin_users"},
+		{"unknown key", "help_overrides:\n  jellyfin_maintenance_mode: Accounts\n", "field help_overrides not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config := testConfig(t)
+			config.ConfigFile = path
+			err := validateConfig(config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateConfig error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewJellyfinGetCollector(config)
+			c.collectors = []Collector{NewSystemCollector(c)}
+			descs := make(chan *prom.Desc)
+			go func() {
+				c.Describe(descs)
+				close(descs)
+			}()
+			var help string
+			for desc := range descs {
+				if strings.Contains(desc.String(), `fqName: "jellyfin_maintenance_mode"`) {
+					help = desc.String()
+				}
+			}
+			want := `help: "1 if the Jellyfin server is in maintenance mode and refuses logins, 0 otherwise"`
+			if tt.file != "" {
+				want = `help: "Server refuses logins"`
+			}
+			if !strings.Contains(help, want) {
+				t.Errorf("jellyfin_maintenance_mode described as %s, want %s", help, want)
+			}
+		})
+	}
+}
+
+// changeField changes v to a value different from the one it has.
+func changeField(t *testing.T, name string, v reflect.Value) {
+	t.Helper()
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(v.String() + "x")
+	case reflect.Bool:
+		v.SetBool(!v.Bool())
+	case reflect.Int, reflect.Int64:
+		v.SetInt(v.Int() + 1)
+	case reflect.Float64:
+		v.SetFloat(v.Float() + 1)
+	case reflect.Slice:
+		v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+	case reflect.Map:
+		changed := reflect.MakeMap(v.Type())
+		changed.SetMapIndex(reflect.ValueOf("changed"), reflect.Zero(v.Type().Elem()))
+		v.Set(changed)
+	default:
+		t.Fatalf("%s: can't change a %s", name, v.Kind())
+	}
+}
+
+func TestHashConfig(t *testing.T) {
+	base := testConfig(t)
+	hash := hashConfig(base)
+	if again := hashConfig(testConfig(t)); again != hash {
+		t.Fatalf("hash of the same config changed from %s to %s", hash, again)
+	}
+
+	fields := reflect.TypeOf(*base)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		config := testConfig(t)
+		changeField(t, field.Name, reflect.ValueOf(config).Elem().Field(i))
+		changed := hashConfig(config) != hash
+		if sensitive := sensitiveOptions[field.Tag.Get("long")]; changed == sensitive {
+			t.Errorf("changing %s changed the hash: %v, want %v", field.Name, changed, !sensitive)
+		}
+	}
+
+	config := testConfig(t)
+	config.helpOverrides = map[string]string{"jellyfin_users_total": "Accounts"}
+	if hashConfig(config) == hash {
+		t.Error("the help overrides of the config file don't change the hash")
+	}
+}
+
+func TestCheckMetricNames(t *testing.T) {
+	tests := []struct {
+		namespace string
+		wantErr   bool
+	}{
+		{"jellyfin", false},
+		{"media_server", false},
+		{"media:jellyfin", false},
+		{"_jellyfin", false},
+		{"jelly-fin", true},
+		{"jelly fin", true},
+		{"jellyfin.prod", true},
+		{"1jellyfin", true},
+		{"jellyfïn", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			config := testConfig(t)
+			config.Namespace = tt.namespace
+			err := checkMetricNames(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkMetricNames error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			// every metric is named after the namespace
+			want := strconv.Quote(metricFQName(config, "up"))
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q doesn't name the invalid %s", err, want)
+			}
+			if err := validateConfig(config); err == nil {
+				t.Error("validateConfig accepted the invalid namespace")
+			}
+		})
+	}
+}
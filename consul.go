@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// consulService is an instance of a service in the Consul catalog.
+type consulService struct {
+	ServiceID      string            `json:"ServiceID"`
+	Address        string            `json:"Address"`
+	ServiceAddress string            `json:"ServiceAddress"`
+	ServicePort    int               `json:"ServicePort"`
+	ServiceMeta    map[string]string `json:"ServiceMeta"`
+}
+
+// host returns the url of the Jellyfin instance. The service address falls
+// back to the address of the node, the scheme is taken from the scheme meta
+// key and defaults to http.
+func (s consulService) host() string {
+	address := s.ServiceAddress
+	if address == "" {
+		address = s.Address
+	}
+	scheme := s.ServiceMeta["scheme"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(address, strconv.Itoa(s.ServicePort))
+}
+
+// discoverConsul returns the instances of service in the catalog of the
+// Consul agent at address.
+func discoverConsul(ctx context.Context, address, service string) ([]consulService, error) {
+	u, err := apiURL(address, "", "/v1/catalog/service/"+url.PathEscape(service))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul catalog: %s", resp.Status)
+	}
+
+	var services []consulService
+	err = json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&services)
+	return services, err
+}
+
+// CollectorManager runs a collector per Jellyfin instance found through
+// Consul. Each collector exports its metrics with a jellyfin_instance label
+// of the Consul service id, instance is the label of the scrape target.
+type CollectorManager struct {
+	config *ExporterConfig
+	// setup creates the collector of an instance, see setupCollector
+	setup func(*ExporterConfig) (*JellyfinGetCollector, error)
+
+	mu         sync.RWMutex
+	collectors map[string]*JellyfinGetCollector
+}
+
+func NewCollectorManager(config *ExporterConfig, setup func(*ExporterConfig) (*JellyfinGetCollector, error)) *CollectorManager {
+	return &CollectorManager{
+		config:     config,
+		setup:      setup,
+		collectors: make(map[string]*JellyfinGetCollector),
+	}
+}
+
+// Add starts collecting the instance id at host. A known instance keeps its
+// collector unless its host changed.
+func (m *CollectorManager) Add(id, host string) error {
+	m.mu.RLock()
+	existing, ok := m.collectors[id]
+	m.mu.RUnlock()
+	if ok && existing.Config.Host == host {
+		return nil
+	}
+
+	config := *m.config
+	config.Host = host
+	config.instance = id
+	collector, err := m.setup(&config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.collectors[id] = collector
+	m.mu.Unlock()
+	log.WithField("instance", id).Infof("collecting jellyfin at %s", host)
+	return nil
+}
+
+// Remove stops collecting the instance id.
+func (m *CollectorManager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.collectors[id]; ok {
+		delete(m.collectors, id)
+		log.WithField("instance", id).Info("jellyfin instance left consul, stopped collecting it")
+	}
+}
+
+// Collectors returns the collectors of all instances, ordered by id.
+func (m *CollectorManager) Collectors() []*JellyfinGetCollector {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.collectors))
+	for id := range m.collectors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	collectors := make([]*JellyfinGetCollector, 0, len(ids))
+	for _, id := range ids {
+		collectors = append(collectors, m.collectors[id])
+	}
+	return collectors
+}
+
+// Refresh adds the instances registered in Consul and removes those that
+// aren't anymore.
+func (m *CollectorManager) Refresh(ctx context.Context) error {
+	services, err := discoverConsul(ctx, m.config.ConsulAddress, m.config.ConsulServiceName)
+	if err != nil {
+		return err
+	}
+
+	registered := make(map[string]bool, len(services))
+	for _, service := range services {
+		registered[service.ServiceID] = true
+		err = m.Add(service.ServiceID, service.host())
+		if err != nil {
+			log.WithError(err).WithField("instance", service.ServiceID).Warn("failed to add jellyfin instance")
+		}
+	}
+	for _, collector := range m.Collectors() {
+		if !registered[collector.Config.instance] {
+			m.Remove(collector.Config.instance)
+		}
+	}
+	return nil
+}
+
+// Watch refreshes the instances every interval until ctx is done.
+func (m *CollectorManager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := m.Refresh(ctx)
+			if err != nil {
+				log.WithError(err).Warn("failed to refresh jellyfin instances from consul")
+			}
+		}
+	}
+}
+
+// readinessHandler responds 200 when instances are known and all of them
+// are reachable, 503 otherwise.
+func (m *CollectorManager) readinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		collectors := m.Collectors()
+		if len(collectors) == 0 {
+			http.Error(w, "no jellyfin instances in consul", http.StatusServiceUnavailable)
+			return
+		}
+		for _, collector := range collectors {
+			err := collector.checkReadiness(ctx)
+			if err != nil {
+				requestLog(ctx).WithError(err).WithField("instance", collector.Config.instance).
+					Warn("readiness check failed")
+				http.Error(w, "jellyfin unreachable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			requestLog(ctx).WithError(err).Warn("write readiness response")
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConsulServiceHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		service consulService
+		want    string
+	}{
+		{"service address", consulService{Address: "10.0.0.1", ServiceAddress: "10.0.0.2", ServicePort: 8096}, "http://10.0.0.2:8096"},
+		{"node address", consulService{Address: "10.0.0.1", ServicePort: 8096}, "http://10.0.0.1:8096"},
+		{"scheme meta", consulService{ServiceAddress: "media.internal", ServicePort: 8920, ServiceMeta: map[string]string{"scheme": "https"}}, "https://media.internal:8920"},
+		{"ipv6", consulService{ServiceAddress: "2001:db8::2", ServicePort: 8096}, "http://[2001:db8::2]:8096"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.service.host(); got != tt.want {
+				t.Errorf("host = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectorManagerRefresh(t *testing.T) {
+	var mu sync.Mutex
+	var catalog string
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/catalog/service/jellyfin" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		rawJSON(catalog)(w, r)
+	}))
+	defer consul.Close()
+	setCatalog := func(services string) {
+		mu.Lock()
+		defer mu.Unlock()
+		catalog = services
+	}
+
+	config := testConfig(t, "--consul-address="+consul.URL, "--apikey=key")
+	var setups int
+	manager := NewCollectorManager(config, func(config *ExporterConfig) (*JellyfinGetCollector, error) {
+		setups++
+		return NewJellyfinGetCollector(config), nil
+	})
+
+	steps := []struct {
+		name       string
+		catalog    string
+		wantHosts  map[string]string
+		wantSetups int
+	}{
+		{
+			name: "discovered",
+			catalog: `[
+				{"ServiceID": "jellyfin-1", "Address": "10.0.0.1", "ServicePort": 8096},
+				{"ServiceID": "jellyfin-2", "Address": "10.0.0.2", "ServicePort": 8096}
+			]`,
+			wantHosts:  map[string]string{"jellyfin-1": "http://10.0.0.1:8096", "jellyfin-2": "http://10.0.0.2:8096"},
+			wantSetups: 2,
+		},
+		{
+			name: "unchanged",
+			catalog: `[
+				{"ServiceID": "jellyfin-1", "Address": "10.0.0.1", "ServicePort": 8096},
+				{"ServiceID": "jellyfin-2", "Address": "10.0.0.2", "ServicePort": 8096}
+			]`,
+			wantHosts:  map[string]string{"jellyfin-1": "http://10.0.0.1:8096", "jellyfin-2": "http://10.0.0.2:8096"},
+			wantSetups: 2,
+		},
+		{
+			name: "moved and deregistered",
+			catalog: `[
+				{"ServiceID": "jellyfin-1", "Address": "10.0.0.3", "ServicePort": 8096}
+			]`,
+			wantHosts:  map[string]string{"jellyfin-1": "http://10.0.0.3:8096"},
+			wantSetups: 3,
+		},
+	}
+	for _, step := range steps {
+		setCatalog(step.catalog)
+		if err := manager.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		collectors := manager.Collectors()
+		if len(collectors) != len(step.wantHosts) {
+			t.Errorf("%s: %d collectors, want %d", step.name, len(collectors), len(step.wantHosts))
+		}
+		for _, collector := range collectors {
+			id := collector.Config.instance
+			if want := step.wantHosts[id]; collector.Config.Host != want {
+				t.Errorf("%s: instance %q collects %s, want %s", step.name, id, collector.Config.Host, want)
+			}
+			if got := instanceLabels(collector.Config)["jellyfin_instance"]; got != id {
+				t.Errorf("%s: jellyfin_instance label %q, want %q", step.name, got, id)
+			}
+		}
+		if setups != step.wantSetups {
+			t.Errorf("%s: %d collectors set up, want %d", step.name, setups, step.wantSetups)
+		}
+	}
+	// the template isn't changed by the instances
+	if config.Host != "http://jellyfin.test" || config.instance != "" {
+		t.Errorf("config changed to host %q and instance %q", config.Host, config.instance)
+	}
+}
+
+func TestCollectorManagerConsulDown(t *testing.T) {
+	consul := httptest.NewServer(statusResponse(http.StatusInternalServerError))
+	defer consul.Close()
+
+	config := testConfig(t, "--consul-address="+consul.URL, "--apikey=key")
+	manager := NewCollectorManager(config, func(config *ExporterConfig) (*JellyfinGetCollector, error) {
+		return NewJellyfinGetCollector(config), nil
+	})
+	if err := manager.Refresh(context.Background()); err == nil {
+		t.Error("Refresh succeeded with consul answering 500")
+	}
+
+	// no instances, not ready
+	w := httptest.NewRecorder()
+	manager.readinessHandler()(w, httptest.NewRequest(http.MethodGet, "/_ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/_ready status %d without instances, want 503", w.Code)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/jessevdk/go-flags"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+//go:embed dashboard.json.tmpl
+var dashboardTemplate string
+
+// DashboardOptions are the options of the dashboard subcommand.
+type DashboardOptions struct {
+	Namespace string `long:"namespace" description:"metric name prefix" default:"jellyfin" env:"METRIC_NAMESPACE"`
+}
+
+type dashboardTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+type dashboardGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type dashboardPanel struct {
+	ID          int               `json:"id"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	Type        string            `json:"type"`
+	Datasource  map[string]string `json:"datasource"`
+	GridPos     dashboardGridPos  `json:"gridPos"`
+	Targets     []dashboardTarget `json:"targets"`
+}
+
+// runDashboard writes a Grafana dashboard with a panel for every metric to
+// out. Its args are those following the dashboard subcommand.
+func runDashboard(args []string, out io.Writer) error {
+	var options DashboardOptions
+	_, err := flags.ParseArgs(&options, args)
+	if err != nil {
+		return err
+	}
+
+	dashboard, err := generateDashboard(options.Namespace)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(dashboard)
+	return err
+}
+
+// generateDashboard renders the dashboard for metrics named with namespace.
+// The overview panels come first, followed by one panel per metric.
+func generateDashboard(namespace string) ([]byte, error) {
+	name := func(metric string) string {
+		return prom.BuildFQName(namespace, "", metric)
+	}
+
+	var panels []dashboardPanel
+	add := func(title, description, panelType string, targets ...dashboardTarget) {
+		for i := range targets {
+			targets[i].RefID = string(rune('A' + i))
+		}
+		panels = append(panels, dashboardPanel{
+			ID:          len(panels) + 1,
+			Title:       title,
+			Description: description,
+			Type:        panelType,
+			Datasource:  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+			GridPos:     dashboardGridPos{H: 8, W: 12, X: len(panels) % 2 * 12, Y: len(panels) / 2 * 8},
+			Targets:     targets,
+		})
+	}
+
+	add("Version", "Jellyfin server version", "stat",
+		dashboardTarget{Expr: name("version"), LegendFormat: "{{version}}"})
+	add("Total counts", "Number of movies and series in the library", "timeseries",
+		dashboardTarget{Expr: name("movieCount"), LegendFormat: "movies"},
+		dashboardTarget{Expr: name("seriesCount"), LegendFormat: "series"})
+	add("Session breakdown", "Playing sessions per streaming protocol and media type", "timeseries",
+		dashboardTarget{Expr: name("sessions_by_protocol_total"), LegendFormat: "{{protocol}}"},
+		dashboardTarget{Expr: name("streams_by_media_type_total"), LegendFormat: "{{media_type}}"})
+	add("Error rates", "Failed calls to the Jellyfin api per second", "timeseries",
+		dashboardTarget{Expr: fmt.Sprintf("rate(%s[5m])", name("scrape_errors_total")), LegendFormat: "{{endpoint}}"})
+
+	for _, info := range metricInfos {
+		var legend []string
+		for _, label := range info.Labels {
+			legend = append(legend, "{{"+label+"}}")
+		}
+		add(info.Name, info.Help, "timeseries",
+			dashboardTarget{Expr: name(info.Name), LegendFormat: strings.Join(legend, " ")})
+	}
+
+	tmpl, err := template.New("dashboard").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(dashboardTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, map[string]interface{}{
+		"UID":    namespace + "-exporter",
+		"Panels": panels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var indented bytes.Buffer
+	err = json.Indent(&indented, rendered.Bytes(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("dashboard template: %w", err)
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunDashboard(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		namespace string
+	}{
+		{"default namespace", nil, "jellyfin"},
+		{"namespace", []string{"--namespace=media"}, "media"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runDashboard(tt.args, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dashboard struct {
+				UID    string
+				Panels []dashboardPanel
+			}
+			err = json.Unmarshal(out.Bytes(), &dashboard)
+			if err != nil {
+				t.Fatalf("invalid dashboard JSON: %v", err)
+			}
+			if dashboard.UID != tt.namespace+"-exporter" {
+				t.Errorf("uid %q, want %s-exporter", dashboard.UID, tt.namespace)
+			}
+
+			titles := make(map[string]bool)
+			for _, panel := range dashboard.Panels {
+				titles[panel.Title] = true
+				for _, target := range panel.Targets {
+					if !strings.Contains(target.Expr, tt.namespace+"_") {
+						t.Errorf("panel %q queries %q without the %s namespace", panel.Title, target.Expr, tt.namespace)
+					}
+				}
+			}
+			for _, title := range []string{"Version", "Total counts", "Session breakdown", "Error rates", "maintenance_mode"} {
+				if !titles[title] {
+					t.Errorf("no %q panel", title)
+				}
+			}
+			if want := 4 + len(metricInfos); len(dashboard.Panels) != want {
+				t.Errorf("%d panels, want %d", len(dashboard.Panels), want)
+			}
+		})
+	}
+}
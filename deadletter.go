@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deadLetter is the audit record of a failed endpoint. The exporter doesn't
+// schedule retries, the endpoint is called again on the next scrape, so
+// NextRetryAt is always null.
+type deadLetter struct {
+	Endpoint      string     `json:"endpoint"`
+	Error         string     `json:"error"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt time.Time  `json:"last_attempt_at"`
+	NextRetryAt   *time.Time `json:"next_retry_at"`
+}
+
+// deadLetterLog logs failed endpoints at error level and, if out is set,
+// writes them to it as JSON lines.
+type deadLetterLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (d *deadLetterLog) record(ctx context.Context, err *EndpointError) {
+	entry := deadLetter{
+		Endpoint:      err.Endpoint,
+		Error:         err.Err.Error(),
+		Attempts:      err.Attempts,
+		LastAttemptAt: time.Now().UTC(),
+	}
+
+	requestLog(ctx).WithError(err.Err).WithFields(logrus.Fields{
+		"endpoint":        entry.Endpoint,
+		"attempts":        entry.Attempts,
+		"last_attempt_at": entry.LastAttemptAt.Format(time.RFC3339),
+		"next_retry_at":   nil,
+	}).Errorf("dead letter, serving %d cached metrics", err.Cached)
+
+	if d.out == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := json.NewEncoder(d.out).Encode(entry); err != nil {
+		requestLog(ctx).WithError(err).Warn("write dead letter file")
+	}
+}
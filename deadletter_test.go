@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDeadLetters(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": statusResponse(http.StatusInternalServerError),
+	})
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	c.collectors = []Collector{library}
+	var file bytes.Buffer
+	c.deadLetters.out = &file
+
+	scrape(t, c)
+	scrape(t, c)
+
+	var entries []map[string]interface{}
+	lines := bufio.NewScanner(&file)
+	for lines.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			t.Fatalf("dead letter %q: %v", lines.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d dead letters, want 2", len(entries))
+	}
+	for i, entry := range entries {
+		if entry["endpoint"] != "/Items/Counts" || entry["attempts"] != float64(i+1) {
+			t.Errorf("dead letter %d: %v", i, entry)
+		}
+		if entry["error"] == "" || entry["last_attempt_at"] == "" {
+			t.Errorf("dead letter %d without error or last attempt: %v", i, entry)
+		}
+		if next, ok := entry["next_retry_at"]; !ok || next != nil {
+			t.Errorf("dead letter %d: next_retry_at %v, want null", i, next)
+		}
+	}
+
+	var logged int
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel && entry.Data["endpoint"] == "/Items/Counts" {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Errorf("%d dead letters logged at error level, want 2", logged)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// collectorState is the outcome of the last run of a collector, served at
+// /debug/collector.
+type collectorState struct {
+	Name string `json:"name"`
+	// Instance is the Consul service id of the Jellyfin instance
+	Instance    string     `json:"instance,omitempty"`
+	LastRun     *time.Time `json:"last_run"`
+	LastError   *string    `json:"last_error"`
+	MetricCount int        `json:"metric_count"`
+}
+
+// collectorRun is the result of running a collector during a scrape.
+type collectorRun struct {
+	collector Collector
+	finished  time.Time
+	err       error
+}
+
+// recordCollectorRuns stores the state of the collectors after a scrape,
+// series are the number of series sent per descriptor during it.
+func (c *JellyfinGetCollector) recordCollectorRuns(runs []collectorRun, series map[*prom.Desc]int) {
+	c.collectorStatesMu.Lock()
+	defer c.collectorStatesMu.Unlock()
+	for _, run := range runs {
+		finished := run.finished
+		state := collectorState{
+			Name:     run.collector.Name(),
+			Instance: c.Config.instance,
+			LastRun:  &finished,
+		}
+		if run.err != nil {
+			message := run.err.Error()
+			state.LastError = &message
+		}
+
+		descs := make(chan *prom.Desc)
+		go func() {
+			run.collector.Describe(descs)
+			close(descs)
+		}()
+		for desc := range descs {
+			state.MetricCount += series[desc]
+		}
+		c.collectorStates[state.Name] = state
+	}
+}
+
+// debugStates returns the state of the enabled collectors, in the order
+// they run. Collectors that haven't run yet have no last run.
+func (c *JellyfinGetCollector) debugStates() []collectorState {
+	c.collectorStatesMu.Lock()
+	defer c.collectorStatesMu.Unlock()
+	states := make([]collectorState, 0, len(c.collectors))
+	for _, collector := range c.collectors {
+		state, ok := c.collectorStates[collector.Name()]
+		if !ok {
+			state = collectorState{Name: collector.Name(), Instance: c.Config.instance}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// debugCollectorHandler serves the state of the collectors of every Jellyfin
+// instance as JSON.
+func debugCollectorHandler(targets func() []*JellyfinGetCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		states := []collectorState{}
+		for _, collector := range targets() {
+			states = append(states, collector.debugStates()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(states)
+		if err != nil {
+			requestLog(r.Context()).WithError(err).Warn("write debug response")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func TestDebugCollectorHandler(t *testing.T) {
+	var fail atomic.Bool
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": failable(&fail, jsonResponse(jellyfin.ItemCounts{MovieCount: 7})),
+		"/Users":        jsonResponse([]jellyfin.User{{Name: "alice"}}),
+	})
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	users := NewUserCollector(c)
+	users.endpoints = users.endpoints[:1]
+	c.collectors = []Collector{library, users}
+	handler := debugCollectorHandler(func() []*JellyfinGetCollector { return []*JellyfinGetCollector{c} })
+
+	type state struct {
+		name      string
+		ran       bool
+		failed    bool
+		hasSeries bool
+	}
+	tests := []struct {
+		name   string
+		scrape bool
+		fail   bool
+		want   []state
+	}{
+		{
+			name: "before the first scrape",
+			want: []state{{name: "library"}, {name: "users"}},
+		},
+		{
+			name:   "successful scrape",
+			scrape: true,
+			want: []state{
+				{name: "library", ran: true, hasSeries: true},
+				{name: "users", ran: true, hasSeries: true},
+			},
+		},
+		{
+			// the failed endpoint is served from cache
+			name:   "failed scrape",
+			scrape: true,
+			fail:   true,
+			want: []state{
+				{name: "library", ran: true, failed: true, hasSeries: true},
+				{name: "users", ran: true, hasSeries: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail.Store(tt.fail)
+			start := time.Now()
+			if tt.scrape {
+				scrape(t, c)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/debug/collector", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", got)
+			}
+			var states []map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &states); err != nil {
+				t.Fatal(err)
+			}
+			if len(states) != len(tt.want) {
+				t.Fatalf("%d collectors, want %d: %s", len(states), len(tt.want), w.Body)
+			}
+			for i, want := range tt.want {
+				got := states[i]
+				for _, key := range []string{"name", "last_run", "last_error", "metric_count"} {
+					if _, ok := got[key]; !ok {
+						t.Errorf("%s: no %s: %s", want.name, key, w.Body)
+					}
+				}
+				if got["name"] != want.name {
+					t.Errorf("collector %d named %v, want %s", i, got["name"], want.name)
+				}
+				lastRun, _ := got["last_run"].(string)
+				if ran := lastRun != ""; ran != want.ran {
+					t.Errorf("%s: last_run %v, want a run %v", want.name, got["last_run"], want.ran)
+				}
+				if run, err := time.Parse(time.RFC3339Nano, lastRun); want.ran && (err != nil || run.Before(start)) {
+					t.Errorf("%s: last_run %q, want the time of the scrape", want.name, lastRun)
+				}
+				lastError, _ := got["last_error"].(string)
+				if failed := lastError != ""; failed != want.failed {
+					t.Errorf("%s: last_error %v, want an error %v", want.name, got["last_error"], want.failed)
+				}
+				count, _ := got["metric_count"].(float64)
+				if (count > 0) != want.hasSeries {
+					t.Errorf("%s: metric_count %v, want series %v", want.name, count, want.hasSeries)
+				}
+			}
+		})
+	}
+}
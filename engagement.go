@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// metricsUser is the id of the user the api key belongs to, looked up on the
+// first call that needs it.
+type metricsUser struct {
+	mu sync.Mutex
+	id string
+}
+
+// metricsUserID returns --metrics-user-id or, if it is empty, the id of the
+// api key user. Resume points, favorites and play counts are user data,
+// /Items only returns them for the user of the UserId parameter.
+func (c *JellyfinGetCollector) metricsUserID(ctx context.Context, client jellyfin.Client) (string, error) {
+	if c.Config.MetricsUserID != "" {
+		return c.Config.MetricsUserID, nil
+	}
+	c.metricsUser.mu.Lock()
+	defer c.metricsUser.mu.Unlock()
+	if c.metricsUser.id == "" {
+		me, err := client.GetCurrentUser(ctx)
+		if err != nil {
+			// api keys created in the dashboard have no user
+			return "", fmt.Errorf("look up the api key user, set --metrics-user-id: %w", err)
+		}
+		c.metricsUser.id = me.ID
+	}
+	return c.metricsUser.id, nil
+}
+
+func (c *JellyfinGetCollector) fetchResumableItems(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	userID, err := c.metricsUserID(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, mediaType := range []string{"Movie", "Episode"} {
+		count, err := client.CountItems(ctx, "Filters=IsResumable&IncludeItemTypes="+mediaType+"&UserId="+url.QueryEscape(userID))
+		if err != nil {
+			return err
+		}
+		rec.RecordGauge("items_in_progress_total", count, mediaType)
+	}
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchFavorites(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	userID, err := c.metricsUserID(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, mediaType := range []string{"Movie", "Series", "Episode", "Audio"} {
+		count, err := client.CountItems(ctx, "Filters=IsFavorite&IncludeItemTypes="+mediaType+"&UserId="+url.QueryEscape(userID))
+		if err != nil {
+			return err
+		}
+		rec.RecordGauge("favorite_items_total", count, mediaType)
+	}
+	return nil
+}
+
+// playCountBuckets are the upper bounds of item_play_count_distribution.
+var playCountBuckets = []float64{0, 1, 2, 5, 10, 25, 100}
+
+func (c *JellyfinGetCollector) fetchPlayCountDistribution(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	userID, err := c.metricsUserID(ctx, client)
+	if err != nil {
+		return err
+	}
+	items, err := client.GetAllItems(ctx, "IncludeItemTypes=Movie,Episode,Audio&Fields=UserData&UserId="+url.QueryEscape(userID))
+	if err != nil {
+		return err
+	}
+
+	count, sum, buckets := playCountHistogram(items, playCountBuckets)
+	rec.RecordHistogram("item_play_count_distribution", count, sum, buckets)
+	return nil
+}
+
+// playCountHistogram returns the count, sum and cumulative bucket counts of
+// the play counts of items, items without user data count as unplayed.
+func playCountHistogram(items []jellyfin.Item, bounds []float64) (uint64, float64, map[float64]uint64) {
+	var sum float64
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	for _, item := range items {
+		var plays float64
+		if item.UserData != nil {
+			plays = item.UserData.PlayCount
+		}
+		sum += plays
+		for _, bound := range bounds {
+			if plays <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+	return uint64(len(items)), sum, buckets
+}
+
+// maxTopNItems limits --top-n-items and --top-n-series, every item is a label
+// value.
+const maxTopNItems = 50
+
+// topN limits n to maxTopNItems.
+func topN(n int) int {
+	if n > maxTopNItems {
+		return maxTopNItems
+	}
+	return n
+}
+
+// getMostPlayed returns the n items of the item types most played by the
+// metricsUserID user.
+func (c *JellyfinGetCollector) getMostPlayed(ctx context.Context, client jellyfin.Client, itemTypes string, n int) ([]jellyfin.Item, error) {
+	userID, err := c.metricsUserID(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	items, err := client.GetItems(ctx, fmt.Sprintf(
+		"SortBy=PlayCount&SortOrder=Descending&Limit=%d&IncludeItemTypes=%s&Recursive=true&Fields=UserData&UserId=%s",
+		n, itemTypes, url.QueryEscape(userID),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return items.Items, nil
+}
+
+// recordPlayCounts records the play count of items under the label values
+// returned by labels. Items are expected in order of play count, of items
+// with the same label values only the most played one is recorded.
+func recordPlayCounts(rec MetricRecorder, name string, items []jellyfin.Item, labels func(jellyfin.Item) []string) {
+	seen := make(map[string]bool)
+	for _, i := range items {
+		values := labels(i)
+		key := strings.Join(values, "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var playCount float64
+		if i.UserData != nil {
+			playCount = i.UserData.PlayCount
+		}
+		rec.RecordGauge(name, playCount, values...)
+	}
+}
+
+func (c *JellyfinGetCollector) fetchPopularItems(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	items, err := c.getMostPlayed(ctx, client, "Movie", topN(c.Config.TopNItems))
+	if err != nil {
+		return err
+	}
+
+	recordPlayCounts(rec, "item_play_count", items, func(i jellyfin.Item) []string {
+		return []string{sanitizeLabelValue(i.Name), i.Type}
+	})
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchPopularSeries(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	series, err := c.getMostPlayed(ctx, client, "Series", topN(c.Config.TopNSeries))
+	if err != nil {
+		return err
+	}
+
+	recordPlayCounts(rec, "series_play_count", series, func(i jellyfin.Item) []string {
+		return []string{sanitizeLabelValue(i.Name)}
+	})
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchPopularAlbums(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	albums, err := c.getMostPlayed(ctx, client, "MusicAlbum", c.Config.MaxItemLabels)
+	if err != nil {
+		return err
+	}
+
+	recordPlayCounts(rec, "album_play_count", albums, func(i jellyfin.Item) []string {
+		return []string{sanitizeLabelValue(i.Name), sanitizeLabelValue(i.AlbumArtist)}
+	})
+	return nil
+}
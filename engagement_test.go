@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// userItemCounts answers /Items with the count of counts for the
+// IncludeItemTypes of the query, if it asks for the user data of userID.
+func userItemCounts(t *testing.T, userID, filter string, counts map[string]float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("UserId") != userID {
+			t.Errorf("%s: UserId %q, want %q", r.URL, query.Get("UserId"), userID)
+		}
+		if query.Get("Filters") != filter {
+			t.Errorf("%s: Filters %q, want %q", r.URL, query.Get("Filters"), filter)
+		}
+		jsonResponse(jellyfin.ItemsResponse{TotalRecordCount: counts[query.Get("IncludeItemTypes")]})(w, r)
+	}
+}
+
+func TestFetchResumableItems(t *testing.T) {
+	counts := map[string]float64{"Movie": 3, "Episode": 12}
+	tests := []struct {
+		name       string
+		args       []string
+		wantUserID string
+	}{
+		{"api key user", nil, "me"},
+		{"metrics user", []string{"--metrics-user-id=u1"}, "u1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Users/Me": jsonResponse(jellyfin.User{ID: "me"}),
+				"/Items":    userItemCounts(t, tt.wantUserID, "IsResumable", counts),
+			}, tt.args...)
+			rec := NewTestRecorder()
+			err := c.fetchResumableItems(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for mediaType, want := range counts {
+				if got, _ := rec.Value("items_in_progress_total", mediaType); got != want {
+					t.Errorf("items_in_progress_total{%s} = %v, want %v", mediaType, got, want)
+				}
+			}
+			if len(rec.Values) != len(counts) {
+				t.Errorf("recorded %v", rec.Values)
+			}
+		})
+	}
+}
+
+func TestMetricsUserIDWithoutUser(t *testing.T) {
+	// api keys created in the dashboard have no user
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Users/Me": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no user", http.StatusBadRequest)
+		},
+		"/Items": func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%s called without user", r.URL)
+		},
+	})
+	err := c.fetchResumableItems(context.Background(), *c.client, NewTestRecorder())
+	if err == nil {
+		t.Fatal("fetchResumableItems succeeded without user")
+	}
+}
+
+func TestFetchFavorites(t *testing.T) {
+	counts := map[string]float64{"Movie": 4, "Series": 2, "Episode": 0, "Audio": 31}
+	calls := make(map[string]int)
+	items := userItemCounts(t, "u1", "IsFavorite", counts)
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Query().Get("IncludeItemTypes")]++
+		items(w, r)
+	}}, "--metrics-user-id=u1")
+
+	rec := NewTestRecorder()
+	err := c.fetchFavorites(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mediaType, want := range counts {
+		if calls[mediaType] != 1 {
+			t.Errorf("%d calls for %s, want 1", calls[mediaType], mediaType)
+		}
+		if got, ok := rec.Value("favorite_items_total", mediaType); !ok || got != want {
+			t.Errorf("favorite_items_total{%s} = %v, want %v", mediaType, got, want)
+		}
+	}
+	if len(calls) != len(counts) {
+		t.Errorf("calls %v, want one per media type", calls)
+	}
+}
+
+// mostPlayed answers /Items with items in order of play count, limited by
+// the Limit query parameter, if it asks for the user data of userID.
+func mostPlayed(t *testing.T, userID, itemTypes string, items []jellyfin.Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("UserId") != userID || query.Get("IncludeItemTypes") != itemTypes ||
+			query.Get("SortBy") != "PlayCount" || query.Get("SortOrder") != "Descending" {
+			t.Errorf("unexpected query %s", r.URL)
+		}
+		itemPages(items)(w, r)
+	}
+}
+
+func played(name string, plays float64) jellyfin.Item {
+	return jellyfin.Item{Name: name, Type: "Movie", UserData: &jellyfin.UserData{PlayCount: plays}}
+}
+
+func TestFetchPopularItems(t *testing.T) {
+	movies := []jellyfin.Item{
+		played("The Matrix", 12),
+		played("Alien", 9),
+		// a remake of the same name is hidden by the more played original
+		played("The Matrix", 3),
+		played("Heat", 2),
+		{Name: "Unplayed", Type: "Movie"},
+	}
+	tests := []struct {
+		name string
+		topN string
+		want map[string]float64
+	}{
+		{
+			name: "top 3",
+			topN: "3",
+			want: map[string]float64{"The_Matrix": 12, "Alien": 9},
+		},
+		{
+			name: "all",
+			topN: "10",
+			want: map[string]float64{"The_Matrix": 12, "Alien": 9, "Heat": 2, "Unplayed": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": mostPlayed(t, "u1", "Movie", movies)},
+				"--metrics-user-id=u1", "--top-n-items="+tt.topN)
+			rec := NewTestRecorder()
+			err := c.fetchPopularItems(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rec.Values) != len(tt.want) {
+				t.Errorf("recorded %v, want %v", rec.Values, tt.want)
+			}
+			for name, want := range tt.want {
+				if got, ok := rec.Value("item_play_count", name, "Movie"); !ok || got != want {
+					t.Errorf("item_play_count{%s,Movie} = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchPopularSeries(t *testing.T) {
+	series := []jellyfin.Item{
+		{Name: "Breaking Bad", Type: "Series", UserData: &jellyfin.UserData{PlayCount: 62}},
+		{Name: "The Wire", Type: "Series", UserData: &jellyfin.UserData{PlayCount: 60}},
+		{Name: "Firefly", Type: "Series", UserData: &jellyfin.UserData{PlayCount: 14}},
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Users/Me": jsonResponse(jellyfin.User{ID: "me"}),
+		"/Items":    mostPlayed(t, "me", "Series", series),
+	})
+	rec := NewTestRecorder()
+	err := c.fetchPopularSeries(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Values) != len(series) {
+		t.Errorf("recorded %v, want one series_play_count per series", rec.Values)
+	}
+	for _, show := range series {
+		name := sanitizeLabelValue(show.Name)
+		if got, ok := rec.Value("series_play_count", name); !ok || got != show.UserData.PlayCount {
+			t.Errorf("series_play_count{%s} = %v, want %v", name, got, show.UserData.PlayCount)
+		}
+	}
+}
+
+func TestFetchPopularAlbums(t *testing.T) {
+	albums := []jellyfin.Item{
+		{Name: "OK Computer", AlbumArtist: "Radiohead", UserData: &jellyfin.UserData{PlayCount: 40}},
+		{Name: "Greatest Hits", AlbumArtist: "Queen", UserData: &jellyfin.UserData{PlayCount: 25}},
+		{Name: "Greatest Hits", AlbumArtist: "ABBA", UserData: &jellyfin.UserData{PlayCount: 7}},
+		{Name: "Blue", AlbumArtist: "Joni Mitchell", UserData: &jellyfin.UserData{PlayCount: 3}},
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": mostPlayed(t, "u1", "MusicAlbum", albums)},
+		"--metrics-user-id=u1", "--max-item-label-count=3")
+	rec := NewTestRecorder()
+	err := c.fetchPopularAlbums(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"album_play_count{OK_Computer,Radiohead}": 40,
+		"album_play_count{Greatest_Hits,Queen}":   25,
+		"album_play_count{Greatest_Hits,ABBA}":    7,
+	}
+	if len(rec.Values) != len(want) {
+		t.Errorf("recorded %v, want %v", rec.Values, want)
+	}
+	for key, value := range want {
+		if got, ok := rec.Values[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestFetchPlayCountDistribution(t *testing.T) {
+	var items []jellyfin.Item
+	for _, plays := range []float64{0, 0, 1, 2, 3, 5, 6, 10, 11, 30, 250} {
+		items = append(items, jellyfin.Item{UserData: &jellyfin.UserData{PlayCount: plays}})
+	}
+	// items without user data count as unplayed
+	items = append(items, jellyfin.Item{})
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("UserId"); got != "u1" {
+			t.Errorf("%s: UserId %q, want u1", r.URL, got)
+		}
+		itemPages(items)(w, r)
+	}}, "--metrics-user-id=u1", "--page-size=5")
+
+	rec := NewTestRecorder()
+	err := c.fetchPlayCountDistribution(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cumulative counts per upper bound
+	wantBuckets := map[float64]uint64{0: 3, 1: 4, 2: 5, 5: 7, 10: 9, 25: 10, 100: 11}
+	buckets := rec.Histograms["item_play_count_distribution"]
+	if len(buckets) != len(wantBuckets) {
+		t.Errorf("buckets %v, want %v", buckets, wantBuckets)
+	}
+	for bound, want := range wantBuckets {
+		if buckets[bound] != want {
+			t.Errorf("bucket %v = %d, want %d", bound, buckets[bound], want)
+		}
+	}
+	if got, _ := rec.Value("item_play_count_distribution_count"); got != 12 {
+		t.Errorf("count = %v, want 12", got)
+	}
+	if got, _ := rec.Value("item_play_count_distribution_sum"); got != 318 {
+		t.Errorf("sum = %v, want 318", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EndpointError is the failure of a single endpoint during a scrape.
+type EndpointError struct {
+	Endpoint string
+	// Cached is the number of cached samples served in place of fresh ones
+	Cached int
+	// Attempts is the number of consecutive failed calls to the endpoint
+	Attempts int
+	Err      error
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Endpoint, e.Err)
+}
+
+func (e *EndpointError) Unwrap() error { return e.Err }
+
+// ContentTypeError is returned for api responses that aren't JSON, such as
+// the login page of a proxy in front of Jellyfin.
+type ContentTypeError struct {
+	Endpoint    string
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("%s: expected a JSON response, got content type %q", e.Endpoint, e.ContentType)
+}
+
+// MultiError holds all errors of a scrape, so a failing endpoint doesn't hide
+// the failures of the others.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	messages := make([]string, len(m))
+	for i, err := range m {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(m), strings.Join(messages, "; "))
+}
+
+// Errors returns the errors, with nested MultiErrors flattened.
+func (m MultiError) Errors() []error {
+	var errs []error
+	for _, err := range m {
+		if nested, ok := err.(MultiError); ok {
+			errs = append(errs, nested.Errors()...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// newMultiError returns the non-nil errors of errs as MultiError, or nil if
+// there are none.
+func newMultiError(errs []error) error {
+	var m MultiError
+	for _, err := range errs {
+		if err != nil {
+			m = append(m, err)
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
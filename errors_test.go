@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	counts := &EndpointError{Endpoint: "/Items/Counts", Cached: 2, Err: errors.New("timeout")}
+	users := &EndpointError{Endpoint: "/Users", Err: errors.New("503 Service Unavailable")}
+
+	if err := newMultiError([]error{nil, nil}); err != nil {
+		t.Errorf("newMultiError of no failures = %v, want nil", err)
+	}
+
+	err := newMultiError([]error{nil, counts})
+	if got, want := err.Error(), "/Items/Counts: timeout"; got != want {
+		t.Errorf("single error %q, want %q", got, want)
+	}
+
+	err = newMultiError([]error{counts, nil, newMultiError([]error{users, nil})})
+	if got, want := err.Error(), "2 errors: /Items/Counts: timeout; /Users: 503 Service Unavailable"; got != want {
+		t.Errorf("multiple errors %q, want %q", got, want)
+	}
+	errs := err.(MultiError).Errors()
+	if len(errs) != 2 || errs[0] != counts || errs[1] != users {
+		t.Errorf("Errors() = %v, want the nested errors flattened", errs)
+	}
+
+	var endpointErr *EndpointError
+	if !errors.As(errs[1], &endpointErr) || endpointErr.Endpoint != "/Users" {
+		t.Errorf("errors.As of %v = %v", errs[1], endpointErr)
+	}
+}
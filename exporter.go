@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+type JellyfinGetCollector struct {
+	Config *ExporterConfig
+
+	client *jellyfin.Client
+
+	// collectors are run on every scrape, main sets them to the collectors
+	// enabled in its CollectorRegistry
+	collectors []Collector
+
+	// descs holds the descriptor of every metric in metricInfos by name
+	descs map[string]*prom.Desc
+
+	// cache holds the samples from the last successful call to each
+	// endpoint, served in place of fresh values when Jellyfin is unreachable
+	// or the endpoint isn't due yet. lastSuccess is the time of the last
+	// successful call to any endpoint and probeFailedAt that of the last
+	// failed background health probe, zero once a probe succeeds
+	cacheMu       sync.Mutex
+	cache         map[string]sampleRecorder
+	lastCollected map[string]time.Time
+	lastSuccess   time.Time
+	probeFailedAt time.Time
+
+	// CollectionSchedule is the minimum interval between calls to an
+	// endpoint, endpoints without interval are called on every scrape
+	CollectionSchedule map[string]time.Duration
+
+	// health records whether the last call to each endpoint succeeded, and
+	// failures the number of consecutive failed calls
+	healthMu sync.RWMutex
+	health   map[string]float64
+	failures map[string]int
+
+	deadLetters deadLetterLog
+
+	// breaker serves the scrapes from cache while Jellyfin keeps failing
+	breaker circuitBreaker
+
+	// redirects counts the redirects followed per api path
+	redirectsMu sync.Mutex
+	redirects   map[string]float64
+
+	// tlsResumptions counts the TLS handshakes that resumed a session
+	tlsResumptionsMu sync.Mutex
+	tlsResumptions   float64
+
+	// reusedConns and newConns count the api calls per api path that reused
+	// an idle connection and that opened a new one
+	connectionsMu sync.Mutex
+	reusedConns   map[string]float64
+	newConns      map[string]float64
+
+	// certExpiry is the expiry of the certificate Jellyfin presented on the
+	// last api call over https
+	certExpiryMu sync.Mutex
+	certExpiry   time.Time
+
+	// scrapeErrors counts the failures per endpoint
+	scrapeErrorsMu sync.Mutex
+	scrapeErrors   map[string]float64
+
+	// activity log entries up to the cursor have been added to the counters
+	// derived from the activity log
+	activityMu     sync.Mutex
+	activitySince  time.Time
+	activityLastID int64
+	imageRequests  map[string]float64
+	adminActions   map[string]float64
+	configChanges  float64
+
+	// lastTranscodes are the transcodes running at the last call to
+	// /Sessions, by session and item id, conversions counts the transcodes
+	// started since per source and target codec
+	transcodesMu   sync.Mutex
+	lastTranscodes map[string]bool
+	conversions    map[[2]string]float64
+
+	// startupTime is the start time reported by the last call to
+	// /System/Info, restarts counts the server restarts detected from it
+	restartsMu  sync.Mutex
+	startupTime time.Time
+	restarts    float64
+
+	// the counters of the events received at /ingest/activity, itemsAdded
+	// and itemsDeleted per media type
+	webhookMu     sync.Mutex
+	loginFailures float64
+	itemsAdded    map[string]float64
+	itemsDeleted  map[string]float64
+
+	// features are those supported by the version of Jellyfin, set by main
+	// before the collectors are created
+	features features
+
+	// collectorStates are the results of the last run of each collector, by
+	// name
+	collectorStatesMu sync.Mutex
+	collectorStates   map[string]collectorState
+
+	// inflight is the number of running scrapes
+	inflight atomic.Int64
+
+	// configHash identifies the effective config, see hashConfig
+	configHash string
+
+	twoFactorWarning sync.Once
+
+	session sessionAuth
+	apiKeys apiKeyRotation
+
+	// metricsUser is the user of the resume point, favorite and play count
+	// queries
+	metricsUser metricsUser
+
+	// transport pools the connections of all api calls
+	transport *http.Transport
+	// buffers pools the *bytes.Buffer api responses are read into
+	buffers sync.Pool
+
+	// apiDurations observes the duration of every api call, and
+	// apiResponseSizes the size of its response body as transferred
+	apiDurations     *prom.HistogramVec
+	apiResponseSizes *prom.HistogramVec
+
+	// readinessDuration is the duration of the last readiness check
+	readinessDuration prom.Gauge
+
+	// streamBitrates and audioBitrates observe the video and audio bitrate
+	// of playing sessions on every scrape
+	streamBitrates prom.Histogram
+	audioBitrates  prom.Histogram
+
+	// localNetwork is the network of the server's local address, sessions
+	// from it are counted as local
+	networkMu    sync.RWMutex
+	localNetwork *net.IPNet
+
+	// countries resolves the countries of remote sessions, nil without
+	// --geoip-enabled and --geoip-db
+	countries countryResolver
+}
+
+// sanitizeLabelValue reduces a name taken from Jellyfin to ASCII letters,
+// digits and single underscores, so names with spaces, punctuation or
+// unicode characters give predictable label values.
+func sanitizeLabelValue(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range s {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.Trim(b.String(), "_")
+}
+
+// scrapeCollector binds the collector to the context of a single scrape.
+type scrapeCollector struct {
+	*JellyfinGetCollector
+	ctx context.Context
+}
+
+func (s scrapeCollector) Collect(metrics chan<- prom.Metric) {
+	s.collect(s.ctx, metrics)
+}
+
+func NewJellyfinGetCollector(config *ExporterConfig) *JellyfinGetCollector {
+	descs := make(map[string]*prom.Desc, len(metricInfos))
+	for _, info := range metricInfos {
+		name := metricFQName(config, info.Name)
+		help := info.Help
+		if override, ok := config.helpOverrides[name]; ok {
+			help = override
+		}
+		descs[info.Name] = prom.NewDesc(name, help, info.Labels, constLabels(config, info.Name))
+	}
+
+	c := &JellyfinGetCollector{
+		Config: config,
+
+		descs:  descs,
+		cache:  make(map[string]sampleRecorder),
+		health: make(map[string]float64),
+
+		lastCollected:      make(map[string]time.Time),
+		lastSuccess:        time.Now(),
+		CollectionSchedule: make(map[string]time.Duration),
+
+		failures: make(map[string]int),
+		breaker:  circuitBreaker{threshold: config.CircuitBreakerThreshold, cooldown: config.CircuitBreakerCooldown},
+
+		redirects:    make(map[string]float64),
+		reusedConns:  make(map[string]float64),
+		newConns:     make(map[string]float64),
+		scrapeErrors: make(map[string]float64),
+
+		features:   allFeatures,
+		configHash: hashConfig(config),
+
+		activitySince: time.Now(),
+		imageRequests: make(map[string]float64),
+		adminActions:  make(map[string]float64),
+		itemsAdded:    make(map[string]float64),
+		conversions:   make(map[[2]string]float64),
+		itemsDeleted:  make(map[string]float64),
+
+		collectorStates: make(map[string]collectorState),
+
+		apiDurations: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:        overridePrefix(config, prom.BuildFQName(config.Namespace, "", "api_request_duration_seconds")),
+			Help:        "Duration of calls to the Jellyfin api",
+			Buckets:     config.apiDurationBuckets,
+			ConstLabels: constLabels(config, "api_request_duration_seconds"),
+		}, []string{"endpoint"}),
+		apiResponseSizes: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:        overridePrefix(config, prom.BuildFQName(config.Namespace, "", "api_response_bytes")),
+			Help:        "Size of the response bodies of the Jellyfin api, before decompression",
+			Buckets:     []float64{1e3, 10e3, 100e3, 1e6, 10e6},
+			ConstLabels: constLabels(config, "api_response_bytes"),
+		}, []string{"endpoint"}),
+
+		readinessDuration: prom.NewGauge(prom.GaugeOpts{
+			Name:        overridePrefix(config, prom.BuildFQName(config.Namespace, "", "readiness_check_duration_seconds")),
+			Help:        "Duration of the last readiness check against the Jellyfin api",
+			ConstLabels: constLabels(config, "readiness_check_duration_seconds"),
+		}),
+
+		streamBitrates: prom.NewHistogram(prom.HistogramOpts{
+			Name:        overridePrefix(config, prom.BuildFQName(config.Namespace, "", "active_stream_bitrate_bits")),
+			Help:        "Bitrate of the video streams of playing sessions, observed on every scrape",
+			Buckets:     []float64{500e3, 1e6, 2e6, 4e6, 8e6, 15e6, 25e6, 50e6},
+			ConstLabels: constLabels(config, "active_stream_bitrate_bits"),
+		}),
+		audioBitrates: prom.NewHistogram(prom.HistogramOpts{
+			Name:        overridePrefix(config, prom.BuildFQName(config.Namespace, "", "active_audio_stream_bitrate_bits")),
+			Help:        "Bitrate of the audio streams of playing sessions, observed on every scrape",
+			Buckets:     []float64{64e3, 128e3, 192e3, 256e3, 320e3, 512e3, 1024e3},
+			ConstLabels: constLabels(config, "active_audio_stream_bitrate_bits"),
+		}),
+	}
+	c.transport = http.DefaultTransport.(*http.Transport).Clone()
+	c.transport.MaxIdleConns = config.HTTPMaxIdleConns
+	c.transport.MaxIdleConnsPerHost = config.HTTPMaxIdleConnsPerHost
+	c.transport.IdleConnTimeout = config.HTTPIdleConnTimeout
+	// getAPI requests and decodes gzip itself, so it shows up in --log-http
+	c.transport.DisableCompression = true
+	// resuming sessions saves most of the cost of the handshakes of new
+	// connections
+	c.transport.TLSClientConfig = &tls.Config{
+		SessionTicketsDisabled: false,
+		ClientSessionCache:     tls.NewLRUClientSessionCache(32),
+	}
+	c.buffers.New = func() interface{} { return new(bytes.Buffer) }
+	c.apiKeys.keys = append([]string{config.APIKey}, splitList(config.APIKeyFallbacks)...)
+	c.client = jellyfin.NewClient(jellyfin.TransportFunc(c.getAPI))
+	c.client.PageSize = config.PageSize
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// collectEndpoint records the samples produced by fetch and remembers them
+// for later scrapes. If fetch fails, the last successful result for the
+// endpoint is recorded instead and the endpoint is marked unhealthy. Endpoints
+// that aren't due according to the CollectionSchedule are served from cache.
+func (c *JellyfinGetCollector) collectEndpoint(
+	ctx context.Context, endpoint string, client jellyfin.Client, rec MetricRecorder,
+	fetch func(context.Context, jellyfin.Client, MetricRecorder) error,
+) error {
+	c.cacheMu.Lock()
+	last, collected := c.lastCollected[endpoint]
+	if collected && time.Since(last) < c.CollectionSchedule[endpoint] {
+		cached := c.cache[endpoint]
+		c.cacheMu.Unlock()
+		cached.replay(rec)
+		return nil
+	}
+	c.cacheMu.Unlock()
+
+	// once the scrape is cancelled or timed out the endpoints that haven't
+	// started are served from cache without calling Jellyfin, as are all
+	// endpoints while the circuit breaker is open
+	var result sampleRecorder
+	err := ctx.Err()
+	if err == nil && breakerOpen(ctx) {
+		err = errCircuitOpen
+	}
+	if err == nil {
+		err = fetch(ctx, client, &result)
+	}
+
+	c.cacheMu.Lock()
+	if err == nil {
+		c.cache[endpoint] = result
+		c.lastCollected[endpoint] = time.Now()
+		c.lastSuccess = time.Now()
+	} else if c.stale(endpoint) {
+		// the cached values are too old to be passed off as current
+		delete(c.cache, endpoint)
+		result = nil
+	} else {
+		result = c.cache[endpoint]
+	}
+	c.cacheMu.Unlock()
+
+	c.healthMu.Lock()
+	if err == nil {
+		c.health[endpoint] = 1
+		delete(c.failures, endpoint)
+	} else {
+		c.health[endpoint] = 0
+		c.failures[endpoint]++
+	}
+	attempts := c.failures[endpoint]
+	c.healthMu.Unlock()
+
+	result.replay(rec)
+	if err != nil {
+		return &EndpointError{Endpoint: endpoint, Cached: len(result), Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+// stale reports whether the last successful call to endpoint is more than
+// --staleness-timeout past the time it was due again. The caller holds
+// cacheMu.
+func (c *JellyfinGetCollector) stale(endpoint string) bool {
+	last, collected := c.lastCollected[endpoint]
+	return collected && c.Config.StalenessTimeout > 0 &&
+		time.Since(last) > c.CollectionSchedule[endpoint]+c.Config.StalenessTimeout
+}
+
+func (c *JellyfinGetCollector) Collect(metrics chan<- prom.Metric) {
+	c.collect(context.Background(), metrics)
+}
+
+// runningCollects is the number of collects running in the process, of any
+// collector.
+var runningCollects atomic.Int64
+
+func (c *JellyfinGetCollector) collect(ctx context.Context, metrics chan<- prom.Metric) {
+	// all api calls of the scrape share its request id
+	if _, ok := ctx.Value(requestIDKey{}).(string); !ok {
+		ctx = context.WithValue(ctx, requestIDKey{}, newRequestID())
+	}
+	requestLog(ctx).Debug("collect")
+	if c.Config.APIKeyFile != "" && !c.Config.UseSessionAuth {
+		c.reloadAPIKey(ctx)
+	}
+
+	inflight := c.inflight.Add(1)
+	defer c.inflight.Add(-1)
+	runningCollects.Add(1)
+	defer runningCollects.Add(-1)
+	if c.Config.InflightScrapeThreshold > 0 && inflight > int64(c.Config.InflightScrapeThreshold) {
+		requestLog(ctx).WithField("inflight", inflight).Warn("overlapping scrapes")
+	}
+
+	if c.Config.MaxScrapeDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Config.MaxScrapeDuration)
+		defer cancel()
+	}
+
+	started := time.Now()
+	calling := c.breaker.allow(started)
+	if !calling {
+		ctx = context.WithValue(ctx, circuitOpenKey{}, true)
+	}
+
+	// count the series of every metric on their way to the registry
+	// buffered so that the collectors don't wait for each other while the
+	// registry reads a metric
+	forward := make(chan prom.Metric, c.Config.MetricChannelBufferSize)
+	series := make(map[*prom.Desc]int)
+	done := make(chan struct{})
+	go func() {
+		for metric := range forward {
+			series[metric.Desc()]++
+			metrics <- metric
+		}
+		close(done)
+	}()
+	goroutines := runtime.NumGoroutine()
+
+	// a failing collector doesn't cancel the others, its metrics are sent
+	// before it returns and the cache serves those that failed. Wait only
+	// returns the first error, all of them are reported
+	var (
+		group  errgroup.Group
+		errsMu sync.Mutex
+		errs   []error
+	)
+	runs := make([]collectorRun, len(c.collectors))
+	for i, collector := range c.collectors {
+		i, collector := i, collector
+		group.Go(func() error {
+			err := collector.Collect(ctx, forward, *c.client)
+			runs[i] = collectorRun{collector, time.Now().UTC(), err}
+			errsMu.Lock()
+			errs = append(errs, err)
+			errsMu.Unlock()
+			return err
+		})
+	}
+	_ = group.Wait()
+	err := newMultiError(errs)
+	c.reportErrors(ctx, err)
+	if calling {
+		// a scrape fails if none of its api calls succeeded
+		c.cacheMu.Lock()
+		succeeded := !c.lastSuccess.Before(started)
+		c.cacheMu.Unlock()
+		if c.breaker.record(time.Now(), err != nil && !succeeded) {
+			c.breaker.mu.Lock()
+			openDuration := c.breaker.openDuration
+			c.breaker.mu.Unlock()
+			requestLog(ctx).WithField("open_duration", openDuration).Info("circuit breaker closed, jellyfin recovered")
+		}
+	}
+
+	rec := PromRecorder{Descs: c.descs, Metrics: forward}
+
+	// the endpoints that didn't finish in time are served from cache
+	up := 1.0
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		requestLog(ctx).Warn("scrape aborted, serving the metrics collected so far")
+		up = 0
+	}
+	c.cacheMu.Lock()
+	lastSuccess, probeFailedAt := c.lastSuccess, c.probeFailedAt
+	c.cacheMu.Unlock()
+	if c.Config.StalenessTimeout > 0 && time.Since(lastSuccess) > c.Config.StalenessTimeout {
+		requestLog(ctx).WithField("last_success", lastSuccess.UTC().Format(time.RFC3339)).
+			Warn("no successful jellyfin api call within --staleness-timeout")
+		up = 0
+	}
+	// the later of the failed probe and the last successful api call wins
+	if probeFailedAt.After(lastSuccess) {
+		up = 0
+	}
+	if !calling {
+		up = 0
+	}
+	rec.RecordGauge("up", up)
+	c.breaker.recordMetrics(rec)
+	rec.RecordGauge("exporter_config_hash", 1, c.configHash)
+	rec.RecordGauge("exporter_inflight_scrapes", float64(inflight))
+
+	var stale float64
+	c.healthMu.RLock()
+	for endpoint, healthy := range c.health {
+		rec.RecordGauge("endpoint_healthy", healthy, endpoint)
+		if healthy == 0 {
+			stale = 1
+		}
+	}
+	c.healthMu.RUnlock()
+	rec.RecordGauge("metrics_stale", stale)
+
+	c.redirectsMu.Lock()
+	for endpoint, count := range c.redirects {
+		rec.RecordCounter("api_redirects_total", count, endpoint)
+	}
+	c.redirectsMu.Unlock()
+
+	if c.Config.TLSSessionMetrics {
+		c.tlsResumptionsMu.Lock()
+		rec.RecordCounter("tls_session_reuse_total", c.tlsResumptions)
+		c.tlsResumptionsMu.Unlock()
+	}
+
+	if c.Config.ConnectionMetrics {
+		c.connectionsMu.Lock()
+		for endpoint, count := range c.reusedConns {
+			rec.RecordCounter("api_connection_reuse_total", count, endpoint)
+		}
+		for endpoint, count := range c.newConns {
+			rec.RecordCounter("api_new_connections_total", count, endpoint)
+		}
+		c.connectionsMu.Unlock()
+	}
+
+	c.restartsMu.Lock()
+	rec.RecordCounter("server_restart_total", c.restarts)
+	c.restartsMu.Unlock()
+
+	c.certExpiryMu.Lock()
+	if !c.certExpiry.IsZero() {
+		rec.RecordGauge("ssl_cert_expiry_timestamp_seconds", float64(c.certExpiry.Unix()))
+	}
+	c.certExpiryMu.Unlock()
+
+	c.scrapeErrorsMu.Lock()
+	for endpoint, count := range c.scrapeErrors {
+		rec.RecordCounter("scrape_errors_total", count, endpoint)
+	}
+	c.scrapeErrorsMu.Unlock()
+
+	c.apiDurations.Collect(forward)
+	c.apiResponseSizes.Collect(forward)
+	c.readinessDuration.Collect(forward)
+
+	// leaked goroutines are those of the collectors that are still running,
+	// the forwarding goroutine is counted at both ends. Other collects, of
+	// overlapping scrapes or other Consul instances, add their goroutines
+	delta := runtime.NumGoroutine() - goroutines
+	if c.Config.GoroutineLeakThreshold > 0 && delta > c.Config.GoroutineLeakThreshold && runningCollects.Load() == 1 {
+		requestLog(ctx).WithField("delta", delta).Warn("possible goroutine leak")
+	}
+	rec.RecordGauge("exporter_goroutines_delta", float64(delta))
+
+	close(forward)
+	<-done
+	c.recordCollectorRuns(runs, series)
+
+	out := PromRecorder{Descs: c.descs, Metrics: metrics}
+	// collectors without enabled endpoints can't fail, they don't count
+	// towards a failed scrape
+	var sent, active, failed int
+	for _, count := range series {
+		sent += count
+	}
+	for _, run := range runs {
+		if callsAPI(run.collector) {
+			active++
+		}
+		if run.err != nil {
+			failed++
+		}
+	}
+	status := "success"
+	if failed > 0 && failed >= active {
+		status = "failure"
+	} else if failed > 0 {
+		status = "partial"
+	}
+	out.RecordGauge("collection_summary", 1, status)
+	out.RecordGauge("collection_metric_count", float64(sent))
+	out.RecordGauge("collection_error_count", float64(failed))
+
+	for _, info := range metricInfos {
+		count, ok := series[c.descs[info.Name]]
+		if !ok || len(info.Labels) == 0 {
+			continue
+		}
+		if c.Config.CardinalityWarnThreshold > 0 && count > c.Config.CardinalityWarnThreshold {
+			requestLog(ctx).WithFields(logrus.Fields{
+				"metric": info.Name,
+				"count":  count,
+			}).Warn("high metric cardinality")
+		}
+		out.RecordGauge("metric_cardinality", float64(count), info.Name)
+	}
+}
+
+// reportErrors logs every failure of a scrape and counts it per endpoint.
+func (c *JellyfinGetCollector) reportErrors(ctx context.Context, err error) {
+	multi, ok := err.(MultiError)
+	if !ok {
+		return
+	}
+
+	c.scrapeErrorsMu.Lock()
+	defer c.scrapeErrorsMu.Unlock()
+	for _, err := range multi.Errors() {
+		var endpointErr *EndpointError
+		if errors.Is(err, errCircuitOpen) {
+			continue
+		}
+		if !errors.As(err, &endpointErr) {
+			requestLog(ctx).WithError(err).Warn("scrape failed")
+			continue
+		}
+		c.scrapeErrors[endpointErr.Endpoint]++
+		c.deadLetters.record(ctx, endpointErr)
+	}
+}
+
+func (c *JellyfinGetCollector) Describe(descr chan<- *prom.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(descr)
+	}
+	for _, name := range collectorMetrics {
+		descr <- c.descs[name]
+	}
+	c.apiDurations.Describe(descr)
+	c.apiResponseSizes.Describe(descr)
+	c.readinessDuration.Describe(descr)
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// testConfig returns the options parsed from args like main does, without
+// env vars, and with the options derived by validateConfig. The host
+// defaults to http://jellyfin.test.
+func testConfig(t testing.TB, args ...string) *ExporterConfig {
+	t.Helper()
+	var config ExporterConfig
+	parser := flags.NewParser(&config, flags.None)
+	ignoreEnv(parser.Groups())
+	_, err := parser.ParseArgs(append([]string{"--host=http://jellyfin.test", "--apikey=key"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+// newTestCollector returns a collector with the options of testConfig,
+// running the collectors they enable like main.
+func newTestCollector(t testing.TB, args ...string) *JellyfinGetCollector {
+	t.Helper()
+	config := testConfig(t, args...)
+	c := NewJellyfinGetCollector(config)
+	registry := NewCollectorRegistry()
+	registerCollectors(registry, c)
+	if err := registry.Select(splitList(config.EnableCollectors), splitList(config.DisableCollectors), config.DisableDefaultCollectors); err != nil {
+		t.Fatal(err)
+	}
+	c.collectors = registry.Enabled()
+	return c
+}
+
+// newFakeJellyfin starts a fake Jellyfin api serving routes by path, other
+// paths answer 404, and returns a collector calling it with the options of
+// args.
+func newFakeJellyfin(t *testing.T, routes map[string]http.HandlerFunc, args ...string) *JellyfinGetCollector {
+	t.Helper()
+	mux := http.NewServeMux()
+	for path, handler := range routes {
+		mux.HandleFunc(path, handler)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return newTestCollector(t, append([]string{"--host=" + server.URL}, args...)...)
+}
+
+// jsonResponse answers with v as JSON.
+func jsonResponse(v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// failable answers with handler until fail is set, then with 503.
+func failable(fail *atomic.Bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// itemPages answers with the page of items selected by the StartIndex and
+// Limit query parameters, like /Items does.
+func itemPages(items []jellyfin.Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("StartIndex"))
+		end := len(items)
+		if limit := r.URL.Query().Get("Limit"); limit != "" {
+			n, _ := strconv.Atoi(limit)
+			if start+n < end {
+				end = start + n
+			}
+		}
+		if start > end {
+			start = end
+		}
+		jsonResponse(jellyfin.ItemsResponse{Items: items[start:end], TotalRecordCount: float64(len(items))})(w, r)
+	}
+}
+
+// scrape collects c once through a pedantic registry, which fails the test
+// on duplicate or inconsistent series, and returns the samples keyed like
+// TestRecorder: by the name in metricInfos and the values of its labels.
+func scrape(t *testing.T, c *JellyfinGetCollector) *TestRecorder {
+	t.Helper()
+	registry := prom.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := make(map[string][]string, len(metricInfos))
+	names := make(map[string]string, len(metricInfos))
+	for _, info := range metricInfos {
+		names[prom.BuildFQName(c.Config.Namespace, "", info.Name)] = info.Name
+		labels[info.Name] = info.Labels
+	}
+	rec := NewTestRecorder()
+	for _, family := range families {
+		name, ok := names[family.GetName()]
+		if !ok {
+			name = family.GetName()
+		}
+		for _, metric := range family.Metric {
+			values := make([]string, len(labels[name]))
+			for i, label := range labels[name] {
+				for _, pair := range metric.Label {
+					if pair.GetName() == label {
+						values[i] = pair.GetValue()
+					}
+				}
+			}
+			switch {
+			case metric.Gauge != nil:
+				rec.RecordGauge(name, metric.Gauge.GetValue(), values...)
+			case metric.Counter != nil:
+				rec.RecordCounter(name, metric.Counter.GetValue(), values...)
+			}
+		}
+	}
+	return rec
+}
+
+func TestMetricsStale(t *testing.T) {
+	var fail atomic.Bool
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts":           failable(&fail, jsonResponse(map[string]float64{"MovieCount": 7})),
+		"/System/Info":            jsonResponse(map[string]string{"Version": "10.8.13"}),
+		"/System/Configuration":   rawJSON(`{}`),
+		"/Users":                  rawJSON(`[]`),
+		"/ScheduledTasks":         rawJSON(`[]`),
+		"/Sessions":               rawJSON(`[]`),
+		"/Items":                  rawJSON(`{"Items": [], "TotalRecordCount": 0}`),
+		"/Library/VirtualFolders": rawJSON(`[]`),
+		"/Users/Me":               rawJSON(`{"Id": "u1", "Name": "admin"}`),
+	})
+
+	tests := []struct {
+		name       string
+		fail       bool
+		wantStale  float64
+		wantMovies float64
+	}{
+		{"live", false, 0, 7},
+		{"served from cache", true, 1, 7},
+		{"live again", false, 0, 7},
+	}
+	for _, tt := range tests {
+		fail.Store(tt.fail)
+		rec := scrape(t, c)
+		if got, _ := rec.Value("metrics_stale"); got != tt.wantStale {
+			t.Errorf("%s: metrics_stale = %v, want %v", tt.name, got, tt.wantStale)
+		}
+		if got, _ := rec.Value("movieCount"); got != tt.wantMovies {
+			t.Errorf("%s: movieCount = %v, want %v", tt.name, got, tt.wantMovies)
+		}
+	}
+}
+
+func TestStalenessTimeout(t *testing.T) {
+	type step struct {
+		fail bool
+		// age moves the last successful call back in time
+		age        time.Duration
+		wantUp     float64
+		wantMovies bool
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		steps []step
+	}{
+		{
+			name: "dropped after the timeout",
+			steps: []step{
+				{wantUp: 1, wantMovies: true},
+				{fail: true, age: time.Minute, wantUp: 1, wantMovies: true},
+				{fail: true, age: 6 * time.Minute, wantUp: 0},
+				{wantUp: 1, wantMovies: true},
+			},
+		},
+		{
+			name: "disabled",
+			args: []string{"--staleness-timeout=0"},
+			steps: []step{
+				{wantUp: 1, wantMovies: true},
+				{fail: true, age: 24 * time.Hour, wantUp: 1, wantMovies: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fail atomic.Bool
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items/Counts": failable(&fail, jsonResponse(jellyfin.ItemCounts{MovieCount: 7})),
+			}, tt.args...)
+			library := NewLibraryCollector(c)
+			library.endpoints = library.endpoints[:1]
+			c.collectors = []Collector{library}
+
+			for i, s := range tt.steps {
+				fail.Store(s.fail)
+				c.cacheMu.Lock()
+				for endpoint := range c.lastCollected {
+					c.lastCollected[endpoint] = c.lastCollected[endpoint].Add(-s.age)
+				}
+				c.lastSuccess = c.lastSuccess.Add(-s.age)
+				c.cacheMu.Unlock()
+
+				rec := scrape(t, c)
+				if got, _ := rec.Value("up"); got != s.wantUp {
+					t.Errorf("step %d: up = %v, want %v", i, got, s.wantUp)
+				}
+				if got, ok := rec.Value("movieCount"); ok != s.wantMovies || (ok && got != 7) {
+					t.Errorf("step %d: movieCount = %v (recorded %v), want recorded %v", i, got, ok, s.wantMovies)
+				}
+			}
+		})
+	}
+}
+
+func TestEndpointHealthy(t *testing.T) {
+	var fail atomic.Bool
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts":           failable(&fail, jsonResponse(map[string]float64{})),
+		"/System/Info":            jsonResponse(map[string]string{"Version": "10.8.13"}),
+		"/System/Configuration":   rawJSON(`{}`),
+		"/Users":                  rawJSON(`[]`),
+		"/ScheduledTasks":         rawJSON(`[]`),
+		"/Sessions":               rawJSON(`[]`),
+		"/Items":                  rawJSON(`{"Items": [], "TotalRecordCount": 0}`),
+		"/Library/VirtualFolders": rawJSON(`[]`),
+		"/Users/Me":               rawJSON(`{"Id": "u1", "Name": "admin"}`),
+	})
+
+	tests := []struct {
+		fail bool
+		want map[string]float64
+	}{
+		{false, map[string]float64{"/Items/Counts": 1, "/System/Info": 1}},
+		{true, map[string]float64{"/Items/Counts": 0, "/System/Info": 1}},
+		{false, map[string]float64{"/Items/Counts": 1, "/System/Info": 1}},
+	}
+	for i, tt := range tests {
+		fail.Store(tt.fail)
+		rec := scrape(t, c)
+		for endpoint, want := range tt.want {
+			if got, ok := rec.Value("endpoint_healthy", endpoint); !ok || got != want {
+				t.Errorf("scrape %d: endpoint_healthy{%s} = %v, want %v", i, endpoint, got, want)
+			}
+		}
+	}
+}
+
+func TestScrapeErrors(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	var fail atomic.Bool
+	fail.Store(true)
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": failable(&fail, jsonResponse(map[string]float64{"MovieCount": 7})),
+		"/System/Info":  jsonResponse(map[string]string{"Version": "10.8.13"}),
+		"/Users":        failable(&fail, rawJSON(`[]`)),
+	})
+
+	tests := []struct {
+		fail bool
+		want float64
+	}{
+		{true, 1},
+		{true, 2},
+		{false, 2},
+	}
+	for i, tt := range tests {
+		fail.Store(tt.fail)
+		rec := scrape(t, c)
+		// every failing endpoint is counted, not only the first
+		for _, endpoint := range []string{"/Items/Counts", "/Users"} {
+			if got, _ := rec.Value("scrape_errors_total", endpoint); got != tt.want {
+				t.Errorf("scrape %d: scrape_errors_total{%s} = %v, want %v", i, endpoint, got, tt.want)
+			}
+		}
+		if _, ok := rec.Value("scrape_errors_total", "/System/Info"); ok {
+			t.Errorf("scrape %d: scrape errors counted for a healthy endpoint", i)
+		}
+	}
+
+	logged := make(map[interface{}]int)
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "serving") {
+			logged[entry.Data["endpoint"]]++
+		}
+	}
+	if logged["/Items/Counts"] != 2 || logged["/Users"] != 2 {
+		t.Errorf("logged failures per endpoint %v, want 2 for /Items/Counts and /Users", logged)
+	}
+}
+
+// rawJSON answers with body, a JSON document as Jellyfin sends it.
+func rawJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(body))
+	}
+}
+
+// statusResponse answers with the status code.
+func statusResponse(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+// countSeries returns the number of series of the metric in rec.
+func countSeries(rec *TestRecorder, name string) int {
+	var n int
+	for key := range rec.Values {
+		if key == name || strings.HasPrefix(key, name+"{") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCardinalityWarning(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   int
+		series      int
+		wantWarning bool
+	}{
+		{"below the threshold", 3, 2, false},
+		{"at the threshold", 3, 3, false},
+		{"above the threshold", 3, 4, true},
+		{"disabled", 0, 200, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			// every item has an id of its own metadata provider
+			items := make([]jellyfin.Item, tt.series)
+			for i := range items {
+				items[i].ID = strconv.Itoa(i)
+				items[i].ProviderIds = map[string]string{"source" + strconv.Itoa(i): "1"}
+			}
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": itemPages(items)},
+				"--metadata-source-metrics-enabled", "--cardinality-warn-threshold="+strconv.Itoa(tt.threshold))
+			rec := scrape(t, c)
+			if got, _ := rec.Value("metric_cardinality", "metadata_source_total"); got != float64(tt.series) {
+				t.Errorf("metric_cardinality{metadata_source_total} = %v, want %v", got, tt.series)
+			}
+
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "high metric cardinality" && entry.Data["metric"] == "metadata_source_total" {
+					warned = true
+					if entry.Data["count"] != tt.series {
+						t.Errorf("warning fields %v", entry.Data)
+					}
+				}
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("cardinality warning logged = %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"alice", "alice"},
+		{"Living Room TV", "Living_Room_TV"},
+		{"  leading and trailing  ", "leading_and_trailing"},
+		{"snake_case__name", "snake_case_name"},
+		{"Amélie (2001)", "Am_lie_2001"},
+		{"東京", ""},
+		{"Grey's Anatomy: S01", "Grey_s_Anatomy_S01"},
+		{"!!!", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabelValue(tt.in); got != tt.want {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSlowMetricsCached(t *testing.T) {
+	c := newTestCollector(t, "--slow-metrics-interval=1h", "--chapter-metrics-enabled")
+	// addSlow schedules the expensive endpoints
+	NewLibraryCollector(c)
+	if got := c.CollectionSchedule["/Items?Fields=Chapters"]; got != time.Hour {
+		t.Fatalf("chapters scheduled every %v, want 1h", got)
+	}
+	if _, ok := c.CollectionSchedule["/Items/Counts"]; ok {
+		t.Fatal("item counts scheduled, they should refresh on every scrape")
+	}
+
+	calls := map[string]int{}
+	fetch := func(endpoint string) func(context.Context, jellyfin.Client, MetricRecorder) error {
+		return func(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+			calls[endpoint]++
+			rec.RecordGauge("library_chapters_total", float64(calls[endpoint]))
+			return nil
+		}
+	}
+	collect := func(endpoint string) float64 {
+		rec := NewTestRecorder()
+		err := c.collectEndpoint(context.Background(), endpoint, *c.client, rec, fetch(endpoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := rec.Value("library_chapters_total")
+		return value
+	}
+
+	tests := []struct {
+		name      string
+		endpoint  string
+		age       time.Duration
+		wantCalls int
+		wantValue float64
+	}{
+		{"slow first scrape", "/Items?Fields=Chapters", 0, 1, 1},
+		{"slow within the interval", "/Items?Fields=Chapters", 59 * time.Minute, 1, 1},
+		{"slow after the interval", "/Items?Fields=Chapters", time.Hour, 2, 2},
+		{"fast first scrape", "/Items/Counts", 0, 1, 1},
+		{"fast next scrape", "/Items/Counts", 0, 2, 2},
+	}
+	for _, tt := range tests {
+		c.cacheMu.Lock()
+		if last, ok := c.lastCollected[tt.endpoint]; ok {
+			c.lastCollected[tt.endpoint] = last.Add(-tt.age)
+		}
+		c.cacheMu.Unlock()
+
+		value := collect(tt.endpoint)
+		if calls[tt.endpoint] != tt.wantCalls || value != tt.wantValue {
+			t.Errorf("%s: %d calls and value %v, want %d and %v", tt.name, calls[tt.endpoint], value, tt.wantCalls, tt.wantValue)
+		}
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		wantIdle        int
+		wantIdlePerHost int
+		wantIdleTimeout time.Duration
+	}{
+		{"defaults", nil, 100, 10, 90 * time.Second},
+		{
+			name:            "configured",
+			args:            []string{"--http-max-idle-conns=20", "--http-max-idle-conns-per-host=5", "--http-idle-conn-timeout=30s"},
+			wantIdle:        20,
+			wantIdlePerHost: 5,
+			wantIdleTimeout: 30 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestCollector(t, tt.args...).transport
+			if transport.MaxIdleConns != tt.wantIdle {
+				t.Errorf("MaxIdleConns %d, want %d", transport.MaxIdleConns, tt.wantIdle)
+			}
+			if transport.MaxIdleConnsPerHost != tt.wantIdlePerHost {
+				t.Errorf("MaxIdleConnsPerHost %d, want %d", transport.MaxIdleConnsPerHost, tt.wantIdlePerHost)
+			}
+			if transport.IdleConnTimeout != tt.wantIdleTimeout {
+				t.Errorf("IdleConnTimeout %v, want %v", transport.IdleConnTimeout, tt.wantIdleTimeout)
+			}
+		})
+	}
+}
+
+func TestGoroutinesDelta(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts":   jsonResponse(jellyfin.ItemCounts{MovieCount: 7}),
+		"/ScheduledTasks": jsonResponse([]jellyfin.ScheduledTask{{Name: "Scan Media Library", State: "Idle"}}),
+	})
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:2]
+	c.collectors = []Collector{library}
+
+	// the first scrape opens the connections kept alive by the transport
+	scrape(t, c)
+	for i := 0; i < 3; i++ {
+		rec := scrape(t, c)
+		if got, ok := rec.Value("exporter_goroutines_delta"); !ok || got != 0 {
+			t.Errorf("scrape %d: exporter_goroutines_delta = %v, want 0", i, got)
+		}
+	}
+}
+
+func TestMaxScrapeDuration(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Info": rawJSON(`{"Version": "10.8.13"}`),
+		"/Items/Counts": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(10 * time.Second):
+			case <-r.Context().Done():
+			}
+		},
+	}, "--max-scrape-duration=200ms")
+	system := NewSystemCollector(c)
+	system.endpoints = system.endpoints[:1]
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	c.collectors = []Collector{system, library}
+
+	start := time.Now()
+	rec := scrape(t, c)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("scrape took %v with --max-scrape-duration=200ms", elapsed)
+	}
+	if got, _ := rec.Value("up"); got != 0 {
+		t.Errorf("up = %v after an aborted scrape, want 0", got)
+	}
+	if _, ok := rec.Value("version", "10.8.13"); !ok {
+		t.Errorf("the metrics collected before the abort are missing: %v", rec.Values)
+	}
+	aborted := false
+	for _, entry := range hook.AllEntries() {
+		aborted = aborted || entry.Message == "scrape aborted, serving the metrics collected so far"
+	}
+	if !aborted {
+		t.Error("no warning about the aborted scrape")
+	}
+}
+
+// seriesCollector exports n series of metadata_source_total without calling
+// Jellyfin.
+type seriesCollector struct {
+	owner *JellyfinGetCollector
+	n     int
+}
+
+func (s seriesCollector) Name() string { return "series" }
+
+func (s seriesCollector) Describe(descs chan<- *prom.Desc) {
+	descs <- s.owner.descs["metadata_source_total"]
+}
+
+func (s seriesCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	rec := PromRecorder{Descs: s.owner.descs, Metrics: metrics}
+	for i := 0; i < s.n; i++ {
+		rec.RecordGauge("metadata_source_total", 1, "source"+strconv.Itoa(i))
+	}
+	return nil
+}
+
+// doneCollector closes done when its collector returned.
+type doneCollector struct {
+	Collector
+	done chan struct{}
+}
+
+func (d doneCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	defer close(d.done)
+	return d.Collector.Collect(ctx, metrics, client)
+}
+
+func TestMetricChannelBuffer(t *testing.T) {
+	tests := []struct {
+		name       string
+		bufferSize int
+		wantDone   bool
+	}{
+		{"buffer absorbs the metrics", 256, true},
+		{"unbuffered", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t, "--metric-channel-buffer-size="+strconv.Itoa(tt.bufferSize))
+			var dones []chan struct{}
+			for i := 0; i < 2; i++ {
+				done := make(chan struct{})
+				dones = append(dones, done)
+				c.collectors = append(c.collectors, doneCollector{seriesCollector{c, 100}, done})
+			}
+
+			// the consumer doesn't read until the collectors are done
+			metrics := make(chan prom.Metric)
+			collected := make(chan struct{})
+			go func() {
+				c.collect(context.Background(), metrics)
+				close(collected)
+			}()
+			finished := true
+			timeout := time.After(200 * time.Millisecond)
+			for _, done := range dones {
+				select {
+				case <-done:
+					continue
+				case <-timeout:
+					finished = false
+				}
+				break
+			}
+			if finished != tt.wantDone {
+				t.Errorf("collectors finished before the metrics were read %v, want %v", finished, tt.wantDone)
+			}
+
+			go func() {
+				for range metrics {
+				}
+			}()
+			<-collected
+			close(metrics)
+		})
+	}
+}
+
+// blockingCollector signals started when a scrape collects it, and returns
+// once release is closed.
+type blockingCollector struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingCollector) Name() string { return "blocking" }
+
+func (b blockingCollector) Describe(descs chan<- *prom.Desc) {}
+
+func (b blockingCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	b.started <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func TestInflightScrapes(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	c := newTestCollector(t)
+	blocking := blockingCollector{started: make(chan struct{}), release: make(chan struct{})}
+	c.collectors = []Collector{blocking}
+
+	// two overlapping scrapes
+	recs := make(chan *TestRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			metrics := make(chan prom.Metric)
+			go func() {
+				c.collect(context.Background(), metrics)
+				close(metrics)
+			}()
+			rec := NewTestRecorder()
+			for metric := range metrics {
+				if metric.Desc() == c.descs["exporter_inflight_scrapes"] {
+					var m dto.Metric
+					metric.Write(&m)
+					rec.RecordGauge("exporter_inflight_scrapes", m.GetGauge().GetValue())
+				}
+			}
+			recs <- rec
+		}()
+		<-blocking.started
+	}
+	if got := c.inflight.Load(); got != 2 {
+		t.Errorf("%d scrapes in flight, want 2", got)
+	}
+	close(blocking.release)
+	var values []float64
+	for i := 0; i < 2; i++ {
+		got, _ := (<-recs).Value("exporter_inflight_scrapes")
+		values = append(values, got)
+	}
+	sort.Float64s(values)
+	if values[0] != 1 || values[1] != 2 {
+		t.Errorf("exporter_inflight_scrapes of the overlapping scrapes %v, want 1 and 2", values)
+	}
+	if got := c.inflight.Load(); got != 0 {
+		t.Errorf("%d scrapes in flight after they returned, want 0", got)
+	}
+
+	var warnings int
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "overlapping scrapes" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("%d warnings about overlapping scrapes, want 1", warnings)
+	}
+
+	// the blocking collector returns right away now
+	go func() { <-blocking.started }()
+	rec := scrape(t, c)
+	if got, _ := rec.Value("exporter_inflight_scrapes"); got != 1 {
+		t.Errorf("exporter_inflight_scrapes = %v for a single scrape, want 1", got)
+	}
+}
+
+func TestCollectCancelled(t *testing.T) {
+	called := make(chan struct{})
+	cancelled := make(chan struct{})
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": func(w http.ResponseWriter, r *http.Request) {
+			close(called)
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(10 * time.Second):
+			}
+		},
+	}, "--max-scrape-duration=0")
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	c.collectors = []Collector{library}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics := make(chan prom.Metric)
+	collected := make(chan struct{})
+	go func() {
+		c.collect(ctx, metrics)
+		close(collected)
+	}()
+	go func() {
+		for range metrics {
+		}
+	}()
+	defer close(metrics)
+
+	// Prometheus gives up while Jellyfin answers
+	<-called
+	cancel()
+	select {
+	case <-collected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("collect still running 2s after the scrape was cancelled")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("the api call wasn't cancelled")
+	}
+}
+
+// failingCollector sends one series of metadata_source_total, then fails.
+type failingCollector struct{ owner *JellyfinGetCollector }
+
+func (f failingCollector) Name() string { return "failing" }
+
+func (f failingCollector) Describe(descs chan<- *prom.Desc) {
+	descs <- f.owner.descs["metadata_source_total"]
+}
+
+func (f failingCollector) Collect(ctx context.Context, metrics chan<- prom.Metric, client jellyfin.Client) error {
+	rec := PromRecorder{Descs: f.owner.descs, Metrics: metrics}
+	rec.RecordGauge("metadata_source_total", 1, "sent before failing")
+	return errors.New("collector failed")
+}
+
+func TestCollectionSummary(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       bool
+		collectors func(c *JellyfinGetCollector) []Collector
+		wantStatus string
+		wantErrors float64
+	}{
+		{
+			name:       "success",
+			collectors: func(c *JellyfinGetCollector) []Collector { return []Collector{seriesCollector{c, 3}} },
+			wantStatus: "success",
+		},
+		{
+			name: "partial",
+			collectors: func(c *JellyfinGetCollector) []Collector {
+				return []Collector{seriesCollector{c, 3}, failingCollector{c}}
+			},
+			wantStatus: "partial",
+			wantErrors: 1,
+		},
+		{
+			name:       "failure",
+			fail:       true,
+			collectors: func(c *JellyfinGetCollector) []Collector { return []Collector{failingCollector{c}} },
+			wantStatus: "failure",
+			wantErrors: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fail atomic.Bool
+			fail.Store(tt.fail)
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items/Counts": failable(&fail, jsonResponse(jellyfin.ItemCounts{MovieCount: 7})),
+			})
+			library := NewLibraryCollector(c)
+			library.endpoints = library.endpoints[:1]
+			c.collectors = append([]Collector{library}, tt.collectors(c)...)
+
+			rec := scrape(t, c)
+			if n := countSeries(rec, "collection_summary"); n != 1 {
+				t.Errorf("collection_summary has %d series, want 1: %v", n, rec.Values)
+			}
+			if got, ok := rec.Value("collection_summary", tt.wantStatus); !ok || got != 1 {
+				t.Errorf("collection_summary{status=%q} = %v, %v, want 1", tt.wantStatus, got, ok)
+			}
+			if got, _ := rec.Value("collection_error_count"); got != tt.wantErrors {
+				t.Errorf("collection_error_count = %v, want %v", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestCollectionMetricCount(t *testing.T) {
+	count := func(n int) float64 {
+		c := newTestCollector(t)
+		c.collectors = []Collector{seriesCollector{c, n}}
+		got, _ := scrape(t, c).Value("collection_metric_count")
+		return got
+	}
+	// the collectors add to the metrics of the exporter itself
+	if got := count(10) - count(3); got != 7 {
+		t.Errorf("collection_metric_count grew by %v for 7 more series, want 7", got)
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts":   statusResponse(http.StatusInternalServerError),
+		"/ScheduledTasks": jsonResponse([]jellyfin.ScheduledTask{{Name: "Scan Media Library", State: "Idle"}}),
+	})
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:2]
+	c.collectors = []Collector{library, failingCollector{c}}
+
+	for i := 1; i <= 2; i++ {
+		rec := scrape(t, c)
+		if got, _ := rec.Value("scrape_errors_total", "/Items/Counts"); got != float64(i) {
+			t.Errorf("scrape %d: scrape_errors_total{/Items/Counts} = %v, want %d", i, got, i)
+		}
+		// the metrics of the failing collectors are still served
+		if _, ok := rec.Value("metadata_source_total", "sent before failing"); !ok {
+			t.Errorf("scrape %d: the metric sent before the error is missing", i)
+		}
+		if _, ok := rec.Value("library_scan_in_progress"); !ok {
+			t.Errorf("scrape %d: the metrics of the healthy endpoint are missing", i)
+		}
+	}
+
+	var logged int
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "scrape failed" && entry.Data[logrus.ErrorKey].(error).Error() == "collector failed" {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Errorf("the collector error was logged %d times, want 2", logged)
+	}
+}
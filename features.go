@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// features are the version specific parts of the Jellyfin api the exporter
+// uses. Endpoints of unsupported features are disabled to avoid 404s.
+type features struct {
+	supportsTrickplay      bool
+	supportsHWAcceleration bool
+	supportsBackup         bool
+}
+
+// allFeatures is assumed when the version of Jellyfin is unknown.
+var allFeatures = features{
+	supportsTrickplay:      true,
+	supportsHWAcceleration: true,
+	supportsBackup:         true,
+}
+
+// featureVersions are the first Jellyfin versions supporting each feature.
+// The names are the feature label of jellyfin_feature_compatibility.
+var featureVersions = []struct {
+	name    string
+	version [3]int
+	field   func(*features) *bool
+}{
+	{"trickplay", [3]int{10, 9, 0}, func(f *features) *bool { return &f.supportsTrickplay }},
+	{"hardware_acceleration", [3]int{10, 0, 0}, func(f *features) *bool { return &f.supportsHWAcceleration }},
+	{"backup", [3]int{10, 11, 0}, func(f *features) *bool { return &f.supportsBackup }},
+}
+
+// featureDetector derives the supported features from the server version.
+type featureDetector struct{}
+
+// Detect returns the features of a Jellyfin version, such as 10.8.13. An
+// unparsable version returns all features and an error.
+func (featureDetector) Detect(version string) (features, error) {
+	parsed, err := parseVersion(version)
+	if err != nil {
+		return allFeatures, err
+	}
+
+	var detected features
+	for _, feature := range featureVersions {
+		supported := compareVersions(parsed, feature.version) >= 0
+		*feature.field(&detected) = supported
+		if !supported {
+			log.Warnf("jellyfin %s doesn't support %s metrics, they need %d.%d.%d",
+				version, feature.name, feature.version[0], feature.version[1], feature.version[2])
+		}
+	}
+	return detected, nil
+}
+
+// parseVersion parses a major.minor.patch version, ignoring a leading v and
+// any pre-release or build suffix.
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	core := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return parsed, fmt.Errorf("invalid version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("invalid version %q", version)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// supported reports for every feature of featureVersions whether f supports
+// it.
+func (f features) supported() map[string]bool {
+	supported := make(map[string]bool, len(featureVersions))
+	for _, feature := range featureVersions {
+		supported[feature.name] = *feature.field(&f)
+	}
+	return supported
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestFeatureDetector(t *testing.T) {
+	tests := []struct {
+		version string
+		want    features
+		wantErr bool
+	}{
+		{"10.11.2", allFeatures, false},
+		{"v10.11.0-rc1", allFeatures, false},
+		{"10.9.11", features{supportsTrickplay: true, supportsHWAcceleration: true}, false},
+		{"10.8.13", features{supportsHWAcceleration: true}, false},
+		{"10.8", features{supportsHWAcceleration: true}, false},
+		{"unstable", allFeatures, true},
+		{"10.8.13.1", allFeatures, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := featureDetector{}.Detect(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Detect error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Detect = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOldVersionDisablesEndpoints(t *testing.T) {
+	tests := []struct {
+		version     string
+		wantEnabled map[string]bool
+	}{
+		{"10.8.13", map[string]bool{
+			"/Items?ImageTypes=Trickplay":    false,
+			"/System/Backup/Status":          false,
+			"/System/Configuration/encoding": true,
+		}},
+		{"10.11.0", map[string]bool{
+			"/Items?ImageTypes=Trickplay":    true,
+			"/System/Backup/Status":          true,
+			"/System/Configuration/encoding": true,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			c := newTestCollector(t, "--trickplay-metrics-enabled", "--backup-metrics-enabled", "--hardware-metrics-enabled")
+			var err error
+			c.features, err = featureDetector{}.Detect(tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.collectors = []Collector{NewSystemCollector(c), NewLibraryCollector(c)}
+
+			enabled := map[string]bool{}
+			for _, collector := range c.collectors {
+				for _, ep := range collector.(endpointLister).Endpoints() {
+					enabled[ep.key] = ep.enabled
+				}
+			}
+			for key, want := range tt.wantEnabled {
+				if enabled[key] != want {
+					t.Errorf("%s enabled %v, want %v", key, enabled[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestFeatureCompatibility(t *testing.T) {
+	for _, feature := range featureVersions {
+		major, minor, patch := feature.version[0], feature.version[1], feature.version[2]
+		below := fmt.Sprintf("%d.%d.%d", major-1, 99, 99)
+		if minor > 0 {
+			below = fmt.Sprintf("%d.%d.%d", major, minor-1, 99)
+		}
+		tests := []struct {
+			version   string
+			supported bool
+		}{
+			{below, false},
+			{fmt.Sprintf("%d.%d.%d", major, minor, patch), true},
+			{fmt.Sprintf("%d.%d.%d", major, minor, patch+1), true},
+		}
+		for _, tt := range tests {
+			t.Run(feature.name+"/"+tt.version, func(t *testing.T) {
+				hook := logtest.NewLocal(log.Logger)
+				defer hook.Reset()
+
+				detected, err := featureDetector{}.Detect(tt.version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := detected.supported()[feature.name]; got != tt.supported {
+					t.Errorf("%s supported %v, want %v", feature.name, got, tt.supported)
+				}
+				warned := false
+				for _, entry := range hook.AllEntries() {
+					warned = warned || strings.Contains(entry.Message, "support "+feature.name+" metrics")
+				}
+				if warned == tt.supported {
+					t.Errorf("warned %v about %s metrics, want %v", warned, feature.name, !tt.supported)
+				}
+
+				c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+					"/System/Info": rawJSON(systemInfo("")),
+				})
+				c.features = detected
+				rec := NewTestRecorder()
+				if err := c.fetchSystemInfo(context.Background(), *c.client, rec); err != nil {
+					t.Fatal(err)
+				}
+				want, other := "0", "1"
+				if tt.supported {
+					want, other = "1", "0"
+				}
+				if _, ok := rec.Value("feature_compatibility", feature.name, want); !ok {
+					t.Errorf("no feature_compatibility{feature=%q, supported=%q}", feature.name, want)
+				}
+				if _, ok := rec.Value("feature_compatibility", feature.name, other); ok {
+					t.Errorf("feature_compatibility{feature=%q} recorded as %q too", feature.name, other)
+				}
+			})
+		}
+	}
+}
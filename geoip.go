@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// countryResolver returns the ISO country code of an ip address, or an
+// empty string if it is unknown.
+type countryResolver interface {
+	Country(ip net.IP) (string, error)
+}
+
+// geoipDatabase resolves countries with a MaxMind GeoLite2 Country or City
+// database.
+type geoipDatabase struct {
+	reader *geoip2.Reader
+}
+
+func openGeoIPDatabase(path string) (*geoipDatabase, error) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoipDatabase{reader}, nil
+}
+
+func (d *geoipDatabase) Country(ip net.IP) (string, error) {
+	record, err := d.reader.Country(ip)
+	if err != nil {
+		return "", err
+	}
+	return record.Country.IsoCode, nil
+}
+
+func (d *geoipDatabase) Close() error {
+	return d.reader.Close()
+}
+
+// countSessionCountries returns the number of remote sessions per country
+// code, unknown for addresses resolver has no country for. Sessions without
+// remote address and those from a loopback, private or the local network
+// aren't counted.
+func countSessionCountries(sessions []jellyfin.Session, resolver countryResolver, local *net.IPNet) map[string]float64 {
+	countries := make(map[string]float64)
+	for _, s := range sessions {
+		ip := s.RemoteIP()
+		if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+			(local != nil && local.Contains(ip)) {
+			continue
+		}
+		country, err := resolver.Country(ip)
+		if err != nil || country == "" {
+			country = "unknown"
+		}
+		countries[country]++
+	}
+	return countries
+}
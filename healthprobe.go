@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// healthProbeTimeout is the time Jellyfin has to answer a background ping,
+// shorter than --timeout so that a failing probe doesn't overlap the next.
+const healthProbeTimeout = 3 * time.Second
+
+// runHealthProbes pings the Jellyfin hosts of targets every interval, all at
+// the same time, until ctx is done.
+func runHealthProbes(ctx context.Context, interval time.Duration, targets func() []*JellyfinGetCollector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, collector := range targets() {
+			wg.Add(1)
+			go func(collector *JellyfinGetCollector) {
+				defer wg.Done()
+				collector.probeHealth(ctx)
+			}(collector)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeHealth calls /System/Ping with a client of its own and records when
+// it failed, so that up turns 0 until a ping or api call succeeds again.
+func (c *JellyfinGetCollector) probeHealth(ctx context.Context) {
+	err := c.ping(ctx)
+
+	c.cacheMu.Lock()
+	failing := !c.probeFailedAt.IsZero()
+	if err != nil {
+		c.probeFailedAt = time.Now()
+	} else {
+		c.probeFailedAt = time.Time{}
+	}
+	c.cacheMu.Unlock()
+
+	entry := log.WithField("host", c.Config.Host)
+	if err != nil && !failing {
+		entry.WithError(err).Warn("background health probe failed")
+	} else if err == nil && failing {
+		entry.Info("background health probe succeeded again")
+	}
+}
+
+func (c *JellyfinGetCollector) ping(ctx context.Context) error {
+	u, err := apiURL(c.Config.Host, c.Config.BasePath, "/System/Ping")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	netClient := &http.Client{Transport: c.transport, Timeout: healthProbeTimeout}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &jellyfin.APIError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
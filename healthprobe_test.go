@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeHealth(t *testing.T) {
+	var pingFailing, infoFailing atomic.Bool
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Ping": failable(&pingFailing, rawJSON(`"Jellyfin Server"`)),
+		"/System/Info": failable(&infoFailing, rawJSON(`{"Version": "10.8.13"}`)),
+	}, "--background-health-probe-enabled")
+	system := NewSystemCollector(c)
+	system.endpoints = system.endpoints[:1]
+
+	steps := []struct {
+		name string
+		// calls is whether the scrape calls Jellyfin or only reports up
+		calls       bool
+		pingFailing bool
+		infoFailing bool
+		want        float64
+	}{
+		{name: "ping succeeds", want: 1},
+		{name: "ping fails", pingFailing: true, want: 0},
+		{name: "still failing", pingFailing: true, want: 0},
+		{name: "ping succeeds again", want: 1},
+		{name: "ping fails before a scrape", pingFailing: true, calls: true, infoFailing: true, want: 0},
+		{name: "api call succeeds after the ping failed", pingFailing: true, calls: true, want: 1},
+	}
+	for _, s := range steps {
+		pingFailing.Store(s.pingFailing)
+		infoFailing.Store(s.infoFailing)
+		c.probeHealth(context.Background())
+
+		c.collectors = nil
+		if s.calls {
+			c.collectors = []Collector{system}
+		}
+		if got, _ := scrape(t, c).Value("up"); got != s.want {
+			t.Errorf("%s: up = %v, want %v", s.name, got, s.want)
+		}
+	}
+}
+
+func TestRunHealthProbes(t *testing.T) {
+	var pings atomic.Int64
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Ping": func(w http.ResponseWriter, r *http.Request) {
+			pings.Add(1)
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		},
+	}, "--background-health-probe-enabled", "--health-check-interval=10ms")
+	c.collectors = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runHealthProbes(ctx, c.Config.HealthCheckInterval, func() []*JellyfinGetCollector {
+			return []*JellyfinGetCollector{c}
+		})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for pings.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if pings.Load() < 3 {
+		t.Fatalf("%d pings in 5s, want a ping every 10ms", pings.Load())
+	}
+	if got, _ := scrape(t, c).Value("up"); got != 0 {
+		t.Errorf("up = %v while the pings fail, want 0", got)
+	}
+}
+
+func TestHealthCheckIntervalValidation(t *testing.T) {
+	config := testConfig(t)
+	config.BackgroundHealthProbe = true
+	config.HealthCheckInterval = 0
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig accepted --health-check-interval=0")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// influxField is a field of a line, the value of gauges and counters or the
+// count, sum and buckets or quantiles of histograms and summaries.
+type influxField struct {
+	key   string
+	value float64
+}
+
+// writeInfluxLines writes families in the InfluxDB line protocol, a line per
+// series with the metric name as measurement and the labels as tags. Series
+// without timestamp are written with now. Influx has no NaN or infinity,
+// fields with such values are left out, as are empty tags.
+func writeInfluxLines(out io.Writer, families []*dto.MetricFamily, now time.Time) error {
+	w := bufio.NewWriter(out)
+	for _, family := range families {
+		measurement := influxMeasurementEscaper.Replace(family.GetName())
+		for _, metric := range family.GetMetric() {
+			var fields []string
+			for _, field := range influxFields(metric) {
+				if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+					continue
+				}
+				fields = append(fields, influxTagEscaper.Replace(field.key)+"="+
+					strconv.FormatFloat(field.value, 'g', -1, 64))
+			}
+			if len(fields) == 0 {
+				continue
+			}
+
+			w.WriteString(measurement)
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == "" {
+					continue
+				}
+				w.WriteString("," + influxTagEscaper.Replace(label.GetName()) + "=" +
+					influxTagEscaper.Replace(label.GetValue()))
+			}
+			timestamp := now
+			if metric.TimestampMs != nil {
+				timestamp = time.UnixMilli(metric.GetTimestampMs())
+			}
+			w.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(timestamp.UnixNano(), 10) + "\n")
+		}
+	}
+	return w.Flush()
+}
+
+func influxFields(metric *dto.Metric) []influxField {
+	switch {
+	case metric.Histogram != nil:
+		fields := []influxField{
+			{"count", float64(metric.Histogram.GetSampleCount())},
+			{"sum", metric.Histogram.GetSampleSum()},
+		}
+		for _, bucket := range metric.Histogram.GetBucket() {
+			// the +Inf bucket is the count, added below for histograms that
+			// leave it out
+			if math.IsInf(bucket.GetUpperBound(), 1) {
+				continue
+			}
+			fields = append(fields, influxField{
+				strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64),
+				float64(bucket.GetCumulativeCount()),
+			})
+		}
+		return append(fields, influxField{"+Inf", float64(metric.Histogram.GetSampleCount())})
+	case metric.Summary != nil:
+		fields := []influxField{
+			{"count", float64(metric.Summary.GetSampleCount())},
+			{"sum", metric.Summary.GetSampleSum()},
+		}
+		for _, quantile := range metric.Summary.GetQuantile() {
+			fields = append(fields, influxField{
+				strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64),
+				quantile.GetValue(),
+			})
+		}
+		return fields
+	default:
+		return []influxField{{"value", metricValue(metric)}}
+	}
+}
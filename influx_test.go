@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// influxLine matches a line of the InfluxDB line protocol: the measurement
+// and tags, the fields and the timestamp, with spaces and commas escaped.
+var influxLine = regexp.MustCompile(`^(?:[^ ,\\]|\\.)+(?:,(?:[^ ,=\\]|\\.)+=(?:[^ ,=\\]|\\.)+)* ` +
+	`(?:[^ ,=\\]|\\.)+=[-+0-9.e]+(?:,(?:[^ ,=\\]|\\.)+=[-+0-9.e]+)* [0-9]+$`)
+
+func TestWriteInfluxLines(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ns := "1700000000000000000"
+	tests := []struct {
+		name    string
+		collect func(registry *prom.Registry)
+		want    []string
+	}{
+		{
+			name: "gauge",
+			collect: func(registry *prom.Registry) {
+				g := prom.NewGaugeVec(prom.GaugeOpts{Name: "jellyfin_library_item_count", Help: "h"}, []string{"library_name", "media_type"})
+				g.WithLabelValues("Movies", "Movie").Set(812)
+				registry.MustRegister(g)
+			},
+			want: []string{"jellyfin_library_item_count,library_name=Movies,media_type=Movie value=812 " + ns},
+		},
+		{
+			name: "escaped tags",
+			collect: func(registry *prom.Registry) {
+				g := prom.NewGaugeVec(prom.GaugeOpts{Name: "jellyfin_version", Help: "h"}, []string{"version", "channel"})
+				g.WithLabelValues("10.8.13, beta=1", "").Set(1)
+				registry.MustRegister(g)
+			},
+			// empty tags are left out
+			want: []string{`jellyfin_version,version=10.8.13\,\ beta\=1 value=1 ` + ns},
+		},
+		{
+			name: "counter",
+			collect: func(registry *prom.Registry) {
+				c := prom.NewCounter(prom.CounterOpts{Name: "jellyfin_server_restart_total", Help: "h"})
+				c.Add(2)
+				registry.MustRegister(c)
+			},
+			want: []string{"jellyfin_server_restart_total value=2 " + ns},
+		},
+		{
+			name: "not a number",
+			collect: func(registry *prom.Registry) {
+				g := prom.NewGauge(prom.GaugeOpts{Name: "jellyfin_ratio", Help: "h"})
+				g.Set(math.NaN())
+				registry.MustRegister(g)
+			},
+		},
+		{
+			name: "histogram",
+			collect: func(registry *prom.Registry) {
+				h := prom.NewHistogram(prom.HistogramOpts{Name: "jellyfin_api_request_duration_seconds", Help: "h", Buckets: []float64{0.1, 1}})
+				h.Observe(0.05)
+				h.Observe(0.5)
+				h.Observe(5)
+				registry.MustRegister(h)
+			},
+			want: []string{"jellyfin_api_request_duration_seconds count=3,sum=5.55,0.1=1,1=2,+Inf=3 " + ns},
+		},
+		{
+			name: "summary",
+			collect: func(registry *prom.Registry) {
+				s := prom.NewSummary(prom.SummaryOpts{Name: "jellyfin_scan_seconds", Help: "h", Objectives: map[float64]float64{0.5: 0.05}})
+				s.Observe(4)
+				registry.MustRegister(s)
+			},
+			want: []string{"jellyfin_scan_seconds count=1,sum=4,0.5=4 " + ns},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prom.NewRegistry()
+			tt.collect(registry)
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := writeInfluxLines(&out, families, now); err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if out.Len() == 0 {
+				got = nil
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			for _, line := range got {
+				if !influxLine.MatchString(line) {
+					t.Errorf("invalid line protocol: %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestInfluxLineSyntax(t *testing.T) {
+	c := newTestCollector(t)
+	c.collectors = []Collector{seriesCollector{c, 3}}
+	registry := prom.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeInfluxLines(&out, families, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) < len(families) {
+		t.Errorf("%d lines for %d metric families", len(lines), len(families))
+	}
+	for _, line := range lines {
+		if !influxLine.MatchString(line) {
+			t.Errorf("invalid line protocol: %q", line)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// constLabels returns the constant labels of the metric name: the instance
+// label, the --version-extra-labels of version and with --snmp-compat-labels
+// the oid label.
+func constLabels(config *ExporterConfig, name string) prom.Labels {
+	labels := instanceLabels(config)
+	extra := prom.Labels{}
+	if name == "version" {
+		for key, value := range config.versionLabels {
+			extra[key] = value
+		}
+	}
+	if oid, ok := metricOIDs[name]; ok && config.SNMPCompatLabels {
+		extra["oid"] = fmt.Sprintf("%s.%s", config.SNMPOIDBase, oid)
+	}
+	if len(extra) == 0 {
+		return labels
+	}
+	for key, value := range labels {
+		extra[key] = value
+	}
+	return extra
+}
+
+// instanceLabels returns the constant labels of the metrics of a collector,
+// the jellyfin_instance label of collectors created by a CollectorManager
+// and the --instance-name label.
+func instanceLabels(config *ExporterConfig) prom.Labels {
+	labels := prom.Labels{}
+	if config.instance != "" {
+		labels["jellyfin_instance"] = config.instance
+	}
+	if config.InstanceName != "" {
+		labels["instance_name"] = config.InstanceName
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// metricFQName returns the name a metric of metricInfos is exported as.
+func metricFQName(config *ExporterConfig, name string) string {
+	namespace := config.Namespace
+	if prefix, ok := config.libraryPrefixes[metricLibraryTypes[name]]; ok {
+		namespace = prefix
+	}
+	return overridePrefix(config, prom.BuildFQName(namespace, "", name))
+}
+
+// overridePrefix applies the first --metric-prefix-override matching the
+// fully qualified name.
+func overridePrefix(config *ExporterConfig, fqName string) string {
+	for _, override := range config.prefixOverrides {
+		if strings.HasPrefix(fqName, override.from) {
+			return override.to + strings.TrimPrefix(fqName, override.from)
+		}
+	}
+	return fqName
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLibraryTypePrefixes(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		metric string
+		want   string
+	}{
+		{"movies", "movies=video_library,music=music_library", "movieCount", "video_library_movieCount"},
+		{"music", "movies=video_library,music=music_library", "music_album_track_ratio", "music_library_music_album_track_ratio"},
+		{"unmapped type", "movies=video_library,music=music_library", "seriesCount", "jellyfin_seriesCount"},
+		{"other metric", "movies=video_library", "maintenance_mode", "jellyfin_maintenance_mode"},
+		{"json", `{"tvshows": "tv_library"}`, "series_completion_ratio", "tv_library_series_completion_ratio"},
+		{"no map", "", "movieCount", "jellyfin_movieCount"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, "--library-type-prefix-map="+tt.value)
+			var err error
+			config.libraryPrefixes, err = parseLibraryPrefixes(config.LibraryTypePrefixes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc := NewJellyfinGetCollector(config).descs[tt.metric].String()
+			if !strings.Contains(desc, `fqName: "`+tt.want+`"`) {
+				t.Errorf("%s is exported as %s, want %s", tt.metric, desc, tt.want)
+			}
+		})
+	}
+}
+
+// describedNames returns the names of the metrics c describes.
+func describedNames(c *JellyfinGetCollector) map[string]bool {
+	pattern := regexp.MustCompile(`fqName: "([^"]*)"`)
+	descs := make(chan *prom.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	names := make(map[string]bool)
+	for desc := range descs {
+		if match := pattern.FindStringSubmatch(desc.String()); match != nil {
+			names[match[1]] = true
+		}
+	}
+	return names
+}
+
+func TestMetricPrefixOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "single override",
+			args:    []string{"--metric-prefix-override=jellyfin_movie=media_movie"},
+			want:    []string{"media_movieCount", "jellyfin_seriesCount"},
+			notWant: []string{"jellyfin_movieCount"},
+		},
+		{
+			name: "repeated overrides",
+			args: []string{
+				"--metric-prefix-override=jellyfin_movie=media_movie",
+				"--metric-prefix-override=jellyfin_api_=jf_api_",
+			},
+			want:    []string{"media_movieCount", "jf_api_request_duration_seconds", "jf_api_response_bytes", "jellyfin_up"},
+			notWant: []string{"jellyfin_movieCount", "jellyfin_api_request_duration_seconds"},
+		},
+		{
+			name: "no override",
+			want: []string{"jellyfin_movieCount", "jellyfin_api_request_duration_seconds"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t, tt.args...)
+			c.collectors = []Collector{NewLibraryCollector(c)}
+			names := describedNames(c)
+			for _, name := range tt.want {
+				if !names[name] {
+					t.Errorf("%s isn't described", name)
+				}
+			}
+			for _, name := range tt.notWant {
+				if names[name] {
+					t.Errorf("%s is described after the rename", name)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrefixOverrides(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    prefixOverride
+		wantErr bool
+	}{
+		{value: "jellyfin_movie=media_movie", want: prefixOverride{"jellyfin_movie", "media_movie"}},
+		{value: " jellyfin_ = jf_ ", want: prefixOverride{"jellyfin_", "jf_"}},
+		{value: "jellyfin_movie", wantErr: true},
+		{value: "jellyfin_movie=media-movie", wantErr: true},
+		{value: "jellyfin_movie=1media", wantErr: true},
+		{value: "=media_", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parsePrefixOverrides([]string{tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrefixOverrides error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got[0] != tt.want {
+				t.Errorf("parsePrefixOverrides = %+v, want %+v", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionExtraLabels(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": rawJSON(systemInfo(""))},
+		"--version-extra-labels=update_channel=stable", "--version-extra-labels=commit_hash=5e8f2a1")
+	system := NewSystemCollector(c)
+	system.endpoints = system.endpoints[:1]
+	c.collectors = []Collector{system}
+	want := map[string]string{"update_channel": "stable", "commit_hash": "5e8f2a1", "version": "10.8.13"}
+
+	descs := make(chan *prom.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	described := false
+	for desc := range descs {
+		s := desc.String()
+		extra := strings.Contains(s, `update_channel="stable"`) && strings.Contains(s, `commit_hash="5e8f2a1"`)
+		isVersion := strings.Contains(s, `fqName: "jellyfin_version"`)
+		if isVersion {
+			described = extra
+		} else if strings.Contains(s, "update_channel") {
+			t.Errorf("extra labels on another metric: %s", s)
+		}
+	}
+	if !described {
+		t.Error("jellyfin_version isn't described with the extra labels")
+	}
+
+	registry := prom.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected := false
+	for _, family := range families {
+		if family.GetName() != "jellyfin_version" {
+			continue
+		}
+		collected = true
+		labels := map[string]string{}
+		for _, pair := range family.Metric[0].Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if !reflect.DeepEqual(labels, want) {
+			t.Errorf("jellyfin_version labels %v, want %v", labels, want)
+		}
+	}
+	if !collected {
+		t.Error("jellyfin_version isn't collected")
+	}
+}
+
+func TestParseVersionLabels(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{values: nil, want: map[string]string{}},
+		{values: []string{"update_channel=stable", " commit_hash = 5e8f2a1 "}, want: map[string]string{"update_channel": "stable", "commit_hash": "5e8f2a1"}},
+		{values: []string{"build="}, want: map[string]string{"build": ""}},
+		{values: []string{"update_channel"}, wantErr: true},
+		{values: []string{"update-channel=stable"}, wantErr: true},
+		{values: []string{"__name__=other"}, wantErr: true},
+		{values: []string{"version=10.9"}, wantErr: true},
+		{values: []string{"instance_name=media"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.values, ","), func(t *testing.T) {
+			got, err := parseVersionLabels(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVersionLabels error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVersionLabels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceNameLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"named", []string{"--instance-name=home-media"}, "home-media"},
+		{"unnamed", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info":  rawJSON(systemInfo("")),
+				"/Items/Counts": rawJSON(`{"movieCount": 42}`),
+			}, tt.args...)
+			gatherer := scrapeGatherer(c.Config, func() []*JellyfinGetCollector { return []*JellyfinGetCollector{c} })
+			families, err := gatherer(context.Background()).Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(families) == 0 {
+				t.Fatal("no metrics gathered")
+			}
+			for _, family := range families {
+				for _, metric := range family.Metric {
+					var got string
+					for _, pair := range metric.Label {
+						if pair.GetName() == "instance_name" {
+							got = pair.GetValue()
+						}
+					}
+					if got != tt.want {
+						t.Errorf("%s has instance_name %q, want %q", family.GetName(), got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// subtitleFormats maps ffmpeg subtitle codec names to display names.
+var subtitleFormats = map[string]string{
+	"srt":               "SRT",
+	"subrip":            "SRT",
+	"ass":               "ASS",
+	"ssa":               "SSA",
+	"pgs":               "PGS",
+	"pgssub":            "PGS",
+	"hdmv_pgs_subtitle": "PGS",
+	"dvdsub":            "VobSub",
+	"dvd_subtitle":      "VobSub",
+	"vobsub":            "VobSub",
+	"dvbsub":            "DVB",
+	"dvb_subtitle":      "DVB",
+	"vtt":               "WebVTT",
+	"webvtt":            "WebVTT",
+	"mov_text":          "MOV_TEXT",
+	"tx3g":              "MOV_TEXT",
+	"microdvd":          "MicroDVD",
+	"sami":              "SAMI",
+	"smi":               "SAMI",
+	"ttml":              "TTML",
+	"eia_608":           "CEA-608",
+	"cc_dec":            "CEA-608",
+}
+
+// subtitleFormatName returns the display name of a subtitle codec, falling
+// back to the upper-cased codec name for formats without a known name.
+func subtitleFormatName(codec string) string {
+	codec = strings.ToLower(strings.TrimSpace(codec))
+	if name, ok := subtitleFormats[codec]; ok {
+		return name
+	}
+	if codec == "" {
+		return "unknown"
+	}
+	return strings.ToUpper(codec)
+}
+
+// libraryScanTasks are the names the library scan task has had across
+// Jellyfin versions, in lower case.
+var libraryScanTasks = []string{"scan all libraries", "scan media library"}
+
+func (c *JellyfinGetCollector) fetchItemCounts(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	counts, err := client.GetItemCounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("movieCount", counts.MovieCount)
+	rec.RecordGauge("seriesCount", counts.SeriesCount)
+	rec.RecordGauge("items_total", counts.MovieCount+counts.SeriesCount+counts.EpisodeCount+
+		counts.SongCount+counts.AlbumCount+counts.ArtistCount+counts.BookCount+counts.MusicVideoCount)
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchVirtualFolders(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	folders, err := client.GetVirtualFolders(ctx)
+	if jellyfin.IsStatus(err, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to read the virtual folders, skipping virtual folder metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]float64)
+	for _, folder := range folders {
+		count := float64(len(folder.Locations))
+		if folder.ItemID != "" {
+			count, err = client.CountItems(ctx, "ParentId="+url.QueryEscape(folder.ItemID))
+			if err != nil {
+				return err
+			}
+		}
+		counts[sanitizeLabelValue(folder.Name)] += count
+	}
+
+	rec.RecordGauge("virtual_folders_total", float64(len(folders)))
+	for name, count := range counts {
+		rec.RecordGauge("virtual_folder_item_count", count, name)
+	}
+	return nil
+}
+
+// libraryMediaTypes are the item types counted per library type by
+// library_item_count. Libraries of other types count all of them.
+var libraryMediaTypes = map[string][]string{
+	"movies":      {"Movie"},
+	"tvshows":     {"Series", "Episode"},
+	"music":       {"MusicAlbum", "Audio"},
+	"musicvideos": {"MusicVideo"},
+	"books":       {"Book", "AudioBook"},
+	"":            {"Movie", "Series", "Episode", "MusicAlbum", "Audio", "MusicVideo"},
+}
+
+// fetchLibraryItemCounts counts the items per type of every library,
+// --library-fetch-concurrency libraries at a time. A failing library cancels
+// the others, the endpoint is served from cache anyway.
+func (c *JellyfinGetCollector) fetchLibraryItemCounts(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	folders, err := client.GetVirtualFolders(ctx)
+	if err != nil {
+		return err
+	}
+
+	type libraryCount struct {
+		library, mediaType string
+		count              float64
+	}
+	var (
+		countsMu sync.Mutex
+		counts   []libraryCount
+	)
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(c.Config.LibraryConcurrency)
+	for _, folder := range folders {
+		if folder.ItemID == "" {
+			continue
+		}
+		folder := folder
+		mediaTypes, ok := libraryMediaTypes[folder.CollectionType]
+		if !ok {
+			mediaTypes = libraryMediaTypes[""]
+		}
+		group.Go(func() error {
+			ctx, cancel := context.WithTimeout(ctx, c.Config.LibraryFetchTimeout)
+			defer cancel()
+			for _, mediaType := range mediaTypes {
+				count, err := client.CountItems(ctx,
+					"ParentId="+url.QueryEscape(folder.ItemID)+"&IncludeItemTypes="+mediaType)
+				if err != nil {
+					return fmt.Errorf("count %s of library %s: %w", mediaType, folder.Name, err)
+				}
+				countsMu.Lock()
+				counts = append(counts, libraryCount{sanitizeLabelValue(folder.Name), mediaType, count})
+				countsMu.Unlock()
+			}
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
+
+	// libraries can share a name, their counts are added up
+	totals := make(map[[2]string]float64, len(counts))
+	for _, count := range counts {
+		totals[[2]string{count.library, count.mediaType}] += count.count
+	}
+	for key, count := range totals {
+		rec.RecordGauge("library_item_count", count, key[0], key[1])
+	}
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchSharing(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	libraries, err := client.GetMediaFolders(ctx)
+	if err != nil {
+		return err
+	}
+	users, err := client.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	shares := make(map[string]int, len(libraries))
+	for _, library := range libraries {
+		shares[library.ID] = 0
+	}
+	for _, u := range users {
+		if u.Policy.EnableAllFolders {
+			for id := range shares {
+				shares[id]++
+			}
+			continue
+		}
+		for _, id := range u.Policy.EnabledFolders {
+			if _, ok := shares[id]; ok {
+				shares[id]++
+			}
+		}
+	}
+
+	var shared, total float64
+	for _, count := range shares {
+		if count > 0 {
+			shared++
+		}
+		total += float64(count)
+	}
+
+	rec.RecordGauge("shared_libraries_total", shared)
+	rec.RecordGauge("library_shares_total", total)
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchScheduledTasks(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	tasks, err := client.GetScheduledTasks(ctx)
+	if jellyfin.IsStatus(err, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to read scheduled tasks, skipping scheduled task and library scan metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string]float64)
+	for _, task := range tasks {
+		states[task.State]++
+	}
+	rec.RecordGauge("scheduled_tasks_total", float64(len(tasks)))
+	for state, count := range states {
+		rec.RecordGauge("scheduled_tasks_by_state_total", count, state)
+	}
+
+	for _, task := range tasks {
+		if !containsString(libraryScanTasks, strings.ToLower(task.Name)) {
+			continue
+		}
+
+		var lastScan float64
+		if task.LastExecutionResult != nil && !task.LastExecutionResult.EndTimeUtc.IsZero() {
+			lastScan = float64(task.LastExecutionResult.EndTimeUtc.Unix())
+		}
+		rec.RecordGauge("library_scan_in_progress", boolToFloat(task.State == "Running"))
+		rec.RecordGauge("library_last_scan_timestamp_seconds", lastScan)
+		return nil
+	}
+
+	requestLog(ctx).Debug("library scan task not found")
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchUnidentifiedItems(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	for _, mediaType := range []string{"Movie", "Series", "Episode", "Audio"} {
+		count, err := client.CountItems(ctx, "IsUnidentified=true&IncludeItemTypes="+mediaType)
+		if err != nil {
+			return err
+		}
+		rec.RecordGauge("items_unidentified_total", count, mediaType)
+	}
+	return nil
+}
+
+// ingestMediaTypes are the item types counted by items_added_per_day_7d_avg.
+var ingestMediaTypes = []string{"Movie", "Series", "Episode", "Audio"}
+
+// ingestItemsLimit is the number of newest items the ingest rate is
+// computed from.
+const ingestItemsLimit = 1000
+
+func (c *JellyfinGetCollector) fetchIngestRate(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	items, err := client.GetItems(ctx, fmt.Sprintf(
+		"SortBy=DateCreated&SortOrder=Descending&Limit=%d&IncludeItemTypes=%s&Recursive=true&Fields=DateCreated",
+		ingestItemsLimit, strings.Join(ingestMediaTypes, ","),
+	))
+	if err != nil {
+		return err
+	}
+	if len(items.Items) == ingestItemsLimit &&
+		time.Since(items.Items[len(items.Items)-1].DateCreated) < 7*24*time.Hour {
+		requestLog(ctx).Debugf("more than %d items added in 7 days, the ingest rate is underestimated", ingestItemsLimit)
+	}
+
+	averages := itemsAddedPerDay(items.Items, time.Now(), 7)
+	for _, mediaType := range ingestMediaTypes {
+		rec.RecordGauge("items_added_per_day_7d_avg", averages[mediaType], mediaType)
+	}
+	return nil
+}
+
+// itemsAddedPerDay returns the average number of items added per day over
+// the days before now, per item type.
+func itemsAddedPerDay(items []jellyfin.Item, now time.Time, days int) map[string]float64 {
+	since := now.Add(-time.Duration(days) * 24 * time.Hour)
+	counts := make(map[string]int)
+	for _, item := range items {
+		if item.DateCreated.After(since) && !item.DateCreated.After(now) {
+			counts[item.Type]++
+		}
+	}
+
+	averages := make(map[string]float64, len(counts))
+	for itemType, count := range counts {
+		averages[itemType] = float64(count) / float64(days)
+	}
+	return averages
+}
+
+// recentMediaTypes are the item types counted by items_added_last_*_total.
+var recentMediaTypes = []string{"Movie", "Series"}
+
+// recentItemsLimit is the number of newest items recently added items are
+// counted from.
+const recentItemsLimit = 200
+
+// recentWindows are the metrics counting recently added items and the time
+// before now each one covers.
+var recentWindows = []struct {
+	metric string
+	window time.Duration
+}{
+	{"items_added_last_day_total", 24 * time.Hour},
+	{"items_added_last_week_total", 7 * 24 * time.Hour},
+}
+
+func (c *JellyfinGetCollector) fetchRecentlyAdded(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	items, err := client.GetItems(ctx, fmt.Sprintf(
+		"Recursive=true&SortBy=DateCreated&SortOrder=Descending&IncludeItemTypes=%s&Limit=%d&Fields=DateCreated",
+		strings.Join(recentMediaTypes, ","), recentItemsLimit,
+	))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, w := range recentWindows {
+		counts := itemsAddedSince(items.Items, now.Add(-w.window), now)
+		for _, mediaType := range recentMediaTypes {
+			rec.RecordGauge(w.metric, counts[mediaType], mediaType)
+		}
+	}
+	return nil
+}
+
+// itemsAddedSince returns the number of items created between since and now,
+// per item type.
+func itemsAddedSince(items []jellyfin.Item, since, now time.Time) map[string]float64 {
+	counts := make(map[string]float64)
+	for _, item := range items {
+		if item.DateCreated.After(since) && !item.DateCreated.After(now) {
+			counts[item.Type]++
+		}
+	}
+	return counts
+}
+
+func (c *JellyfinGetCollector) fetchTrickplay(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	count, err := client.CountItems(ctx, "ImageTypes=Trickplay")
+	if jellyfin.IsStatus(err, http.StatusBadRequest) {
+		requestLog(ctx).WithError(err).
+			Debug("jellyfin does not support trickplay images, skipping trickplay metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("items_with_trickplay_total", count)
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchIntroMarkers(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	episodes, err := client.GetAllItems(ctx, "IncludeItemTypes=Episode&Fields=Chapters")
+	if err != nil {
+		return err
+	}
+
+	var with, without float64
+	for _, episode := range episodes {
+		if episode.HasIntroMarker() {
+			with++
+		} else {
+			without++
+		}
+	}
+
+	rec.RecordGauge("episodes_with_intro_data_total", with)
+	rec.RecordGauge("episodes_without_intro_data_total", without)
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchTrailers(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	movies, err := client.GetAllItems(ctx, "IncludeItemTypes=Movie&Fields=ProviderIds,LocalTrailerCount")
+	if err != nil {
+		return err
+	}
+
+	var with, without float64
+	for _, movie := range movies {
+		if movie.LocalTrailerCount > 0 {
+			with++
+		} else {
+			without++
+		}
+	}
+
+	rec.RecordGauge("movies_with_trailer_total", with)
+	rec.RecordGauge("movies_without_trailer_total", without)
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchChapters(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	videos, err := client.GetAllItems(ctx, "IncludeItemTypes=Movie,Episode,MusicVideo&Fields=Chapters")
+	if err != nil {
+		return err
+	}
+
+	var chapters, withChapters float64
+	for _, video := range videos {
+		chapters += float64(len(video.Chapters))
+		if len(video.Chapters) > 0 {
+			withChapters++
+		}
+	}
+
+	rec.RecordGauge("library_chapters_total", chapters)
+	rec.RecordGauge("items_with_chapters_total", withChapters)
+	return nil
+}
+
+// fetchProviderIds counts items with nfo metadata and items per metadata
+// provider. Jellyfin merges the ids read from nfo files with those of online
+// providers, so only items where the nfo reader recorded its own provider id
+// can be detected as having nfo metadata.
+func (c *JellyfinGetCollector) fetchProviderIds(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	items, err := client.GetAllItems(ctx, "IncludeItemTypes=Movie,Series,Episode,MusicVideo&Fields=ProviderIds")
+	if err != nil {
+		return err
+	}
+
+	var withNFO float64
+	sources := make(map[string]float64)
+	for _, i := range items {
+		for provider := range i.ProviderIds {
+			provider = strings.ToLower(provider)
+			if provider == "nfo" {
+				withNFO++
+			}
+			sources[provider]++
+		}
+	}
+
+	if c.Config.NFOMetrics {
+		rec.RecordGauge("items_with_nfo_total", withNFO)
+	}
+	if c.Config.MetadataSources {
+		for source, count := range sources {
+			rec.RecordGauge("metadata_source_total", count, source)
+		}
+	}
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchSubtitles(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	videos, err := client.GetAllItems(ctx, "IncludeItemTypes=Movie,Episode,MusicVideo&Fields=MediaStreams")
+	if err != nil {
+		return err
+	}
+
+	formats := make(map[string]float64)
+	external := map[string]float64{"Movie": 0, "Episode": 0, "MusicVideo": 0}
+	embedded := map[string]float64{"Movie": 0, "Episode": 0, "MusicVideo": 0}
+	for _, video := range videos {
+		hasExternal, hasEmbedded := false, false
+		for _, stream := range video.MediaStreams {
+			if stream.Type == "Subtitle" {
+				formats[subtitleFormatName(stream.Codec)]++
+				hasExternal = hasExternal || stream.IsExternal
+				hasEmbedded = hasEmbedded || !stream.IsExternal
+			}
+		}
+		if hasExternal {
+			external[video.Type]++
+		}
+		if hasEmbedded {
+			embedded[video.Type]++
+		}
+	}
+	if c.Config.SubtitleFormats {
+		for format, count := range formats {
+			rec.RecordGauge("subtitle_format_total", count, format)
+		}
+	}
+	if c.Config.SubtitleMetrics {
+		for mediaType, count := range external {
+			rec.RecordGauge("items_with_external_subtitles_total", count, mediaType)
+		}
+		for mediaType, count := range embedded {
+			rec.RecordGauge("items_with_embedded_subtitles_total", count, mediaType)
+		}
+	}
+
+	return nil
+}
+
+// maxChannelGroups is the number of groups exported by
+// iptv_channels_by_group_total, the rest is counted as other.
+const maxChannelGroups = 50
+
+func (c *JellyfinGetCollector) fetchLiveTVChannels(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	channels, err := client.GetLiveTVChannels(ctx)
+	if jellyfin.IsStatus(err, http.StatusNotFound) {
+		requestLog(ctx).WithError(err).
+			Debug("jellyfin does not provide live tv, skipping live tv metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]float64)
+	for _, channel := range channels {
+		groups[channelGroup(channel)]++
+	}
+	rec.RecordGauge("iptv_channels_total", float64(len(channels)))
+	for group, count := range topCounts(groups, maxChannelGroups) {
+		rec.RecordGauge("iptv_channels_by_group_total", count, group)
+	}
+	return nil
+}
+
+// channelGroup returns the first tag of a live tv channel, or the major part
+// of its channel number such as 5 of 5.1, or none.
+func channelGroup(channel jellyfin.Item) string {
+	if len(channel.Tags) > 0 && channel.Tags[0] != "" {
+		return channel.Tags[0]
+	}
+	if major, _, _ := strings.Cut(channel.ChannelNumber, "."); major != "" {
+		return major
+	}
+	return "none"
+}
+
+// maxFileExtensions is the number of extensions exported by
+// library_file_extension_total, the rest is counted as other.
+const maxFileExtensions = 50
+
+func (c *JellyfinGetCollector) fetchFileExtensions(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	items, err := client.GetAllItems(ctx, "IsFolder=false&Fields=Path")
+	if err != nil {
+		return err
+	}
+
+	extensions := make(map[string]float64)
+	for _, item := range items {
+		if item.Path != "" {
+			extensions[fileExtension(item.Path)]++
+		}
+	}
+	for extension, count := range topCounts(extensions, maxFileExtensions) {
+		rec.RecordGauge("library_file_extension_total", count, extension)
+	}
+	return nil
+}
+
+// fileExtension returns the lower case extension of path without dot, none
+// if it has no extension.
+func fileExtension(path string) string {
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	if extension == "" {
+		return "none"
+	}
+	return extension
+}
+
+// topCounts returns the n highest counts, with the rest summed up as other.
+func topCounts(counts map[string]float64, n int) map[string]float64 {
+	if len(counts) <= n {
+		return counts
+	}
+
+	ranked := make([]string, 0, len(counts))
+	for key := range counts {
+		ranked = append(ranked, key)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if counts[ranked[i]] != counts[ranked[j]] {
+			return counts[ranked[i]] > counts[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	top := make(map[string]float64, n+1)
+	for i, key := range ranked {
+		if i < n {
+			top[key] = counts[key]
+		} else {
+			top["other"] += counts[key]
+		}
+	}
+	return top
+}
+
+func (c *JellyfinGetCollector) fetchSeriesCompletion(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	series, err := client.GetItems(ctx, fmt.Sprintf(
+		"IncludeItemTypes=Series&Recursive=true&SortBy=SortName&Limit=%d", c.Config.MaxItemLabels,
+	))
+	if err != nil {
+		return err
+	}
+
+	for _, show := range series.Items {
+		present, err := client.CountEpisodes(ctx, show.ID, false)
+		if err != nil {
+			return err
+		}
+		missing, err := client.CountEpisodes(ctx, show.ID, true)
+		if err != nil {
+			return err
+		}
+
+		total := present + missing
+		if total == 0 {
+			continue
+		}
+		// remakes share the name of the original series, the id tells them
+		// apart
+		rec.RecordGauge("series_completion_ratio", present/total, sanitizeLabelValue(show.Name), show.ID)
+	}
+
+	return nil
+}
+
+// albumTrackRatio returns the ratio of tracks present to the expected track
+// count of an album. Jellyfin doesn't know the official track count, so the
+// highest track number of each disc is used instead.
+func albumTrackRatio(tracks []jellyfin.Item) float64 {
+	discs := make(map[int]int)
+	for _, track := range tracks {
+		if track.IndexNumber > discs[track.ParentIndexNumber] {
+			discs[track.ParentIndexNumber] = track.IndexNumber
+		}
+	}
+
+	var expected int
+	for _, highest := range discs {
+		expected += highest
+	}
+	if expected <= len(tracks) {
+		return 1
+	}
+	return float64(len(tracks)) / float64(expected)
+}
+
+func (c *JellyfinGetCollector) fetchAlbumCompleteness(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	albums, err := client.GetItems(ctx, fmt.Sprintf(
+		"IncludeItemTypes=MusicAlbum&Recursive=true&SortBy=SortName&Limit=%d", c.Config.MaxItemLabels,
+	))
+	if err != nil {
+		return err
+	}
+
+	for _, album := range albums.Items {
+		tracks, err := client.GetAllItems(ctx, "IncludeItemTypes=Audio&ParentId="+url.QueryEscape(album.ID))
+		if err != nil {
+			return err
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		// albums of the same name, such as Greatest Hits, are told apart by
+		// their artist and id
+		rec.RecordGauge("music_album_track_ratio", albumTrackRatio(tracks),
+			sanitizeLabelValue(album.Name), sanitizeLabelValue(album.AlbumArtist), album.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,990 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func TestLibraryScanStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		tasks        string
+		wantRunning  float64
+		wantLastScan float64
+	}{
+		{
+			name: "running",
+			tasks: `[{"Name": "Scan Media Library", "State": "Running", "CurrentProgressPercentage": 42.5,
+				"LastExecutionResult": {"EndTimeUtc": "2024-03-01T04:00:12.0000000Z", "Status": "Completed"}}]`,
+			wantRunning:  1,
+			wantLastScan: 1709265612,
+		},
+		{
+			name: "completed",
+			tasks: `[{"Name": "Clean Cache Directory", "State": "Idle"},
+				{"Name": "Scan Media Library", "State": "Idle",
+				"LastExecutionResult": {"EndTimeUtc": "2024-03-01T04:00:12.0000000Z", "Status": "Completed"}}]`,
+			wantLastScan: 1709265612,
+		},
+		{
+			name:  "never run",
+			tasks: `[{"Name": "Scan Media Library", "State": "Idle", "LastExecutionResult": null}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/ScheduledTasks": rawJSON(tt.tasks)})
+			rec := NewTestRecorder()
+			err := c.fetchScheduledTasks(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := rec.Value("library_scan_in_progress"); !ok || got != tt.wantRunning {
+				t.Errorf("library_scan_in_progress = %v, want %v", got, tt.wantRunning)
+			}
+			if got, ok := rec.Value("library_last_scan_timestamp_seconds"); !ok || got != tt.wantLastScan {
+				t.Errorf("library_last_scan_timestamp_seconds = %v, want %v", got, tt.wantLastScan)
+			}
+		})
+	}
+}
+
+func TestTrickplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  http.HandlerFunc
+		wantCount float64
+		wantOK    bool
+	}{
+		{"supported", rawJSON(`{"Items": [], "TotalRecordCount": 12}`), 12, true},
+		{"unsupported query", statusResponse(http.StatusBadRequest), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+				if got := r.URL.Query().Get("ImageTypes"); got != "Trickplay" {
+					t.Errorf("ImageTypes = %q, want Trickplay", got)
+				}
+				tt.response(w, r)
+			}}, "--trickplay-metrics-enabled")
+
+			rec := NewTestRecorder()
+			err := c.fetchTrickplay(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := rec.Value("items_with_trickplay_total")
+			if ok != tt.wantOK || got != tt.wantCount {
+				t.Errorf("items_with_trickplay_total = %v (recorded %v), want %v (recorded %v)", got, ok, tt.wantCount, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFetchChapters(t *testing.T) {
+	// every other video has three chapters, across three pages of 500
+	videos := make([]jellyfin.Item, 1001)
+	for i := range videos {
+		videos[i].ID = strconv.Itoa(i)
+		if i%2 == 0 {
+			videos[i].Chapters = make([]jellyfin.Chapter, 3)
+		}
+	}
+	tests := []struct {
+		name         string
+		videos       []jellyfin.Item
+		wantChapters float64
+		wantWith     float64
+		wantPages    int
+	}{
+		{"no videos", nil, 0, 0, 1},
+		{"across pages", videos, 3 * 501, 501, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := 0
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+				pages++
+				itemPages(tt.videos)(w, r)
+			}}, "--chapter-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchChapters(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := rec.Value("library_chapters_total"); got != tt.wantChapters {
+				t.Errorf("library_chapters_total = %v, want %v", got, tt.wantChapters)
+			}
+			if got, _ := rec.Value("items_with_chapters_total"); got != tt.wantWith {
+				t.Errorf("items_with_chapters_total = %v, want %v", got, tt.wantWith)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("%d pages requested, want %d", pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestItemsWithNFO(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []jellyfin.Item
+		want  float64
+	}{
+		{"no items", nil, 0},
+		{
+			name: "online providers only",
+			items: []jellyfin.Item{
+				{ID: "1", ProviderIds: map[string]string{"Tmdb": "603", "Imdb": "tt0133093"}},
+				{ID: "2"},
+			},
+			want: 0,
+		},
+		{
+			name: "nfo and online providers",
+			items: []jellyfin.Item{
+				{ID: "1", ProviderIds: map[string]string{"Tmdb": "603", "Nfo": "movie.nfo"}},
+				{ID: "2", ProviderIds: map[string]string{"Tvdb": "81189"}},
+				{ID: "3", ProviderIds: map[string]string{"nfo": "tvshow.nfo"}},
+			},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": itemPages(tt.items)}, "--nfo-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchProviderIds(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := rec.Value("items_with_nfo_total"); !ok || got != tt.want {
+				t.Errorf("items_with_nfo_total = %v, want %v", got, tt.want)
+			}
+			if n := countSeries(rec, "metadata_source_total"); n != 0 {
+				t.Errorf("%d metadata_source_total series without --metadata-source-metrics-enabled", n)
+			}
+		})
+	}
+}
+
+func TestSubtitleFormatName(t *testing.T) {
+	tests := []struct {
+		codec string
+		want  string
+	}{
+		{"srt", "SRT"},
+		{"subrip", "SRT"},
+		{"ASS", "ASS"},
+		{"ssa", "SSA"},
+		{"hdmv_pgs_subtitle", "PGS"},
+		{"PGSSUB", "PGS"},
+		{"dvd_subtitle", "VobSub"},
+		{"dvb_subtitle", "DVB"},
+		{"webvtt", "WebVTT"},
+		{"mov_text", "MOV_TEXT"},
+		{"tx3g", "MOV_TEXT"},
+		{"microdvd", "MicroDVD"},
+		{"smi", "SAMI"},
+		{"eia_608", "CEA-608"},
+		{" srt ", "SRT"},
+		{"jacosub", "JACOSUB"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := subtitleFormatName(tt.codec); got != tt.want {
+			t.Errorf("subtitleFormatName(%q) = %q, want %q", tt.codec, got, tt.want)
+		}
+	}
+}
+
+func TestSubtitleFormats(t *testing.T) {
+	subtitle := func(codec string) jellyfin.MediaStream { return jellyfin.MediaStream{Type: "Subtitle", Codec: codec} }
+	videos := []jellyfin.Item{
+		{ID: "1", Type: "Movie", MediaStreams: []jellyfin.MediaStream{
+			{Type: "Video", Codec: "hevc"}, subtitle("subrip"), subtitle("hdmv_pgs_subtitle"),
+		}},
+		{ID: "2", Type: "Episode", MediaStreams: []jellyfin.MediaStream{subtitle("srt"), subtitle("ass")}},
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": itemPages(videos)}, "--subtitle-format-metrics-enabled")
+	rec := NewTestRecorder()
+	err := c.fetchSubtitles(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"SRT": 2, "PGS": 1, "ASS": 1}
+	if n := countSeries(rec, "subtitle_format_total"); n != len(want) {
+		t.Errorf("subtitle_format_total has %d series, want %d: %v", n, len(want), rec.Values)
+	}
+	for format, count := range want {
+		if got, _ := rec.Value("subtitle_format_total", format); got != count {
+			t.Errorf("subtitle_format_total{%s} = %v, want %v", format, got, count)
+		}
+	}
+}
+
+func TestSubtitleMetrics(t *testing.T) {
+	subtitle := func(external bool) jellyfin.MediaStream {
+		return jellyfin.MediaStream{Type: "Subtitle", Codec: "srt", IsExternal: external}
+	}
+	videos := []jellyfin.Item{
+		{ID: "1", Type: "Movie", MediaStreams: []jellyfin.MediaStream{{Type: "Video"}, subtitle(true), subtitle(false)}},
+		{ID: "2", Type: "Movie", MediaStreams: []jellyfin.MediaStream{subtitle(true), subtitle(true)}},
+		{ID: "3", Type: "Movie", MediaStreams: []jellyfin.MediaStream{{Type: "Video"}, {Type: "Audio"}}},
+		{ID: "4", Type: "Episode", MediaStreams: []jellyfin.MediaStream{subtitle(false)}},
+		// an external audio track isn't an external subtitle
+		{ID: "5", Type: "Episode", MediaStreams: []jellyfin.MediaStream{{Type: "Audio", IsExternal: true}}},
+	}
+	tests := []struct {
+		name         string
+		args         []string
+		wantExternal map[string]float64
+		wantEmbedded map[string]float64
+	}{
+		{
+			name:         "enabled",
+			args:         []string{"--subtitle-metrics-enabled"},
+			wantExternal: map[string]float64{"Movie": 2, "Episode": 0, "MusicVideo": 0},
+			wantEmbedded: map[string]float64{"Movie": 1, "Episode": 1, "MusicVideo": 0},
+		},
+		{name: "only formats", args: []string{"--subtitle-format-metrics-enabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": itemPages(videos)}, tt.args...)
+			rec := NewTestRecorder()
+			err := c.fetchSubtitles(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string]map[string]float64{
+				"items_with_external_subtitles_total": tt.wantExternal,
+				"items_with_embedded_subtitles_total": tt.wantEmbedded,
+			} {
+				if n := countSeries(rec, name); n != len(want) {
+					t.Errorf("%s has %d series, want %d: %v", name, n, len(want), rec.Values)
+				}
+				for mediaType, count := range want {
+					if got, _ := rec.Value(name, mediaType); got != count {
+						t.Errorf("%s{%s} = %v, want %v", name, mediaType, got, count)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataSources(t *testing.T) {
+	body := `{"Items": [
+		{"Id": "1", "Type": "Movie", "ProviderIds": {"Tmdb": "603", "Imdb": "tt0133093", "TmdbCollection": "2344"}},
+		{"Id": "2", "Type": "Series", "ProviderIds": {"Tvdb": "81189", "Imdb": "tt0903747", "Tmdb": "1396", "TvRage": "18164"}},
+		{"Id": "3", "Type": "Episode", "ProviderIds": {"Tvdb": "349232"}},
+		{"Id": "4", "Type": "Movie", "ProviderIds": {}}
+	], "TotalRecordCount": 4}`
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": rawJSON(body)}, "--metadata-source-metrics-enabled")
+	rec := NewTestRecorder()
+	err := c.fetchProviderIds(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"tmdb": 2, "imdb": 2, "tvdb": 2, "tmdbcollection": 1, "tvrage": 1}
+	if n := countSeries(rec, "metadata_source_total"); n != len(want) {
+		t.Errorf("metadata_source_total has %d series, want %d: %v", n, len(want), rec.Values)
+	}
+	for source, count := range want {
+		if got, _ := rec.Value("metadata_source_total", source); got != count {
+			t.Errorf("metadata_source_total{%s} = %v, want %v", source, got, count)
+		}
+	}
+	if _, ok := rec.Value("items_with_nfo_total"); ok {
+		t.Error("items_with_nfo_total recorded without --nfo-metrics-enabled")
+	}
+}
+
+func TestFetchSharing(t *testing.T) {
+	folders := `{"Items": [{"Id": "movies", "Name": "Movies"}, {"Id": "shows", "Name": "Shows"}, {"Id": "music", "Name": "Music"}]}`
+	tests := []struct {
+		name       string
+		users      string
+		wantShared float64
+		wantShares float64
+	}{
+		{
+			name:  "not shared",
+			users: `[{"Id": "a1", "Name": "alice", "Policy": {"EnableAllFolders": false, "EnabledFolders": []}}]`,
+		},
+		{
+			name: "shared",
+			users: `[
+				{"Id": "a1", "Name": "alice", "Policy": {"EnableAllFolders": true}},
+				{"Id": "b2", "Name": "bob", "Policy": {"EnableAllFolders": false, "EnabledFolders": ["movies", "shows"]}},
+				{"Id": "c3", "Name": "carol", "Policy": {"EnableAllFolders": false, "EnabledFolders": ["movies", "deleted"]}}
+			]`,
+			wantShared: 3,
+			wantShares: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Library/MediaFolders": rawJSON(folders),
+				"/Users":                rawJSON(tt.users),
+			}, "--sharing-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchSharing(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := rec.Value("shared_libraries_total"); got != tt.wantShared {
+				t.Errorf("shared_libraries_total = %v, want %v", got, tt.wantShared)
+			}
+			if got, _ := rec.Value("library_shares_total"); got != tt.wantShares {
+				t.Errorf("library_shares_total = %v, want %v", got, tt.wantShares)
+			}
+		})
+	}
+}
+
+func TestFetchVirtualFolders(t *testing.T) {
+	folders := `[
+		{"Name": "Movies", "ItemId": "f1", "CollectionType": "movies", "Locations": ["/media/movies"]},
+		{"Name": "TV Shows", "ItemId": "f2", "CollectionType": "tvshows", "Locations": ["/media/tv", "/media/tv2"]},
+		{"Name": "Old Shares", "CollectionType": "mixed", "Locations": ["/mnt/a", "/mnt/b", "/mnt/c"]}
+	]`
+	counts := map[string]float64{"f1": 812, "f2": 4390}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Library/VirtualFolders": rawJSON(folders),
+		"/Items": func(w http.ResponseWriter, r *http.Request) {
+			jsonResponse(jellyfin.ItemsResponse{TotalRecordCount: counts[r.URL.Query().Get("ParentId")]})(w, r)
+		},
+	})
+	rec := NewTestRecorder()
+	err := c.fetchVirtualFolders(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := rec.Value("virtual_folders_total"); got != 3 {
+		t.Errorf("virtual_folders_total = %v, want 3", got)
+	}
+	// folders without an item id count their locations
+	want := map[string]float64{"Movies": 812, "TV_Shows": 4390, "Old_Shares": 3}
+	if n := countSeries(rec, "virtual_folder_item_count"); n != len(want) {
+		t.Errorf("virtual_folder_item_count has %d series, want %d: %v", n, len(want), rec.Values)
+	}
+	for folder, count := range want {
+		if got, _ := rec.Value("virtual_folder_item_count", folder); got != count {
+			t.Errorf("virtual_folder_item_count{%s} = %v, want %v", folder, got, count)
+		}
+	}
+}
+
+func TestFetchLibraryItemCounts(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	folders := `[
+		{"Name": "Movies", "ItemId": "f1", "CollectionType": "movies"},
+		{"Name": "TV Shows", "ItemId": "f2", "CollectionType": "tvshows"},
+		{"Name": "Music", "ItemId": "f3", "CollectionType": "music"},
+		{"Name": "Home Videos", "ItemId": "f4", "CollectionType": "homevideos"},
+		{"Name": "Unindexed", "CollectionType": "movies"}
+	]`
+	counts := map[string]float64{
+		"f1/Movie": 812, "f2/Series": 61, "f2/Episode": 4390, "f3/MusicAlbum": 120, "f3/Audio": 1544, "f4/Movie": 3,
+	}
+	want := map[[2]string]float64{
+		{"Movies", "Movie"}: 812, {"TV_Shows", "Series"}: 61, {"TV_Shows", "Episode"}: 4390,
+		{"Music", "MusicAlbum"}: 120, {"Music", "Audio"}: 1544,
+		// libraries of other types count every type
+		{"Home_Videos", "Movie"}: 3, {"Home_Videos", "Series"}: 0, {"Home_Videos", "Episode"}: 0,
+		{"Home_Videos", "MusicAlbum"}: 0, {"Home_Videos", "Audio"}: 0, {"Home_Videos", "MusicVideo"}: 0,
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantErr      bool
+		wantInflight int64
+	}{
+		{name: "parallel", args: []string{"--library-fetch-concurrency=4", "--library-fetch-timeout=5s"}, wantInflight: 4},
+		{name: "sequential", args: []string{"--library-fetch-concurrency=1", "--library-fetch-timeout=5s"}, wantInflight: 1},
+		{name: "library timeout", args: []string{"--library-fetch-timeout=10ms"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inflight, maxInflight atomic.Int64
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Library/VirtualFolders": rawJSON(folders),
+				"/Items": func(w http.ResponseWriter, r *http.Request) {
+					n := inflight.Add(1)
+					defer inflight.Add(-1)
+					for max := maxInflight.Load(); n > max && !maxInflight.CompareAndSwap(max, n); max = maxInflight.Load() {
+					}
+					select {
+					case <-time.After(delay):
+					case <-r.Context().Done():
+						return
+					}
+					query := r.URL.Query()
+					count := counts[query.Get("ParentId")+"/"+query.Get("IncludeItemTypes")]
+					jsonResponse(jellyfin.ItemsResponse{TotalRecordCount: count})(w, r)
+				},
+			}, tt.args...)
+
+			rec := NewTestRecorder()
+			err := c.fetchLibraryItemCounts(context.Background(), *c.client, rec)
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("error %v, want the library timeout", err)
+				}
+				if n := countSeries(rec, "library_item_count"); n != 0 {
+					t.Errorf("recorded %d library_item_count series of a failed fetch", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := maxInflight.Load(); got != tt.wantInflight {
+				t.Errorf("%d libraries counted at once, want %d", got, tt.wantInflight)
+			}
+			if n := countSeries(rec, "library_item_count"); n != len(want) {
+				t.Errorf("library_item_count has %d series, want %d: %v", n, len(want), rec.Values)
+			}
+			for key, count := range want {
+				if got, _ := rec.Value("library_item_count", key[0], key[1]); got != count {
+					t.Errorf("library_item_count{%s, %s} = %v, want %v", key[0], key[1], got, count)
+				}
+			}
+		})
+	}
+}
+
+func TestItemsAddedPerDay(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days float64) time.Time { return now.Add(-time.Duration(days * float64(24*time.Hour))) }
+	var items []jellyfin.Item
+	for i := 0; i < 14; i++ {
+		items = append(items, jellyfin.Item{Type: "Movie", DateCreated: daysAgo(float64(i) / 2)})
+	}
+	items = append(items,
+		jellyfin.Item{Type: "Episode", DateCreated: daysAgo(1)},
+		jellyfin.Item{Type: "Episode", DateCreated: daysAgo(6.9)},
+		// outside of the window
+		jellyfin.Item{Type: "Episode", DateCreated: daysAgo(7.1)},
+		jellyfin.Item{Type: "Movie", DateCreated: daysAgo(30)},
+		jellyfin.Item{Type: "Movie", DateCreated: now.Add(time.Hour)},
+	)
+
+	got := itemsAddedPerDay(items, now, 7)
+	want := map[string]float64{"Movie": 2, "Episode": 2.0 / 7}
+	if len(got) != len(want) {
+		t.Errorf("itemsAddedPerDay = %v, want %v", got, want)
+	}
+	for itemType, average := range want {
+		if got[itemType] != average {
+			t.Errorf("itemsAddedPerDay[%s] = %v, want %v", itemType, got[itemType], average)
+		}
+	}
+}
+
+func TestFetchIngestRate(t *testing.T) {
+	var query url.Values
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items": func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			jsonResponse(jellyfin.ItemsResponse{Items: []jellyfin.Item{
+				{Type: "Movie", DateCreated: time.Now().Add(-time.Hour)},
+				{Type: "Series", DateCreated: time.Now().Add(-48 * time.Hour)},
+			}})(w, r)
+		},
+	}, "--ingest-rate-metrics-enabled")
+	rec := NewTestRecorder()
+	err := c.fetchIngestRate(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query.Get("SortOrder") != "Descending" || query.Get("Limit") != "1000" {
+		t.Errorf("items requested with %v, want the 1000 newest", query)
+	}
+	for mediaType, want := range map[string]float64{"Movie": 1.0 / 7, "Series": 1.0 / 7, "Episode": 0, "Audio": 0} {
+		got, ok := rec.Value("items_added_per_day_7d_avg", mediaType)
+		if !ok || got != want {
+			t.Errorf("items_added_per_day_7d_avg{%s} = %v, want %v", mediaType, got, want)
+		}
+	}
+}
+
+func TestFileExtension(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/media/movies/Heat (1995)/Heat.mkv", "mkv"},
+		{"/media/movies/Alien.MP4", "mp4"},
+		{"/media/music/01 - Intro.Flac", "flac"},
+		{"/media/shows/show.s01e01.avi", "avi"},
+		{"/media/movies/video_ts/VIDEO_TS", "none"},
+		{"/media/movies.old/README", "none"},
+	}
+	for _, tt := range tests {
+		if got := fileExtension(tt.path); got != tt.want {
+			t.Errorf("fileExtension(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFetchFileExtensions(t *testing.T) {
+	items := []jellyfin.Item{
+		{Path: "/media/a.mkv"}, {Path: "/media/b.MKV"}, {Path: "/media/c.mp4"},
+		{Path: "/media/BDMV"},
+		// items without a file, such as virtual episodes
+		{},
+	}
+	// the rarest extensions beyond maxFileExtensions are counted as other
+	for i := 0; i < maxFileExtensions+3; i++ {
+		items = append(items, jellyfin.Item{Path: fmt.Sprintf("/media/rare.x%02d", i)})
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": itemPages(items)}, "--file-extension-metrics-enabled")
+	rec := NewTestRecorder()
+	err := c.fetchFileExtensions(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countSeries(rec, "library_file_extension_total"); n != maxFileExtensions+1 {
+		t.Errorf("library_file_extension_total has %d series, want %d", n, maxFileExtensions+1)
+	}
+	for extension, want := range map[string]float64{"mkv": 2, "mp4": 1, "none": 1, "x00": 1, "other": 6} {
+		if got, _ := rec.Value("library_file_extension_total", extension); got != want {
+			t.Errorf("library_file_extension_total{%s} = %v, want %v", extension, got, want)
+		}
+	}
+}
+
+func TestFetchRecentlyAdded(t *testing.T) {
+	added := func(itemType string, age time.Duration) jellyfin.Item {
+		return jellyfin.Item{Type: itemType, DateCreated: time.Now().UTC().Add(-age)}
+	}
+	tests := []struct {
+		name     string
+		items    []jellyfin.Item
+		wantDay  map[string]float64
+		wantWeek map[string]float64
+	}{
+		{"none", nil, map[string]float64{"Movie": 0, "Series": 0}, map[string]float64{"Movie": 0, "Series": 0}},
+		{
+			name: "varying ages",
+			items: []jellyfin.Item{
+				added("Movie", time.Hour),
+				added("Movie", 23*time.Hour),
+				added("Movie", 3*24*time.Hour),
+				added("Series", 2*time.Hour),
+				added("Series", 6*24*time.Hour),
+				added("Movie", 8*24*time.Hour),
+				added("Series", 30*24*time.Hour),
+			},
+			wantDay:  map[string]float64{"Movie": 2, "Series": 1},
+			wantWeek: map[string]float64{"Movie": 3, "Series": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query url.Values
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items": func(w http.ResponseWriter, r *http.Request) {
+					query = r.URL.Query()
+					jsonResponse(jellyfin.ItemsResponse{Items: tt.items})(w, r)
+				},
+			})
+			rec := NewTestRecorder()
+			err := c.fetchRecentlyAdded(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if query.Get("SortBy") != "DateCreated" || query.Get("SortOrder") != "Descending" || query.Get("Limit") != "200" {
+				t.Errorf("items requested with %v, want the 200 newest", query)
+			}
+			for metric, want := range map[string]map[string]float64{
+				"items_added_last_day_total":  tt.wantDay,
+				"items_added_last_week_total": tt.wantWeek,
+			} {
+				for mediaType, count := range want {
+					if got, ok := rec.Value(metric, mediaType); !ok || got != count {
+						t.Errorf("%s{%s} = %v, %v, want %v", metric, mediaType, got, ok, count)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFetchLiveTVChannels(t *testing.T) {
+	channels := `{"Items": [
+		{"Name": "News 24", "ChannelNumber": "5.1", "Tags": ["News"]},
+		{"Name": "World News", "ChannelNumber": "7", "Tags": ["News", "HD"]},
+		{"Name": "Five", "ChannelNumber": "5.2"},
+		{"Name": "Five HD", "ChannelNumber": "5.3", "Tags": [""]},
+		{"Name": "Radio"}
+	], "TotalRecordCount": 5}`
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantTotal float64
+		wantOK    bool
+		want      map[string]float64
+		wantErr   bool
+	}{
+		{
+			name:      "available",
+			handler:   rawJSON(channels),
+			wantTotal: 5,
+			wantOK:    true,
+			want:      map[string]float64{"News": 2, "5": 2, "none": 1},
+		},
+		// servers without live tv
+		{name: "unavailable", handler: statusResponse(http.StatusNotFound)},
+		{name: "failing", handler: statusResponse(http.StatusInternalServerError), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query url.Values
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/LiveTv/Channels": func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query()
+				tt.handler(w, r)
+			}}, "--livetv-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchLiveTVChannels(context.Background(), *c.client, rec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchLiveTVChannels error %v, want error %v", err, tt.wantErr)
+			}
+
+			if query.Get("IsMovie") != "false" || query.Get("IsSeries") != "false" {
+				t.Errorf("channels requested with %v, want IsMovie=false and IsSeries=false", query)
+			}
+			if got, ok := rec.Value("iptv_channels_total"); ok != tt.wantOK || got != tt.wantTotal {
+				t.Errorf("iptv_channels_total = %v, %v, want %v, %v", got, ok, tt.wantTotal, tt.wantOK)
+			}
+			if n := countSeries(rec, "iptv_channels_by_group_total"); n != len(tt.want) {
+				t.Errorf("iptv_channels_by_group_total has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for group, count := range tt.want {
+				if got, _ := rec.Value("iptv_channels_by_group_total", group); got != count {
+					t.Errorf("iptv_channels_by_group_total{%s} = %v, want %v", group, got, count)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchTrailers(t *testing.T) {
+	movies := []jellyfin.Item{
+		{Name: "Heat", LocalTrailerCount: 1},
+		{Name: "Alien", LocalTrailerCount: 3},
+		{Name: "Ronin"},
+		{Name: "Thief"},
+		{Name: "Collateral"},
+	}
+	var itemTypes string
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+		itemTypes = r.URL.Query().Get("IncludeItemTypes")
+		itemPages(movies)(w, r)
+	}}, "--trailer-metrics-enabled")
+	rec := NewTestRecorder()
+	err := c.fetchTrailers(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if itemTypes != "Movie" {
+		t.Errorf("items requested of type %q, want Movie", itemTypes)
+	}
+	if got, _ := rec.Value("movies_with_trailer_total"); got != 2 {
+		t.Errorf("movies_with_trailer_total = %v, want 2", got)
+	}
+	if got, _ := rec.Value("movies_without_trailer_total"); got != 3 {
+		t.Errorf("movies_without_trailer_total = %v, want 3", got)
+	}
+}
+
+func TestScheduledTasksByState(t *testing.T) {
+	tasks := `[
+		{"Name": "Scan Media Library", "State": "Running"},
+		{"Name": "Extract Chapter Images", "State": "Running"},
+		{"Name": "Clean Cache Directory", "State": "Idle"},
+		{"Name": "Clean Log Directory", "State": "Idle"},
+		{"Name": "Refresh People", "State": "Idle"},
+		{"Name": "Download missing subtitles", "State": "Cancelling"}
+	]`
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/ScheduledTasks": rawJSON(tasks)})
+	rec := NewTestRecorder()
+	err := c.fetchScheduledTasks(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := rec.Value("scheduled_tasks_total"); got != 6 {
+		t.Errorf("scheduled_tasks_total = %v, want 6", got)
+	}
+	want := map[string]float64{"Running": 2, "Idle": 3, "Cancelling": 1}
+	if n := countSeries(rec, "scheduled_tasks_by_state_total"); n != len(want) {
+		t.Errorf("scheduled_tasks_by_state_total has %d series, want %d: %v", n, len(want), rec.Values)
+	}
+	for state, count := range want {
+		if got, _ := rec.Value("scheduled_tasks_by_state_total", state); got != count {
+			t.Errorf("scheduled_tasks_by_state_total{%s} = %v, want %v", state, got, count)
+		}
+	}
+}
+
+func TestFetchUnidentifiedItems(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts map[string]int
+		want   map[string]float64
+	}{
+		{
+			name:   "unidentified items",
+			counts: map[string]int{"Movie": 3, "Episode": 12},
+			want:   map[string]float64{"Movie": 3, "Series": 0, "Episode": 12, "Audio": 0},
+		},
+		{
+			name: "everything identified",
+			want: map[string]float64{"Movie": 0, "Series": 0, "Episode": 0, "Audio": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items": func(w http.ResponseWriter, r *http.Request) {
+					query := r.URL.Query()
+					if query.Get("IsUnidentified") != "true" || query.Get("Recursive") != "true" || query.Get("Limit") != "0" {
+						t.Errorf("query %q doesn't count the unidentified items", r.URL.RawQuery)
+					}
+					// only the count is returned, the items aren't enumerated
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprintf(w, `{"Items": [], "TotalRecordCount": %d}`, tt.counts[query.Get("IncludeItemTypes")])
+				},
+			})
+			rec := NewTestRecorder()
+			if err := c.fetchUnidentifiedItems(context.Background(), *c.client, rec); err != nil {
+				t.Fatal(err)
+			}
+			for mediaType, want := range tt.want {
+				if got, ok := rec.Value("items_unidentified_total", mediaType); !ok || got != want {
+					t.Errorf("items_unidentified_total{%s} = %v, want %v", mediaType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchItemCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		counts    string
+		wantTotal float64
+	}{
+		{
+			name: "every type",
+			counts: `{"movieCount": 120, "seriesCount": 15, "episodeCount": 600, "songCount": 3000,
+				"albumCount": 250, "artistCount": 80, "bookCount": 12, "musicVideoCount": 4}`,
+			wantTotal: 4081,
+		},
+		{
+			// programs, trailers and box sets aren't library items, itemCount
+			// is a total of its own
+			name: "not counted",
+			counts: `{"movieCount": 2, "programCount": 500, "trailerCount": 30,
+				"boxSetCount": 3, "itemCount": 999}`,
+			wantTotal: 2,
+		},
+		{name: "empty library", counts: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items/Counts": rawJSON(tt.counts)})
+			rec := NewTestRecorder()
+			if err := c.fetchItemCounts(context.Background(), *c.client, rec); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := rec.Value("items_total"); !ok || got != tt.wantTotal {
+				t.Errorf("items_total = %v, want %v", got, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestFetchIntroMarkers(t *testing.T) {
+	intro := []jellyfin.Chapter{{Name: "Prologue"}, {Name: " Intro "}, {Name: "Episode"}}
+	tests := []struct {
+		name        string
+		episodes    []jellyfin.Item
+		wantWith    float64
+		wantWithout float64
+		wantPages   int
+	}{
+		{"no episodes", nil, 0, 0, 1},
+		{
+			name: "detected and undetected intros",
+			episodes: []jellyfin.Item{
+				{ID: "1", Chapters: intro},
+				{ID: "2", Chapters: []jellyfin.Chapter{{Name: "Chapter 1"}}},
+				{ID: "3"},
+				{ID: "4", Chapters: []jellyfin.Chapter{{Name: "intro"}}},
+				{ID: "5", Chapters: intro},
+			},
+			wantWith:    3,
+			wantWithout: 2,
+			wantPages:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// pages of two episodes, the last page is partial
+			pages := 0
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+				pages++
+				itemPages(tt.episodes)(w, r)
+			}}, "--page-size=2")
+			rec := NewTestRecorder()
+			err := c.fetchIntroMarkers(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := rec.Value("episodes_with_intro_data_total"); got != tt.wantWith {
+				t.Errorf("episodes_with_intro_data_total = %v, want %v", got, tt.wantWith)
+			}
+			if got, _ := rec.Value("episodes_without_intro_data_total"); got != tt.wantWithout {
+				t.Errorf("episodes_without_intro_data_total = %v, want %v", got, tt.wantWithout)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("%d pages requested, want %d", pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestAlbumTrackRatio(t *testing.T) {
+	tracks := func(numbers ...[2]int) []jellyfin.Item {
+		var items []jellyfin.Item
+		for _, n := range numbers {
+			items = append(items, jellyfin.Item{ParentIndexNumber: n[0], IndexNumber: n[1]})
+		}
+		return items
+	}
+	tests := []struct {
+		name   string
+		tracks []jellyfin.Item
+		want   float64
+	}{
+		{"complete", tracks([2]int{1, 1}, [2]int{1, 2}, [2]int{1, 3}), 1},
+		{"partial", tracks([2]int{1, 1}, [2]int{1, 4}), 0.5},
+		{"partial second disc", tracks([2]int{1, 1}, [2]int{1, 2}, [2]int{2, 1}, [2]int{2, 4}), 4.0 / 6},
+		{"without track numbers", tracks([2]int{0, 0}, [2]int{0, 0}), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := albumTrackRatio(tt.tracks)
+			if got != tt.want {
+				t.Errorf("albumTrackRatio = %v, want %v", got, tt.want)
+			}
+			if got <= 0 || got > 1 {
+				t.Errorf("albumTrackRatio = %v, not in (0, 1]", got)
+			}
+		})
+	}
+}
+
+func TestFetchAlbumCompleteness(t *testing.T) {
+	albums := []jellyfin.Item{
+		{ID: "a1", Name: "Greatest Hits", AlbumArtist: "Queen"},
+		{ID: "a2", Name: "Greatest Hits", AlbumArtist: "ABBA"},
+		{ID: "a3", Name: "Empty"},
+	}
+	tracks := map[string][]jellyfin.Item{
+		"a1": {{IndexNumber: 1}, {IndexNumber: 2}, {IndexNumber: 3}},
+		"a2": {{IndexNumber: 1}, {IndexNumber: 2}, {IndexNumber: 8}},
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Items": func(w http.ResponseWriter, r *http.Request) {
+		if parent := r.URL.Query().Get("ParentId"); parent != "" {
+			itemPages(tracks[parent])(w, r)
+			return
+		}
+		itemPages(albums)(w, r)
+	}}, "--page-size=2")
+
+	rec := NewTestRecorder()
+	err := c.fetchAlbumCompleteness(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"music_album_track_ratio{Greatest_Hits,Queen,a1}": 1,
+		"music_album_track_ratio{Greatest_Hits,ABBA,a2}":  3.0 / 8,
+	}
+	if len(rec.Values) != len(want) {
+		t.Errorf("recorded %v, want %v", rec.Values, want)
+	}
+	for key, value := range want {
+		if got, ok := rec.Values[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestFetchSeriesCompletion(t *testing.T) {
+	series := []jellyfin.Item{
+		{ID: "s1", Name: "Battlestar Galactica"},
+		{ID: "s2", Name: "Battlestar Galactica"},
+		{ID: "s3", Name: "Complete"},
+		{ID: "s4", Name: "Unknown"},
+	}
+	// present and missing episodes per series
+	episodes := map[string][2]float64{
+		"s1": {17, 7},
+		"s2": {60, 15},
+		"s3": {10, 0},
+	}
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items": itemPages(series),
+		"/Shows/": func(w http.ResponseWriter, r *http.Request) {
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/Shows/"), "/Episodes")
+			count := episodes[id][0]
+			if r.URL.Query().Get("IsMissing") == "true" {
+				count = episodes[id][1]
+			}
+			jsonResponse(jellyfin.ItemsResponse{TotalRecordCount: count})(w, r)
+		},
+	})
+
+	rec := NewTestRecorder()
+	err := c.fetchSeriesCompletion(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"series_completion_ratio{Battlestar_Galactica,s1}": 17.0 / 24,
+		"series_completion_ratio{Battlestar_Galactica,s2}": 0.8,
+		"series_completion_ratio{Complete,s3}":             1,
+	}
+	if len(rec.Values) != len(want) {
+		t.Errorf("recorded %v, want %v", rec.Values, want)
+	}
+	for key, value := range want {
+		if got, ok := rec.Values[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
@@ -2,21 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/jessevdk/go-flags"
 	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
@@ -24,22 +32,6 @@ var (
 	log     *logrus.Entry
 )
 
-type ExporterConfig struct {
-	LogLevel  string `long:"log-level" description:"log verbosity level (trace, debug, info, warn, error, fatal)" env:"LOG_LEVEL" default:"info"`
-	Namespace string `long:"namespace" description:"metric name prefix" default:"jellyfin" env:"METRIC_NAMESPACE"`
-	Listen    string `short:"l" long:"listen" description:"host:port to listen on" default:":9453" env:"LISTEN"`
-	Host      string `short:"h" long:"host" description:"jellyfin host to export metrics for" required:"true" env:"HOST"`
-	APIKey    string `short:"u" long:"apikey" description:"jellyfin apikey for auth" required:"true" env:"API_KEY"`
-}
-
-type JellyfinGetCollector struct {
-	Config *ExporterConfig
-
-	version     *prom.Desc
-	movieCount  *prom.Desc
-	seriesCount *prom.Desc
-}
-
 func init() {
 	log = logrus.WithContext(context.Background())
 	log.Logger.SetOutput(os.Stderr)
@@ -50,9 +42,25 @@ func init() {
 }
 
 func main() {
+	// subcommands print generated files and exit
+	subcommands := map[string]func([]string, io.Writer) error{
+		"dashboard": runDashboard,
+		"alerts":    runAlerts,
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			err := run(os.Args[2:], os.Stdout)
+			if err != nil {
+				log.WithError(err).Fatal(os.Args[1])
+			}
+			return
+		}
+	}
+
 	var config ExporterConfig
 	parser := flags.NewParser(&config, flags.HelpFlag|flags.PassDoubleDash)
 	parser.Groups()[0].ShortDescription = "Options"
+	applyEnvPrefix(parser.Groups(), envPrefix)
 	_, err := parser.Parse()
 	if err != nil {
 		var flagsErr *flags.Error
@@ -66,34 +74,163 @@ func main() {
 		}
 	}
 
-	level, err := logrus.ParseLevel(config.LogLevel)
+	if config.ConfigDiff {
+		defaults, err := defaultConfig()
+		if err != nil {
+			log.WithError(err).Fatal("parse default options")
+		}
+		err = writeConfigDiff(os.Stdout, &config, defaults)
+		if err != nil {
+			log.WithError(err).Fatal("write config diff")
+		}
+		os.Exit(0)
+	}
+
+	if config.Host == "" && config.ConsulAddress == "" {
+		log.Fatal("--host is required without --consul-address")
+	}
+	if config.APIKeyFile != "" {
+		if config.APIKey != "" {
+			log.Warn("--apikey and --apikey-file are both set, using the key in --apikey-file")
+		}
+		config.APIKey, err = readAPIKeyFile(config.APIKeyFile)
+		if err != nil {
+			log.WithError(err).Fatal("read --apikey-file")
+		}
+	}
+	err = checkAuth(&config)
 	if err != nil {
-		log.WithError(err).Warnf("invalid log level")
-	} else {
-		log.Logger.SetLevel(level)
+		log.WithError(err).Fatal("parse flags")
 	}
-	log.Info("jellyfin-exporter version " + Version)
 
-	collector := NewJellyfinGetCollector(&config)
-	prom.MustRegister(collector)
+	err = validateConfig(&config)
+	if err != nil {
+		log.WithError(err).Fatal("invalid config")
+	}
+	if config.ValidateConfig {
+		fmt.Println("Config OK")
+		os.Exit(0)
+	}
 
-	// Test if the host responds
-	var response struct {
-		Version string `json:"version"`
+	level, _ := logrus.ParseLevel(config.LogLevel)
+	log.Logger.SetLevel(level)
+	log.Info("jellyfin-exporter version " + Version)
+
+	var deadLetters io.Writer
+	if config.DeadLetterFile != "" {
+		file, err := os.OpenFile(config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.WithError(err).Fatal("open --dead-letter-file")
+		}
+		defer file.Close()
+		deadLetters = file
+	}
+	var countries countryResolver
+	if config.GeoIPEnabled && config.GeoIPDB == "" {
+		log.Warn("--geoip-enabled without --geoip-db, not exporting sessions per country")
+	} else if config.GeoIPEnabled {
+		database, err := openGeoIPDatabase(config.GeoIPDB)
+		if err != nil {
+			log.WithError(err).Fatal("open --geoip-db")
+		}
+		defer database.Close()
+		countries = database
+	}
+	setup := func(config *ExporterConfig) (*JellyfinGetCollector, error) {
+		return setupCollector(config, deadLetters, countries)
 	}
-	err = collector.getAPI("/System/Info", &response)
+
+	assertions, err := parseAssertions(config.AssertMetrics)
 	if err != nil {
-		log.WithError(err).Warn("failed to get jellyfin version")
+		log.WithError(err).Fatal("invalid --assert-metric")
+	}
+	if config.TopNItems > maxTopNItems || config.TopNSeries > maxTopNItems {
+		log.Warnf("--top-n-items and --top-n-series are limited to %d", maxTopNItems)
+	}
+
+	if config.StartupDelay > 0 {
+		log.Infof("waiting %s for jellyfin to start", config.StartupDelay)
+		time.Sleep(config.StartupDelay)
+	}
+
+	// targets returns the collectors of the Jellyfin hosts, discovered from
+	// Consul or the single --host
+	var targets func() []*JellyfinGetCollector
+	var ready http.HandlerFunc
+	if config.ConsulAddress != "" {
+		manager := NewCollectorManager(&config, setup)
+		err = manager.Refresh(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("failed to discover jellyfin instances from consul")
+		}
+		go manager.Watch(context.Background(), config.ConsulRefreshInterval)
+		targets = manager.Collectors
+		ready = manager.readinessHandler()
 	} else {
-		log.Infof("jellyfin version %s", response.Version)
+		collector, err := setup(&config)
+		if err != nil {
+			log.WithError(err).Fatal("invalid collector selection")
+		}
+		targets = func() []*JellyfinGetCollector { return []*JellyfinGetCollector{collector} }
+		ready = collector.readinessHandler()
+	}
+
+	if len(assertions) > 0 {
+		ok, err := runAssertions(context.Background(), targets(), assertions, os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("collect metrics")
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if config.BackgroundHealthProbe {
+		go runHealthProbes(context.Background(), config.HealthCheckInterval, targets)
 	}
 
-	promHandler := promhttp.Handler()
-	var metrics http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
-		log.WithField("remote", r.RemoteAddr).
-			Info(fmt.Sprintf("%s %s", r.Method, r.URL.Path))
-		promHandler.ServeHTTP(w, r)
+	newGatherer := scrapeGatherer(&config, targets)
+	if config.RemoteWriteURL != "" {
+		go runRemoteWrite(context.Background(), config.RemoteWriteURL, config.RemoteWriteInterval, config.Timeout, newGatherer)
 	}
+	if config.Watch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = runWatch(ctx, config.WatchInterval, config.Timeout, newGatherer, os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("write metrics")
+		}
+		return
+	}
+
+	last := &lastGather{}
+	metrics := promhttp.InstrumentMetricHandler(prom.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, config.Timeout))
+			defer cancel()
+			if config.OTel {
+				ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(r.Header))
+			}
+			gatherer := recordingGatherer{newGatherer(ctx), last}
+			if config.OutputFormat == "influxdb" {
+				families, err := gatherer.Gather()
+				if err != nil {
+					requestLog(ctx).WithError(err).Warn("gather metrics")
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				err = writeInfluxLines(w, families, time.Now())
+				if err != nil {
+					requestLog(ctx).WithError(err).Warn("write metrics")
+				}
+				return
+			}
+			// exemplars are only part of the OpenMetrics format
+			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+				EnableOpenMetrics: config.OTel,
+			}).ServeHTTP(w, r)
+		}),
+	)
 
 	var health http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 		log.Info("Healthcheck status ok")
@@ -104,109 +241,273 @@ func main() {
 		}
 	}
 
-	log.Info("serving metrics at " + config.Listen)
+	listen, err := listenAddress(config.Listen, config.ListenV6)
+	if err != nil {
+		log.WithError(err).Fatal("invalid listen address")
+	}
+	log.Info("serving metrics at " + listen)
 
 	http.Handle("/metrics", metrics)
 	http.Handle("/_health", health)
+	http.Handle("/_ready", ready)
+	if config.EnableAPI {
+		http.Handle("/api/v1/metrics/", last.apiHandler(config.Timeout, newGatherer))
+	}
+	if config.ActivityWebhook {
+		http.Handle("/ingest/activity", activityWebhookHandler(config.ActivityWebhookSecret, targets))
+	}
+	if config.EnableDebugEndpoints {
+		http.Handle("/debug/collector", debugCollectorHandler(targets))
+	}
+
+	var mux http.Handler = http.DefaultServeMux
+	var tlsConfig *tls.Config
+	if config.TLSClientCA != "" {
+		tlsConfig, err = clientCATLSConfig(config.TLSClientCA)
+		if err != nil {
+			log.WithError(err).Fatal("load tls client ca")
+		}
+		mux = requireClientCert(mux)
+	}
 
-	err = http.ListenAndServe(config.Listen, nil) //nolint:gosec
+	server := newServer(&config, listen, mux, tlsConfig)
+	if config.TLSCert != "" {
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.WithError(err).Panic("listenandserve")
 	}
 }
 
-func NewJellyfinGetCollector(config *ExporterConfig) *JellyfinGetCollector {
-	return &JellyfinGetCollector{
-		Config: config,
-
-		version: prom.NewDesc(
-			prom.BuildFQName(config.Namespace, "", "version"),
-			"always 1. label 'version' contains Jellyfin server version",
-			[]string{"version"}, nil,
-		),
-		movieCount: prom.NewDesc(
-			prom.BuildFQName(config.Namespace, "", "movieCount"),
-			"Number of movies in the Library",
-			nil, nil,
-		),
-		seriesCount: prom.NewDesc(
-			prom.BuildFQName(config.Namespace, "", "seriesCount"),
-			"Number of series in the Library",
-			nil, nil,
-		),
+// newServer returns the server of the exporter listening at listen, serving
+// mux with the CORS headers, request ids and h2c support of config.
+func newServer(config *ExporterConfig, listen string, mux http.Handler, tlsConfig *tls.Config) *http.Server {
+	handler := traceRequests(allowOrigins(splitList(config.CORSOrigins), mux))
+	if config.EnableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	return &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ServerReadHeaderTimeout,
+		ReadTimeout:       config.ServerReadTimeout,
+		TLSConfig:         tlsConfig,
 	}
 }
 
-func (c *JellyfinGetCollector) getAPI(endpoint string, out interface{}) error {
-	host := strings.TrimRight(c.Config.Host, "/")
+type requestIDKey struct{}
 
-	u, err := url.Parse(host + endpoint)
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
 	if err != nil {
-		return err
+		log.WithError(err).Panic("generate request id")
 	}
-	log.WithField("url", u.String()).Debug("GET api")
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
+// requestLog returns a log entry carrying the request id stored in ctx, if any.
+func requestLog(ctx context.Context) *logrus.Entry {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return log.WithField("request_id", id)
 	}
+	return log
+}
+
+// traceRequests assigns every request an id, which is returned in the
+// X-Request-Id header and logged with every line related to the request.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		w.Header().Set("X-Request-Id", id)
+
+		reqLog := requestLog(ctx).WithField("remote", r.RemoteAddr)
+		reqLog.Info(fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(ctx))
+		reqLog.WithField("duration", time.Since(start)).
+			Info(fmt.Sprintf("%s %s done", r.Method, r.URL.Path))
+	})
+}
+
+// allowOrigins adds CORS headers to responses for requests from one of the
+// origins. No headers are added when origins is empty.
+func allowOrigins(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && containsString(origins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+// scrapeGatherer returns the gatherer of a scrape of the targets. Each
+// scrape gets its own registry so the collectors can make their api calls
+// with the context (and request id) of the incoming request.
+func scrapeGatherer(config *ExporterConfig, targets func() []*JellyfinGetCollector) func(ctx context.Context) prom.Gatherer {
+	// the process metrics of the default registry have no namespace, they are
+	// replaced by ones named like the exporter metrics, such as
+	// jellyfin_exporter_process_cpu_seconds_total
+	prom.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	process := collectors.NewProcessCollector(collectors.ProcessCollectorOpts{
+		Namespace: prom.BuildFQName(config.Namespace, "", "exporter"),
+	})
+	return func(ctx context.Context) prom.Gatherer {
+		registry := prom.NewRegistry()
+		for _, collector := range targets() {
+			registry.MustRegister(scrapeCollector{collector, ctx})
+		}
+		prom.WrapRegistererWith(instanceLabels(config), registry).MustRegister(process)
+		return prom.Gatherers{labelingGatherer{prom.DefaultGatherer, instanceLabels(config)}, registry}
+	}
+}
+
+// setupCollector creates the collector of config.Host, with the collectors
+// selected by the options and the features of its Jellyfin version.
+func setupCollector(config *ExporterConfig, deadLetters io.Writer, countries countryResolver) (*JellyfinGetCollector, error) {
+	collector := NewJellyfinGetCollector(config)
+	collector.deadLetters.out = deadLetters
+	collector.countries = countries
+
+	// Test if the host responds, its version decides which endpoints the
+	// collectors call
+	info, err := collector.client.GetSystemInfo(context.Background())
 	if err != nil {
-		return err
+		log.WithError(err).Warn("failed to get jellyfin version")
+	} else {
+		log.Infof("jellyfin version %s", info.Version)
+		collector.setLocalNetwork(info)
+		collector.features, err = featureDetector{}.Detect(info.Version)
+		if err != nil {
+			log.WithError(err).Warn("unknown jellyfin version, assuming all features are supported")
+		}
 	}
 
-	req.Header.Set("X-Emby-Token", c.Config.APIKey)
-	// @todo: fix this
-	resp, err := netClient.Do(req) //nolint:bodyclose
+	registry := NewCollectorRegistry()
+	registerCollectors(registry, collector)
+	err = registry.Select(splitList(config.EnableCollectors), splitList(config.DisableCollectors), config.DisableDefaultCollectors)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("jellyfin api response %d %s",
-			resp.StatusCode, http.StatusText(resp.StatusCode),
-		)
+	collector.collectors = registry.Enabled()
+
+	summary, err := json.Marshal(registry.Summary())
+	if err != nil {
+		log.WithError(err).Panic("marshal metric summary")
 	}
-	err = json.NewDecoder(resp.Body).Decode(out)
+	log.WithField("metrics", string(summary)).Info("metric summary")
+
+	collector.checkPermissions(context.Background())
+	return collector, nil
+}
+
+// clientCATLSConfig returns a tls config verifying client certificates
+// against the CAs in caFile. Connections without a certificate are still
+// accepted, rather than requiring one with tls.RequireAndVerifyClientCert,
+// so that probes can reach /_health and /_ready and requireClientCert can
+// answer the other requests with 401 instead of failing the handshake.
+func clientCATLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
 	}
 
-	return nil
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
 }
 
-func (c *JellyfinGetCollector) Collect(metrics chan<- prom.Metric) {
-	var wg sync.WaitGroup
-	wg.Add(2)
+// clientCertPaths are the path prefixes requireClientCert guards, the
+// endpoints serving metrics. Kubelets and load balancers call the probe
+// endpoints without client certificate.
+var clientCertPaths = []string{"/metrics", "/api/", "/debug/"}
 
-	go func() {
-		defer wg.Done()
-		var count map[string]float64
-		err := c.getAPI("/Items/Counts", &count)
-		if err != nil {
-			panic(err)
+// requireClientCert responds 401 to requests of clientCertPaths without a
+// verified client certificate.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guarded := false
+		for _, prefix := range clientCertPaths {
+			guarded = guarded || strings.HasPrefix(r.URL.Path, prefix)
 		}
+		if guarded && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readinessTimeout is the time Jellyfin has to answer a readiness check.
+const readinessTimeout = 2 * time.Second
 
-		metrics <- prom.MustNewConstMetric(c.movieCount, prom.GaugeValue, count["MovieCount"])
-		metrics <- prom.MustNewConstMetric(c.seriesCount, prom.GaugeValue, count["SeriesCount"])
-	}()
+// readinessHandler responds 200 if Jellyfin answers the readiness check
+// endpoint within readinessTimeout, and 503 otherwise.
+func (c *JellyfinGetCollector) readinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
 
-	go func() {
-		defer wg.Done()
-		var response struct {
-			Version string `json:"version"`
+		err := c.checkReadiness(ctx)
+		if err != nil {
+			requestLog(ctx).WithError(err).Warn("readiness check failed")
+			http.Error(w, "jellyfin unreachable", http.StatusServiceUnavailable)
+			return
 		}
-		err := c.getAPI("/System/Info", &response)
+		_, err = w.Write([]byte("OK"))
 		if err != nil {
-			panic(err)
+			requestLog(ctx).WithError(err).Warn("write readiness response")
 		}
-		metrics <- prom.MustNewConstMetric(c.version, prom.GaugeValue, 1, response.Version)
-	}()
+	}
+}
 
-	wg.Wait()
+// checkReadiness calls the --readiness-check-endpoint and records how long
+// it took.
+func (c *JellyfinGetCollector) checkReadiness(ctx context.Context) error {
+	start := time.Now()
+	err := c.client.Ping(ctx, c.Config.ReadinessEndpoint)
+	c.readinessDuration.Set(time.Since(start).Seconds())
+	return err
 }
 
-func (c *JellyfinGetCollector) Describe(descr chan<- *prom.Desc) {
-	descr <- c.version
-	descr <- c.movieCount
-	descr <- c.seriesCount
+// scrapeTimeoutFraction is the part of the Prometheus scrape timeout the
+// exporter uses, leaving time to send the response before Prometheus gives up.
+const scrapeTimeoutFraction = 0.9
+
+// scrapeTimeout returns the time a scrape may take, derived from the timeout
+// Prometheus sends with the request, or fallback if there is none.
+func scrapeTimeout(r *http.Request, fallback time.Duration) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return fallback
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		log.WithField("header", header).Warn("invalid X-Prometheus-Scrape-Timeout-Seconds")
+		return fallback
+	}
+	return time.Duration(seconds * scrapeTimeoutFraction * float64(time.Second))
 }
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/http2"
+)
+
+// testCert is a certificate with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert creates a certificate signed by parent, or self-signed if
+// parent is nil.
+func newTestCert(t *testing.T, name string, ca bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca := newTestCert(t, "test ca", true, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestCert(t, "client", false, ca)
+	untrusted := newTestCert(t, "untrusted", false, newTestCert(t, "other ca", true, nil))
+
+	mux := http.NewServeMux()
+	for _, path := range []string{"/metrics", "/_health", "/_ready", "/api/v1/metrics/up", "/debug/collector"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	server := httptest.NewUnstartedServer(requireClientCert(mux))
+	server.TLS, err = clientCATLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		cert       *testCert
+		path       string
+		wantStatus int
+	}{
+		{"metrics without certificate", nil, "/metrics", http.StatusUnauthorized},
+		{"api without certificate", nil, "/api/v1/metrics/up", http.StatusUnauthorized},
+		{"debug without certificate", nil, "/debug/collector", http.StatusUnauthorized},
+		{"health without certificate", nil, "/_health", http.StatusOK},
+		{"ready without certificate", nil, "/_ready", http.StatusOK},
+		{"metrics with certificate", client, "/metrics", http.StatusOK},
+		{"api with certificate", client, "/api/v1/metrics/up", http.StatusOK},
+		// the client only sends certificates of the CAs the server asks for
+		{"untrusted certificate", untrusted, "/metrics", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			if tt.cert != nil {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{tt.cert.tls}
+			}
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	var handlerID string
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID, _ = r.Context().Value(requestIDKey{}).(string)
+		requestLog(r.Context()).Info("collect")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	id := w.Header().Get("X-Request-Id")
+	if len(id) != 36 || id != handlerID {
+		t.Fatalf("X-Request-Id %q, handler saw %q", id, handlerID)
+	}
+	entries := hook.AllEntries()
+	if len(entries) != 3 {
+		t.Fatalf("%d log entries, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Data["request_id"] != id {
+			t.Errorf("log entry %q has request_id %v, want %s", entry.Message, entry.Data["request_id"], id)
+		}
+	}
+
+	// every request gets its own id
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, httptest.NewRequest("GET", "/metrics", nil))
+	if w2.Header().Get("X-Request-Id") == id {
+		t.Error("two requests got the same request id")
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	config := testConfig(t, "--server-read-header-timeout=100ms", "--server-read-timeout=5s")
+	server := newServer(config, "127.0.0.1:0", http.NotFoundHandler(), nil)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the headers never end
+	_, err = conn.Write([]byte("GET /metrics HTTP/1.1\r\nHost: exporter\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(4 * time.Second))
+	_, err = io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow header sender terminated after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantH2C bool
+	}{
+		{"enabled", []string{"--enable-h2c"}, true},
+		{"disabled", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, tt.args...)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("jellyfin_up 1\n"))
+			})
+			server := httptest.NewServer(newServer(config, "", handler, nil).Handler)
+			defer server.Close()
+
+			h2c := &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}
+			resp, err := (&http.Client{Transport: h2c}).Get(server.URL + "/metrics")
+			if !tt.wantH2C {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("h2c scrape succeeded without --enable-h2c")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+					t.Errorf("h2c scrape: status %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+				}
+			}
+
+			// HTTP/1.1 clients are served either way
+			resp, err = server.Client().Get(server.URL + "/metrics")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+				t.Errorf("HTTP/1.1 scrape: status %d over %s, want 200 over HTTP/1.1", resp.StatusCode, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestAllowOrigins(t *testing.T) {
+	tests := []struct {
+		name       string
+		origins    []string
+		method     string
+		origin     string
+		wantAllow  string
+		wantStatus int
+	}{
+		{"matching origin", []string{"https://grafana.example", "https://other.example"}, "GET", "https://grafana.example", "https://grafana.example", http.StatusOK},
+		{"preflight", []string{"https://grafana.example"}, "OPTIONS", "https://grafana.example", "https://grafana.example", http.StatusNoContent},
+		{"other origin", []string{"https://grafana.example"}, "GET", "https://evil.example", "", http.StatusOK},
+		{"no origin", []string{"https://grafana.example"}, "GET", "", "", http.StatusOK},
+		{"no allowed origins", nil, "GET", "https://grafana.example", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := allowOrigins(tt.origins, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(tt.method, "/metrics", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.wantAllow)
+			}
+			wantMethods := ""
+			if tt.wantAllow != "" {
+				wantMethods = "GET"
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != wantMethods {
+				t.Errorf("Access-Control-Allow-Methods %q, want %q", got, wantMethods)
+			}
+		})
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"10", 9 * time.Second},
+		{"0.5", 450 * time.Millisecond},
+		{"", 15 * time.Second},
+		{"-1", 15 * time.Second},
+		{"soon", 15 * time.Second},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+		}
+		if got := scrapeTimeout(r, 15*time.Second); got != tt.want {
+			t.Errorf("scrapeTimeout(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestScrapeTimeoutHonored(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		},
+	}, "--timeout=10s")
+	library := NewLibraryCollector(c)
+	library.endpoints = library.endpoints[:1]
+	c.collectors = []Collector{library}
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.2")
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout(r, c.Config.Timeout))
+	defer cancel()
+
+	start := time.Now()
+	metrics := make(chan prom.Metric)
+	go func() {
+		c.collect(ctx, metrics)
+		close(metrics)
+	}()
+	for range metrics {
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("scrape took %v, want it cut off after about 180ms", elapsed)
+	}
+}
+
+// TestMain runs main instead of the tests when the test binary is started by
+// runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("JELLYFIN_EXPORTER_RUN_MAIN") == "1" {
+		os.Args = append([]string{"jellyfin-exporter"}, strings.Fields(os.Getenv("JELLYFIN_EXPORTER_ARGS"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the exporter with args, without the environment of the test,
+// and returns its exit code, stdout and stderr.
+func runMain(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = []string{"JELLYFIN_EXPORTER_RUN_MAIN=1", "JELLYFIN_EXPORTER_ARGS=" + strings.Join(args, " ")}
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.String(), stderr.String()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stdout.String(), stderr.String()
+}
+
+func TestValidateConfigFlag(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantOutput string
+	}{
+		{"valid", []string{"--host=http://jellyfin:8096", "--apikey=key"}, 0, "Config OK"},
+		{"missing host", []string{"--apikey=key"}, 1, "--host is required"},
+		{"missing api key", []string{"--host=http://jellyfin:8096"}, 1, "--apikey or --apikey-file is required without --use-session-auth"},
+		{"relative host", []string{"--host=jellyfin:8096", "--apikey=key"}, 1, "is not an absolute url"},
+		{"invalid log level", []string{"--host=http://jellyfin:8096", "--apikey=key", "--log-level=loud"}, 1, "--log-level"},
+		{"invalid duration", []string{"--host=http://jellyfin:8096", "--apikey=key", "--timeout=soon"}, 1, "timeout"},
+		{"invalid namespace", []string{"--host=http://jellyfin:8096", "--apikey=key", "--namespace=jelly-fin"}, 1, `invalid metric names "jelly-fin_`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runMain(t, append(tt.args, "--validate-config")...)
+			if code != tt.wantCode {
+				t.Fatalf("exit code %d, want %d: %s", code, tt.wantCode, stderr)
+			}
+			if !strings.Contains(stdout+stderr, tt.wantOutput) {
+				t.Errorf("output %q doesn't contain %q", stdout+stderr, tt.wantOutput)
+			}
+		})
+	}
+}
+
+// TestInvalidConfig checks that the exporter exits with the error of
+// validateConfig, like --validate-config, before calling Jellyfin.
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantOutput string
+	}{
+		{"invalid log level", []string{"--log-level=loud"}, "--log-level"},
+		{"webhook without secret", []string{"--activity-webhook-enabled"}, "--activity-webhook-enabled requires --activity-webhook-secret"},
+		{"library concurrency", []string{"--library-fetch-concurrency=0"}, "--library-fetch-concurrency must be at least 1"},
+		{"tls key missing", []string{"--tls-cert=cert.pem"}, "--tls-cert and --tls-key must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runMain(t, append([]string{"--host=http://jellyfin:8096", "--apikey=key"}, tt.args...)...)
+			if code != 1 {
+				t.Fatalf("exit code %d, want 1: %s", code, stderr)
+			}
+			if !strings.Contains(stdout+stderr, "invalid config") || !strings.Contains(stdout+stderr, tt.wantOutput) {
+				t.Errorf("output %q doesn't contain invalid config and %q", stdout+stderr, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		delay      time.Duration
+		status     int
+		wantStatus int
+	}{
+		{"pong", 0, http.StatusOK, http.StatusOK},
+		{"error", 0, http.StatusInternalServerError, http.StatusServiceUnavailable},
+		{"timeout", time.Second, http.StatusOK, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pinged atomic.Value
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/": func(w http.ResponseWriter, r *http.Request) {
+					pinged.Store(r.URL.Path)
+					select {
+					case <-time.After(tt.delay):
+					case <-r.Context().Done():
+						return
+					}
+					w.WriteHeader(tt.status)
+				},
+			})
+
+			// the request's deadline stands in for readinessTimeout
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			req := httptest.NewRequest(http.MethodGet, "/_ready", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+			c.readinessHandler()(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got, _ := pinged.Load().(string); got != "/System/Ping" {
+				t.Errorf("readiness check called %q, want /System/Ping", got)
+			}
+
+			var m dto.Metric
+			if err := c.readinessDuration.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			if m.GetGauge().GetValue() <= 0 {
+				t.Errorf("readiness_check_duration_seconds = %v", m.GetGauge().GetValue())
+			}
+		})
+	}
+}
+
+func TestProcessMetrics(t *testing.T) {
+	c := newTestCollector(t)
+	c.collectors = nil
+	gatherer := scrapeGatherer(c.Config, func() []*JellyfinGetCollector { return []*JellyfinGetCollector{c} })
+	families, err := gatherer(context.Background()).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			switch {
+			case metric.Gauge != nil:
+				values[family.GetName()] = metric.Gauge.GetValue()
+			case metric.Counter != nil:
+				values[family.GetName()] = metric.Counter.GetValue()
+			}
+		}
+	}
+	for _, name := range []string{"jellyfin_exporter_process_cpu_seconds_total", "jellyfin_exporter_process_resident_memory_bytes"} {
+		if _, ok := values[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if got := values["jellyfin_exporter_process_resident_memory_bytes"]; got <= 0 {
+		t.Errorf("jellyfin_exporter_process_resident_memory_bytes = %v, want a positive value", got)
+	}
+	// the unprefixed process metrics of the default registry are gone
+	for name := range values {
+		if strings.HasPrefix(name, "process_") {
+			t.Errorf("%s is exported next to the prefixed process metrics", name)
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	// jellyfin takes a while to start, like one started at the same time
+	const starting = 300 * time.Millisecond
+	tests := []struct {
+		name       string
+		delay      time.Duration
+		wantWarned bool
+	}{
+		{"no delay", 0, true},
+		{"delay", 2 * starting, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var firstCall atomic.Value
+			start := time.Now()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				firstCall.CompareAndSwap(nil, time.Now())
+				if r.URL.Path != "/System/Info" {
+					http.NotFound(w, r)
+					return
+				}
+				if time.Since(start) < starting {
+					http.Error(w, "starting", http.StatusServiceUnavailable)
+					return
+				}
+				rawJSON(`{"Version": "10.8.13"}`)(w, r)
+			}))
+			defer server.Close()
+
+			_, stdout, stderr := runMain(t, "--host="+server.URL, "--apikey=key",
+				"--startup-delay="+tt.delay.String(), "--assert-metric=jellyfin_exporter_inflight_scrapes>=0")
+			warned := strings.Contains(stdout+stderr, "failed to get jellyfin version")
+			if warned != tt.wantWarned {
+				t.Errorf("warned about the jellyfin version %v, want %v: %s", warned, tt.wantWarned, stderr)
+			}
+			first, ok := firstCall.Load().(time.Time)
+			if !ok {
+				t.Fatalf("jellyfin not called: %s", stderr)
+			}
+			if waited := first.Sub(start); waited < tt.delay {
+				t.Errorf("first api call after %v, want after the --startup-delay of %v", waited, tt.delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// metricInfo describes a metric exported by the collector.
+type metricInfo struct {
+	Name   string
+	Help   string
+	Labels []string
+}
+
+var metricInfos = []metricInfo{
+	{"version", "always 1. label 'version' contains Jellyfin server version", []string{"version"}},
+	{"server_address_info", "always 1. labels contain the local and wan address reported by Jellyfin", []string{"address_type", "address"}},
+	{"wan_address_info", "always 1. label 'address' contains the public address reported by Jellyfin, empty if it reports none", []string{"address"}},
+	{"target_info", "always 1. labels describe the Jellyfin server, to be joined with its other metrics", []string{"host", "version", "os", "arch"}},
+	{"system_encoder_info", "always 1. label 'encoder_version' contains the ffmpeg version taken from 'encoder_path'", []string{"encoder_version", "encoder_path"}},
+	{"system_info", "always 1. label 'dotnet_version' contains the .NET runtime version reported by Jellyfin", []string{"dotnet_version"}},
+	{"feature_compatibility", "always 1. label 'supported' is 1 if the Jellyfin version supports the metrics of 'feature', 0 if they are disabled", []string{"feature", "supported"}},
+	{"maintenance_mode", "1 if the Jellyfin server is in maintenance mode and refuses logins, 0 otherwise", nil},
+	{"movieCount", "Number of movies in the Library", nil},
+	{"seriesCount", "Number of series in the Library", nil},
+	{"items_total", "Number of movies, series, episodes, songs, albums, artists, books and music videos in the Library", nil},
+	{"remote_access_enabled", "1 if remote connections to the Jellyfin server are allowed, 0 otherwise", nil},
+	{"https_enabled", "1 if the Jellyfin server serves https, 0 otherwise", nil},
+	{"concurrent_stream_limit_configured", "Maximum number of concurrent streams configured on the Jellyfin server", nil},
+	{"subtitle_download_language_configured", "always 1. label 'language' is a language Jellyfin is configured to download subtitles in", []string{"language"}},
+	{"quick_connect_enabled", "1 if passwordless login with Quick Connect is enabled, 0 otherwise", nil},
+	{"api_keys_total", "Number of api keys created in the Jellyfin dashboard, for apps and service accounts", nil},
+	{"transcoding_hardware_acceleration_enabled", "1 if hardware acceleration is configured for transcoding, 0 otherwise", nil},
+	{"transcoding_hardware_acceleration_type", "always 1. label 'type' contains the configured hardware acceleration (nvenc, qsv, vaapi, none, ...)", []string{"type"}},
+	{"user_max_sessions_configured", "Number of sessions the user may have at the same time, 0 for no limit", []string{"username"}},
+	{"user_max_bitrate_configured_bits_per_second", "Maximum bitrate of remote streams of the user, 0 for no limit", []string{"username"}},
+	{"user_last_activity_timestamp_seconds", "Unix timestamp of the last activity of the user, 0 if the user has never been active", []string{"username"}},
+	{"users_by_auth_provider_total", "Number of users per authentication provider (local, ldap, custom)", []string{"auth_provider"}},
+	{"scheduled_tasks_total", "Number of scheduled tasks", nil},
+	{"scheduled_tasks_by_state_total", "Number of scheduled tasks per state (Idle, Running, Cancelling)", []string{"state"}},
+	{"library_scan_in_progress", "1 if a library scan is running, 0 otherwise", nil},
+	{"library_last_scan_timestamp_seconds", "Unix timestamp of when the last library scan finished, 0 if it has never run", nil},
+	{"notifications_unread_total", "Number of unread notifications of the api key user", nil},
+	{"series_completion_ratio", "Ratio of episodes present in the library to all known episodes of the series", []string{"series_name", "series_id"}},
+	{"music_album_track_ratio", "Ratio of tracks present in the library to the track count of the album", []string{"album_name", "artist_name", "album_id"}},
+	{"session_estimated_bandwidth_bits_per_second", "Estimated bandwidth of playing sessions, per user or per session with --per-session-bandwidth", []string{"session_id", "username"}},
+	{"sessions_by_protocol_total", "Number of playing sessions per streaming protocol (hls, dash, progressive, other)", []string{"protocol"}},
+	{"streams_by_media_type_total", "Number of sessions per type of the item playing (Movie, Episode, Audio, ...), none for idle sessions", []string{"media_type"}},
+	{"transcoding_conversions_total", "Number of transcodes started since the exporter started per source and target codec, of the video or for items without video of the audio", []string{"from_codec", "to_codec"}},
+	{"idle_sessions_total", "Number of sessions without activity for longer than --idle-session-threshold", nil},
+	{"sessions_by_ip_version_total", "Number of sessions per ip version of the client, local for sessions without remote address", []string{"ip_version"}},
+	{"sessions_by_tls_total", "Number of sessions per tls use of the client connection (true, false, unknown). Jellyfin doesn't report it, all sessions are unknown", []string{"tls"}},
+	{"sessions_by_network_total", "Number of sessions from the local network of the server and from remote networks", []string{"network"}},
+	{"sessions_by_country_total", "Number of remote sessions per country of the client address, with --geoip-enabled", []string{"country_code"}},
+	{"user_streams_by_media_type_total", "Number of sessions per user and type of the item playing, none for idle sessions", []string{"username", "media_type"}},
+	{"transcode_progress_percent", "Progress of the transcodes of playing sessions", []string{"session_id", "username"}},
+	{"client_version_total", "Number of sessions per client application and version", []string{"client", "version"}},
+	{"items_in_progress_total", "Number of items partially watched by the --metrics-user-id user", []string{"media_type"}},
+	{"favorite_items_total", "Number of items marked as favorite by the --metrics-user-id user", []string{"media_type"}},
+	{"items_unidentified_total", "Number of items Jellyfin could not identify in the metadata providers during library scans", []string{"media_type"}},
+	{"item_play_count_distribution", "Histogram of the play counts of all movies, episodes and tracks by the --metrics-user-id user", nil},
+	{"items_added_last_day_total", "Number of movies and series added to the library in the last 24 hours, from the 200 newest", []string{"media_type"}},
+	{"items_added_last_week_total", "Number of movies and series added to the library in the last 7 days, from the 200 newest", []string{"media_type"}},
+	{"items_added_per_day_7d_avg", "Average number of items added to the library per day over the last 7 days", []string{"media_type"}},
+	{"items_with_trickplay_total", "Number of items with trickplay (seek preview) images", nil},
+	{"movies_with_trailer_total", "Number of movies with a local trailer", nil},
+	{"movies_without_trailer_total", "Number of movies without a local trailer", nil},
+	{"episodes_with_intro_data_total", "Number of episodes with intro markers", nil},
+	{"episodes_without_intro_data_total", "Number of episodes without intro markers", nil},
+	{"library_chapters_total", "Number of chapter markers across all videos in the library", nil},
+	{"items_with_chapters_total", "Number of videos with at least one chapter marker", nil},
+	{"items_with_nfo_total", "Number of items with a provider id from nfo sidecar metadata", nil},
+	{"iptv_channels_total", "Number of live tv channels", nil},
+	{"iptv_channels_by_group_total", "Number of live tv channels per group: their first tag or else their major channel number", []string{"group"}},
+	{"library_file_extension_total", "Number of files in the library per file extension, none for files without extension", []string{"extension"}},
+	{"subtitle_format_total", "Number of subtitle streams in the library per format", []string{"format"}},
+	{"items_with_external_subtitles_total", "Number of videos with at least one subtitle in a separate file", []string{"media_type"}},
+	{"items_with_embedded_subtitles_total", "Number of videos with at least one subtitle embedded in the video file", []string{"media_type"}},
+	{"metadata_source_total", "Number of items with an id from the metadata provider", []string{"source"}},
+	{"item_play_count", "Play count of the items most played by the --metrics-user-id user", []string{"item_name", "media_type"}},
+	{"series_play_count", "Play count of the series most played by the --metrics-user-id user", []string{"series_name"}},
+	{"album_play_count", "Play count of the music albums most played by the --metrics-user-id user", []string{"album_name", "artist_name"}},
+	{"virtual_folders_total", "Number of libraries (virtual folders) of the server", nil},
+	{"virtual_folder_item_count", "Number of items in the library, or its number of paths if Jellyfin doesn't report its item id", []string{"folder_name"}},
+	{"library_item_count", "Number of items in the library per type, the types counted depend on the library type", []string{"library_name", "media_type"}},
+	{"shared_libraries_total", "Number of libraries accessible by at least one user", nil},
+	{"library_shares_total", "Number of library and user pairs where the user can access the library", nil},
+	{"admin_actions_total", "Number of user and configuration changes recorded in the activity log since the exporter started", []string{"action_type"}},
+	{"server_config_changes_total", "Number of server configuration changes recorded in the activity log since the exporter started", nil},
+	{"image_requests_total", "Number of image requests recorded in the activity log since the exporter started", []string{"type"}},
+	{"login_failures_total", "Number of failed logins received at /ingest/activity since the exporter started", nil},
+	{"items_added_total", "Number of items added to the library received at /ingest/activity since the exporter started, media_type unknown if the webhook template has no ItemType", []string{"media_type"}},
+	{"items_deleted_total", "Number of items deleted from the library received at /ingest/activity since the exporter started, media_type unknown if the webhook template has no ItemType", []string{"media_type"}},
+	{"search_index_items_total", "Number of items in the search index", nil},
+	{"search_index_last_updated_timestamp_seconds", "Unix timestamp of the last search index update", nil},
+	{"users_with_2fa_total", "Number of users authenticating with a two-factor authentication plugin", nil},
+	{"users_total", "Number of users of the Jellyfin server", nil},
+	{"users_never_logged_in_total", "Number of users who have never logged in since their account was created", nil},
+	{"last_backup_timestamp_seconds", "Unix timestamp of the last completed backup, 0 if there is none", nil},
+	{"last_backup_size_bytes", "Size of the last completed backup", nil},
+	{"database_size_bytes", "Size of the Jellyfin database", nil},
+	{"log_file_size_bytes", "Size of the Jellyfin log files", nil},
+	{"server_memory_usage_bytes", "Memory used by the Jellyfin server process, on Jellyfin builds that report it", nil},
+	{"server_cpu_usage_percent", "CPU usage of the Jellyfin server process, on Jellyfin builds that report it", nil},
+	{"server_disk_read_bytes_total", "Bytes read from disk by the Jellyfin server process since it started, on Jellyfin builds that report it", nil},
+	{"server_disk_write_bytes_total", "Bytes written to disk by the Jellyfin server process since it started, on Jellyfin builds that report it", nil},
+	{"server_restart_total", "Number of Jellyfin server restarts detected since the exporter started, from the start time of the server, on Jellyfin builds that report it", nil},
+	{"up", "1 if the last scrape completed, 0 if it was aborted after --max-scrape-duration or the scrape timeout, or no api call succeeded within --staleness-timeout or since the last failed background health probe, or the circuit breaker is open", nil},
+	{"metrics_stale", "1 if any metrics were served from cache because Jellyfin could not be reached, 0 if all metrics are live", nil},
+	{"endpoint_healthy", "1 if the last call to the Jellyfin api endpoint succeeded, 0 if it failed", []string{"endpoint"}},
+	{"ssl_cert_expiry_timestamp_seconds", "Unix timestamp the TLS certificate of the Jellyfin server expires at, with --check-cert-expiry and an https --host", nil},
+	{"collection_summary", "always 1. label 'status' is success if all collectors succeeded during the last scrape, partial if some and failure if all of them failed", []string{"status"}},
+	{"collection_metric_count", "Number of series sent during the last scrape, without the metric_cardinality and collection metrics", nil},
+	{"collection_error_count", "Number of collectors that failed during the last scrape", nil},
+	{"tls_session_reuse_total", "Number of TLS connections to the Jellyfin api that resumed a previous session", nil},
+	{"api_connection_reuse_total", "Number of calls to the Jellyfin api endpoint that reused a kept-alive connection, with --http-connection-metrics-enabled", []string{"endpoint"}},
+	{"api_new_connections_total", "Number of calls to the Jellyfin api endpoint that opened a new connection, with --http-connection-metrics-enabled", []string{"endpoint"}},
+	{"api_redirects_total", "Number of redirects followed by calls to the Jellyfin api", []string{"endpoint"}},
+	{"scrape_errors_total", "Number of failed calls to the Jellyfin api endpoint", []string{"endpoint"}},
+	{"exporter_config_hash", "always 1. the hash label identifies the effective configuration of the exporter", []string{"hash"}},
+	{"exporter_inflight_scrapes", "Number of scrapes running when the last scrape started, including itself", nil},
+	{"exporter_goroutines_delta", "Difference in the number of goroutines between the start and the end of the last scrape", nil},
+	{"metric_cardinality", "Number of label combinations exported for the metric in the last scrape", []string{"metric_name"}},
+	{"circuit_breaker_recovery_timestamp_seconds", "Unix timestamp the circuit breaker of --circuit-breaker-threshold last closed at, after a scrape succeeded again", nil},
+	{"circuit_breaker_open_duration_seconds", "Time the circuit breaker was open before it last closed", nil},
+}
+
+// metricLibraryTypes maps the metrics about a single type of library to the
+// Jellyfin collection type of the library.
+var metricLibraryTypes = map[string]string{
+	"movieCount":                        "movies",
+	"item_play_count":                   "movies",
+	"seriesCount":                       "tvshows",
+	"series_completion_ratio":           "tvshows",
+	"series_play_count":                 "tvshows",
+	"episodes_with_intro_data_total":    "tvshows",
+	"episodes_without_intro_data_total": "tvshows",
+	"music_album_track_ratio":           "music",
+	"album_play_count":                  "music",
+}
+
+// collectorMetrics are exported by JellyfinGetCollector itself, about the
+// collection of the other metrics.
+var collectorMetrics = []string{
+	"up", "metrics_stale", "endpoint_healthy", "api_redirects_total", "tls_session_reuse_total", "scrape_errors_total",
+	"api_connection_reuse_total", "api_new_connections_total",
+	"ssl_cert_expiry_timestamp_seconds", "server_restart_total", "collection_summary", "collection_metric_count", "collection_error_count",
+	"exporter_goroutines_delta", "metric_cardinality", "exporter_config_hash", "exporter_inflight_scrapes",
+	"circuit_breaker_recovery_timestamp_seconds", "circuit_breaker_open_duration_seconds",
+}
@@ -0,0 +1,299 @@
+// Package jellyfin is a client for the parts of the Jellyfin api read by the
+// exporter.
+package jellyfin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Transport performs a GET request for an api endpoint, such as
+// /System/Info, and decodes the JSON response into out, unless out is nil.
+// Non-200 responses are returned as *APIError.
+type Transport interface {
+	Get(ctx context.Context, endpoint string, out interface{}) error
+}
+
+// TransportFunc adapts a function to the Transport interface.
+type TransportFunc func(ctx context.Context, endpoint string, out interface{}) error
+
+func (f TransportFunc) Get(ctx context.Context, endpoint string, out interface{}) error {
+	return f(ctx, endpoint, out)
+}
+
+// APIError is returned when Jellyfin responds with a non-200 status code.
+type APIError struct {
+	StatusCode int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("jellyfin api response %d %s",
+		e.StatusCode, http.StatusText(e.StatusCode),
+	)
+}
+
+// IsStatus reports whether err is an APIError with one of the status codes.
+func IsStatus(err error, codes ...int) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPageSize is the number of items requested per page by paginated
+// calls, unless the PageSize of the Client is set.
+const DefaultPageSize = 500
+
+// Client reads typed responses from the Jellyfin api.
+type Client struct {
+	transport Transport
+
+	// PageSize is the number of items requested per page by GetPaginated
+	PageSize int
+}
+
+func NewClient(transport Transport) *Client {
+	return &Client{transport: transport, PageSize: DefaultPageSize}
+}
+
+func (c *Client) GetSystemInfo(ctx context.Context) (*SystemInfo, error) {
+	var info SystemInfo
+	err := c.transport.Get(ctx, "/System/Info", &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) GetItemCounts(ctx context.Context) (*ItemCounts, error) {
+	var counts ItemCounts
+	err := c.transport.Get(ctx, "/Items/Counts", &counts)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+func (c *Client) GetConfiguration(ctx context.Context) (*ServerConfiguration, error) {
+	var config ServerConfiguration
+	err := c.transport.Get(ctx, "/System/Configuration", &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Client) GetEncodingConfiguration(ctx context.Context) (*EncodingConfiguration, error) {
+	var config EncodingConfiguration
+	err := c.transport.Get(ctx, "/System/Configuration/encoding", &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Ping calls a lightweight endpoint, such as /System/Ping, discarding the
+// response.
+func (c *Client) Ping(ctx context.Context, endpoint string) error {
+	return c.transport.Get(ctx, endpoint, nil)
+}
+
+func (c *Client) GetQuickConnectEnabled(ctx context.Context) (bool, error) {
+	var enabled bool
+	err := c.transport.Get(ctx, "/QuickConnect/Enabled", &enabled)
+	return enabled, err
+}
+
+// GetAPIKeys returns the api keys created in the dashboard, only
+// administrators may list them.
+func (c *Client) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys struct {
+		Items []APIKey `json:"items"`
+	}
+	err := c.transport.Get(ctx, "/Auth/Keys", &keys)
+	return keys.Items, err
+}
+
+func (c *Client) GetUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.transport.Get(ctx, "/Users", &users)
+	return users, err
+}
+
+// GetCurrentUser returns the user the api key belongs to.
+func (c *Client) GetCurrentUser(ctx context.Context) (*User, error) {
+	var user User
+	err := c.transport.Get(ctx, "/Users/Me", &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) GetNotificationSummary(ctx context.Context, userID string) (*NotificationSummary, error) {
+	var summary NotificationSummary
+	err := c.transport.Get(ctx, "/Notifications/"+url.PathEscape(userID)+"/Summary", &summary)
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// GetMediaFolders returns the libraries of the server.
+func (c *Client) GetMediaFolders(ctx context.Context) ([]Item, error) {
+	var libraries ItemsResponse
+	err := c.transport.Get(ctx, "/Library/MediaFolders", &libraries)
+	return libraries.Items, err
+}
+
+// GetVirtualFolders returns the libraries of the server with their paths.
+// Reading them requires an administrator api key.
+func (c *Client) GetVirtualFolders(ctx context.Context) ([]VirtualFolder, error) {
+	var folders []VirtualFolder
+	err := c.transport.Get(ctx, "/Library/VirtualFolders", &folders)
+	return folders, err
+}
+
+// GetActivityLog returns the activity log entries written since, requesting
+// them in pages of PageSize entries like GetPaginated.
+func (c *Client) GetActivityLog(ctx context.Context, since time.Time) ([]ActivityEntry, error) {
+	pageSize := c.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	var entries []ActivityEntry
+	for {
+		var page struct {
+			Items            []ActivityEntry `json:"items"`
+			TotalRecordCount float64         `json:"totalRecordCount"`
+		}
+		err := c.transport.Get(ctx, fmt.Sprintf(
+			"/System/ActivityLog/Entries?MinDate=%s&StartIndex=%d&Limit=%d",
+			url.QueryEscape(since.UTC().Format(time.RFC3339)), len(entries), pageSize,
+		), &page)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Items...)
+		if len(page.Items) == 0 || float64(len(entries)) >= page.TotalRecordCount {
+			return entries, nil
+		}
+	}
+}
+
+// GetLiveTVChannels returns the live tv channels that aren't movies or
+// series. Servers without live tv respond 404.
+func (c *Client) GetLiveTVChannels(ctx context.Context) ([]Item, error) {
+	var channels ItemsResponse
+	err := c.transport.Get(ctx, "/LiveTv/Channels?IsMovie=false&IsSeries=false", &channels)
+	return channels.Items, err
+}
+
+// GetSearchIndex reads the state of the search index. The endpoint isn't
+// part of stock Jellyfin, which responds 404.
+func (c *Client) GetSearchIndex(ctx context.Context) (*SearchIndex, error) {
+	var index SearchIndex
+	err := c.transport.Get(ctx, "/System/SearchIndex", &index)
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// GetBackupStatus reads the last backup. Not all Jellyfin builds include
+// backups, those without respond 404.
+func (c *Client) GetBackupStatus(ctx context.Context) (*BackupStatus, error) {
+	var backup BackupStatus
+	err := c.transport.Get(ctx, "/System/Backup/Status", &backup)
+	if err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+func (c *Client) GetScheduledTasks(ctx context.Context) ([]ScheduledTask, error) {
+	var tasks []ScheduledTask
+	err := c.transport.Get(ctx, "/ScheduledTasks", &tasks)
+	return tasks, err
+}
+
+func (c *Client) GetSessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	err := c.transport.Get(ctx, "/Sessions", &sessions)
+	return sessions, err
+}
+
+func (c *Client) GetPlugins(ctx context.Context) ([]Plugin, error) {
+	var plugins []Plugin
+	err := c.transport.Get(ctx, "/Plugins", &plugins)
+	return plugins, err
+}
+
+// GetItems makes a single /Items request with the given query.
+func (c *Client) GetItems(ctx context.Context, query string) (*ItemsResponse, error) {
+	var items ItemsResponse
+	err := c.transport.Get(ctx, "/Items?"+query, &items)
+	if err != nil {
+		return nil, err
+	}
+	return &items, nil
+}
+
+// GetPaginated returns all items of an endpoint returning an ItemsResponse,
+// requesting them page by page until StartIndex reaches TotalRecordCount.
+func (c *Client) GetPaginated(ctx context.Context, endpoint, query string) ([]Item, error) {
+	pageSize := c.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	var items []Item
+	for {
+		var page ItemsResponse
+		err := c.transport.Get(ctx, fmt.Sprintf(
+			"%s?%s&StartIndex=%d&Limit=%d", endpoint, query, len(items), pageSize,
+		), &page)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || float64(len(items)) >= page.TotalRecordCount {
+			return items, nil
+		}
+	}
+}
+
+// GetAllItems returns all items matching the recursive /Items query.
+func (c *Client) GetAllItems(ctx context.Context, query string) ([]Item, error) {
+	return c.GetPaginated(ctx, "/Items", "Recursive=true&"+query)
+}
+
+// CountItems returns the number of items matching the recursive /Items
+// query, without enumerating them.
+func (c *Client) CountItems(ctx context.Context, query string) (float64, error) {
+	response, err := c.GetItems(ctx, "Recursive=true&Limit=0&"+query)
+	if err != nil {
+		return 0, err
+	}
+	return response.TotalRecordCount, nil
+}
+
+// CountEpisodes returns the number of episodes of a series, either those
+// present in the library or those known to be missing.
+func (c *Client) CountEpisodes(ctx context.Context, seriesID string, missing bool) (float64, error) {
+	var episodes ItemsResponse
+	err := c.transport.Get(ctx, fmt.Sprintf("/Shows/%s/Episodes?IsMissing=%t&Limit=0",
+		url.PathEscape(seriesID), missing), &episodes)
+	return episodes.TotalRecordCount, err
+}
@@ -0,0 +1,244 @@
+package jellyfin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeTransport answers endpoints with canned JSON responses, by path, and
+// records the requested endpoints.
+type fakeTransport struct {
+	responses map[string]string
+	requests  []string
+}
+
+func (f *fakeTransport) Get(ctx context.Context, endpoint string, out interface{}) error {
+	f.requests = append(f.requests, endpoint)
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	response, ok := f.responses[u.Path]
+	if !ok {
+		return &APIError{StatusCode: http.StatusNotFound}
+	}
+	return json.Unmarshal([]byte(response), out)
+}
+
+func TestClient(t *testing.T) {
+	transport := &fakeTransport{responses: map[string]string{
+		"/System/Info":                    `{"Version": "10.8.13", "MaintenanceMode": true}`,
+		"/Items/Counts":                   `{"MovieCount": 7, "SeriesCount": 2}`,
+		"/Users/Me":                       `{"Name": "admin", "Id": "4f5e1c0a"}`,
+		"/Notifications/4f5e1c0a/Summary": `{"UnreadCount": 5}`,
+	}}
+	client := NewClient(transport)
+	ctx := context.Background()
+
+	info, err := client.GetSystemInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "10.8.13" || !info.MaintenanceMode {
+		t.Errorf("GetSystemInfo = %+v", info)
+	}
+	counts, err := client.GetItemCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.MovieCount != 7 || counts.SeriesCount != 2 {
+		t.Errorf("GetItemCounts = %+v", counts)
+	}
+	me, err := client.GetCurrentUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := client.GetNotificationSummary(ctx, me.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.UnreadCount != 5 {
+		t.Errorf("GetNotificationSummary = %+v", summary)
+	}
+
+	_, err = client.GetBackupStatus(ctx)
+	if !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("GetBackupStatus of a build without backups: %v, want a 404 APIError", err)
+	}
+}
+
+// pagedItems is a transport answering /Items with the page of total items
+// selected by StartIndex and Limit, but reporting reported items in
+// TotalRecordCount. It records the start index of every request.
+type pagedItems struct {
+	total, reported int
+	starts          []int
+}
+
+func (p *pagedItems) Get(ctx context.Context, endpoint string, out interface{}) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	start, _ := strconv.Atoi(u.Query().Get("StartIndex"))
+	limit, _ := strconv.Atoi(u.Query().Get("Limit"))
+	p.starts = append(p.starts, start)
+
+	response := out.(*ItemsResponse)
+	for i := start; i < start+limit && i < p.total; i++ {
+		response.Items = append(response.Items, Item{ID: strconv.Itoa(i)})
+	}
+	response.TotalRecordCount = float64(p.reported)
+	return nil
+}
+
+func TestGetPaginated(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      int
+		reported   int
+		wantStarts []int
+	}{
+		{"three pages", 5, 5, []int{0, 2, 4}},
+		{"full last page", 4, 4, []int{0, 2}},
+		{"no items", 0, 0, []int{0}},
+		// items deleted while paging, the empty page ends it
+		{"fewer items than reported", 3, 6, []int{0, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &pagedItems{total: tt.total, reported: tt.reported}
+			client := NewClient(transport)
+			client.PageSize = 2
+			items, err := client.GetAllItems(context.Background(), "IncludeItemTypes=Movie")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != tt.total {
+				t.Fatalf("%d items, want %d", len(items), tt.total)
+			}
+			for i, item := range items {
+				if item.ID != strconv.Itoa(i) {
+					t.Errorf("item %d has id %s", i, item.ID)
+				}
+			}
+			if fmt.Sprint(transport.starts) != fmt.Sprint(tt.wantStarts) {
+				t.Errorf("requested start indexes %v, want %v", transport.starts, tt.wantStarts)
+			}
+		})
+	}
+}
+
+func TestGetPaginatedError(t *testing.T) {
+	calls := 0
+	client := NewClient(TransportFunc(func(ctx context.Context, endpoint string, out interface{}) error {
+		calls++
+		if strings.Contains(endpoint, "StartIndex=0&") {
+			*out.(*ItemsResponse) = ItemsResponse{Items: []Item{{ID: "0"}}, TotalRecordCount: 2}
+			return nil
+		}
+		return &APIError{StatusCode: 500}
+	}))
+	client.PageSize = 1
+	items, err := client.GetAllItems(context.Background(), "")
+	if err == nil || items != nil {
+		t.Errorf("GetAllItems = %v, %v after a failing page, want an error", items, err)
+	}
+	if calls != 2 {
+		t.Errorf("%d requests, want 2", calls)
+	}
+}
+
+func TestGetPaginatedEndpoint(t *testing.T) {
+	var endpoints []string
+	client := NewClient(TransportFunc(func(ctx context.Context, endpoint string, out interface{}) error {
+		endpoints = append(endpoints, endpoint)
+		return nil
+	}))
+	client.PageSize = 0
+	_, err := client.GetPaginated(context.Background(), "/Users/u1/Items", "Filters=IsFavorite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an unset page size requests pages of the default size
+	want := fmt.Sprintf("/Users/u1/Items?Filters=IsFavorite&StartIndex=0&Limit=%d", DefaultPageSize)
+	if fmt.Sprint(endpoints) != "["+want+"]" {
+		t.Errorf("requested %v, want [%s]", endpoints, want)
+	}
+}
+
+func TestCountItems(t *testing.T) {
+	var endpoint string
+	client := NewClient(TransportFunc(func(ctx context.Context, e string, out interface{}) error {
+		endpoint = e
+		out.(*ItemsResponse).TotalRecordCount = 42
+		return nil
+	}))
+	count, err := client.CountItems(context.Background(), "Filters=IsResumable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 42 {
+		t.Errorf("CountItems = %v, want 42", count)
+	}
+	if want := "/Items?Recursive=true&Limit=0&Filters=IsResumable"; endpoint != want {
+		t.Errorf("requested %s, want %s", endpoint, want)
+	}
+}
+
+func TestCountEpisodes(t *testing.T) {
+	tests := []struct {
+		missing bool
+		want    string
+	}{
+		{false, "/Shows/a%2Fb/Episodes?IsMissing=false&Limit=0"},
+		{true, "/Shows/a%2Fb/Episodes?IsMissing=true&Limit=0"},
+	}
+	for _, tt := range tests {
+		var endpoint string
+		client := NewClient(TransportFunc(func(ctx context.Context, e string, out interface{}) error {
+			endpoint = e
+			out.(*ItemsResponse).TotalRecordCount = 3
+			return nil
+		}))
+		count, err := client.CountEpisodes(context.Background(), "a/b", tt.missing)
+		if err != nil || count != 3 {
+			t.Errorf("CountEpisodes(missing=%v) = %v, %v, want 3", tt.missing, count, err)
+		}
+		if endpoint != tt.want {
+			t.Errorf("requested %s, want %s", endpoint, tt.want)
+		}
+	}
+}
+
+func TestIsStatus(t *testing.T) {
+	notFound := &APIError{StatusCode: http.StatusNotFound}
+	tests := []struct {
+		name  string
+		err   error
+		codes []int
+		want  bool
+	}{
+		{"matching", notFound, []int{http.StatusNotFound}, true},
+		{"one of several", notFound, []int{http.StatusForbidden, http.StatusNotFound}, true},
+		{"other status", notFound, []int{http.StatusForbidden}, false},
+		{"wrapped", fmt.Errorf("get /Plugins: %w", notFound), []int{http.StatusNotFound}, true},
+		{"not an api error", errors.New("connection refused"), []int{http.StatusNotFound}, false},
+		{"nil", nil, []int{http.StatusNotFound}, false},
+	}
+	for _, tt := range tests {
+		if got := IsStatus(tt.err, tt.codes...); got != tt.want {
+			t.Errorf("%s: IsStatus = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got, want := notFound.Error(), "jellyfin api response 404 Not Found"; got != want {
+		t.Errorf("APIError = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,425 @@
+package jellyfin
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SystemInfo is the subset of the /System/Info response used by the exporter.
+type SystemInfo struct {
+	Version            string `json:"version"`
+	OperatingSystem    string `json:"operatingSystem"`
+	SystemArchitecture string `json:"systemArchitecture"`
+	// LocalAddress is the url of the server in the local network, e.g.
+	// http://192.168.1.10:8096
+	LocalAddress string `json:"localAddress"`
+	// WanAddress is the url of the server from the internet, empty if
+	// Jellyfin doesn't know it
+	WanAddress string `json:"wanAddress"`
+	// MaintenanceMode is missing from older Jellyfin builds, leaving it false
+	MaintenanceMode bool   `json:"maintenanceMode"`
+	EncoderPath     string `json:"encoderPath"`
+	// ProductVersion and SystemUpdateLevel are the closest Jellyfin gets to
+	// reporting the .NET runtime it runs on
+	ProductVersion    string `json:"productVersion"`
+	SystemUpdateLevel string `json:"systemUpdateLevel"`
+	// DatabaseSizeBytes and LogFileSizeBytes aren't reported by stock
+	// Jellyfin, only by builds that add them to the system info
+	DatabaseSizeBytes *float64 `json:"databaseSizeBytes"`
+	LogFileSizeBytes  *float64 `json:"logFileSizeBytes"`
+	// MemoryUsageBytes and CPUUsagePercent are the resource usage of the
+	// server process. No Jellyfin release up to 10.10 reports them, only
+	// builds that add them to the system info
+	MemoryUsageBytes *float64 `json:"memoryUsageBytes"`
+	CPUUsagePercent  *float64 `json:"cpuUsagePercent"`
+	// DiskReadBytes and DiskWriteBytes are the bytes the server process
+	// read and wrote since it started. Like the resource usage, only builds
+	// that add them report them
+	DiskReadBytes  *float64 `json:"diskReadBytes"`
+	DiskWriteBytes *float64 `json:"diskWriteBytes"`
+	// StartupTime is when the server started, also only reported by builds
+	// that add it to the system info
+	StartupTime *time.Time `json:"startupTime"`
+}
+
+// encoderVersionPattern matches the ffmpeg version in encoder paths such as
+// /usr/lib/jellyfin-ffmpeg6/ffmpeg or /opt/ffmpeg-6.0.1/bin/ffmpeg.
+var encoderVersionPattern = regexp.MustCompile(`(?i)ffmpeg[-_]?v?(\d+(?:\.\d+)*)`)
+
+// EncoderVersion returns the ffmpeg version of the encoder. Jellyfin doesn't
+// report it, so it is taken from the encoder path, or unknown if the path
+// contains no version.
+func (i SystemInfo) EncoderVersion() string {
+	match := encoderVersionPattern.FindStringSubmatch(i.EncoderPath)
+	if match == nil {
+		return "unknown"
+	}
+	return match[1]
+}
+
+var versionPattern = regexp.MustCompile(`\d+(?:\.\d+)+`)
+
+// DotnetVersion returns the runtime version from ProductVersion, falling back
+// to the raw SystemUpdateLevel when no version can be parsed.
+func (i SystemInfo) DotnetVersion() string {
+	if version := versionPattern.FindString(i.ProductVersion); version != "" {
+		return version
+	}
+	if i.SystemUpdateLevel != "" {
+		return i.SystemUpdateLevel
+	}
+	return "unknown"
+}
+
+// LocalIP returns the ip address of LocalAddress, or nil if it doesn't
+// contain one.
+func (i SystemInfo) LocalIP() net.IP {
+	u, err := url.Parse(i.LocalAddress)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(u.Hostname())
+}
+
+// ItemCounts is the /Items/Counts response.
+type ItemCounts struct {
+	MovieCount      float64 `json:"movieCount"`
+	SeriesCount     float64 `json:"seriesCount"`
+	EpisodeCount    float64 `json:"episodeCount"`
+	ArtistCount     float64 `json:"artistCount"`
+	ProgramCount    float64 `json:"programCount"`
+	TrailerCount    float64 `json:"trailerCount"`
+	SongCount       float64 `json:"songCount"`
+	AlbumCount      float64 `json:"albumCount"`
+	MusicVideoCount float64 `json:"musicVideoCount"`
+	BoxSetCount     float64 `json:"boxSetCount"`
+	BookCount       float64 `json:"bookCount"`
+	ItemCount       float64 `json:"itemCount"`
+}
+
+// ServerConfiguration is the subset of the /System/Configuration response
+// used by the exporter. Reading it requires an administrator api key.
+type ServerConfiguration struct {
+	EnableRemoteAccess bool `json:"enableRemoteAccess"`
+	EnableHTTPS        bool `json:"enableHttps"`
+	// MaxConcurrentStreams is only present when a server-wide stream limit
+	// is configured. RemoteClientBitrateLimit limits bitrate, not streams.
+	MaxConcurrentStreams *float64 `json:"maxConcurrentStreams"`
+	// SubtitleDownloadLanguages are the three letter codes of the languages
+	// subtitle plugins download subtitles in
+	SubtitleDownloadLanguages []string `json:"subtitleDownloadLanguages"`
+}
+
+// EncodingConfiguration is the subset of the /System/Configuration/encoding
+// response used by the exporter.
+type EncodingConfiguration struct {
+	// HardwareAccelerationType is one of none, amf, qsv, nvenc, v4l2m2m,
+	// vaapi or videotoolbox
+	HardwareAccelerationType string `json:"hardwareAccelerationType"`
+}
+
+// APIKey is the subset of a /Auth/Keys response entry used by the exporter,
+// leaving out the key itself.
+type APIKey struct {
+	AppName     string    `json:"appName"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+// User is the subset of a /Users response entry used by the exporter.
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// LastActivityDate is null for users who have never been active
+	LastActivityDate *time.Time `json:"lastActivityDate"`
+	// LastLoginDate is null for users who have never logged in
+	LastLoginDate *time.Time `json:"lastLoginDate"`
+	Policy        UserPolicy `json:"policy"`
+}
+
+type UserPolicy struct {
+	IsAdministrator          bool   `json:"isAdministrator"`
+	AuthenticationProviderID string `json:"authenticationProviderId"`
+	// MaxActiveSessions is the number of sessions the user may have at the
+	// same time, 0 for no limit
+	MaxActiveSessions int `json:"maxActiveSessions"`
+	// RemoteClientBitrateLimit is the maximum bitrate of streams outside the
+	// local network in bits per second, 0 for no limit
+	RemoteClientBitrateLimit float64 `json:"remoteClientBitrateLimit"`
+	// EnabledFolders lists the library ids the user can access, unless
+	// EnableAllFolders gives access to every library
+	EnableAllFolders bool     `json:"enableAllFolders"`
+	EnabledFolders   []string `json:"enabledFolders"`
+}
+
+// ItemsResponse is the envelope returned by the /Items family of endpoints.
+type ItemsResponse struct {
+	Items            []Item  `json:"items"`
+	TotalRecordCount float64 `json:"totalRecordCount"`
+}
+
+// Item is the subset of a library item used by the exporter.
+type Item struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// AlbumArtist is the main artist of music albums and tracks
+	AlbumArtist string `json:"albumArtist"`
+	// IndexNumber and ParentIndexNumber are the track and disc number of
+	// audio items
+	IndexNumber       int `json:"indexNumber"`
+	ParentIndexNumber int `json:"parentIndexNumber"`
+	// ProviderIds maps metadata providers (Tmdb, Imdb, ...) to the id of the
+	// item with that provider, included when requested with Fields=ProviderIds
+	ProviderIds map[string]string `json:"providerIds"`
+	// MediaStreams is only included when requested with Fields=MediaStreams
+	MediaStreams []MediaStream `json:"mediaStreams"`
+	// Chapters is only included when requested with Fields=Chapters
+	Chapters []Chapter `json:"chapters"`
+	// UserData is only included when requested with Fields=UserData, it
+	// describes the item for the api key user
+	UserData *UserData `json:"userData"`
+	// Path is the file of the item on the server, included when requested
+	// with Fields=Path
+	Path string `json:"path"`
+	// LocalTrailerCount is the number of trailers stored with a movie,
+	// included when requested with Fields=LocalTrailerCount
+	LocalTrailerCount int `json:"localTrailerCount"`
+	// ChannelNumber and Tags are set on live tv channels
+	ChannelNumber string   `json:"channelNumber"`
+	Tags          []string `json:"tags"`
+	// DateCreated is when the item was added to the library, included when
+	// requested with Fields=DateCreated
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+type UserData struct {
+	PlayCount float64 `json:"playCount"`
+}
+
+type Chapter struct {
+	Name string `json:"name"`
+}
+
+// HasIntroMarker reports whether the intro detection plugin has marked the
+// intro of the item, which it does by adding an "Intro" chapter.
+func (i Item) HasIntroMarker() bool {
+	for _, chapter := range i.Chapters {
+		if strings.EqualFold(strings.TrimSpace(chapter.Name), "intro") {
+			return true
+		}
+	}
+	return false
+}
+
+// VirtualFolder is a /Library/VirtualFolders response entry, a library with
+// the paths it is read from.
+type VirtualFolder struct {
+	Name string `json:"name"`
+	// ItemID is the id of the library item, items in the library have it as
+	// their parent id
+	ItemID         string   `json:"itemId"`
+	CollectionType string   `json:"collectionType"`
+	Locations      []string `json:"locations"`
+}
+
+// Session is the subset of a /Sessions response entry used by the exporter.
+type Session struct {
+	ID                 string `json:"id"`
+	UserName           string `json:"userName"`
+	Client             string `json:"client"`
+	ApplicationVersion string `json:"applicationVersion"`
+	// RemoteEndPoint is the address of the client, with or without port
+	RemoteEndPoint   string    `json:"remoteEndPoint"`
+	LastActivityDate time.Time `json:"lastActivityDate"`
+	// NowPlayingItem is null for idle sessions
+	NowPlayingItem *NowPlayingItem `json:"nowPlayingItem"`
+	PlayState      struct {
+		// PlayMethod is one of DirectPlay, DirectStream or Transcode
+		PlayMethod string `json:"playMethod"`
+	} `json:"playState"`
+	// TranscodingInfo is null unless the session is being transcoded
+	TranscodingInfo *TranscodingInfo `json:"transcodingInfo"`
+}
+
+type NowPlayingItem struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`
+	MediaStreams []MediaStream `json:"mediaStreams"`
+}
+
+type TranscodingInfo struct {
+	Bitrate   float64 `json:"bitrate"`
+	Container string  `json:"container"`
+	// VideoCodec and AudioCodec are the codecs transcoded to
+	VideoCodec string `json:"videoCodec"`
+	AudioCodec string `json:"audioCodec"`
+	// CompletionPercentage is null until the transcoder reports progress
+	CompletionPercentage *float64 `json:"completionPercentage"`
+}
+
+type MediaStream struct {
+	// Type is one of Audio, Video, Subtitle, EmbeddedImage or Data
+	Type    string  `json:"type"`
+	Codec   string  `json:"codec"`
+	BitRate float64 `json:"bitRate"`
+	// IsExternal is set for streams in a separate file, such as an srt
+	// next to the video
+	IsExternal bool `json:"isExternal"`
+}
+
+// EstimatedBandwidth returns the bitrate a playing session is streamed at:
+// the transcoding bitrate, or the combined bitrate of the source streams
+// when playing directly.
+func (s Session) EstimatedBandwidth() float64 {
+	if s.TranscodingInfo != nil && s.TranscodingInfo.Bitrate > 0 {
+		return s.TranscodingInfo.Bitrate
+	}
+
+	var bitrate float64
+	if s.NowPlayingItem != nil {
+		for _, stream := range s.NowPlayingItem.MediaStreams {
+			bitrate += stream.BitRate
+		}
+	}
+	return bitrate
+}
+
+// RemoteIP returns the ip address of the client, or nil if RemoteEndPoint
+// doesn't contain one.
+func (s Session) RemoteIP() net.IP {
+	host := s.RemoteEndPoint
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+// IPVersion returns ipv4 or ipv6 depending on the address of the client, or
+// local if the session has no remote address.
+func (s Session) IPVersion() string {
+	ip := s.RemoteIP()
+	switch {
+	case ip == nil:
+		return "local"
+	case ip.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+// TranscodeCodecs returns the codec a transcoding session converts from and
+// to, of the video or for items without video of the audio, unknown for
+// codecs Jellyfin doesn't report.
+func (s Session) TranscodeCodecs() (from, to string) {
+	from, to = "unknown", "unknown"
+	if s.TranscodingInfo == nil || s.NowPlayingItem == nil {
+		return from, to
+	}
+	streamType, codec := "Audio", s.TranscodingInfo.AudioCodec
+	for _, stream := range s.NowPlayingItem.MediaStreams {
+		if stream.Type == "Video" {
+			streamType, codec = "Video", s.TranscodingInfo.VideoCodec
+		}
+	}
+	if codec != "" {
+		to = strings.ToLower(codec)
+	}
+	for _, stream := range s.NowPlayingItem.MediaStreams {
+		if stream.Type == streamType && stream.Codec != "" {
+			return strings.ToLower(stream.Codec), to
+		}
+	}
+	return from, to
+}
+
+// StreamingProtocol returns hls, dash, progressive or other depending on how
+// a playing session is streamed.
+func (s Session) StreamingProtocol() string {
+	if s.TranscodingInfo != nil {
+		switch strings.ToLower(s.TranscodingInfo.Container) {
+		case "ts", "mpegts", "fmp4", "mp4":
+			return "hls"
+		case "webm":
+			return "dash"
+		default:
+			return "other"
+		}
+	}
+	if s.PlayState.PlayMethod == "DirectPlay" {
+		return "progressive"
+	}
+	return "other"
+}
+
+// ScheduledTask is the subset of a /ScheduledTasks response entry used by
+// the exporter.
+type ScheduledTask struct {
+	Name string `json:"name"`
+	// State is one of Idle, Cancelling or Running
+	State string `json:"state"`
+	// LastExecutionResult is null for tasks that have never run
+	LastExecutionResult *struct {
+		EndTimeUtc time.Time `json:"endTimeUtc"`
+		Status     string    `json:"status"`
+	} `json:"lastExecutionResult"`
+}
+
+// ActivityEntry is the subset of a /System/ActivityLog/Entries response
+// entry used by the exporter.
+type ActivityEntry struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	ShortOverview string    `json:"shortOverview"`
+	Date          time.Time `json:"date"`
+}
+
+// ImageRequestType returns thumbnail, backdrop, logo or other for an
+// ImageRequest activity log entry.
+func (e ActivityEntry) ImageRequestType() string {
+	text := strings.ToLower(e.Name + " " + e.ShortOverview)
+	switch {
+	case strings.Contains(text, "backdrop"):
+		return "backdrop"
+	case strings.Contains(text, "logo"):
+		return "logo"
+	case strings.Contains(text, "thumb"):
+		return "thumbnail"
+	default:
+		return "other"
+	}
+}
+
+// NotificationSummary is the /Notifications/{userId}/Summary response.
+type NotificationSummary struct {
+	UnreadCount float64 `json:"unreadCount"`
+}
+
+// SearchIndex is the state of the search index, reported by builds with a
+// search index admin endpoint.
+type SearchIndex struct {
+	ItemCount   float64   `json:"itemCount"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// BackupStatus describes the last backup, reported by builds that include
+// backups.
+type BackupStatus struct {
+	LastBackupDate *time.Time `json:"lastBackupDate"`
+	SizeBytes      float64    `json:"sizeBytes"`
+}
+
+// Plugin is an entry of the /Plugins response.
+type Plugin struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Status is one of Active, Restart, Deleted, Superceded, Malfunctioned,
+	// NotSupported or Disabled
+	Status string `json:"status"`
+}
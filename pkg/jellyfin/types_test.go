@@ -0,0 +1,59 @@
+package jellyfin
+
+import (
+	"testing"
+)
+
+func TestStreamingProtocol(t *testing.T) {
+	transcoding := func(container string) Session {
+		return Session{TranscodingInfo: &TranscodingInfo{Container: container}}
+	}
+	direct := func(method string) Session {
+		var s Session
+		s.PlayState.PlayMethod = method
+		return s
+	}
+	tests := []struct {
+		name    string
+		session Session
+		want    string
+	}{
+		{"ts", transcoding("ts"), "hls"},
+		{"mpegts", transcoding("mpegts"), "hls"},
+		{"fmp4", transcoding("fMP4"), "hls"},
+		{"mp4", transcoding("mp4"), "hls"},
+		{"webm", transcoding("webm"), "dash"},
+		{"unknown container", transcoding("mkv"), "other"},
+		{"no container", transcoding(""), "other"},
+		{"direct play", direct("DirectPlay"), "progressive"},
+		{"direct stream", direct("DirectStream"), "other"},
+		{"no play state", Session{}, "other"},
+	}
+	for _, tt := range tests {
+		if got := tt.session.StreamingProtocol(); got != tt.want {
+			t.Errorf("%s: StreamingProtocol = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"192.168.1.1:12345", "ipv4"},
+		{"192.168.1.1", "ipv4"},
+		{"[2001:db8::1]:12345", "ipv6"},
+		{"[::1]:12345", "ipv6"},
+		{"2001:db8::1", "ipv6"},
+		// dual-stack sockets report ipv4 clients as mapped addresses
+		{"[::ffff:192.168.1.1]:12345", "ipv4"},
+		{"", "local"},
+		{"localhost:8096", "local"},
+	}
+	for _, tt := range tests {
+		if got := (Session{RemoteEndPoint: tt.remote}).IPVersion(); got != tt.want {
+			t.Errorf("IPVersion of %q = %s, want %s", tt.remote, got, tt.want)
+		}
+	}
+}
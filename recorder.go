@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricRecorder receives the values produced while collecting metrics.
+// Metrics are identified by their name in metricInfos, without namespace.
+type MetricRecorder interface {
+	RecordGauge(name string, value float64, labels ...string)
+	// RecordCounter records the current total of a counter, counters are
+	// accumulated by the collector and not by the recorder.
+	RecordCounter(name string, value float64, labels ...string)
+	// RecordHistogram records a histogram computed by the collector, buckets
+	// maps upper bounds to cumulative counts.
+	RecordHistogram(name string, count uint64, sum float64, buckets map[float64]uint64, labels ...string)
+}
+
+// PromRecorder sends recorded values to a prometheus metric channel.
+type PromRecorder struct {
+	Descs   map[string]*prom.Desc
+	Metrics chan<- prom.Metric
+}
+
+func (r PromRecorder) RecordGauge(name string, value float64, labels ...string) {
+	r.record(name, prom.GaugeValue, value, labels)
+}
+
+func (r PromRecorder) RecordCounter(name string, value float64, labels ...string) {
+	r.record(name, prom.CounterValue, value, labels)
+}
+
+func (r PromRecorder) RecordHistogram(name string, count uint64, sum float64, buckets map[float64]uint64, labels ...string) {
+	desc, ok := r.Descs[name]
+	if !ok {
+		log.WithField("metric", name).Error("record unknown metric")
+		return
+	}
+	metric, err := prom.NewConstHistogram(desc, count, sum, buckets, labels...)
+	if err != nil {
+		log.WithError(err).WithField("metric", name).Error("record metric")
+		return
+	}
+	r.Metrics <- metric
+}
+
+func (r PromRecorder) record(name string, valueType prom.ValueType, value float64, labels []string) {
+	desc, ok := r.Descs[name]
+	if !ok {
+		log.WithField("metric", name).Error("record unknown metric")
+		return
+	}
+	metric, err := prom.NewConstMetric(desc, valueType, value, labels...)
+	if err != nil {
+		log.WithError(err).WithField("metric", name).Error("record metric")
+		return
+	}
+	r.Metrics <- metric
+}
+
+// TestRecorder stores recorded values in memory, keyed by metric name and
+// label values, to check collection results without a prometheus registry.
+// Histograms are stored by their cumulative bucket counts.
+type TestRecorder struct {
+	Values     map[string]float64
+	Histograms map[string]map[float64]uint64
+}
+
+func NewTestRecorder() *TestRecorder {
+	return &TestRecorder{
+		Values:     make(map[string]float64),
+		Histograms: make(map[string]map[float64]uint64),
+	}
+}
+
+func (r *TestRecorder) RecordGauge(name string, value float64, labels ...string) {
+	r.Values[testRecorderKey(name, labels)] = value
+}
+
+func (r *TestRecorder) RecordCounter(name string, value float64, labels ...string) {
+	r.Values[testRecorderKey(name, labels)] = value
+}
+
+func (r *TestRecorder) RecordHistogram(name string, count uint64, sum float64, buckets map[float64]uint64, labels ...string) {
+	r.Values[testRecorderKey(name+"_count", labels)] = float64(count)
+	r.Values[testRecorderKey(name+"_sum", labels)] = sum
+	r.Histograms[testRecorderKey(name, labels)] = buckets
+}
+
+// Value returns the value recorded for the metric with the given labels.
+func (r *TestRecorder) Value(name string, labels ...string) (float64, bool) {
+	value, ok := r.Values[testRecorderKey(name, labels)]
+	return value, ok
+}
+
+func testRecorderKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// sample is a single recorded value, or histogram if buckets is set.
+type sample struct {
+	name    string
+	counter bool
+	value   float64
+	labels  []string
+
+	count   uint64
+	buckets map[float64]uint64
+}
+
+// sampleRecorder keeps recorded values in order so they can be replayed.
+type sampleRecorder []sample
+
+func (r *sampleRecorder) RecordGauge(name string, value float64, labels ...string) {
+	*r = append(*r, sample{name: name, value: value, labels: labels})
+}
+
+func (r *sampleRecorder) RecordCounter(name string, value float64, labels ...string) {
+	*r = append(*r, sample{name: name, counter: true, value: value, labels: labels})
+}
+
+func (r *sampleRecorder) RecordHistogram(name string, count uint64, sum float64, buckets map[float64]uint64, labels ...string) {
+	*r = append(*r, sample{name: name, value: sum, labels: labels, count: count, buckets: buckets})
+}
+
+func (r sampleRecorder) replay(rec MetricRecorder) {
+	for _, s := range r {
+		if s.buckets != nil {
+			rec.RecordHistogram(s.name, s.count, s.value, s.buckets, s.labels...)
+		} else if s.counter {
+			rec.RecordCounter(s.name, s.value, s.labels...)
+		} else {
+			rec.RecordGauge(s.name, s.value, s.labels...)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// recordSamples records the same samples into every recorder.
+func recordSamples(rec MetricRecorder) {
+	rec.RecordGauge("movieCount", 12)
+	rec.RecordGauge("endpoint_healthy", 1, "/Sessions")
+	rec.RecordCounter("image_requests_total", 2, "logo")
+}
+
+func TestTestRecorder(t *testing.T) {
+	rec := NewTestRecorder()
+	recordSamples(rec)
+
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+		ok     bool
+	}{
+		{"movieCount", nil, 12, true},
+		{"endpoint_healthy", []string{"/Sessions"}, 1, true},
+		{"endpoint_healthy", []string{"/Users"}, 0, false},
+		{"image_requests_total", []string{"logo"}, 2, true},
+		{"seriesCount", nil, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := rec.Value(tt.name, tt.labels...)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Value(%s, %v) = %v, %v, want %v, %v", tt.name, tt.labels, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSampleRecorderReplay(t *testing.T) {
+	var samples sampleRecorder
+	recordSamples(&samples)
+	replayed := NewTestRecorder()
+	samples.replay(replayed)
+
+	want := NewTestRecorder()
+	recordSamples(want)
+	if len(replayed.Values) != len(want.Values) {
+		t.Errorf("replayed %v, want %v", replayed.Values, want.Values)
+	}
+	for key, value := range want.Values {
+		if replayed.Values[key] != value {
+			t.Errorf("replayed %s = %v, want %v", key, replayed.Values[key], value)
+		}
+	}
+}
+
+func TestPromRecorder(t *testing.T) {
+	c := newTestCollector(t)
+	metrics := make(chan prom.Metric, 10)
+	recordSamples(PromRecorder{Descs: c.descs, Metrics: metrics})
+	// unknown metrics and wrong label counts are logged and dropped
+	PromRecorder{Descs: c.descs, Metrics: metrics}.RecordGauge("no_such_metric", 1)
+	PromRecorder{Descs: c.descs, Metrics: metrics}.RecordGauge("movieCount", 1, "extra")
+	close(metrics)
+
+	types := make(map[string]string)
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case m.Gauge != nil:
+			types[metric.Desc().String()] = "gauge"
+		case m.Counter != nil:
+			types[metric.Desc().String()] = "counter"
+		}
+	}
+	want := map[string]string{
+		"movieCount":           "gauge",
+		"endpoint_healthy":     "gauge",
+		"image_requests_total": "counter",
+	}
+	if len(types) != len(want) {
+		t.Errorf("sent %v, want %v", types, want)
+	}
+	for name, typ := range want {
+		if got := types[c.descs[name].String()]; got != typ {
+			t.Errorf("%s sent as %q, want %s", name, got, typ)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Items/Counts": jsonResponse(map[string]float64{"MovieCount": 7, "SeriesCount": 2}),
+	})
+
+	rec := scrape(t, c)
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"movieCount", nil, 7},
+		{"seriesCount", nil, 2},
+		{"endpoint_healthy", []string{"/Items/Counts"}, 1},
+		// the other endpoints answer 404
+		{"endpoint_healthy", []string{"/System/Info"}, 0},
+	}
+	for _, tt := range tests {
+		if got, ok := rec.Value(tt.name, tt.labels...); !ok || got != tt.want {
+			t.Errorf("%s%v = %v, %v, want %v", tt.name, tt.labels, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteSeries is a sample of a single series as sent by remote write, with
+// the metric name in the __name__ label.
+type remoteSeries struct {
+	labels      []remoteLabel
+	value       float64
+	timestampMs int64
+}
+
+type remoteLabel struct {
+	name, value string
+}
+
+// checkRemoteWrite validates --remote-write-url and --remote-write-interval.
+func checkRemoteWrite(config *ExporterConfig) error {
+	u, err := url.Parse(config.RemoteWriteURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("--remote-write-url: %q is not an http or https url", config.RemoteWriteURL)
+	}
+	if config.RemoteWriteInterval <= 0 {
+		return errors.New("--remote-write-interval must be positive")
+	}
+	return nil
+}
+
+// runRemoteWrite collects the metrics of newGatherer every interval,
+// starting right away, and pushes them to writeURL with the Prometheus remote
+// write protocol until ctx is done. Failed pushes are logged, the next
+// interval pushes the metrics collected then.
+func runRemoteWrite(ctx context.Context, writeURL string, interval, timeout time.Duration, newGatherer func(context.Context) prom.Gatherer) {
+	client := &http.Client{Timeout: timeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := pushMetrics(ctx, client, writeURL, timeout, newGatherer)
+		if err != nil {
+			log.WithError(err).WithField("url", writeURL).Warn("remote write failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pushMetrics gathers the metrics once, with timeout, and posts them to writeURL
+// as snappy compressed WriteRequest. Gather errors are logged, the metrics
+// gathered despite them are pushed anyway.
+func pushMetrics(ctx context.Context, client *http.Client, writeURL string, timeout time.Duration, newGatherer func(context.Context) prom.Gatherer) error {
+	gatherCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	families, err := newGatherer(gatherCtx).Gather()
+	if err != nil {
+		log.WithError(err).Warn("gather metrics")
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(remoteWriteSeries(families, time.Now())))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// remoteWriteSeries flattens families into the series Prometheus would
+// store them as: histograms into _bucket series with an le label, _sum and
+// _count, summaries into series with a quantile label, _sum and _count.
+// Metrics without timestamp get now.
+func remoteWriteSeries(families []*dto.MetricFamily, now time.Time) []remoteSeries {
+	var series []remoteSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			timestamp := now.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...remoteLabel) {
+				labels := []remoteLabel{{"__name__", name + suffix}}
+				for _, label := range metric.GetLabel() {
+					labels = append(labels, remoteLabel{label.GetName(), label.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, remoteSeries{labels, value, timestamp})
+			}
+
+			switch {
+			case metric.Histogram != nil:
+				infBucket := false
+				for _, bucket := range metric.Histogram.GetBucket() {
+					infBucket = infBucket || math.IsInf(bucket.GetUpperBound(), 1)
+					add("_bucket", float64(bucket.GetCumulativeCount()),
+						remoteLabel{"le", strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)})
+				}
+				count := float64(metric.Histogram.GetSampleCount())
+				if !infBucket {
+					add("_bucket", count, remoteLabel{"le", "+Inf"})
+				}
+				add("_sum", metric.Histogram.GetSampleSum())
+				add("_count", count)
+			case metric.Summary != nil:
+				for _, quantile := range metric.Summary.GetQuantile() {
+					add("", quantile.GetValue(),
+						remoteLabel{"quantile", strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)})
+				}
+				add("_sum", metric.Summary.GetSampleSum())
+				add("_count", float64(metric.Summary.GetSampleCount()))
+			default:
+				add("", metricValue(metric))
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes series as prometheus.WriteRequest protobuf
+// message, a TimeSeries with a single Sample per series.
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var timeSeries []byte
+		for _, label := range s.labels {
+			var pair []byte
+			pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+			pair = protowire.AppendString(pair, label.name)
+			pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+			pair = protowire.AppendString(pair, label.value)
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, pair)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestampMs))
+		timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+		timeSeries = protowire.AppendBytes(timeSeries, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
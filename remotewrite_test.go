@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a field of a protobuf message, with the value of its type.
+type protoField struct {
+	num    protowire.Number
+	bytes  []byte
+	fixed  uint64
+	varint uint64
+}
+
+func decodeMessage(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		field := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			field.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("field %d has unexpected type %d", num, typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest of TimeSeries with a
+// single Sample each.
+func decodeWriteRequest(t *testing.T, body []byte) []remoteSeries {
+	t.Helper()
+	var series []remoteSeries
+	for _, field := range decodeMessage(t, body) {
+		if field.num != 1 {
+			t.Fatalf("WriteRequest has field %d, want only timeseries", field.num)
+		}
+		var s remoteSeries
+		samples := 0
+		for _, field := range decodeMessage(t, field.bytes) {
+			switch field.num {
+			case 1:
+				var label remoteLabel
+				for _, field := range decodeMessage(t, field.bytes) {
+					switch field.num {
+					case 1:
+						label.name = string(field.bytes)
+					case 2:
+						label.value = string(field.bytes)
+					}
+				}
+				s.labels = append(s.labels, label)
+			case 2:
+				samples++
+				for _, field := range decodeMessage(t, field.bytes) {
+					switch field.num {
+					case 1:
+						s.value = math.Float64frombits(field.fixed)
+					case 2:
+						s.timestampMs = int64(field.varint)
+					}
+				}
+			default:
+				t.Fatalf("TimeSeries has unexpected field %d", field.num)
+			}
+		}
+		if samples != 1 {
+			t.Fatalf("TimeSeries %v has %d samples, want 1", s.labels, samples)
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+func TestPushMetrics(t *testing.T) {
+	registry := prom.NewPedanticRegistry()
+	gauge := prom.NewGaugeVec(prom.GaugeOpts{Name: "test_items", Help: "Items."}, []string{"library"})
+	gauge.WithLabelValues("movies").Set(3)
+	histogram := prom.NewHistogram(prom.HistogramOpts{Name: "test_duration_seconds", Help: "Durations.", Buckets: []float64{0.5, 1}})
+	histogram.Observe(0.25)
+	histogram.Observe(2)
+	summary := prom.NewSummary(prom.SummaryOpts{Name: "test_latency_seconds", Help: "Latencies.", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(1)
+	registry.MustRegister(gauge, histogram, summary)
+
+	var (
+		mu   sync.Mutex
+		body []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		for header, want := range map[string]string{
+			"Content-Type":                      "application/x-protobuf",
+			"Content-Encoding":                  "snappy",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+		} {
+			if got := r.Header.Get(header); got != want {
+				t.Errorf("%s %q, want %q", header, got, want)
+			}
+		}
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		body, err = snappy.Decode(nil, compressed)
+		mu.Unlock()
+		if err != nil {
+			t.Errorf("body isn't snappy compressed: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	before := time.Now().UnixMilli()
+	err := pushMetrics(context.Background(), server.Client(), server.URL, time.Second,
+		func(context.Context) prom.Gatherer { return registry })
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixMilli()
+
+	mu.Lock()
+	series := decodeWriteRequest(t, body)
+	mu.Unlock()
+	for i := range series {
+		if ts := series[i].timestampMs; ts < before || ts > after {
+			t.Errorf("%v timestamp %d, want the time of the push", series[i].labels, ts)
+		}
+		series[i].timestampMs = 0
+	}
+	name := func(name string, extra ...remoteLabel) []remoteLabel {
+		return append([]remoteLabel{{"__name__", name}}, extra...)
+	}
+	want := []remoteSeries{
+		{labels: name("test_duration_seconds_bucket", remoteLabel{"le", "0.5"}), value: 1},
+		{labels: name("test_duration_seconds_bucket", remoteLabel{"le", "1"}), value: 1},
+		{labels: name("test_duration_seconds_bucket", remoteLabel{"le", "+Inf"}), value: 2},
+		{labels: name("test_duration_seconds_sum"), value: 2.25},
+		{labels: name("test_duration_seconds_count"), value: 2},
+		{labels: name("test_items", remoteLabel{"library", "movies"}), value: 3},
+		{labels: name("test_latency_seconds", remoteLabel{"quantile", "0.5"}), value: 1},
+		{labels: name("test_latency_seconds_sum"), value: 1},
+		{labels: name("test_latency_seconds_count"), value: 1},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("pushed\n%v\nwant\n%v", series, want)
+	}
+}
+
+func TestPushMetricsRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := pushMetrics(context.Background(), server.Client(), server.URL, time.Second,
+		func(context.Context) prom.Gatherer { return prom.NewRegistry() })
+	if err == nil || err.Error() != "400 Bad Request: out of order sample" {
+		t.Errorf("error %v, want the status and message of the response", err)
+	}
+}
+
+func TestRunRemoteWrite(t *testing.T) {
+	pushes := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes <- struct{}{}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runRemoteWrite(ctx, server.URL, 10*time.Millisecond, time.Second,
+			func(context.Context) prom.Gatherer { return prom.NewRegistry() })
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pushes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d pushes in 5s, want a push every 10ms", i)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestCheckRemoteWrite(t *testing.T) {
+	tests := []struct {
+		url      string
+		interval time.Duration
+		wantErr  bool
+	}{
+		{url: "http://prometheus:9090/api/v1/write", interval: 30 * time.Second},
+		{url: "https://mimir.example.com/api/v1/push", interval: time.Minute},
+		{url: "prometheus:9090/api/v1/write", interval: 30 * time.Second, wantErr: true},
+		{url: "ftp://prometheus/write", interval: 30 * time.Second, wantErr: true},
+		{url: "http:///api/v1/write", interval: 30 * time.Second, wantErr: true},
+		{url: "http://prometheus:9090/api/v1/write", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			config := testConfig(t)
+			config.RemoteWriteURL = tt.url
+			config.RemoteWriteInterval = tt.interval
+			if err := checkRemoteWrite(config); (err != nil) != tt.wantErr {
+				t.Errorf("checkRemoteWrite error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// sessionAuth holds the access token of --use-session-auth. It is obtained
+// on the first api call and again whenever Jellyfin rejects it.
+type sessionAuth struct {
+	mu    sync.Mutex
+	token string
+}
+
+// apiKeyRotation is the api key in use out of --apikey and the
+// --api-key-fallbacks that follow it in keys.
+type apiKeyRotation struct {
+	mu     sync.Mutex
+	keys   []string
+	active int
+}
+
+// checkAuth returns an error unless the options configure an api key or
+// session authentication.
+func checkAuth(config *ExporterConfig) error {
+	if !config.UseSessionAuth {
+		if config.APIKey == "" {
+			return errors.New("--apikey or --apikey-file is required without --use-session-auth")
+		}
+		return nil
+	}
+	if config.JellyfinUsername == "" {
+		return errors.New("--use-session-auth requires --jellyfin-username")
+	}
+	return nil
+}
+
+// accessToken returns the token to authenticate api calls with, the api key
+// unless --use-session-auth is set.
+func (c *JellyfinGetCollector) accessToken(ctx context.Context) (string, error) {
+	if !c.Config.UseSessionAuth {
+		c.apiKeys.mu.Lock()
+		defer c.apiKeys.mu.Unlock()
+		return c.apiKeys.keys[c.apiKeys.active], nil
+	}
+
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	if c.session.token == "" {
+		token, err := c.authenticateByName(ctx)
+		if err != nil {
+			return "", fmt.Errorf("authenticate as %s: %w", c.Config.JellyfinUsername, err)
+		}
+		c.session.token = token
+	}
+	return c.session.token, nil
+}
+
+// expireToken forgets token so that the next api call authenticates again.
+// Calls that were rejected at the same time only authenticate once.
+func (c *JellyfinGetCollector) expireToken(token string) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	if c.session.token == token {
+		c.session.token = ""
+	}
+}
+
+// nextAPIKey switches from the rejected key to the next fallback key. It
+// returns false if there is none left.
+func (c *JellyfinGetCollector) nextAPIKey(ctx context.Context, rejected string) bool {
+	c.apiKeys.mu.Lock()
+	defer c.apiKeys.mu.Unlock()
+	// another call may have switched keys already
+	if c.apiKeys.keys[c.apiKeys.active] != rejected {
+		return true
+	}
+	if c.apiKeys.active+1 >= len(c.apiKeys.keys) {
+		return false
+	}
+	c.apiKeys.active++
+	requestLog(ctx).WithField("fallback", c.apiKeys.active).
+		Warn("jellyfin rejected the api key, using the next of --api-key-fallbacks")
+	return true
+}
+
+// readAPIKeyFile returns the api key in the file of --apikey-file, such as a
+// mounted Kubernetes secret, without surrounding whitespace.
+func readAPIKeyFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// reloadAPIKey reads --apikey-file again so that a rotated secret is used
+// without a restart. A changed key replaces the primary key and is tried
+// before the fallback keys again.
+func (c *JellyfinGetCollector) reloadAPIKey(ctx context.Context) {
+	key, err := readAPIKeyFile(c.Config.APIKeyFile)
+	if err != nil {
+		requestLog(ctx).WithError(err).Warn("failed to read --apikey-file, keeping the current api key")
+		return
+	}
+	c.apiKeys.mu.Lock()
+	defer c.apiKeys.mu.Unlock()
+	if c.apiKeys.keys[0] != key {
+		c.apiKeys.keys[0] = key
+		c.apiKeys.active = 0
+		requestLog(ctx).Info("api key in --apikey-file changed")
+	}
+}
+
+// mediaBrowserAuthorization returns the MediaBrowser style authorization
+// header identifying the exporter, with token unless it is empty.
+func mediaBrowserAuthorization(token string) string {
+	// Jellyfin identifies the session by the device, a stable id reuses it
+	// instead of adding a device on every login
+	device, err := os.Hostname()
+	if err != nil {
+		device = "unknown"
+	}
+	header := fmt.Sprintf(`MediaBrowser Client="jellyfin-exporter", Device=%q, DeviceId=%q, Version=%q`,
+		device, "jellyfin-exporter-"+device, Version)
+	if token != "" {
+		header += fmt.Sprintf(", Token=%q", token)
+	}
+	return header
+}
+
+// authenticateByName logs in with --jellyfin-username and
+// --jellyfin-password and returns the access token of the new session.
+func (c *JellyfinGetCollector) authenticateByName(ctx context.Context) (string, error) {
+	u, err := apiURL(c.Config.Host, c.Config.BasePath, "/Users/AuthenticateByName")
+	if err != nil {
+		return "", err
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"Username": c.Config.JellyfinUsername,
+		"Pw":       c.Config.JellyfinPassword,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(credentials))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", mediaBrowserAuthorization(""))
+
+	netClient := &http.Client{Transport: c.transport, Timeout: c.Config.Timeout}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &jellyfin.APIError{StatusCode: resp.StatusCode}
+	}
+
+	var result struct {
+		AccessToken string `json:"accessToken"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, c.Config.MaxResponseBytes)).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	requestLog(ctx).WithField("user", c.Config.JellyfinUsername).Info("authenticated with jellyfin")
+	return result.AccessToken, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// fakeSessions is a Jellyfin that hands out a new access token on every
+// login and accepts only the latest.
+type fakeSessions struct {
+	mu     sync.Mutex
+	logins int
+	valid  string
+	// tokens are the tokens /System/Info was called with
+	tokens []string
+}
+
+func (f *fakeSessions) authenticate(w http.ResponseWriter, r *http.Request) {
+	var credentials struct{ Username, Pw string }
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&credentials) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if credentials.Username != "exporter" || credentials.Pw != "s3cret" {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "MediaBrowser ") {
+		http.Error(w, "no client identification", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.logins++
+	f.valid = fmt.Sprintf("token-%d", f.logins)
+	f.mu.Unlock()
+	jsonResponse(map[string]string{"AccessToken": f.valid})(w, r)
+}
+
+func (f *fakeSessions) systemInfo(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Emby-Token")
+	f.mu.Lock()
+	f.tokens = append(f.tokens, token)
+	valid := token == f.valid
+	f.mu.Unlock()
+	if !valid {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rawJSON(`{"Version": "10.8.13"}`)(w, r)
+}
+
+// revoke ends the session, like a logout in the dashboard.
+func (f *fakeSessions) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.valid = ""
+}
+
+func TestSessionAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		wantErr    bool
+		wantLogins int
+		wantTokens []string
+	}{
+		{
+			name:       "login again after the session is revoked",
+			password:   "s3cret",
+			wantLogins: 2,
+			wantTokens: []string{"token-1", "token-1", "token-1", "token-2"},
+		},
+		{name: "wrong password", password: "guess", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSessions{}
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Users/AuthenticateByName": fake.authenticate,
+				"/System/Info":              fake.systemInfo,
+			}, "--use-session-auth", "--jellyfin-username=exporter", "--jellyfin-password="+tt.password)
+
+			for i := 0; i < 3; i++ {
+				if i == 2 {
+					fake.revoke()
+				}
+				var info jellyfin.SystemInfo
+				err := c.getAPI(context.Background(), "/System/Info", &info)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("getAPI succeeded with a wrong password")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+				if info.Version != "10.8.13" {
+					t.Errorf("call %d: version %q, want 10.8.13", i, info.Version)
+				}
+			}
+			if fake.logins != tt.wantLogins {
+				t.Errorf("%d logins, want %d", fake.logins, tt.wantLogins)
+			}
+			if strings.Join(fake.tokens, ",") != strings.Join(tt.wantTokens, ",") {
+				t.Errorf("called with tokens %v, want %v", fake.tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ExporterConfig
+		wantErr bool
+	}{
+		{"api key", ExporterConfig{APIKey: "key"}, false},
+		{"no api key", ExporterConfig{}, true},
+		{"session auth", ExporterConfig{UseSessionAuth: true, JellyfinUsername: "exporter"}, false},
+		{"session auth without user", ExporterConfig{UseSessionAuth: true, APIKey: "key"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAuth(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAuth error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIKeyFallbacks(t *testing.T) {
+	tests := []struct {
+		name       string
+		fallbacks  string
+		wantErr    bool
+		wantKeys   []string
+		wantWarned int
+	}{
+		{
+			name:       "second key accepted",
+			fallbacks:  "new-key,old-key",
+			wantKeys:   []string{"rotated-key", "new-key", "new-key", "new-key"},
+			wantWarned: 1,
+		},
+		{
+			name:       "third key accepted",
+			fallbacks:  "rotated-too,new-key",
+			wantKeys:   []string{"rotated-key", "rotated-too", "new-key", "new-key", "new-key"},
+			wantWarned: 2,
+		},
+		{
+			name:       "every key rejected",
+			fallbacks:  "rotated-too",
+			wantErr:    true,
+			wantKeys:   []string{"rotated-key", "rotated-too"},
+			wantWarned: 1,
+		},
+		{name: "no fallbacks", wantErr: true, wantKeys: []string{"rotated-key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			var mu sync.Mutex
+			var keys []string
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+					key := r.Header.Get("X-Emby-Token")
+					mu.Lock()
+					keys = append(keys, key)
+					mu.Unlock()
+					if key != "new-key" {
+						http.Error(w, "unauthorized", http.StatusUnauthorized)
+						return
+					}
+					rawJSON(`{"Version": "10.8.13"}`)(w, r)
+				},
+			}, "--apikey=rotated-key", "--api-key-fallbacks="+tt.fallbacks)
+
+			calls := 3
+			if tt.wantErr {
+				calls = 1
+			}
+			for i := 0; i < calls; i++ {
+				var info jellyfin.SystemInfo
+				err := c.getAPI(context.Background(), "/System/Info", &info)
+				if tt.wantErr {
+					if !jellyfin.IsStatus(err, http.StatusUnauthorized) {
+						t.Errorf("call %d: error %v, want 401", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+			}
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("called with keys %v, want %v", keys, tt.wantKeys)
+			}
+			warned := 0
+			for _, entry := range hook.AllEntries() {
+				if strings.Contains(entry.Message, "--api-key-fallbacks") {
+					warned++
+					if entry.Level != logrus.WarnLevel {
+						t.Errorf("logged %q at %s, want warning", entry.Message, entry.Level)
+					}
+				}
+			}
+			if warned != tt.wantWarned {
+				t.Errorf("%d warnings about a fallback key, want %d", warned, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestReadAPIKeyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "secret volume", content: "s3cret", want: "s3cret"},
+		{name: "trailing newline", content: "s3cret\n", want: "s3cret"},
+		{name: "surrounding whitespace", content: " \ts3cret\r\n\n", want: "s3cret"},
+		{name: "empty", content: "", wantErr: true},
+		{name: "only whitespace", content: "\n \n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "apikey")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readAPIKeyFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readAPIKeyFile error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readAPIKeyFile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readAPIKeyFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readAPIKeyFile read a missing file")
+	}
+}
+
+func TestReloadAPIKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikey")
+	write := func(key string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first-key")
+
+	var mu sync.Mutex
+	var keys []string
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			keys = append(keys, r.Header.Get("X-Emby-Token"))
+			mu.Unlock()
+			rawJSON(`{"Version": "10.8.13"}`)(w, r)
+		},
+	}, "--apikey-file="+path)
+	system := NewSystemCollector(c)
+	system.endpoints = system.endpoints[:1]
+	c.collectors = []Collector{system}
+
+	scrape(t, c)
+	// the secret is rotated
+	write("second-key")
+	scrape(t, c)
+	// a secret being replaced keeps the current key
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	scrape(t, c)
+
+	want := []string{"first-key", "second-key", "second-key"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("called with keys %v, want %v", keys, want)
+	}
+}
+
+func TestAPIKeyFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikey")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr := runMain(t, "--host=http://jellyfin:8096", "--apikey=key", "--apikey-file="+path, "--validate-config")
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0: %s", code, stderr)
+	}
+	if !strings.Contains(stderr, "--apikey and --apikey-file are both set") {
+		t.Errorf("output %q doesn't warn about --apikey being ignored", stderr)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// countConversions adds the transcodes that weren't running in the previous
+// call to the conversion counters and returns them per source and target
+// codec. A transcode is a session playing an item, a session that moves on
+// to the next item starts a new one.
+func (c *JellyfinGetCollector) countConversions(sessions []jellyfin.Session) map[[2]string]float64 {
+	c.transcodesMu.Lock()
+	defer c.transcodesMu.Unlock()
+	running := make(map[string]bool)
+	for _, s := range sessions {
+		if s.TranscodingInfo == nil || s.NowPlayingItem == nil {
+			continue
+		}
+		id := s.ID + "/" + s.NowPlayingItem.ID
+		running[id] = true
+		if !c.lastTranscodes[id] {
+			from, to := s.TranscodeCodecs()
+			c.conversions[[2]string{from, to}]++
+		}
+	}
+	c.lastTranscodes = running
+
+	conversions := make(map[[2]string]float64, len(c.conversions))
+	for codecs, count := range c.conversions {
+		conversions[codecs] = count
+	}
+	return conversions
+}
+
+// countIdleSessions returns the number of sessions whose last activity was
+// more than threshold before now. Sessions without activity date are skipped.
+func countIdleSessions(sessions []jellyfin.Session, now time.Time, threshold time.Duration) float64 {
+	var idle float64
+	for _, s := range sessions {
+		if !s.LastActivityDate.IsZero() && now.Sub(s.LastActivityDate) > threshold {
+			idle++
+		}
+	}
+	return idle
+}
+
+type clientVersion struct{ client, version string }
+
+// topClientVersions counts sessions per client and version, keeping the n
+// most common combinations and counting the rest as other.
+func topClientVersions(sessions []jellyfin.Session, n int) map[clientVersion]float64 {
+	counts := make(map[clientVersion]float64)
+	for _, s := range sessions {
+		counts[clientVersion{s.Client, s.ApplicationVersion}]++
+	}
+	if len(counts) <= n {
+		return counts
+	}
+
+	ranked := make([]clientVersion, 0, len(counts))
+	for cv := range counts {
+		ranked = append(ranked, cv)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if counts[ranked[i]] != counts[ranked[j]] {
+			return counts[ranked[i]] > counts[ranked[j]]
+		}
+		if ranked[i].client != ranked[j].client {
+			return ranked[i].client < ranked[j].client
+		}
+		return ranked[i].version < ranked[j].version
+	})
+
+	other := clientVersion{"other", "other"}
+	top := make(map[clientVersion]float64, n+1)
+	for i, cv := range ranked {
+		if i < n {
+			top[cv] = counts[cv]
+		} else {
+			top[other] += counts[cv]
+		}
+	}
+	return top
+}
+
+// sessionMediaType returns the type of the item playing in a session, none
+// for idle sessions.
+func sessionMediaType(s jellyfin.Session) string {
+	switch {
+	case s.NowPlayingItem == nil:
+		return "none"
+	case s.NowPlayingItem.Type == "":
+		return "unknown"
+	default:
+		return s.NowPlayingItem.Type
+	}
+}
+
+// countMediaTypes counts sessions per media type, in total and per user.
+func countMediaTypes(sessions []jellyfin.Session) (map[string]float64, map[string]map[string]float64) {
+	total := make(map[string]float64)
+	perUser := make(map[string]map[string]float64)
+	for _, s := range sessions {
+		mediaType := sessionMediaType(s)
+		total[mediaType]++
+
+		username := sanitizeLabelValue(s.UserName)
+		if perUser[username] == nil {
+			perUser[username] = make(map[string]float64)
+		}
+		perUser[username][mediaType]++
+	}
+	return total, perUser
+}
+
+func (c *JellyfinGetCollector) fetchSessions(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	sessions, err := client.GetSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Without --per-session-bandwidth the session_id label is left empty and
+	// bandwidth is summed up per user
+	type bandwidthKey struct{ sessionID, username string }
+	bandwidth := make(map[bandwidthKey]float64)
+	protocols := make(map[string]float64)
+	for _, s := range sessions {
+		if s.NowPlayingItem == nil {
+			continue
+		}
+		key := bandwidthKey{username: sanitizeLabelValue(s.UserName)}
+		if c.Config.PerSessionBandwidth {
+			key.sessionID = s.ID
+		}
+		bandwidth[key] += s.EstimatedBandwidth()
+		protocols[s.StreamingProtocol()]++
+		for _, stream := range s.NowPlayingItem.MediaStreams {
+			if stream.BitRate <= 0 {
+				continue
+			}
+			switch stream.Type {
+			case "Video":
+				c.streamBitrates.Observe(stream.BitRate)
+			case "Audio":
+				c.audioBitrates.Observe(stream.BitRate)
+			}
+		}
+	}
+	var bandwidthUsers []string
+	for key := range bandwidth {
+		if !containsString(bandwidthUsers, key.username) {
+			bandwidthUsers = append(bandwidthUsers, key.username)
+		}
+	}
+	sort.Strings(bandwidthUsers)
+	bandwidthUsers = c.limitUserLabels(ctx, bandwidthUsers)
+	for key, bitrate := range bandwidth {
+		if containsString(bandwidthUsers, key.username) {
+			rec.RecordGauge("session_estimated_bandwidth_bits_per_second", bitrate, key.sessionID, key.username)
+		}
+	}
+	for protocol, count := range protocols {
+		rec.RecordGauge("sessions_by_protocol_total", count, protocol)
+	}
+	rec.RecordGauge("idle_sessions_total", countIdleSessions(sessions, time.Now(), c.Config.IdleSessionThreshold))
+	for codecs, count := range c.countConversions(sessions) {
+		rec.RecordCounter("transcoding_conversions_total", count, codecs[0], codecs[1])
+	}
+	mediaTypes, userMediaTypes := countMediaTypes(sessions)
+	for mediaType, count := range mediaTypes {
+		rec.RecordGauge("streams_by_media_type_total", count, mediaType)
+	}
+	users := make([]string, 0, len(userMediaTypes))
+	for username := range userMediaTypes {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	for _, username := range c.limitUserLabels(ctx, users) {
+		for mediaType, count := range userMediaTypes[username] {
+			rec.RecordGauge("user_streams_by_media_type_total", count, username, mediaType)
+		}
+	}
+
+	ipVersions := map[string]float64{"ipv4": 0, "ipv6": 0, "local": 0}
+	for _, s := range sessions {
+		ipVersions[s.IPVersion()]++
+	}
+	for ipVersion, count := range ipVersions {
+		rec.RecordGauge("sessions_by_ip_version_total", count, ipVersion)
+	}
+	// the session api has no field telling whether the client connected over
+	// tls, neither the protocol nor the server id or device reveal it
+	rec.RecordGauge("sessions_by_tls_total", float64(len(sessions)), "unknown")
+
+	c.networkMu.RLock()
+	local := c.localNetwork
+	c.networkMu.RUnlock()
+	if local != nil {
+		networks := map[string]float64{"local": 0, "remote": 0}
+		for _, s := range sessions {
+			ip := s.RemoteIP()
+			if ip == nil {
+				continue
+			}
+			if ip.IsLoopback() || local.Contains(ip) {
+				networks["local"]++
+			} else {
+				networks["remote"]++
+			}
+		}
+		for network, count := range networks {
+			rec.RecordGauge("sessions_by_network_total", count, network)
+		}
+	}
+	if c.countries != nil {
+		for country, count := range countSessionCountries(sessions, c.countries, local) {
+			rec.RecordGauge("sessions_by_country_total", count, country)
+		}
+	}
+
+	if c.Config.TranscodeProgress {
+		for _, s := range sessions {
+			if s.TranscodingInfo == nil || s.TranscodingInfo.CompletionPercentage == nil {
+				continue
+			}
+			progress := math.Min(math.Max(*s.TranscodingInfo.CompletionPercentage, 0), 100)
+			rec.RecordGauge("transcode_progress_percent", progress, s.ID, sanitizeLabelValue(s.UserName))
+		}
+	}
+
+	if c.Config.ClientVersions {
+		for cv, count := range topClientVersions(sessions, c.Config.ClientVersionsTopN) {
+			rec.RecordGauge("client_version_total", count, cv.client, cv.version)
+		}
+	}
+
+	return nil
+}
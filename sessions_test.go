@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// fetchSessions calls fetchSessions against a fake /Sessions answering
+// sessions and returns the collector and the recorded values.
+func fetchSessions(t *testing.T, sessions []jellyfin.Session, args ...string) (*JellyfinGetCollector, *TestRecorder) {
+	t.Helper()
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Sessions": jsonResponse(sessions)}, args...)
+	rec := NewTestRecorder()
+	err := c.fetchSessions(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, rec
+}
+
+// playing returns a session of user playing an item of the media streams.
+func playing(id, user string, streams ...jellyfin.MediaStream) jellyfin.Session {
+	return jellyfin.Session{
+		ID:             id,
+		UserName:       user,
+		NowPlayingItem: &jellyfin.NowPlayingItem{Type: "Movie", MediaStreams: streams},
+	}
+}
+
+func TestSessionBandwidth(t *testing.T) {
+	video := jellyfin.MediaStream{Type: "Video", Codec: "h264", BitRate: 8e6}
+	audio := jellyfin.MediaStream{Type: "Audio", Codec: "aac", BitRate: 256e3}
+	transcoded := playing("s2", "alice", video, audio)
+	transcoded.TranscodingInfo = &jellyfin.TranscodingInfo{Bitrate: 3e6}
+	sessions := []jellyfin.Session{
+		playing("s1", "alice", video, audio),
+		transcoded,
+		playing("s3", "bob", audio),
+		// idle sessions don't stream
+		{ID: "s4", UserName: "carol"},
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want map[[2]string]float64
+	}{
+		{
+			name: "per user",
+			want: map[[2]string]float64{{"", "alice"}: 8256e3 + 3e6, {"", "bob"}: 256e3},
+		},
+		{
+			name: "per session",
+			args: []string{"--per-session-bandwidth"},
+			want: map[[2]string]float64{{"s1", "alice"}: 8256e3, {"s2", "alice"}: 3e6, {"s3", "bob"}: 256e3},
+		},
+		{
+			name: "user label limit",
+			args: []string{"--max-user-label-count=1"},
+			want: map[[2]string]float64{{"", "alice"}: 8256e3 + 3e6},
+		},
+		{
+			name: "per session user label limit",
+			args: []string{"--per-session-bandwidth", "--max-user-label-count=1"},
+			want: map[[2]string]float64{{"s1", "alice"}: 8256e3, {"s2", "alice"}: 3e6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rec := fetchSessions(t, sessions, tt.args...)
+			if series := countSeries(rec, "session_estimated_bandwidth_bits_per_second"); series != len(tt.want) {
+				t.Errorf("%d bandwidth series, want %d: %v", series, len(tt.want), rec.Values)
+			}
+			for labels, want := range tt.want {
+				got, ok := rec.Value("session_estimated_bandwidth_bits_per_second", labels[0], labels[1])
+				if !ok || got != want {
+					t.Errorf("session_estimated_bandwidth_bits_per_second{%s,%s} = %v, want %v", labels[0], labels[1], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionsByProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		want    string
+	}{
+		{"ts", `"TranscodingInfo": {"Container": "ts"}`, "hls"},
+		{"mpegts", `"TranscodingInfo": {"Container": "mpegts"}`, "hls"},
+		{"fmp4", `"TranscodingInfo": {"Container": "fMP4"}`, "hls"},
+		{"mp4", `"TranscodingInfo": {"Container": "mp4"}`, "hls"},
+		{"webm", `"TranscodingInfo": {"Container": "webm"}`, "dash"},
+		{"unknown container", `"TranscodingInfo": {"Container": "mkv"}`, "other"},
+		{"no container", `"TranscodingInfo": {}`, "other"},
+		{"direct play", `"PlayState": {"PlayMethod": "DirectPlay"}`, "progressive"},
+		{"direct stream", `"PlayState": {"PlayMethod": "DirectStream"}`, "other"},
+		{"no play state", `"Id": "s1"`, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var session jellyfin.Session
+			err := json.Unmarshal([]byte(`{"UserName": "alice", "NowPlayingItem": {"Type": "Movie"}, `+tt.session+`}`), &session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, rec := fetchSessions(t, []jellyfin.Session{session})
+			if series := countSeries(rec, "sessions_by_protocol_total"); series != 1 {
+				t.Errorf("%d protocol series, want 1: %v", series, rec.Values)
+			}
+			if got, ok := rec.Value("sessions_by_protocol_total", tt.want); !ok || got != 1 {
+				t.Errorf("sessions_by_protocol_total{%s} = %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTopClientVersions(t *testing.T) {
+	session := func(client, version string) jellyfin.Session {
+		return jellyfin.Session{Client: client, ApplicationVersion: version}
+	}
+	sessions := []jellyfin.Session{
+		session("Jellyfin Web", "10.8.13"), session("Jellyfin Web", "10.8.13"), session("Jellyfin Web", "10.8.13"),
+		session("Jellyfin Android", "2.6.0"), session("Jellyfin Android", "2.6.0"),
+		session("Infuse", "7.7"), session("Infuse", "7.6"),
+		session("Kodi", "0.7.10"),
+	}
+	tests := []struct {
+		name string
+		n    int
+		want map[clientVersion]float64
+	}{
+		{
+			name: "all fit",
+			n:    10,
+			want: map[clientVersion]float64{
+				{"Jellyfin Web", "10.8.13"}: 3, {"Jellyfin Android", "2.6.0"}: 2,
+				{"Infuse", "7.7"}: 1, {"Infuse", "7.6"}: 1, {"Kodi", "0.7.10"}: 1,
+			},
+		},
+		{
+			// ties are broken by client and version
+			name: "top 3",
+			n:    3,
+			want: map[clientVersion]float64{
+				{"Jellyfin Web", "10.8.13"}: 3, {"Jellyfin Android", "2.6.0"}: 2,
+				{"Infuse", "7.6"}: 1, {"other", "other"}: 2,
+			},
+		},
+		{
+			name: "only other",
+			n:    0,
+			want: map[clientVersion]float64{{"other", "other"}: 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := topClientVersions(sessions, tt.n)
+			if len(got) != len(tt.want) {
+				t.Errorf("topClientVersions = %v, want %v", got, tt.want)
+			}
+			for cv, want := range tt.want {
+				if got[cv] != want {
+					t.Errorf("%v = %v, want %v", cv, got[cv], want)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamsByMediaType(t *testing.T) {
+	withType := func(id, mediaType string) jellyfin.Session {
+		s := playing(id, "alice")
+		s.NowPlayingItem.Type = mediaType
+		return s
+	}
+	sessions := []jellyfin.Session{
+		playing("s1", "alice"),
+		withType("s2", "Episode"),
+		withType("s3", "Episode"),
+		withType("s4", "Audio"),
+		withType("s5", "TvChannel"),
+		withType("s6", ""),
+		// idle sessions
+		{ID: "s7", UserName: "bob"},
+		{ID: "s8", UserName: "carol"},
+	}
+	_, rec := fetchSessions(t, sessions)
+
+	want := map[string]float64{"Movie": 1, "Episode": 2, "Audio": 1, "TvChannel": 1, "unknown": 1, "none": 2}
+	if n := countSeries(rec, "streams_by_media_type_total"); n != len(want) {
+		t.Errorf("streams_by_media_type_total has %d series, want %d: %v", n, len(want), rec.Values)
+	}
+	for mediaType, count := range want {
+		if got, _ := rec.Value("streams_by_media_type_total", mediaType); got != count {
+			t.Errorf("streams_by_media_type_total{%s} = %v, want %v", mediaType, got, count)
+		}
+	}
+}
+
+func TestSessionsByNetwork(t *testing.T) {
+	session := func(remote string) jellyfin.Session { return jellyfin.Session{RemoteEndPoint: remote} }
+	tests := []struct {
+		name         string
+		localAddress string
+		sessions     []jellyfin.Session
+		want         map[string]float64
+	}{
+		{
+			name:         "ipv4",
+			localAddress: "http://192.168.1.10:8096",
+			sessions: []jellyfin.Session{
+				session("192.168.1.55"),
+				session("192.168.1.254:51234"),
+				session("192.168.2.5"),
+				session("203.0.113.7:51234"),
+				session("127.0.0.1"),
+				session(""),
+			},
+			want: map[string]float64{"local": 3, "remote": 2},
+		},
+		{
+			name:         "ipv6",
+			localAddress: "http://[2001:db8:1:2::10]:8096",
+			sessions: []jellyfin.Session{
+				session("[2001:db8:1:2::77]:51234"),
+				session("2001:db8:1:3::77"),
+				session("192.168.1.55"),
+			},
+			want: map[string]float64{"local": 1, "remote": 2},
+		},
+		{
+			name:     "unknown local address",
+			sessions: []jellyfin.Session{session("192.168.1.55")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": jsonResponse(jellyfin.SystemInfo{Version: "10.8.13", LocalAddress: tt.localAddress}),
+				"/Sessions":    jsonResponse(tt.sessions),
+			})
+			rec := NewTestRecorder()
+			err := c.fetchSystemInfo(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.fetchSessions(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := countSeries(rec, "sessions_by_network_total"); n != len(tt.want) {
+				t.Errorf("sessions_by_network_total has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for network, count := range tt.want {
+				if got, _ := rec.Value("sessions_by_network_total", network); got != count {
+					t.Errorf("sessions_by_network_total{%s} = %v, want %v", network, got, count)
+				}
+			}
+		})
+	}
+}
+
+func TestUserStreamsByMediaType(t *testing.T) {
+	withType := func(id, user, mediaType string) jellyfin.Session {
+		s := playing(id, user)
+		s.NowPlayingItem.Type = mediaType
+		return s
+	}
+	sessions := []jellyfin.Session{
+		withType("s1", "alice", "Movie"),
+		withType("s2", "alice", "Episode"),
+		withType("s3", "alice", "Episode"),
+		withType("s4", "bob", "Audio"),
+		withType("s5", "bob", "Audio"),
+		{ID: "s6", UserName: "bob"},
+		withType("s7", "carol", "Movie"),
+	}
+	tests := []struct {
+		name string
+		args []string
+		want map[[2]string]float64
+	}{
+		{
+			name: "all users",
+			want: map[[2]string]float64{
+				{"alice", "Movie"}: 1, {"alice", "Episode"}: 2,
+				{"bob", "Audio"}: 2, {"bob", "none"}: 1,
+				{"carol", "Movie"}: 1,
+			},
+		},
+		{
+			name: "limited users",
+			args: []string{"--max-user-label-count=2"},
+			want: map[[2]string]float64{
+				{"alice", "Movie"}: 1, {"alice", "Episode"}: 2,
+				{"bob", "Audio"}: 2, {"bob", "none"}: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rec := fetchSessions(t, sessions, tt.args...)
+			if n := countSeries(rec, "user_streams_by_media_type_total"); n != len(tt.want) {
+				t.Errorf("user_streams_by_media_type_total has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for labels, want := range tt.want {
+				if got, _ := rec.Value("user_streams_by_media_type_total", labels[0], labels[1]); got != want {
+					t.Errorf("user_streams_by_media_type_total{%s,%s} = %v, want %v", labels[0], labels[1], got, want)
+				}
+			}
+		})
+	}
+}
+
+// histogram returns the sample count, sum and cumulative bucket counts of h.
+func histogram(t *testing.T, h prom.Histogram) (uint64, float64, map[float64]uint64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	buckets := make(map[float64]uint64)
+	for _, bucket := range m.Histogram.Bucket {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum(), buckets
+}
+
+func TestActiveStreamBitrates(t *testing.T) {
+	sessions := []jellyfin.Session{
+		playing("s1", "alice", jellyfin.MediaStream{Type: "Video", BitRate: 3e6}, jellyfin.MediaStream{Type: "Audio", BitRate: 640e3}),
+		playing("s2", "bob", jellyfin.MediaStream{Type: "Video", BitRate: 20e6}),
+		// streams without a known bitrate aren't observed
+		playing("s3", "carol", jellyfin.MediaStream{Type: "Video"}),
+		{ID: "s4", UserName: "dave"},
+	}
+	c, _ := fetchSessions(t, sessions)
+
+	count, sum, buckets := histogram(t, c.streamBitrates)
+	if count != 2 || sum != 23e6 {
+		t.Errorf("active_stream_bitrate_bits count %d, sum %v, want 2 and 23e6", count, sum)
+	}
+	want := map[float64]uint64{500e3: 0, 1e6: 0, 2e6: 0, 4e6: 1, 8e6: 1, 15e6: 1, 25e6: 2, 50e6: 2}
+	for bound, cumulative := range want {
+		if buckets[bound] != cumulative {
+			t.Errorf("active_stream_bitrate_bits bucket %v = %d, want %d", bound, buckets[bound], cumulative)
+		}
+	}
+}
+
+func TestActiveAudioStreamBitrates(t *testing.T) {
+	sessions := []jellyfin.Session{
+		playing("s1", "alice", jellyfin.MediaStream{Type: "Video", BitRate: 8e6}, jellyfin.MediaStream{Type: "Audio", BitRate: 640e3}),
+		playing("s2", "bob", jellyfin.MediaStream{Type: "Audio", BitRate: 320e3}),
+		playing("s3", "carol", jellyfin.MediaStream{Type: "Audio", BitRate: 96e3}),
+	}
+	c, _ := fetchSessions(t, sessions)
+
+	// the video stream of s1 is only observed by active_stream_bitrate_bits
+	count, sum, buckets := histogram(t, c.audioBitrates)
+	if count != 3 || sum != 1056e3 {
+		t.Errorf("active_audio_stream_bitrate_bits count %d, sum %v, want 3 and 1056e3", count, sum)
+	}
+	want := map[float64]uint64{64e3: 0, 128e3: 1, 192e3: 1, 256e3: 1, 320e3: 2, 512e3: 2, 1024e3: 3}
+	for bound, cumulative := range want {
+		if buckets[bound] != cumulative {
+			t.Errorf("active_audio_stream_bitrate_bits bucket %v = %d, want %d", bound, buckets[bound], cumulative)
+		}
+	}
+	if count, _, _ := histogram(t, c.streamBitrates); count != 1 {
+		t.Errorf("active_stream_bitrate_bits observed %d streams, want the 1 video stream", count)
+	}
+}
+
+func TestTranscodeProgress(t *testing.T) {
+	transcoding := func(id, user string, progress *float64) jellyfin.Session {
+		s := playing(id, user)
+		s.TranscodingInfo = &jellyfin.TranscodingInfo{Bitrate: 3e6, CompletionPercentage: progress}
+		return s
+	}
+	percent := func(p float64) *float64 { return &p }
+	sessions := []jellyfin.Session{
+		transcoding("s1", "alice", percent(42.5)),
+		transcoding("s2", "bob", percent(100.3)),
+		transcoding("s3", "carol", percent(-1)),
+		// no progress reported yet
+		transcoding("s4", "dave", nil),
+		playing("s5", "erin"),
+		{ID: "s6", UserName: "frank"},
+	}
+	tests := []struct {
+		name string
+		args []string
+		want map[[2]string]float64
+	}{
+		{
+			name: "enabled",
+			args: []string{"--transcode-progress-metrics-enabled"},
+			want: map[[2]string]float64{{"s1", "alice"}: 42.5, {"s2", "bob"}: 100, {"s3", "carol"}: 0},
+		},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rec := fetchSessions(t, sessions, tt.args...)
+			if n := countSeries(rec, "transcode_progress_percent"); n != len(tt.want) {
+				t.Errorf("transcode_progress_percent has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for labels, want := range tt.want {
+				if got, _ := rec.Value("transcode_progress_percent", labels[0], labels[1]); got != want {
+					t.Errorf("transcode_progress_percent{%s,%s} = %v, want %v", labels[0], labels[1], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleSessions(t *testing.T) {
+	now := time.Now()
+	session := func(id string, idle time.Duration) jellyfin.Session {
+		return jellyfin.Session{ID: id, UserName: "alice", LastActivityDate: now.Add(-idle)}
+	}
+	sessions := []jellyfin.Session{
+		session("s1", 10*time.Second),
+		session("s2", 4*time.Minute),
+		session("s3", 6*time.Minute),
+		session("s4", 3*time.Hour),
+		// no activity date
+		{ID: "s5", UserName: "bob"},
+	}
+	tests := []struct {
+		name string
+		args []string
+		want float64
+	}{
+		{"default threshold", nil, 2},
+		{"lower threshold", []string{"--idle-session-threshold=1m"}, 3},
+		{"higher threshold", []string{"--idle-session-threshold=24h"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rec := fetchSessions(t, sessions, tt.args...)
+			if got, ok := rec.Value("idle_sessions_total"); !ok || got != tt.want {
+				t.Errorf("idle_sessions_total = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionsByIPVersion(t *testing.T) {
+	sessions := []jellyfin.Session{
+		{ID: "s1", RemoteEndPoint: "192.168.1.20:51234"},
+		{ID: "s2", RemoteEndPoint: "203.0.113.7:443"},
+		{ID: "s3", RemoteEndPoint: "[2001:db8::7]:51234"},
+		{ID: "s4"},
+	}
+	_, rec := fetchSessions(t, sessions)
+	for ipVersion, want := range map[string]float64{"ipv4": 2, "ipv6": 1, "local": 1} {
+		if got, ok := rec.Value("sessions_by_ip_version_total", ipVersion); !ok || got != want {
+			t.Errorf("sessions_by_ip_version_total{%s} = %v, %v, want %v", ipVersion, got, ok, want)
+		}
+	}
+}
+
+func TestSessionsByTLS(t *testing.T) {
+	sessions := []jellyfin.Session{
+		{ID: "s1", RemoteEndPoint: "192.168.1.20:51234", Client: "Jellyfin Android TV", ApplicationVersion: "0.16.0"},
+		{ID: "s2", RemoteEndPoint: "203.0.113.7:443", Client: "Jellyfin Web", ApplicationVersion: "10.8.13"},
+		{ID: "s3"},
+	}
+	_, rec := fetchSessions(t, sessions)
+	// Jellyfin doesn't tell whether a session connected over tls
+	for tls, want := range map[string]float64{"unknown": 3} {
+		if got, ok := rec.Value("sessions_by_tls_total", tls); !ok || got != want {
+			t.Errorf("sessions_by_tls_total{%s} = %v, %v, want %v", tls, got, ok, want)
+		}
+	}
+	for _, tls := range []string{"true", "false"} {
+		if got, ok := rec.Value("sessions_by_tls_total", tls); ok {
+			t.Errorf("sessions_by_tls_total{%s} = %v, want no series", tls, got)
+		}
+	}
+}
+
+func TestTranscodingConversions(t *testing.T) {
+	transcoding := func(id, item string, to jellyfin.TranscodingInfo, streams ...jellyfin.MediaStream) jellyfin.Session {
+		s := playing(id, "alice", streams...)
+		s.NowPlayingItem.ID = item
+		s.TranscodingInfo = &to
+		return s
+	}
+	h264 := jellyfin.MediaStream{Type: "Video", Codec: "H264"}
+	flac := jellyfin.MediaStream{Type: "Audio", Codec: "flac"}
+	toHEVC := jellyfin.TranscodingInfo{VideoCodec: "hevc", AudioCodec: "aac"}
+	toAAC := jellyfin.TranscodingInfo{AudioCodec: "aac"}
+
+	scrapes := []struct {
+		sessions []jellyfin.Session
+		want     map[[2]string]float64
+	}{
+		{
+			sessions: []jellyfin.Session{transcoding("s1", "movie", toHEVC, h264, flac)},
+			want:     map[[2]string]float64{{"h264", "hevc"}: 1},
+		},
+		{
+			// s1 is still transcoding, s2 started and s3 plays directly
+			sessions: []jellyfin.Session{
+				transcoding("s1", "movie", toHEVC, h264, flac),
+				transcoding("s2", "song", toAAC, flac),
+				playing("s3", "bob", h264),
+			},
+			want: map[[2]string]float64{{"h264", "hevc"}: 1, {"flac", "aac"}: 1},
+		},
+		{
+			// s1 moved on to the next item, s2 stopped
+			sessions: []jellyfin.Session{transcoding("s1", "sequel", toHEVC, h264)},
+			want:     map[[2]string]float64{{"h264", "hevc"}: 2, {"flac", "aac"}: 1},
+		},
+		{
+			// s2 starts the same song again, a codec Jellyfin doesn't report
+			// is unknown
+			sessions: []jellyfin.Session{
+				transcoding("s1", "sequel", toHEVC, h264),
+				transcoding("s2", "song", toAAC, flac),
+				transcoding("s4", "clip", jellyfin.TranscodingInfo{}, jellyfin.MediaStream{Type: "Video"}),
+			},
+			want: map[[2]string]float64{{"h264", "hevc"}: 2, {"flac", "aac"}: 2, {"unknown", "unknown"}: 1},
+		},
+		{sessions: nil, want: map[[2]string]float64{{"h264", "hevc"}: 2, {"flac", "aac"}: 2, {"unknown", "unknown"}: 1}},
+	}
+
+	var sessions atomic.Value
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Sessions": func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(sessions.Load())(w, r)
+	}})
+	for i, s := range scrapes {
+		sessions.Store(s.sessions)
+		rec := NewTestRecorder()
+		if err := c.fetchSessions(context.Background(), *c.client, rec); err != nil {
+			t.Fatal(err)
+		}
+		if n := countSeries(rec, "transcoding_conversions_total"); n != len(s.want) {
+			t.Errorf("scrape %d: transcoding_conversions_total has %d series, want %d: %v", i, n, len(s.want), rec.Values)
+		}
+		for codecs, want := range s.want {
+			if got, _ := rec.Value("transcoding_conversions_total", codecs[0], codecs[1]); got != want {
+				t.Errorf("scrape %d: transcoding_conversions_total{%s, %s} = %v, want %v", i, codecs[0], codecs[1], got, want)
+			}
+		}
+	}
+}
+
+// fakeCountries resolves the addresses in its map, and fails for the others.
+type fakeCountries map[string]string
+
+func (f fakeCountries) Country(ip net.IP) (string, error) {
+	country, ok := f[ip.String()]
+	if !ok {
+		return "", errors.New("address not in the database")
+	}
+	return country, nil
+}
+
+func TestSessionsByCountry(t *testing.T) {
+	resolver := fakeCountries{
+		"198.51.100.7": "SE",
+		"198.51.100.8": "SE",
+		"203.0.113.9":  "FI",
+		"2001:db8::1":  "DE",
+		"192.0.2.1":    "",
+	}
+	remote := func(address string) jellyfin.Session { return jellyfin.Session{ID: address, RemoteEndPoint: address} }
+	sessions := []jellyfin.Session{
+		remote("198.51.100.7:51234"), remote("198.51.100.8"), remote("203.0.113.9:443"),
+		remote("[2001:db8::1]:8920"), remote("192.0.2.1"), remote("192.0.2.2"),
+		// private and loopback addresses and sessions without address are
+		// local
+		remote("192.168.1.20:50000"), remote("127.0.0.1"), remote("fe80::1"), {ID: "no address"},
+	}
+	tests := []struct {
+		name     string
+		resolver countryResolver
+		local    string
+		want     map[string]float64
+	}{
+		{name: "no database"},
+		{
+			name:     "countries",
+			resolver: resolver,
+			want:     map[string]float64{"SE": 2, "FI": 1, "DE": 1, "unknown": 2},
+		},
+		{
+			name:     "local network of jellyfin",
+			resolver: resolver,
+			local:    "203.0.113.0/24",
+			want:     map[string]float64{"SE": 2, "DE": 1, "unknown": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Sessions": jsonResponse(sessions)})
+			c.countries = tt.resolver
+			if tt.local != "" {
+				_, network, err := net.ParseCIDR(tt.local)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.localNetwork = network
+			}
+			rec := NewTestRecorder()
+			if err := c.fetchSessions(context.Background(), *c.client, rec); err != nil {
+				t.Fatal(err)
+			}
+			if n := countSeries(rec, "sessions_by_country_total"); n != len(tt.want) {
+				t.Errorf("sessions_by_country_total has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for country, want := range tt.want {
+				if got, _ := rec.Value("sessions_by_country_total", country); got != want {
+					t.Errorf("sessions_by_country_total{%s} = %v, want %v", country, got, want)
+				}
+			}
+		})
+	}
+}
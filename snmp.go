@@ -0,0 +1,122 @@
+package main
+
+// metricOIDs are the object ids of the metrics below --snmp-oid-base, the
+// metrics of metricInfos under .1 and the histograms under .2. Assigned ids
+// must never change, new metrics get the next free id.
+var metricOIDs = map[string]string{
+	"version":                            "1.1",
+	"server_address_info":                "1.2",
+	"wan_address_info":                   "1.3",
+	"target_info":                        "1.4",
+	"system_encoder_info":                "1.5",
+	"system_info":                        "1.6",
+	"feature_compatibility":              "1.7",
+	"maintenance_mode":                   "1.8",
+	"movieCount":                         "1.9",
+	"seriesCount":                        "1.10",
+	"remote_access_enabled":              "1.11",
+	"https_enabled":                      "1.12",
+	"concurrent_stream_limit_configured": "1.13",
+	"quick_connect_enabled":              "1.14",
+	"transcoding_hardware_acceleration_enabled":   "1.15",
+	"transcoding_hardware_acceleration_type":      "1.16",
+	"user_max_sessions_configured":                "1.17",
+	"user_max_bitrate_configured_bits_per_second": "1.18",
+	"user_last_activity_timestamp_seconds":        "1.19",
+	"users_by_auth_provider_total":                "1.20",
+	"scheduled_tasks_total":                       "1.21",
+	"scheduled_tasks_by_state_total":              "1.22",
+	"library_scan_in_progress":                    "1.23",
+	"library_last_scan_timestamp_seconds":         "1.24",
+	"notifications_unread_total":                  "1.25",
+	"series_completion_ratio":                     "1.26",
+	"music_album_track_ratio":                     "1.27",
+	"session_estimated_bandwidth_bits_per_second": "1.28",
+	"sessions_by_protocol_total":                  "1.29",
+	"streams_by_media_type_total":                 "1.30",
+	"transcoding_conversions_total":               "1.31",
+	"idle_sessions_total":                         "1.32",
+	"sessions_by_ip_version_total":                "1.33",
+	"sessions_by_tls_total":                       "1.34",
+	"sessions_by_network_total":                   "1.35",
+	"user_streams_by_media_type_total":            "1.36",
+	"transcode_progress_percent":                  "1.37",
+	"client_version_total":                        "1.38",
+	"items_in_progress_total":                     "1.39",
+	"favorite_items_total":                        "1.40",
+	"item_play_count_distribution":                "1.41",
+	"items_added_last_day_total":                  "1.42",
+	"items_added_last_week_total":                 "1.43",
+	"items_added_per_day_7d_avg":                  "1.44",
+	"items_with_trickplay_total":                  "1.45",
+	"movies_with_trailer_total":                   "1.46",
+	"movies_without_trailer_total":                "1.47",
+	"episodes_with_intro_data_total":              "1.48",
+	"episodes_without_intro_data_total":           "1.49",
+	"library_chapters_total":                      "1.50",
+	"items_with_chapters_total":                   "1.51",
+	"items_with_nfo_total":                        "1.52",
+	"iptv_channels_total":                         "1.53",
+	"iptv_channels_by_group_total":                "1.54",
+	"library_file_extension_total":                "1.55",
+	"subtitle_format_total":                       "1.56",
+	"items_with_external_subtitles_total":         "1.57",
+	"items_with_embedded_subtitles_total":         "1.58",
+	"metadata_source_total":                       "1.59",
+	"item_play_count":                             "1.60",
+	"series_play_count":                           "1.61",
+	"album_play_count":                            "1.62",
+	"virtual_folders_total":                       "1.63",
+	"virtual_folder_item_count":                   "1.64",
+	"library_item_count":                          "1.65",
+	"shared_libraries_total":                      "1.66",
+	"library_shares_total":                        "1.67",
+	"admin_actions_total":                         "1.68",
+	"image_requests_total":                        "1.69",
+	"login_failures_total":                        "1.70",
+	"items_added_total":                           "1.71",
+	"items_deleted_total":                         "1.72",
+	"search_index_items_total":                    "1.73",
+	"search_index_last_updated_timestamp_seconds": "1.74",
+	"users_with_2fa_total":                        "1.75",
+	"last_backup_timestamp_seconds":               "1.76",
+	"last_backup_size_bytes":                      "1.77",
+	"database_size_bytes":                         "1.78",
+	"log_file_size_bytes":                         "1.79",
+	"server_memory_usage_bytes":                   "1.80",
+	"server_cpu_usage_percent":                    "1.81",
+	"server_disk_read_bytes_total":                "1.82",
+	"server_disk_write_bytes_total":               "1.83",
+	"up":                                          "1.84",
+	"metrics_stale":                               "1.85",
+	"endpoint_healthy":                            "1.86",
+	"ssl_cert_expiry_timestamp_seconds":           "1.87",
+	"collection_summary":                          "1.88",
+	"collection_metric_count":                     "1.89",
+	"collection_error_count":                      "1.90",
+	"tls_session_reuse_total":                     "1.91",
+	"api_redirects_total":                         "1.92",
+	"scrape_errors_total":                         "1.93",
+	"exporter_config_hash":                        "1.94",
+	"exporter_inflight_scrapes":                   "1.95",
+	"exporter_goroutines_delta":                   "1.96",
+	"metric_cardinality":                          "1.97",
+	"server_restart_total":                        "1.98",
+	"api_connection_reuse_total":                  "1.99",
+	"api_new_connections_total":                   "1.100",
+	"subtitle_download_language_configured":       "1.101",
+	"sessions_by_country_total":                   "1.102",
+	"users_total":                                 "1.103",
+	"users_never_logged_in_total":                 "1.104",
+	"server_config_changes_total":                 "1.105",
+	"api_keys_total":                              "1.106",
+	"items_unidentified_total":                    "1.107",
+	"circuit_breaker_recovery_timestamp_seconds":  "1.108",
+	"circuit_breaker_open_duration_seconds":       "1.109",
+	"items_total":                                 "1.110",
+	"api_request_duration_seconds":                "2.1",
+	"api_response_bytes":                          "2.2",
+	"readiness_check_duration_seconds":            "2.3",
+	"active_stream_bitrate_bits":                  "2.4",
+	"active_audio_stream_bitrate_bits":            "2.5",
+}
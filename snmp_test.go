@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramNames are the metrics exported as histograms, which aren't in
+// metricInfos.
+var histogramNames = []string{
+	"api_request_duration_seconds", "api_response_bytes", "readiness_check_duration_seconds",
+	"active_stream_bitrate_bits", "active_audio_stream_bitrate_bits",
+}
+
+func TestMetricOIDs(t *testing.T) {
+	owners := make(map[string]string, len(metricOIDs))
+	check := func(name, branch string) {
+		oid, ok := metricOIDs[name]
+		if !ok {
+			t.Errorf("%s has no oid", name)
+			return
+		}
+		if !strings.HasPrefix(oid, branch) || !regexp.MustCompile(`^\d+\.[1-9]\d*$`).MatchString(oid) {
+			t.Errorf("%s has oid %s, want one below %s", name, oid, branch)
+		}
+		if owner, ok := owners[oid]; ok {
+			t.Errorf("%s and %s share the oid %s", name, owner, oid)
+		}
+		owners[oid] = name
+	}
+	for _, info := range metricInfos {
+		check(info.Name, "1.")
+	}
+	for _, name := range histogramNames {
+		check(name, "2.")
+	}
+	if len(owners) != len(metricOIDs) {
+		t.Errorf("%d oids of metrics that don't exist", len(metricOIDs)-len(owners))
+	}
+}
+
+func TestSNMPCompatLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		base string
+	}{
+		{"default base", []string{"--snmp-compat-labels"}, "1.3.6.1.4.1.99999.1"},
+		{"configured base", []string{"--snmp-compat-labels", "--snmp-oid-base=1.3.6.1.4.1.4242"}, "1.3.6.1.4.1.4242"},
+		{"disabled", nil, ""},
+	}
+	pattern := regexp.MustCompile(`fqName: "jellyfin_([^"]*)"`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": rawJSON(`{"Version": "10.8.13"}`),
+				"/Users/Me":    rawJSON(`{"Name": "admin", "Policy": {"IsAdministrator": true}}`),
+			}, tt.args...)
+			c, err := setupCollector(c.Config, io.Discard, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			descs := make(chan *prom.Desc)
+			go func() {
+				c.Describe(descs)
+				close(descs)
+			}()
+			described := 0
+			for desc := range descs {
+				match := pattern.FindStringSubmatch(desc.String())
+				if match == nil {
+					t.Errorf("unexpected metric %s", desc)
+					continue
+				}
+				described++
+				labeled := strings.Contains(desc.String(), "oid=")
+				if tt.base == "" {
+					if labeled {
+						t.Errorf("%s has an oid label without --snmp-compat-labels", match[1])
+					}
+					continue
+				}
+				want := `oid="` + tt.base + "." + metricOIDs[match[1]] + `"`
+				if !strings.Contains(desc.String(), want) {
+					t.Errorf("%s doesn't have the label %s: %s", match[1], want, desc)
+				}
+			}
+			if described < len(metricInfos) {
+				t.Errorf("%d metrics described, want at least %d", described, len(metricInfos))
+			}
+		})
+	}
+}
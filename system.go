@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+func (c *JellyfinGetCollector) fetchSystemInfo(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	response, err := client.GetSystemInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.networkMu.RLock()
+	known := c.localNetwork != nil
+	c.networkMu.RUnlock()
+	if !known {
+		c.setLocalNetwork(response)
+	}
+
+	rec.RecordGauge("version", 1, response.Version)
+	rec.RecordGauge("system_encoder_info", 1, response.EncoderVersion(), response.EncoderPath)
+	rec.RecordGauge("system_info", 1, response.DotnetVersion())
+	for feature, supported := range c.features.supported() {
+		rec.RecordGauge("feature_compatibility", 1, feature, strconv.Itoa(int(boolToFloat(supported))))
+	}
+	rec.RecordGauge("target_info", 1, c.hostLabel(), response.Version,
+		response.OperatingSystem, response.SystemArchitecture)
+	if response.LocalAddress != "" {
+		rec.RecordGauge("server_address_info", 1, "local", response.LocalAddress)
+	}
+	if response.WanAddress != "" {
+		rec.RecordGauge("server_address_info", 1, "wan", response.WanAddress)
+	} else {
+		requestLog(ctx).Debug("jellyfin reports no wan address")
+	}
+	rec.RecordGauge("wan_address_info", 1, response.WanAddress)
+	rec.RecordGauge("maintenance_mode", boolToFloat(response.MaintenanceMode))
+	if response.StartupTime != nil {
+		c.detectRestartFromStartup(ctx, *response.StartupTime)
+	}
+
+	if c.Config.StorageDetails {
+		if response.DatabaseSizeBytes != nil {
+			rec.RecordGauge("database_size_bytes", *response.DatabaseSizeBytes)
+		}
+		if response.LogFileSizeBytes != nil {
+			rec.RecordGauge("log_file_size_bytes", *response.LogFileSizeBytes)
+		}
+	}
+	if response.MemoryUsageBytes != nil {
+		rec.RecordGauge("server_memory_usage_bytes", *response.MemoryUsageBytes)
+	}
+	if response.CPUUsagePercent != nil {
+		rec.RecordGauge("server_cpu_usage_percent", *response.CPUUsagePercent)
+	}
+	if c.Config.IOMetrics {
+		if response.DiskReadBytes != nil {
+			rec.RecordCounter("server_disk_read_bytes_total", *response.DiskReadBytes)
+		}
+		if response.DiskWriteBytes != nil {
+			rec.RecordCounter("server_disk_write_bytes_total", *response.DiskWriteBytes)
+		}
+	}
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchConfiguration(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	config, err := client.GetConfiguration(ctx)
+	if jellyfin.IsStatus(err, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to read the server configuration, skipping configuration metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("remote_access_enabled", boolToFloat(config.EnableRemoteAccess))
+	rec.RecordGauge("https_enabled", boolToFloat(config.EnableHTTPS))
+	if config.MaxConcurrentStreams != nil {
+		rec.RecordGauge("concurrent_stream_limit_configured", *config.MaxConcurrentStreams)
+	}
+	if c.Config.SubtitleConfig {
+		for _, language := range config.SubtitleDownloadLanguages {
+			rec.RecordGauge("subtitle_download_language_configured", 1, language)
+		}
+	}
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchQuickConnect(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	enabled, err := client.GetQuickConnectEnabled(ctx)
+	if jellyfin.IsStatus(err, http.StatusUnauthorized, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to read the quick connect status, skipping quick connect metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("quick_connect_enabled", boolToFloat(enabled))
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchAPIKeys(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	keys, err := client.GetAPIKeys(ctx)
+	if jellyfin.IsStatus(err, http.StatusUnauthorized, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to list the api keys, skipping api key metrics")
+		return nil
+	}
+	if jellyfin.IsStatus(err, http.StatusNotFound) {
+		requestLog(ctx).WithError(err).Warn("jellyfin does not list api keys, skipping api key metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("api_keys_total", float64(len(keys)))
+	return nil
+}
+
+func (c *JellyfinGetCollector) fetchEncodingConfiguration(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	config, err := client.GetEncodingConfiguration(ctx)
+	if jellyfin.IsStatus(err, http.StatusForbidden) {
+		requestLog(ctx).WithError(err).
+			Warn("api key is not allowed to read the encoding configuration, skipping hardware metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	accel := strings.ToLower(config.HardwareAccelerationType)
+	if accel == "" {
+		accel = "none"
+	}
+
+	rec.RecordGauge("transcoding_hardware_acceleration_enabled", boolToFloat(accel != "none"))
+	rec.RecordGauge("transcoding_hardware_acceleration_type", 1, accel)
+	return nil
+}
+
+// setLocalNetwork remembers the network of the server's local address: the
+// /24 of IPv4 addresses or the /64 of IPv6 addresses.
+func (c *JellyfinGetCollector) setLocalNetwork(info *jellyfin.SystemInfo) {
+	ip := info.LocalIP()
+	if ip == nil {
+		return
+	}
+	bits := 64
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 24
+	}
+	mask := net.CIDRMask(bits, len(ip)*8)
+
+	c.networkMu.Lock()
+	c.localNetwork = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	c.networkMu.Unlock()
+}
+
+// fetchSearchIndex reads the state of the search index. The endpoint isn't
+// part of stock Jellyfin, only builds with a search index admin endpoint
+// provide it.
+func (c *JellyfinGetCollector) fetchSearchIndex(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	index, err := client.GetSearchIndex(ctx)
+	if jellyfin.IsStatus(err, http.StatusNotFound) {
+		requestLog(ctx).WithError(err).
+			Debug("jellyfin does not provide search index information, skipping search metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lastUpdated float64
+	if !index.LastUpdated.IsZero() {
+		lastUpdated = float64(index.LastUpdated.Unix())
+	}
+	rec.RecordGauge("search_index_items_total", index.ItemCount)
+	rec.RecordGauge("search_index_last_updated_timestamp_seconds", lastUpdated)
+	return nil
+}
+
+// fetchBackupStatus reads the last backup. Not all Jellyfin builds include
+// backups, those without respond 404.
+func (c *JellyfinGetCollector) fetchBackupStatus(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	backup, err := client.GetBackupStatus(ctx)
+	if jellyfin.IsStatus(err, http.StatusNotFound) {
+		requestLog(ctx).WithError(err).
+			Warn("jellyfin does not provide backup status, skipping backup metrics")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lastBackup float64
+	if backup.LastBackupDate != nil && !backup.LastBackupDate.IsZero() {
+		lastBackup = float64(backup.LastBackupDate.Unix())
+	}
+	rec.RecordGauge("last_backup_timestamp_seconds", lastBackup)
+	rec.RecordGauge("last_backup_size_bytes", backup.SizeBytes)
+	return nil
+}
+
+// detectRestartFromStartup counts a restart if the server start time
+// differs from the one of the previous call to /System/Info.
+func (c *JellyfinGetCollector) detectRestartFromStartup(ctx context.Context, startup time.Time) {
+	c.restartsMu.Lock()
+	defer c.restartsMu.Unlock()
+	if !c.startupTime.IsZero() && !startup.Equal(c.startupTime) {
+		c.restarts++
+		requestLog(ctx).WithField("started", startup.Format(time.RFC3339)).Warn("jellyfin restarted")
+	}
+	c.startupTime = startup
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// systemInfo is a /System/Info response of Jellyfin 10.8 with the fields
+// added by extra, such as `"MaintenanceMode": true`.
+func systemInfo(extra string) string {
+	if extra != "" {
+		extra = ", " + extra
+	}
+	return `{
+		"LocalAddress": "http://192.168.1.10:8096",
+		"ServerName": "media",
+		"Version": "10.8.13",
+		"ProductName": "Jellyfin Server",
+		"OperatingSystem": "Linux",
+		"Id": "1f5c7e1f8c1d4d4c9e5a8b3c2d1e0f9a",
+		"StartupWizardCompleted": true,
+		"OperatingSystemDisplayName": "Linux",
+		"HasPendingRestart": false,
+		"IsShuttingDown": false,
+		"SupportsLibraryMonitor": true,
+		"WebSocketPortNumber": 8096,
+		"CanSelfRestart": true,
+		"CanLaunchWebBrowser": false,
+		"ProgramDataPath": "/config",
+		"WebPath": "/jellyfin/jellyfin-web",
+		"ItemsByNamePath": "/config/metadata",
+		"CachePath": "/cache",
+		"LogPath": "/config/log",
+		"InternalMetadataPath": "/config/metadata",
+		"TranscodingTempPath": "/config/transcodes",
+		"HasUpdateAvailable": false,
+		"EncoderLocation": "System",
+		"SystemArchitecture": "X64",
+		"EncoderPath": "/usr/lib/jellyfin-ffmpeg/ffmpeg"` + extra + `
+	}`
+}
+
+// fetchSystemInfo calls fetchSystemInfo against a fake /System/Info
+// answering body and returns the recorded values.
+func fetchSystemInfo(t *testing.T, body string, args ...string) *TestRecorder {
+	t.Helper()
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": rawJSON(body)}, args...)
+	rec := NewTestRecorder()
+	err := c.fetchSystemInfo(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  float64
+	}{
+		{"enabled", `"MaintenanceMode": true`, 1},
+		{"disabled", `"MaintenanceMode": false`, 0},
+		{"missing on older builds", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/Items/Counts": jsonResponse(map[string]float64{}),
+				"/System/Info":  rawJSON(systemInfo(tt.extra)),
+			})
+			if got, ok := scrape(t, c).Value("maintenance_mode"); !ok || got != tt.want {
+				t.Errorf("maintenance_mode = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+		want    map[string]float64
+	}{
+		{
+			name:    "ok",
+			handler: rawJSON(`{"EnableRemoteAccess": true, "EnableHttps": false, "EnableUPnP": false, "PublicPort": 8096}`),
+			want:    map[string]float64{"remote_access_enabled": 1, "https_enabled": 0},
+		},
+		{
+			name:    "https only",
+			handler: rawJSON(`{"EnableRemoteAccess": false, "EnableHttps": true}`),
+			want:    map[string]float64{"remote_access_enabled": 0, "https_enabled": 1},
+		},
+		{
+			name:    "forbidden for user api keys",
+			handler: statusResponse(http.StatusForbidden),
+			want:    map[string]float64{},
+		},
+		{
+			name:    "not found",
+			handler: statusResponse(http.StatusNotFound),
+			wantErr: true,
+			want:    map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Configuration": tt.handler})
+			rec := NewTestRecorder()
+			err := c.fetchConfiguration(context.Background(), *c.client, rec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if len(rec.Values) != len(tt.want) {
+				t.Errorf("recorded %v, want %v", rec.Values, tt.want)
+			}
+			for name, want := range tt.want {
+				if got, ok := rec.Value(name); !ok || got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchQuickConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    float64
+		ok      bool
+	}{
+		{"enabled", rawJSON(`true`), 1, true},
+		{"disabled", rawJSON(`false`), 0, true},
+		{"unauthorized", statusResponse(http.StatusUnauthorized), 0, false},
+		{"forbidden", statusResponse(http.StatusForbidden), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/QuickConnect/Enabled": tt.handler})
+			rec := NewTestRecorder()
+			err := c.fetchQuickConnect(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := rec.Value("quick_connect_enabled"); got != tt.want || ok != tt.ok {
+				t.Errorf("quick_connect_enabled = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConcurrentStreamLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want float64
+		ok   bool
+	}{
+		{"configured", `{"MaxConcurrentStreams": 3, "RemoteClientBitrateLimit": 8000000}`, 3, true},
+		{"unlimited", `{"MaxConcurrentStreams": 0}`, 0, true},
+		// the bitrate limit isn't a stream limit
+		{"not configured", `{"RemoteClientBitrateLimit": 8000000}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Configuration": rawJSON(tt.body)})
+			rec := NewTestRecorder()
+			err := c.fetchConfiguration(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := rec.Value("concurrent_stream_limit_configured"); got != tt.want || ok != tt.ok {
+				t.Errorf("concurrent_stream_limit_configured = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFetchEncodingConfiguration(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantEnabled float64
+		wantType    string
+	}{
+		{
+			name: "nvenc",
+			handler: rawJSON(`{"EncodingThreadCount": -1, "HardwareAccelerationType": "nvenc",
+				"EnableHardwareEncoding": true, "HardwareDecodingCodecs": ["h264", "hevc"]}`),
+			wantEnabled: 1,
+			wantType:    "nvenc",
+		},
+		{"vaapi", rawJSON(`{"HardwareAccelerationType": "VAAPI"}`), 1, "vaapi"},
+		{"none", rawJSON(`{"HardwareAccelerationType": "none"}`), 0, "none"},
+		{"empty", rawJSON(`{"HardwareAccelerationType": ""}`), 0, "none"},
+		{"forbidden", statusResponse(http.StatusForbidden), 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Configuration/encoding": tt.handler},
+				"--hardware-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchEncodingConfiguration(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantType == "" {
+				if len(rec.Values) != 0 {
+					t.Errorf("recorded %v without access", rec.Values)
+				}
+				return
+			}
+			if got, _ := rec.Value("transcoding_hardware_acceleration_enabled"); got != tt.wantEnabled {
+				t.Errorf("transcoding_hardware_acceleration_enabled = %v, want %v", got, tt.wantEnabled)
+			}
+			if got, ok := rec.Value("transcoding_hardware_acceleration_type", tt.wantType); !ok || got != 1 {
+				t.Errorf("transcoding_hardware_acceleration_type{%s} = %v, %v, want 1", tt.wantType, got, ok)
+			}
+		})
+	}
+}
+
+func TestFetchSearchIndex(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    http.HandlerFunc
+		wantItems   float64
+		wantUpdated float64
+		wantOK      bool
+	}{
+		{
+			name:        "available",
+			response:    rawJSON(`{"ItemCount": 5120, "LastUpdated": "2024-03-01T20:15:31.4567891Z"}`),
+			wantItems:   5120,
+			wantUpdated: 1709324131,
+			wantOK:      true,
+		},
+		{
+			name:     "never updated",
+			response: rawJSON(`{"ItemCount": 0, "LastUpdated": "0001-01-01T00:00:00Z"}`),
+			wantOK:   true,
+		},
+		{"unavailable", statusResponse(http.StatusNotFound), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/SearchIndex": tt.response}, "--search-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchSearchIndex(context.Background(), *c.client, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, ok := rec.Value("search_index_items_total")
+			if ok != tt.wantOK || items != tt.wantItems {
+				t.Errorf("search_index_items_total = %v (recorded %v), want %v (recorded %v)", items, ok, tt.wantItems, tt.wantOK)
+			}
+			if got, _ := rec.Value("search_index_last_updated_timestamp_seconds"); got != tt.wantUpdated {
+				t.Errorf("search_index_last_updated_timestamp_seconds = %v, want %v", got, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+func TestFetchBackupStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		response http.HandlerFunc
+		wantLast float64
+		wantSize float64
+		wantOK   bool
+		wantErr  bool
+	}{
+		{
+			name:     "available",
+			response: rawJSON(`{"LastBackupDate": "2024-03-01T20:15:31Z", "SizeBytes": 73400320}`),
+			wantLast: 1709324131,
+			wantSize: 73400320,
+			wantOK:   true,
+		},
+		{
+			name:     "no backup yet",
+			response: rawJSON(`{"LastBackupDate": null, "SizeBytes": 0}`),
+			wantOK:   true,
+		},
+		{name: "unavailable", response: statusResponse(http.StatusNotFound)},
+		{name: "failing", response: statusResponse(http.StatusInternalServerError), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Backup/Status": tt.response}, "--backup-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchBackupStatus(context.Background(), *c.client, rec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchBackupStatus error %v, want error %v", err, tt.wantErr)
+			}
+			last, ok := rec.Value("last_backup_timestamp_seconds")
+			if ok != tt.wantOK || last != tt.wantLast {
+				t.Errorf("last_backup_timestamp_seconds = %v (recorded %v), want %v (recorded %v)", last, ok, tt.wantLast, tt.wantOK)
+			}
+			if got, _ := rec.Value("last_backup_size_bytes"); got != tt.wantSize {
+				t.Errorf("last_backup_size_bytes = %v, want %v", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestStorageDetails(t *testing.T) {
+	tests := []struct {
+		name         string
+		extra        string
+		args         []string
+		wantDatabase float64
+		wantLogs     float64
+		wantOK       bool
+	}{
+		{
+			name:         "reported",
+			extra:        `"DatabaseSizeBytes": 104857600, "LogFileSizeBytes": 5242880`,
+			args:         []string{"--storage-detail-metrics-enabled"},
+			wantDatabase: 104857600,
+			wantLogs:     5242880,
+			wantOK:       true,
+		},
+		{name: "not reported", args: []string{"--storage-detail-metrics-enabled"}},
+		{name: "disabled", extra: `"DatabaseSizeBytes": 104857600, "LogFileSizeBytes": 5242880`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchSystemInfo(t, systemInfo(tt.extra), tt.args...)
+			database, ok := rec.Value("database_size_bytes")
+			if ok != tt.wantOK || database != tt.wantDatabase {
+				t.Errorf("database_size_bytes = %v (recorded %v), want %v (recorded %v)", database, ok, tt.wantDatabase, tt.wantOK)
+			}
+			logs, ok := rec.Value("log_file_size_bytes")
+			if ok != tt.wantOK || logs != tt.wantLogs {
+				t.Errorf("log_file_size_bytes = %v (recorded %v), want %v (recorded %v)", logs, ok, tt.wantLogs, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSystemEncoderInfo(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/usr/lib/jellyfin-ffmpeg/ffmpeg", "unknown"},
+		{"/usr/lib/jellyfin-ffmpeg6/ffmpeg", "6"},
+		{"/opt/ffmpeg-6.0.1/bin/ffmpeg", "6.0.1"},
+		{`C:\Program Files\Jellyfin\Server\ffmpeg_v5.1.4\ffmpeg.exe`, "5.1.4"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		body := strings.Replace(systemInfo(""), `"/usr/lib/jellyfin-ffmpeg/ffmpeg"`, strconv.Quote(tt.path), 1)
+		rec := fetchSystemInfo(t, body)
+		if _, ok := rec.Value("system_encoder_info", tt.want, tt.path); !ok {
+			t.Errorf("no system_encoder_info{encoder_version=%q} for %q: %v", tt.want, tt.path, rec.Values)
+		}
+	}
+}
+
+func TestSystemInfoDotnetVersion(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  string
+	}{
+		{"product version", `"ProductVersion": ".NET 8.0.4", "SystemUpdateLevel": "Release"`, "8.0.4"},
+		{"unparsable product version", `"ProductVersion": "Jellyfin Server", "SystemUpdateLevel": "Release"`, "Release"},
+		{"not reported", "", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchSystemInfo(t, systemInfo(tt.extra))
+			if got, ok := rec.Value("system_info", tt.want); !ok || got != 1 {
+				t.Errorf("no system_info{dotnet_version=%q}: %v", tt.want, rec.Values)
+			}
+		})
+	}
+}
+
+func TestTargetInfo(t *testing.T) {
+	var version atomic.Value
+	version.Store("10.8.13")
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+			jsonResponse(map[string]string{
+				"Version":            version.Load().(string),
+				"OperatingSystem":    "Linux",
+				"SystemArchitecture": "X64",
+			})(w, r)
+		},
+	})
+	system := NewSystemCollector(c)
+	system.endpoints = system.endpoints[:1]
+	c.collectors = []Collector{system}
+	host := c.hostLabel()
+
+	rec := scrape(t, c)
+	if got, ok := rec.Value("target_info", host, "10.8.13", "Linux", "X64"); !ok || got != 1 {
+		t.Errorf("target_info = %v, %v, want 1: %v", got, ok, rec.Values)
+	}
+
+	// an upgrade replaces the series
+	version.Store("10.9.0")
+	rec = scrape(t, c)
+	if n := countSeries(rec, "target_info"); n != 1 {
+		t.Errorf("target_info has %d series after an upgrade, want 1", n)
+	}
+	if got, ok := rec.Value("target_info", host, "10.9.0", "Linux", "X64"); !ok || got != 1 {
+		t.Errorf("target_info = %v, %v after an upgrade, want 1: %v", got, ok, rec.Values)
+	}
+}
+
+func TestServerAddressInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  map[string]string
+	}{
+		{"local only", "", map[string]string{"local": "http://192.168.1.10:8096"}},
+		{"local and wan", `"WanAddress": "https://media.example.com"`, map[string]string{
+			"local": "http://192.168.1.10:8096",
+			"wan":   "https://media.example.com",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchSystemInfo(t, systemInfo(tt.extra))
+			if n := countSeries(rec, "server_address_info"); n != len(tt.want) {
+				t.Errorf("server_address_info has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for addressType, address := range tt.want {
+				if got, ok := rec.Value("server_address_info", addressType, address); !ok || got != 1 {
+					t.Errorf("server_address_info{%s, %s} = %v, %v, want 1", addressType, address, got, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestWanAddressInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		extra      string
+		want       string
+		wantLogged bool
+	}{
+		{"wan address", `"WanAddress": "http://203.0.113.7:8096"`, "http://203.0.113.7:8096", false},
+		{"no wan address", "", "", true},
+		{"null wan address", `"WanAddress": null`, "", true},
+		{"empty wan address", `"WanAddress": ""`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+			level := log.Logger.GetLevel()
+			log.Logger.SetLevel(logrus.DebugLevel)
+			defer log.Logger.SetLevel(level)
+
+			rec := fetchSystemInfo(t, systemInfo(tt.extra))
+			if n := countSeries(rec, "wan_address_info"); n != 1 {
+				t.Errorf("wan_address_info has %d series, want 1: %v", n, rec.Values)
+			}
+			if got, ok := rec.Value("wan_address_info", tt.want); !ok || got != 1 {
+				t.Errorf("wan_address_info{address=%q} = %v, %v, want 1", tt.want, got, ok)
+			}
+			logged := false
+			for _, entry := range hook.AllEntries() {
+				logged = logged || (entry.Level == logrus.DebugLevel && strings.Contains(entry.Message, "no wan address"))
+			}
+			if logged != tt.wantLogged {
+				t.Errorf("logged the missing wan address %v, want %v", logged, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestServerResourceUsage(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name       string
+		extra      string
+		wantMemory *float64
+		wantCPU    *float64
+	}{
+		{"absent", "", nil, nil},
+		{"null", `"memoryUsageBytes": null, "cpuUsagePercent": null`, nil, nil},
+		{"present", `"memoryUsageBytes": 734003200, "cpuUsagePercent": 12.5`, value(734003200), value(12.5)},
+		{"idle", `"memoryUsageBytes": 524288000, "cpuUsagePercent": 0`, value(524288000), value(0)},
+		{"only memory", `"memoryUsageBytes": 524288000`, value(524288000), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchSystemInfo(t, systemInfo(tt.extra))
+			for name, want := range map[string]*float64{
+				"server_memory_usage_bytes": tt.wantMemory,
+				"server_cpu_usage_percent":  tt.wantCPU,
+			} {
+				got, ok := rec.Value(name)
+				if ok != (want != nil) {
+					t.Errorf("%s recorded %v, want %v", name, ok, want != nil)
+				}
+				if ok && want != nil && got != *want {
+					t.Errorf("%s = %v, want %v", name, got, *want)
+				}
+			}
+		})
+	}
+}
+
+func TestServerDiskIO(t *testing.T) {
+	responses := []string{
+		systemInfo(`"diskReadBytes": 1048576, "diskWriteBytes": 65536`),
+		systemInfo(`"diskReadBytes": 5242880, "diskWriteBytes": 131072`),
+	}
+	tests := []struct {
+		name      string
+		args      []string
+		wantRead  []float64
+		wantWrite []float64
+	}{
+		{"enabled", []string{"--io-metrics-enabled"}, []float64{1048576, 5242880}, []float64{65536, 131072}},
+		{"disabled", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response atomic.Int64
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Info": func(w http.ResponseWriter, r *http.Request) {
+				rawJSON(responses[response.Load()])(w, r)
+			}}, tt.args...)
+			system := NewSystemCollector(c)
+			system.endpoints = system.endpoints[:1]
+			c.collectors = []Collector{system}
+			registry := prom.NewPedanticRegistry()
+			registry.MustRegister(c)
+
+			for i := range responses {
+				response.Store(int64(i))
+				families, err := registry.Gather()
+				if err != nil {
+					t.Fatal(err)
+				}
+				counters := map[string]float64{}
+				for _, family := range families {
+					if family.GetType() == dto.MetricType_COUNTER && strings.HasPrefix(family.GetName(), "jellyfin_server_disk_") {
+						counters[family.GetName()] = family.Metric[0].GetCounter().GetValue()
+					}
+				}
+				if tt.wantRead == nil {
+					if len(counters) != 0 {
+						t.Errorf("scrape %d: disk counters %v without --io-metrics-enabled", i, counters)
+					}
+					continue
+				}
+				if got := counters["jellyfin_server_disk_read_bytes_total"]; got != tt.wantRead[i] {
+					t.Errorf("scrape %d: jellyfin_server_disk_read_bytes_total = %v, want %v", i, got, tt.wantRead[i])
+				}
+				if got := counters["jellyfin_server_disk_write_bytes_total"]; got != tt.wantWrite[i] {
+					t.Errorf("scrape %d: jellyfin_server_disk_write_bytes_total = %v, want %v", i, got, tt.wantWrite[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServerRestarts(t *testing.T) {
+	started := func(at string) string { return systemInfo(`"startupTime": "` + at + `"`) }
+	sessions := func(ids ...string) []jellyfin.Session {
+		list := []jellyfin.Session{}
+		for _, id := range ids {
+			list = append(list, jellyfin.Session{ID: id})
+		}
+		return list
+	}
+	type step struct {
+		// info is a /System/Info response, sessions a /Sessions response if
+		// info is empty
+		info     string
+		sessions []jellyfin.Session
+		want     float64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "start time changes",
+			steps: []step{
+				{info: started("2024-03-01T08:00:00Z")},
+				{info: started("2024-03-01T08:00:00Z")},
+				{info: started("2024-03-01T09:30:00Z"), want: 1},
+				{info: started("2024-03-01T09:30:00Z"), want: 1},
+				{info: started("2024-03-01T09:32:00Z"), want: 2},
+			},
+		},
+		{
+			// sessions end on their own, without the start time their
+			// disappearing doesn't count as a restart
+			name: "sessions disappear",
+			steps: []step{
+				{info: systemInfo("")},
+				{sessions: sessions("s1", "s2")},
+				{sessions: sessions("s3")},
+				{sessions: sessions()},
+			},
+		},
+		{
+			name: "start time reported",
+			steps: []step{
+				{info: started("2024-03-01T08:00:00Z")},
+				{sessions: sessions("s1")},
+				// the sessions ended, the start time didn't change
+				{sessions: sessions("s2")},
+				{info: started("2024-03-01T09:30:00Z"), want: 1},
+			},
+		},
+		{
+			name: "no start time",
+			steps: []step{
+				{info: systemInfo("")},
+				{info: systemInfo("")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var info, list atomic.Value
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+				"/System/Info": func(w http.ResponseWriter, r *http.Request) { rawJSON(info.Load().(string))(w, r) },
+				"/Sessions":    func(w http.ResponseWriter, r *http.Request) { jsonResponse(list.Load())(w, r) },
+			})
+			for i, s := range tt.steps {
+				var err error
+				if s.info != "" {
+					info.Store(s.info)
+					err = c.fetchSystemInfo(context.Background(), *c.client, NewTestRecorder())
+				} else {
+					list.Store(s.sessions)
+					err = c.fetchSessions(context.Background(), *c.client, NewTestRecorder())
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, _ := scrape(t, c).Value("server_restart_total"); got != s.want {
+					t.Errorf("step %d: server_restart_total = %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSubtitleDownloadLanguages(t *testing.T) {
+	config := rawJSON(`{"EnableRemoteAccess": true, "SubtitleDownloadLanguages": ["eng", "swe", "fin"]}`)
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		args       []string
+		want       []string
+		wantWarned bool
+	}{
+		{name: "enabled", handler: config, args: []string{"--subtitle-config-metrics-enabled"}, want: []string{"eng", "swe", "fin"}},
+		{
+			name:    "no languages",
+			handler: rawJSON(`{"EnableRemoteAccess": true, "SubtitleDownloadLanguages": []}`),
+			args:    []string{"--subtitle-config-metrics-enabled"},
+		},
+		{name: "disabled", handler: config},
+		{
+			name:       "forbidden",
+			handler:    statusResponse(http.StatusForbidden),
+			args:       []string{"--subtitle-config-metrics-enabled"},
+			wantWarned: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/System/Configuration": tt.handler}, tt.args...)
+			rec := NewTestRecorder()
+			if err := c.fetchConfiguration(context.Background(), *c.client, rec); err != nil {
+				t.Fatal(err)
+			}
+			if n := countSeries(rec, "subtitle_download_language_configured"); n != len(tt.want) {
+				t.Errorf("subtitle_download_language_configured has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for _, language := range tt.want {
+				if got, ok := rec.Value("subtitle_download_language_configured", language); !ok || got != 1 {
+					t.Errorf("subtitle_download_language_configured{%s} = %v, %v, want 1", language, got, ok)
+				}
+			}
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				warned = warned || entry.Level == logrus.WarnLevel
+			}
+			if warned != tt.wantWarned {
+				t.Errorf("warned %v, want %v", warned, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestFetchAPIKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantErr    bool
+		wantOK     bool
+		want       float64
+		wantWarned bool
+	}{
+		{
+			name: "keys",
+			handler: rawJSON(`{"Items": [
+				{"AccessToken": "0a1b", "AppName": "jellyfin-exporter", "DateCreated": "2024-01-10T12:00:00Z"},
+				{"AccessToken": "2c3d", "AppName": "Jellyseerr", "DateCreated": "2024-02-01T08:30:00Z"},
+				{"AccessToken": "4e5f", "AppName": "Home Assistant", "DateCreated": "2024-02-20T18:45:00Z"}
+			], "TotalRecordCount": 3}`),
+			wantOK: true,
+			want:   3,
+		},
+		{name: "no keys", handler: rawJSON(`{"Items": [], "TotalRecordCount": 0}`), wantOK: true},
+		{name: "forbidden for user api keys", handler: statusResponse(http.StatusForbidden), wantWarned: true},
+		{name: "unauthorized", handler: statusResponse(http.StatusUnauthorized), wantWarned: true},
+		{name: "not listed by jellyfin", handler: statusResponse(http.StatusNotFound), wantWarned: true},
+		{name: "server error", handler: statusResponse(http.StatusInternalServerError), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Auth/Keys": tt.handler}, "--security-metrics-enabled")
+			rec := NewTestRecorder()
+			err := c.fetchAPIKeys(context.Background(), *c.client, rec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			got, ok := rec.Value("api_keys_total")
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("api_keys_total = %v (recorded %v), want %v (recorded %v)", got, ok, tt.want, tt.wantOK)
+			}
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				warned = warned || entry.Level == logrus.WarnLevel
+			}
+			if warned != tt.wantWarned {
+				t.Errorf("warned %v, want %v", warned, tt.wantWarned)
+			}
+		})
+	}
+}
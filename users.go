@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"jellyfin-exporter/pkg/jellyfin"
+)
+
+// limitUserLabels truncates user names to --max-user-label-count so that
+// per-user metrics cannot grow without bound.
+func (c *JellyfinGetCollector) limitUserLabels(ctx context.Context, users []string) []string {
+	limit := c.Config.MaxUserLabels
+	if limit <= 0 || len(users) <= limit {
+		return users
+	}
+	requestLog(ctx).Debugf("exporting per-user metrics for %d of %d users", limit, len(users))
+	return users[:limit]
+}
+
+// authProviderName maps a Jellyfin authentication provider id to local, ldap
+// or custom.
+func authProviderName(id string) string {
+	switch {
+	case id == "" || strings.HasSuffix(id, ".DefaultAuthenticationProvider"):
+		return "local"
+	case strings.Contains(strings.ToLower(id), "ldap"):
+		return "ldap"
+	default:
+		return "custom"
+	}
+}
+
+// maxLimit returns the higher of two limits of which 0 is no limit.
+func maxLimit(a, b float64) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return math.Max(a, b)
+}
+
+func (c *JellyfinGetCollector) fetchUsers(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	users, err := client.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	// names differing only in characters dropped by sanitizeLabelValue share
+	// a label, keep the latest activity of them and the highest session and
+	// bitrate limits unless one of them has none
+	lastActivity := make(map[string]float64)
+	maxSessions := make(map[string]float64)
+	maxBitrates := make(map[string]float64)
+	var names []string
+	for _, u := range users {
+		name := sanitizeLabelValue(u.Name)
+		if _, ok := lastActivity[name]; !ok {
+			names = append(names, name)
+			lastActivity[name] = 0
+			maxSessions[name] = float64(u.Policy.MaxActiveSessions)
+			maxBitrates[name] = u.Policy.RemoteClientBitrateLimit
+		}
+		if u.LastActivityDate != nil && !u.LastActivityDate.IsZero() {
+			lastActivity[name] = math.Max(lastActivity[name], float64(u.LastActivityDate.Unix()))
+		}
+		maxSessions[name] = maxLimit(maxSessions[name], float64(u.Policy.MaxActiveSessions))
+		maxBitrates[name] = maxLimit(maxBitrates[name], u.Policy.RemoteClientBitrateLimit)
+	}
+	for _, name := range c.limitUserLabels(ctx, names) {
+		rec.RecordGauge("user_last_activity_timestamp_seconds", lastActivity[name], name)
+		rec.RecordGauge("user_max_sessions_configured", maxSessions[name], name)
+		if c.Config.UserPolicyMetrics {
+			rec.RecordGauge("user_max_bitrate_configured_bits_per_second", maxBitrates[name], name)
+		}
+	}
+
+	if c.Config.AuthMetrics {
+		providers := make(map[string]float64)
+		for _, u := range users {
+			providers[authProviderName(u.Policy.AuthenticationProviderID)]++
+		}
+		for provider, count := range providers {
+			rec.RecordGauge("users_by_auth_provider_total", count, provider)
+		}
+
+		var twoFactor float64
+		for _, u := range users {
+			if isTwoFactorProvider(u.Policy.AuthenticationProviderID) {
+				twoFactor++
+			}
+		}
+		if twoFactor == 0 {
+			c.twoFactorWarning.Do(func() {
+				requestLog(ctx).Warn("jellyfin has no two-factor authentication of its own, " +
+					"users_with_2fa_total only counts users of two-factor authentication plugins")
+			})
+		}
+		rec.RecordGauge("users_with_2fa_total", twoFactor)
+	}
+
+	if c.Config.UserMetrics {
+		var neverLoggedIn float64
+		for _, u := range users {
+			if u.LastLoginDate == nil || u.LastLoginDate.IsZero() {
+				neverLoggedIn++
+			}
+		}
+		rec.RecordGauge("users_total", float64(len(users)))
+		rec.RecordGauge("users_never_logged_in_total", neverLoggedIn)
+	}
+	return nil
+}
+
+// isTwoFactorProvider reports whether the authentication provider id belongs
+// to a two-factor authentication plugin.
+func isTwoFactorProvider(id string) bool {
+	id = strings.ToLower(id)
+	for _, marker := range []string{"twofactor", "2fa", "totp", "mfa"} {
+		if strings.Contains(id, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *JellyfinGetCollector) fetchNotifications(ctx context.Context, client jellyfin.Client, rec MetricRecorder) error {
+	// Notifications are per user, so look up who the api key belongs to
+	me, err := client.GetCurrentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	summary, err := client.GetNotificationSummary(ctx, me.ID)
+	if err != nil {
+		return err
+	}
+
+	rec.RecordGauge("notifications_unread_total", summary.UnreadCount)
+	return nil
+}
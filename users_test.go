@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// fetchUsers calls fetchUsers against a fake /Users answering body and
+// returns the recorded values.
+func fetchUsers(t *testing.T, body string, args ...string) *TestRecorder {
+	t.Helper()
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{"/Users": rawJSON(body)}, args...)
+	rec := NewTestRecorder()
+	err := c.fetchUsers(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestUserLastActivity(t *testing.T) {
+	// Jellyfin sends seven fractional digits
+	rec := fetchUsers(t, `[
+		{"Name": "alice", "Id": "a1", "LastActivityDate": "2024-03-01T20:15:31.4567891Z"},
+		{"Name": "bob", "Id": "b2", "LastActivityDate": "2024-03-01T21:15:31+01:00"},
+		{"Name": "carol", "Id": "c3", "LastActivityDate": null},
+		{"Name": "dave", "Id": "d4", "LastActivityDate": "0001-01-01T00:00:00.0000000Z"},
+		{"Name": "erin", "Id": "e5"}
+	]`)
+
+	activity := time.Date(2024, 3, 1, 20, 15, 31, 0, time.UTC).Unix()
+	tests := []struct {
+		user string
+		want float64
+	}{
+		{"alice", float64(activity)},
+		{"bob", float64(activity)},
+		{"carol", 0},
+		{"dave", 0},
+		{"erin", 0},
+	}
+	for _, tt := range tests {
+		if got, ok := rec.Value("user_last_activity_timestamp_seconds", tt.user); !ok || got != tt.want {
+			t.Errorf("user_last_activity_timestamp_seconds{%s} = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestMaxUserLabels(t *testing.T) {
+	body := `[{"Name": "alice"}, {"Name": "bob"}, {"Name": "carol"}]`
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--max-user-label-count=2"}, []string{"alice", "bob"}},
+		{[]string{"--max-user-label-count=0"}, []string{"alice", "bob", "carol"}},
+	}
+	for _, tt := range tests {
+		rec := fetchUsers(t, body, tt.args...)
+		if n := countSeries(rec, "user_last_activity_timestamp_seconds"); n != len(tt.want) {
+			t.Errorf("%v: recorded %v, want users %v", tt.args, rec.Values, tt.want)
+		}
+		for _, user := range tt.want {
+			if _, ok := rec.Value("user_last_activity_timestamp_seconds", user); !ok {
+				t.Errorf("%v: no user_last_activity_timestamp_seconds{%s}", tt.args, user)
+			}
+		}
+	}
+}
+
+func TestUsersByAuthProvider(t *testing.T) {
+	rec := fetchUsers(t, `[
+		{"Name": "admin", "Policy": {"AuthenticationProviderId": "Jellyfin.Server.Implementations.Users.DefaultAuthenticationProvider"}},
+		{"Name": "guest", "Policy": {}},
+		{"Name": "alice", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.LDAP_Auth.LdapAuthenticationProviderPlugin"}},
+		{"Name": "bob", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.LDAP_Auth.LdapAuthenticationProviderPlugin"}},
+		{"Name": "carol", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.SSO.SSOAuthenticationProvider"}}
+	]`, "--auth-metrics-enabled")
+
+	want := map[string]float64{"local": 2, "ldap": 2, "custom": 1}
+	for provider, count := range want {
+		if got, ok := rec.Value("users_by_auth_provider_total", provider); !ok || got != count {
+			t.Errorf("users_by_auth_provider_total{%s} = %v, want %v", provider, got, count)
+		}
+	}
+}
+
+func TestUsersWith2FA(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		want        float64
+		wantWarning bool
+	}{
+		{
+			name: "no two-factor plugin",
+			body: `[
+				{"Name": "admin", "Policy": {"AuthenticationProviderId": "Jellyfin.Server.Implementations.Users.DefaultAuthenticationProvider"}},
+				{"Name": "alice", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.LDAP_Auth.LdapAuthenticationProviderPlugin"}}
+			]`,
+			wantWarning: true,
+		},
+		{
+			name: "two-factor plugins",
+			body: `[
+				{"Name": "admin", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.TwoFactorAuth.TwoFactorAuthenticationProvider"}},
+				{"Name": "alice", "Policy": {"AuthenticationProviderId": "Jellyfin.Plugin.Totp.TotpProvider"}},
+				{"Name": "bob", "Policy": {"AuthenticationProviderId": "Jellyfin.Server.Implementations.Users.DefaultAuthenticationProvider"}},
+				{"Name": "guest", "Policy": {}}
+			]`,
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewLocal(log.Logger)
+			defer hook.Reset()
+
+			rec := fetchUsers(t, tt.body, "--auth-metrics-enabled")
+			if got, ok := rec.Value("users_with_2fa_total"); !ok || got != tt.want {
+				t.Errorf("users_with_2fa_total = %v, want %v", got, tt.want)
+			}
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				warned = warned || strings.Contains(entry.Message, "two-factor")
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("two-factor warning logged = %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestAuthProviderName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"", "local"},
+		{"Jellyfin.Server.Implementations.Users.DefaultAuthenticationProvider", "local"},
+		{"Jellyfin.Plugin.LDAP_Auth.LdapAuthenticationProviderPlugin", "ldap"},
+		{"Jellyfin.Plugin.SSO.SSOAuthenticationProvider", "custom"},
+	}
+	for _, tt := range tests {
+		if got := authProviderName(tt.id); got != tt.want {
+			t.Errorf("authProviderName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFetchNotifications(t *testing.T) {
+	c := newFakeJellyfin(t, map[string]http.HandlerFunc{
+		"/Users/Me": rawJSON(`{"Name": "admin", "Id": "4f5e1c0a9b8d4e2f"}`),
+		"/Notifications/": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/Notifications/4f5e1c0a9b8d4e2f/Summary" {
+				http.NotFound(w, r)
+				return
+			}
+			rawJSON(`{"UnreadCount": 5, "MaxUnreadNotificationLevel": "Normal"}`)(w, r)
+		},
+	})
+	rec := NewTestRecorder()
+	err := c.fetchNotifications(context.Background(), *c.client, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := rec.Value("notifications_unread_total"); !ok || got != 5 {
+		t.Errorf("notifications_unread_total = %v, want 5", got)
+	}
+}
+
+func TestUserMaxSessions(t *testing.T) {
+	body := `[
+		{"Name": "alice", "Policy": {"MaxActiveSessions": 3}},
+		{"Name": "bob", "Policy": {"MaxActiveSessions": 0}},
+		{"Name": "carol", "Policy": {"MaxActiveSessions": 1}},
+		{"Name": "dave", "Policy": {"MaxActiveSessions": 1}},
+		{"Name": "dave!", "Policy": {"MaxActiveSessions": 2}},
+		{"Name": "erin", "Policy": {"MaxActiveSessions": 2}},
+		{"Name": "erin!", "Policy": {"MaxActiveSessions": 0}}
+	]`
+	tests := []struct {
+		name string
+		args []string
+		want map[string]float64
+	}{
+		// 0 is unlimited, users sharing a label get the highest limit unless
+		// one of them has none
+		{"all users", nil, map[string]float64{"alice": 3, "bob": 0, "carol": 1, "dave": 2, "erin": 0}},
+		{"user label limit", []string{"--max-user-label-count=2"}, map[string]float64{"alice": 3, "bob": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchUsers(t, body, tt.args...)
+			if n := countSeries(rec, "user_max_sessions_configured"); n != len(tt.want) {
+				t.Errorf("user_max_sessions_configured has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for user, want := range tt.want {
+				if got, ok := rec.Value("user_max_sessions_configured", user); !ok || got != want {
+					t.Errorf("user_max_sessions_configured{%s} = %v, %v, want %v", user, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUserMaxBitrate(t *testing.T) {
+	body := `[
+		{"Name": "alice", "Policy": {"RemoteClientBitrateLimit": 8000000}},
+		{"Name": "bob", "Policy": {"RemoteClientBitrateLimit": 0}},
+		{"Name": "carol", "Policy": {}},
+		{"Name": "dave", "Policy": {"RemoteClientBitrateLimit": 120000000}},
+		{"Name": "erin", "Policy": {"RemoteClientBitrateLimit": 2000000}},
+		{"Name": "erin!", "Policy": {"RemoteClientBitrateLimit": 4000000}},
+		{"Name": "frank", "Policy": {"RemoteClientBitrateLimit": 2000000}},
+		{"Name": "frank!", "Policy": {"RemoteClientBitrateLimit": 0}}
+	]`
+	tests := []struct {
+		name string
+		args []string
+		want map[string]float64
+	}{
+		{"disabled", nil, map[string]float64{}},
+		{
+			// 0 is unlimited, users sharing a label get the highest limit
+			// unless one of them has none
+			name: "all users",
+			args: []string{"--user-policy-metrics-enabled"},
+			want: map[string]float64{
+				"alice": 8000000, "bob": 0, "carol": 0, "dave": 120000000, "erin": 4000000, "frank": 0,
+			},
+		},
+		{
+			name: "user label limit",
+			args: []string{"--user-policy-metrics-enabled", "--max-user-label-count=2"},
+			want: map[string]float64{"alice": 8000000, "bob": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchUsers(t, body, tt.args...)
+			if n := countSeries(rec, "user_max_bitrate_configured_bits_per_second"); n != len(tt.want) {
+				t.Errorf("user_max_bitrate_configured_bits_per_second has %d series, want %d: %v", n, len(tt.want), rec.Values)
+			}
+			for user, want := range tt.want {
+				if got, ok := rec.Value("user_max_bitrate_configured_bits_per_second", user); !ok || got != want {
+					t.Errorf("user_max_bitrate_configured_bits_per_second{%s} = %v, %v, want %v", user, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUsersNeverLoggedIn(t *testing.T) {
+	body := `[
+		{"Name": "alice", "LastLoginDate": "2024-03-01T20:15:31.4567891Z"},
+		{"Name": "bob", "LastLoginDate": null},
+		{"Name": "carol"},
+		{"Name": "dave", "LastLoginDate": "0001-01-01T00:00:00.0000000Z"},
+		{"Name": "erin", "LastLoginDate": "2023-11-12T08:00:00Z"}
+	]`
+	tests := []struct {
+		name      string
+		body      string
+		args      []string
+		wantOK    bool
+		wantUsers float64
+		wantNever float64
+	}{
+		{name: "mixed", body: body, args: []string{"--user-metrics-enabled"}, wantOK: true, wantUsers: 5, wantNever: 3},
+		{name: "no users", body: `[]`, args: []string{"--user-metrics-enabled"}, wantOK: true},
+		{name: "disabled", body: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := fetchUsers(t, tt.body, tt.args...)
+			users, ok := rec.Value("users_total")
+			if ok != tt.wantOK || users != tt.wantUsers {
+				t.Errorf("users_total = %v (recorded %v), want %v (recorded %v)", users, ok, tt.wantUsers, tt.wantOK)
+			}
+			never, ok := rec.Value("users_never_logged_in_total")
+			if ok != tt.wantOK || never != tt.wantNever {
+				t.Errorf("users_never_logged_in_total = %v (recorded %v), want %v (recorded %v)", never, ok, tt.wantNever, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestUserLabelSanitized(t *testing.T) {
+	// both names give the label Am_lie, the later activity is kept
+	rec := fetchUsers(t, `[
+		{"Name": "Amélie", "LastActivityDate": "2024-03-01T20:15:31Z"},
+		{"Name": "Am lie", "LastActivityDate": "2024-03-02T20:15:31Z"}
+	]`)
+	if n := countSeries(rec, "user_last_activity_timestamp_seconds"); n != 1 {
+		t.Errorf("%d user_last_activity_timestamp_seconds series, want 1: %v", n, rec.Values)
+	}
+	want := float64(time.Date(2024, 3, 2, 20, 15, 31, 0, time.UTC).Unix())
+	if got, _ := rec.Value("user_last_activity_timestamp_seconds", "Am_lie"); got != want {
+		t.Errorf("user_last_activity_timestamp_seconds{Am_lie} = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// clearScreen moves the cursor home and clears a terminal.
+const clearScreen = "\033[H\033[2J"
+
+// runWatch collects the metrics of newGatherer every interval, starting right
+// away, and writes them in the text format to out until ctx is done. The
+// screen is cleared between collections if out is a terminal, otherwise they
+// are separated by a line with the time.
+func runWatch(ctx context.Context, interval, timeout time.Duration, newGatherer func(context.Context) prom.Gatherer, out io.Writer) error {
+	terminal := isTerminal(out)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if terminal {
+			fmt.Fprint(out, clearScreen)
+		} else {
+			fmt.Fprintf(out, "# --- %s\n", time.Now().UTC().Format(time.RFC3339))
+		}
+		err := writeMetrics(ctx, timeout, newGatherer, out)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeMetrics gathers the metrics once, with timeout, and writes them to
+// out. Gather errors are logged, the metrics gathered despite them are
+// written anyway.
+func writeMetrics(ctx context.Context, timeout time.Duration, newGatherer func(context.Context) prom.Gatherer, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	families, err := newGatherer(ctx).Gather()
+	if err != nil {
+		log.WithError(err).Warn("gather metrics")
+	}
+	encoder := expfmt.NewEncoder(out, expfmt.FmtText)
+	for _, family := range families {
+		err = encoder.Encode(family)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
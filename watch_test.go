@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRunWatch(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	const collections = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var times []time.Time
+	gauge := prom.NewGauge(prom.GaugeOpts{Name: "jellyfin_watched", Help: "collections so far"})
+	newGatherer := func(context.Context) prom.Gatherer {
+		times = append(times, time.Now())
+		gauge.Set(float64(len(times)))
+		if len(times) == collections {
+			cancel()
+		}
+		registry := prom.NewRegistry()
+		registry.MustRegister(gauge)
+		return registry
+	}
+
+	var out bytes.Buffer
+	start := time.Now()
+	if err := runWatch(ctx, interval, time.Second, newGatherer, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(times) != collections {
+		t.Fatalf("%d collections, want %d", len(times), collections)
+	}
+	if first := times[0].Sub(start); first >= interval {
+		t.Errorf("first collection after %v, want right away", first)
+	}
+	for i := 1; i < len(times); i++ {
+		// ticks may be late but never early, a late tick doesn't delay the
+		// following ones
+		due := time.Duration(i) * interval
+		if at := times[i].Sub(start); at < due*9/10 || at > due+10*interval {
+			t.Errorf("collection %d %v after the start, want %v", i, at, due)
+		}
+	}
+
+	// out isn't a terminal, the collections are separated instead of cleared
+	if strings.Contains(out.String(), clearScreen) {
+		t.Error("cleared the screen of a buffer")
+	}
+	if got := strings.Count(out.String(), "# --- "); got != collections {
+		t.Errorf("%d separators, want %d:\n%s", got, collections, out.String())
+	}
+	if !strings.Contains(out.String(), "jellyfin_watched 4\n") {
+		t.Errorf("last collection not written:\n%s", out.String())
+	}
+}
+
+func TestWatchIntervalValidation(t *testing.T) {
+	config := testConfig(t)
+	config.Watch = true
+	config.WatchInterval = 0
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig accepted --watch with a --watch-interval of 0")
+	}
+}
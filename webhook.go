@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// activityEvent is the subset of a Jellyfin webhook plugin notification used
+// by the exporter. Activity log entries, which name the event in Type, are
+// accepted too.
+type activityEvent struct {
+	NotificationType string `json:"NotificationType"`
+	Type             string `json:"Type"`
+	// ItemType is the type of the item of ItemAdded and ItemDeleted
+	// notifications, if the webhook template includes it
+	ItemType string `json:"ItemType"`
+}
+
+// webhookEventTypes maps the notification and activity log types of the
+// events counted from webhooks to their metric.
+var webhookEventTypes = map[string]string{
+	"AuthenticationFailure": "login_failures_total",
+	"AuthenticationFailed":  "login_failures_total",
+	"ItemAdded":             "items_added_total",
+	"ItemDeleted":           "items_deleted_total",
+}
+
+// webhookMediaTypes are the item types counted by their name in the
+// media_type label of items_added_total and items_deleted_total, others are
+// counted as other so that senders can't create arbitrary label values.
+var webhookMediaTypes = map[string]bool{
+	"Movie":       true,
+	"Series":      true,
+	"Season":      true,
+	"Episode":     true,
+	"Audio":       true,
+	"AudioBook":   true,
+	"MusicAlbum":  true,
+	"MusicArtist": true,
+	"MusicVideo":  true,
+	"Book":        true,
+	"Photo":       true,
+	"Video":       true,
+	"BoxSet":      true,
+	"Trailer":     true,
+}
+
+// webhookMetrics are exported by the activity collector with
+// --activity-webhook-enabled.
+var webhookMetrics = []string{"login_failures_total", "items_added_total", "items_deleted_total"}
+
+// countActivityEvent adds event to the webhook counters. It returns false if
+// the event isn't counted.
+func (c *JellyfinGetCollector) countActivityEvent(event activityEvent) bool {
+	eventType := event.NotificationType
+	if eventType == "" {
+		eventType = event.Type
+	}
+	metric, ok := webhookEventTypes[eventType]
+	if !ok {
+		return false
+	}
+	mediaType := event.ItemType
+	if mediaType == "" {
+		mediaType = "unknown"
+	} else if !webhookMediaTypes[mediaType] {
+		mediaType = "other"
+	}
+
+	c.webhookMu.Lock()
+	defer c.webhookMu.Unlock()
+	switch metric {
+	case "login_failures_total":
+		c.loginFailures++
+	case "items_added_total":
+		c.itemsAdded[mediaType]++
+	case "items_deleted_total":
+		c.itemsDeleted[mediaType]++
+	}
+	return true
+}
+
+func (c *JellyfinGetCollector) recordWebhookCounters(rec MetricRecorder) {
+	c.webhookMu.Lock()
+	defer c.webhookMu.Unlock()
+	rec.RecordCounter("login_failures_total", c.loginFailures)
+	for mediaType, count := range c.itemsAdded {
+		rec.RecordCounter("items_added_total", count, mediaType)
+	}
+	for mediaType, count := range c.itemsDeleted {
+		rec.RecordCounter("items_deleted_total", count, mediaType)
+	}
+}
+
+// activityWebhookHandler receives the notifications of the Jellyfin webhook
+// plugin at /ingest/activity. Requests must carry secret in the
+// X-Webhook-Secret header or the token query parameter. With several
+// Jellyfin instances the instance query parameter names the one that sent
+// it.
+func activityWebhookHandler(secret string, targets func() []*JellyfinGetCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("X-Webhook-Secret")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "invalid webhook secret", http.StatusUnauthorized)
+			return
+		}
+
+		instance := r.URL.Query().Get("instance")
+		var collector *JellyfinGetCollector
+		for _, target := range targets() {
+			if target.Config.instance == instance {
+				collector = target
+			}
+		}
+		if collector == nil {
+			http.Error(w, "unknown instance "+instance, http.StatusNotFound)
+			return
+		}
+
+		var event activityEvent
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&event)
+		if err != nil {
+			http.Error(w, "invalid activity event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !collector.countActivityEvent(event) {
+			requestLog(r.Context()).WithField("type", event.NotificationType+event.Type).
+				Debug("ignoring activity event")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
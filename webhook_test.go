@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestActivityWebhookHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		secret     string
+		body       string
+		wantStatus int
+		wantAdded  map[string]float64
+		wantFailed float64
+	}{
+		{
+			name:       "secret in header",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"NotificationType": "ItemAdded", "ItemType": "Movie"}`,
+			wantStatus: http.StatusNoContent,
+			wantAdded:  map[string]float64{"Movie": 1},
+		},
+		{
+			name:       "secret in query",
+			method:     http.MethodPost,
+			target:     "/ingest/activity?token=s3cret",
+			body:       `{"NotificationType": "AuthenticationFailure"}`,
+			wantStatus: http.StatusNoContent,
+			wantFailed: 1,
+		},
+		{
+			name:       "activity log entry",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"Type": "AuthenticationFailed"}`,
+			wantStatus: http.StatusNoContent,
+			wantFailed: 1,
+		},
+		{
+			name:       "unknown item type",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"NotificationType": "ItemAdded", "ItemType": "Movie\"} 1\n# x"}`,
+			wantStatus: http.StatusNoContent,
+			wantAdded:  map[string]float64{"other": 1},
+		},
+		{
+			name:       "missing item type",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"NotificationType": "ItemAdded"}`,
+			wantStatus: http.StatusNoContent,
+			wantAdded:  map[string]float64{"unknown": 1},
+		},
+		{
+			name:       "ignored event",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"NotificationType": "PlaybackStart"}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "missing secret",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			body:       `{"NotificationType": "ItemAdded", "ItemType": "Movie"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong secret",
+			method:     http.MethodPost,
+			target:     "/ingest/activity?token=guess",
+			body:       `{"NotificationType": "ItemAdded", "ItemType": "Movie"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "unknown instance",
+			method:     http.MethodPost,
+			target:     "/ingest/activity?instance=other",
+			secret:     "s3cret",
+			body:       `{"NotificationType": "ItemAdded", "ItemType": "Movie"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid json",
+			method:     http.MethodPost,
+			target:     "/ingest/activity",
+			secret:     "s3cret",
+			body:       `{"NotificationType": `,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newTestCollector(t, "--activity-webhook-enabled", "--activity-webhook-secret=s3cret")
+			handler := activityWebhookHandler("s3cret", func() []*JellyfinGetCollector {
+				return []*JellyfinGetCollector{collector}
+			})
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.secret != "" {
+				req.Header.Set("X-Webhook-Secret", tt.secret)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			rec := NewTestRecorder()
+			collector.recordWebhookCounters(rec)
+			if got, _ := rec.Value("login_failures_total"); got != tt.wantFailed {
+				t.Errorf("login_failures_total = %v, want %v", got, tt.wantFailed)
+			}
+			added := 0
+			for key := range rec.Values {
+				if strings.HasPrefix(key, "items_added_total{") {
+					added++
+				}
+			}
+			if added != len(tt.wantAdded) {
+				t.Errorf("items_added_total has %d series, want %d: %v", added, len(tt.wantAdded), rec.Values)
+			}
+			for mediaType, want := range tt.wantAdded {
+				if got, _ := rec.Value("items_added_total", mediaType); got != want {
+					t.Errorf("items_added_total{%s} = %v, want %v", mediaType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestActivityWebhookRequiresSecret(t *testing.T) {
+	config := testConfig(t)
+	config.ActivityWebhook = true
+	if err := validateConfig(config); err == nil {
+		t.Error("validateConfig accepted --activity-webhook-enabled without --activity-webhook-secret")
+	}
+}